@@ -0,0 +1,397 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// formatAlleleFreq is an outputFormat that writes cohort-level
+// allele counts and frequencies (overall and per sample group)
+// without individual genotypes.
+type formatAlleleFreq struct {
+	tsv bool
+	// Counts above zero but below minCellCount are suppressed
+	// (output as "."), along with other counts needed to keep
+	// them from being derived (see suppressed), and sites whose
+	// overall AC is below minCellCount are omitted.
+	minCellCount int
+
+	groups      []string // group labels, e.g., "ancestry_afr"
+	groupColumn []string // grouping column of each group, e.g., "ancestry"
+	sampleGroup [][]int  // sampleGroup[genomeIdx] = indices into groups
+}
+
+func (f *formatAlleleFreq) MaxGoroutines() int { return 0 }
+func (f *formatAlleleFreq) PadLeft() bool      { return true }
+func (f *formatAlleleFreq) Finish(string, io.Writer, string) error {
+	return nil
+}
+
+func (f *formatAlleleFreq) Filename() string {
+	if f.tsv {
+		return "sites.tsv"
+	}
+	return "sites.vcf"
+}
+
+var groupLabelUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// loadGroups sets up per-group counts using loadSampleGroups.
+// Genomes that aren't listed in the file are included in the
+// overall counts only.
+func (f *formatAlleleFreq) loadGroups(filename string, names []string, groupBy []string) error {
+	if filename == "" {
+		f.sampleGroup = make([][]int, len(names))
+		return nil
+	}
+	var err error
+	f.groups, f.groupColumn, f.sampleGroup, err = loadSampleGroups(filename, names, groupBy)
+	return err
+}
+
+// loadSampleGroups reads a CSV file with a header row, a SampleID
+// column, and any number of grouping columns (e.g., ancestry, site,
+// CaseControl). Each distinct non-empty value in a grouping column
+// becomes a group labeled {column}_{value}. If groupBy is not empty,
+// only the listed columns are used. The columns Index,
+// TrainingValidation, and PCA* (as written by choose-samples) are
+// ignored unless listed in groupBy.
+//
+// It returns the sorted group labels, the grouping column of each
+// group, and (for each of the given genome names) the indices of the
+// groups it belongs to.
+func loadSampleGroups(filename string, names []string, groupBy []string) (groups []string, groupColumn []string, sampleGroup [][]int, err error) {
+	sampleGroup = make([][]int, len(names))
+	rdr, err := open(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rdr.Close()
+	buf, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	lines := bytes.Split(buf, []byte{'\n'})
+	header := strings.Split(strings.TrimSuffix(string(lines[0]), "\r"), ",")
+	idcol := -1
+	use := make([]bool, len(header))
+	for i, col := range header {
+		if col == "SampleID" {
+			idcol = i
+			continue
+		}
+		if len(groupBy) == 0 {
+			use[i] = col != "Index" && col != "TrainingValidation" && !strings.HasPrefix(col, "PCA")
+		} else {
+			for _, g := range groupBy {
+				use[i] = use[i] || col == g
+			}
+		}
+	}
+	if idcol < 0 {
+		return nil, nil, nil, fmt.Errorf("%s: no SampleID column in header %q", filename, lines[0])
+	}
+	for _, g := range groupBy {
+		found := false
+		for _, col := range header {
+			found = found || col == g
+		}
+		if !found {
+			return nil, nil, nil, fmt.Errorf("%s: no %q column in header %q", filename, g, lines[0])
+		}
+	}
+
+	sampleIdx := map[string]int{}
+	for i, name := range names {
+		sampleIdx[trimFilenameForLabel(name)] = i
+	}
+	sampleLabels := make([][]string, len(names))
+	groupIdx := map[string]int{}
+	labelColumn := map[string]string{}
+	matched := 0
+	for lineIdx, line := range lines[1:] {
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.Split(strings.TrimSuffix(string(line), "\r"), ",")
+		if len(fields) != len(header) {
+			return nil, nil, nil, fmt.Errorf("%s line %d: wrong number of fields (%d != %d)", filename, lineIdx+2, len(fields), len(header))
+		}
+		si, ok := sampleIdx[fields[idcol]]
+		if !ok {
+			log.Warnf("%s line %d: sample %q not found in input", filename, lineIdx+2, fields[idcol])
+			continue
+		}
+		matched++
+		for i, val := range fields {
+			if !use[i] || val == "" {
+				continue
+			}
+			label := groupLabelUnsafeRe.ReplaceAllString(header[i]+"_"+val, "_")
+			if _, ok := groupIdx[label]; !ok {
+				groupIdx[label] = -1
+				labelColumn[label] = header[i]
+				groups = append(groups, label)
+			}
+			sampleLabels[si] = append(sampleLabels[si], label)
+		}
+	}
+	sort.Strings(groups)
+	for gi, label := range groups {
+		groupIdx[label] = gi
+		groupColumn = append(groupColumn, labelColumn[label])
+	}
+	for si, labels := range sampleLabels {
+		for _, label := range labels {
+			sampleGroup[si] = append(sampleGroup[si], groupIdx[label])
+		}
+	}
+	log.Infof("%s: %d groups, %d of %d samples matched", filename, len(groups), matched, len(names))
+	return groups, groupColumn, sampleGroup, nil
+}
+
+func (f *formatAlleleFreq) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float64) error {
+	labels := append([]string{""}, f.groups...)
+	if f.tsv {
+		cols := []string{"CHROM", "POS", "REF", "ALT"}
+		for _, label := range labels {
+			suffix := ""
+			if label != "" {
+				suffix = "_" + label
+			}
+			cols = append(cols, "AC"+suffix, "AN"+suffix, "AF"+suffix, "nhomalt"+suffix)
+		}
+		_, err := fmt.Fprintln(out, strings.Join(cols, "\t"))
+		return err
+	}
+	hdr := "##fileformat=VCFv4.2\n" + vcfSVHeader
+	for _, label := range labels {
+		suffix, desc := "", ""
+		if label != "" {
+			suffix, desc = "_"+label, " in group "+label
+		}
+		hdr += fmt.Sprintf(`##INFO=<ID=AC%s,Number=A,Type=Integer,Description="Alternate allele count%s">
+##INFO=<ID=AN%s,Number=1,Type=Integer,Description="Total number of called alleles%s">
+##INFO=<ID=AF%s,Number=A,Type=Float,Description="Alternate allele frequency%s">
+##INFO=<ID=nhomalt%s,Number=A,Type=Integer,Description="Number of homozygous alternate individuals%s">
+`, suffix, desc, suffix, desc, suffix, desc, suffix, desc)
+	}
+	if f.minCellCount > 0 {
+		hdr += fmt.Sprintf("##minCellCount=%d\n", f.minCellCount)
+	}
+	_, err := fmt.Fprint(out, hdr+"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
+	return err
+}
+
+// alleleCounts are the counts for one group at one VCF record.
+type alleleCounts struct {
+	an      int
+	ac      []int // per ALT
+	nhomalt []int // per ALT
+}
+
+func (f *formatAlleleFreq) Print(out io.Writer, seqname string, varslice []tvVariant) error {
+	records := vcfRecords(varslice)
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].pos != records[j].pos {
+			return records[i].pos < records[j].pos
+		}
+		return records[i].vref < records[j].vref
+	})
+	for _, rec := range records {
+		altidx := map[string]int{}
+		for i, a := range rec.alts {
+			altidx[a] = i
+		}
+		// counts[0] is overall, counts[1+i] is f.groups[i]
+		counts := make([]alleleCounts, len(f.groups)+1)
+		for i := range counts {
+			counts[i].ac = make([]int, len(rec.alts))
+			counts[i].nhomalt = make([]int, len(rec.alts))
+		}
+		for g := 0; g*2+1 < len(varslice); g++ {
+			var a [2]int
+			for ph := 0; ph < 2; ph++ {
+				v := varslice[g*2+ph]
+				if v.absent {
+					a[ph] = -3 // haploid
+				} else if v.New == "-" {
+					a[ph] = -2 // no-call
+				} else if idx, ok := altidx[v.New]; ok && v.Ref == rec.vref {
+					a[ph] = idx
+				} else {
+					a[ph] = -1 // ref, or a different record
+				}
+			}
+			add := func(c *alleleCounts) {
+				for _, x := range a {
+					if x >= -1 {
+						c.an++
+					}
+					if x >= 0 {
+						c.ac[x]++
+					}
+				}
+				if a[0] >= 0 && a[0] == a[1] {
+					c.nhomalt[a[0]]++
+				}
+			}
+			add(&counts[0])
+			if g < len(f.sampleGroup) {
+				for _, gi := range f.sampleGroup[g] {
+					add(&counts[gi+1])
+				}
+			}
+		}
+		total := 0
+		for _, ac := range counts[0].ac {
+			total += ac
+		}
+		if total == 0 || total < f.minCellCount {
+			continue
+		}
+		var err error
+		if f.tsv {
+			err = f.printTSV(out, seqname, rec, counts)
+		} else {
+			err = f.printVCF(out, seqname, rec, counts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suppressed returns, for each count in cells (cells[0] is the
+// overall count, cells[1+i] is f.groups[i]), whether it should be
+// output as ".".
+//
+// Counts above zero but below f.minCellCount are suppressed. If
+// exactly one count among the groups from one grouping column is
+// suppressed, it could be derived from the overall count and the
+// other groups, so the next smallest non-zero count in that column
+// is suppressed too -- or, if there is none, the overall count.
+func (f *formatAlleleFreq) suppressed(cells []int) []bool {
+	sup := make([]bool, len(cells))
+	for i, n := range cells {
+		sup[i] = n > 0 && n < f.minCellCount
+	}
+	done := map[string]bool{}
+	for gi, col := range f.groupColumn {
+		if done[col] {
+			continue
+		}
+		done[col] = true
+		nsup, next := 0, -1
+		for gj := gi; gj < len(f.groupColumn); gj++ {
+			if f.groupColumn[gj] != col {
+				continue
+			}
+			if n := cells[gj+1]; sup[gj+1] {
+				nsup++
+			} else if n > 0 && (next < 0 || n < cells[next]) {
+				next = gj + 1
+			}
+		}
+		if nsup != 1 {
+			continue
+		} else if next >= 0 {
+			sup[next] = true
+		} else {
+			sup[0] = true
+		}
+	}
+	return sup
+}
+
+// alleleCells returns the AC and nhomalt counts of the given ALT
+// (overall and per group), and whether each should be suppressed.
+func (f *formatAlleleFreq) alleleCells(counts []alleleCounts, alt int) (ac, nhomalt []int, acSup, nhomaltSup []bool) {
+	for _, c := range counts {
+		ac = append(ac, c.ac[alt])
+		nhomalt = append(nhomalt, c.nhomalt[alt])
+	}
+	return ac, nhomalt, f.suppressed(ac), f.suppressed(nhomalt)
+}
+
+// cell returns n as a string, or "." if it is suppressed.
+func cell(n int, suppress bool) string {
+	if suppress {
+		return "."
+	}
+	return strconv.Itoa(n)
+}
+
+// freq returns ac/an as a string, or "." if it is undefined or ac is
+// suppressed.
+func freq(ac, an int, suppress bool) string {
+	if an == 0 || suppress {
+		return "."
+	}
+	return strconv.FormatFloat(float64(ac)/float64(an), 'g', 6, 64)
+}
+
+func (f *formatAlleleFreq) printVCF(out io.Writer, seqname string, rec vcfRecord, counts []alleleCounts) error {
+	var info []string
+	if rec.info != "" {
+		info = append(info, rec.info)
+	}
+	// ac[i][j], af[i][j], nhomalt[i][j] are for counts[i] and
+	// rec.alts[j]
+	ac := make([][]string, len(counts))
+	af := make([][]string, len(counts))
+	nhomalt := make([][]string, len(counts))
+	for i := range counts {
+		ac[i] = make([]string, len(rec.alts))
+		af[i] = make([]string, len(rec.alts))
+		nhomalt[i] = make([]string, len(rec.alts))
+	}
+	for j := range rec.alts {
+		acs, nhomalts, acSup, nhomaltSup := f.alleleCells(counts, j)
+		for i, c := range counts {
+			ac[i][j] = cell(acs[i], acSup[i])
+			af[i][j] = freq(acs[i], c.an, acSup[i])
+			nhomalt[i][j] = cell(nhomalts[i], nhomaltSup[i])
+		}
+	}
+	for i, c := range counts {
+		suffix := ""
+		if i > 0 {
+			suffix = "_" + f.groups[i-1]
+		}
+		info = append(info,
+			"AC"+suffix+"="+strings.Join(ac[i], ","),
+			"AN"+suffix+"="+strconv.Itoa(c.an),
+			"AF"+suffix+"="+strings.Join(af[i], ","),
+			"nhomalt"+suffix+"="+strings.Join(nhomalt[i], ","))
+	}
+	_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t%s\n", seqname, rec.pos, rec.ref, strings.Join(rec.altcol, ","), strings.Join(info, ";"))
+	return err
+}
+
+func (f *formatAlleleFreq) printTSV(out io.Writer, seqname string, rec vcfRecord, counts []alleleCounts) error {
+	for j, alt := range rec.altcol {
+		line := fmt.Sprintf("%s\t%d\t%s\t%s", seqname, rec.pos, rec.ref, alt)
+		acs, nhomalts, acSup, nhomaltSup := f.alleleCells(counts, j)
+		for i, c := range counts {
+			line += "\t" + cell(acs[i], acSup[i]) + "\t" + strconv.Itoa(c.an) + "\t" + freq(acs[i], c.an, acSup[i]) + "\t" + cell(nhomalts[i], nhomaltSup[i])
+		}
+		_, err := fmt.Fprintln(out, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
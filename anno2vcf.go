@@ -20,10 +20,20 @@ import (
 	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/hgvs"
+	"github.com/kshedden/gonpy"
 	log "github.com/sirupsen/logrus"
 )
 
 type anno2vcf struct {
+	knownOptions knownVariantOptions
+}
+
+// onehotKey identifies a column in a slice-numpy one-hot matrix.
+type onehotKey struct {
+	tag     int
+	variant int
+	hom     bool
 }
 
 func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -41,6 +51,9 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 	priority := flags.Int("priority", 500, "container request priority")
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	cmd.knownOptions.Flags(flags)
+	refFile := flags.String("ref", "", "reference `fasta` file, used to left-align indels when matching known variants")
+	genotypes := flags.Bool("genotypes", false, "add GT columns, using samples.csv, ploidy.csv (if any), and matrix or onehot .npy files in input directory")
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
 		err = nil
@@ -69,7 +82,11 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			KeepCache:   2,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir)
+		err = runner.TranslatePaths(inputDir, refFile)
+		if err != nil {
+			return 1
+		}
+		err = cmd.knownOptions.TranslatePaths(&runner)
 		if err != nil {
 			return 1
 		}
@@ -77,7 +94,10 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-pprof", ":6060",
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
+			"-ref", *refFile,
+			fmt.Sprintf("-genotypes=%v", *genotypes),
 		}
+		runner.Args = append(runner.Args, cmd.knownOptions.Args()...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -87,6 +107,28 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 0
 	}
 
+	// Indels in the input annotations are 3'-normalized, while
+	// known variant files are left-aligned, so indels in
+	// repetitive regions are left-aligned using the -ref
+	// sequence before lookup. Without -ref, they are only
+	// matched where the known variant file uses the same
+	// representation.
+	known, err := cmd.knownOptions.Load()
+	if err != nil {
+		return 1
+	}
+	knownHeader := ""
+	var refseqs map[string]string
+	if known != nil {
+		knownHeader = known.VCFHeader()
+		if *refFile != "" {
+			refseqs, err = loadRefSequences(*refFile)
+			if err != nil {
+				return 1
+			}
+		}
+	}
+
 	d, err := open(*inputDir)
 	if err != nil {
 		log.Print(err)
@@ -100,6 +142,54 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 	d.Close()
 	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	haveFile := map[string]bool{}
+	for _, fi := range fis {
+		haveFile[fi.Name()] = true
+	}
+
+	// Association statistics from slice-numpy
+	// (onehot-columns*.npy), if any.
+	pvalues := map[onehotKey]float64{}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), "onehot-columns") || !strings.HasSuffix(fi.Name(), ".npy") {
+			continue
+		}
+		err = loadOnehotPvalues(*inputDir+"/"+fi.Name(), pvalues)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
+	var samples []sampleInfo
+	haveCaseControl := false
+	// ploidy (written by slice-numpy if any sample has a
+	// haploid sequence) is nil if all samples are diploid.
+	var ploidy ploidySpec
+	if *genotypes {
+		samples, err = loadSampleInfo(*inputDir + "/samples.csv")
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		for _, si := range samples {
+			if si.isCase || si.isControl {
+				haveCaseControl = true
+			}
+		}
+		if haveFile["ploidy.csv"] {
+			ploidy, err = loadPloidySpec(*inputDir + "/ploidy.csv")
+			if err != nil {
+				log.Print(err)
+				return 1
+			}
+		}
+	}
+	// singleOnehot is loaded from onehot.npy the first time it is
+	// needed.
+	var singleOnehot genotypeSource
+	var singleOnehotOnce sync.Once
+	var singleOnehotErr error
 
 	type call struct {
 		tile      int
@@ -108,6 +198,8 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 		deletion  []byte
 		insertion []byte
 		hgvsID    []byte
+		gt        []int8 // 2 alleles per sample: 1 (variant), 0 (not variant), -1 (unknown), absentAllele
+		phased    bool
 	}
 	allcalls := map[string][]*call{}
 	var mtx sync.Mutex
@@ -118,7 +210,31 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			continue
 		}
 		filename := *inputDir + "/" + fi.Name()
+		// Genotypes for matrix.0012.annotations.csv come
+		// from matrix.0012.npy or onehot.0012.npy, for
+		// matrix.annotations.csv from matrix.npy or
+		// onehot.npy.
+		prefix := strings.TrimSuffix(fi.Name(), "annotations.csv")
 		thr.Go(func() error {
+			var gtsrc genotypeSource
+			if *genotypes {
+				var err error
+				if onehotfnm := "onehot." + strings.TrimPrefix(prefix, "matrix."); haveFile[prefix+"npy"] {
+					gtsrc, err = loadTileVariantMatrix(*inputDir+"/"+prefix+"npy", len(samples))
+				} else if haveFile[onehotfnm+"npy"] && prefix != "matrix." {
+					gtsrc, err = loadOnehotGenotypes(*inputDir+"/"+onehotfnm+"npy", *inputDir+"/onehot-columns."+strings.TrimPrefix(prefix, "matrix.")+"npy", len(samples), false)
+				} else if haveFile["onehot.npy"] {
+					singleOnehotOnce.Do(func() {
+						singleOnehot, singleOnehotErr = loadOnehotGenotypes(*inputDir+"/onehot.npy", *inputDir+"/onehot-columns.npy", len(samples), true)
+					})
+					gtsrc, err = singleOnehot, singleOnehotErr
+				} else {
+					err = fmt.Errorf("%s: cannot find corresponding matrix or onehot .npy file", filename)
+				}
+				if err != nil {
+					return err
+				}
+			}
 			log.Printf("reading %s", filename)
 			f, err := open(filename)
 			if err != nil {
@@ -132,6 +248,9 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			f.Close()
 			lines := bytes.Split(buf, []byte{'\n'})
 			calls := map[string][]*call{}
+			// haploid[seq][i] is true if samples[i]
+			// is haploid on seq
+			haploid := map[string][]bool{}
 			for lineIdx, line := range lines {
 				if len(line) == 0 {
 					continue
@@ -150,6 +269,7 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 					continue
 				}
 				tile, _ := strconv.ParseInt(string(fields[0]), 10, 64)
+				col, _ := strconv.ParseInt(string(fields[1]), 10, 64)
 				variant, _ := strconv.ParseInt(string(fields[2]), 10, 64)
 				position, _ := strconv.ParseInt(string(fields[5]), 10, 64)
 				seq := string(fields[4])
@@ -174,14 +294,29 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 					del = append([]byte(nil), del...)
 					ins = append([]byte(nil), ins...)
 				}
-				calls[seq] = append(calls[seq], &call{
+				c := &call{
 					tile:      int(tile),
 					variant:   int(variant),
 					position:  int(position),
 					deletion:  del,
 					insertion: ins,
 					hgvsID:    hgvsID,
-				})
+				}
+				if gtsrc != nil {
+					c.gt, c.phased = gtsrc.genotypes(int(tile), int(variant), int(col))
+					if ploidy != nil {
+						h, ok := haploid[seq]
+						if !ok {
+							h = make([]bool, len(samples))
+							for i, si := range samples {
+								h[i] = ploidy.ploidy(si.id, seq) == 1
+							}
+							haploid[seq] = h
+						}
+						setHaploid(c.gt, h)
+					}
+				}
+				calls[seq] = append(calls[seq], c)
 			}
 			mtx.Lock()
 			for seq, seqcalls := range calls {
@@ -226,10 +361,26 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			}
 			defer f.Close()
 			bufw := bufio.NewWriterSize(f, 1<<20)
-			_, err = fmt.Fprintf(bufw, `##fileformat=VCFv4.0
-##INFO=<ID=TV,Number=.,Type=String,Description="tile-variant">
-#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
-`)
+			header := knownHeader
+			if len(pvalues) > 0 {
+				header += `##INFO=<ID=PHET,Number=.,Type=String,Description="association p-value for heterozygous tile variant, for each TV (slice-numpy)">
+##INFO=<ID=PHOM,Number=.,Type=String,Description="association p-value for homozygous tile variant, for each TV (slice-numpy)">
+`
+			}
+			if haveCaseControl {
+				header += `##INFO=<ID=OR,Number=1,Type=Float,Description="allelic odds ratio, cases vs. controls">
+`
+			}
+			columns := "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO"
+			if *genotypes {
+				header += `##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+`
+				columns += "\tFORMAT"
+				for _, si := range samples {
+					columns += "\t" + si.id
+				}
+			}
+			_, err = fmt.Fprintf(bufw, "##fileformat=VCFv4.0\n##INFO=<ID=TV,Number=.,Type=String,Description=\"tile-variant\">\n%s%s\n", header, columns)
 			if err != nil {
 				return err
 			}
@@ -238,6 +389,10 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 				call := seqcalls[i]
 				i++
 				info := fmt.Sprintf("TV=,%d-%d,", call.tile, call.variant)
+				phet := []string{formatPvalue(pvalues, call.tile, call.variant, false)}
+				phom := []string{formatPvalue(pvalues, call.tile, call.variant, true)}
+				gt := call.gt
+				phased := call.phased
 				for i < len(seqcalls) &&
 					call.position == seqcalls[i].position &&
 					len(call.deletion) == len(seqcalls[i].deletion) &&
@@ -245,6 +400,26 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 					call = seqcalls[i]
 					i++
 					info += fmt.Sprintf("%d-%d,", call.tile, call.variant)
+					phet = append(phet, formatPvalue(pvalues, call.tile, call.variant, false))
+					phom = append(phom, formatPvalue(pvalues, call.tile, call.variant, true))
+					if gt != nil {
+						// A sample has the variant
+						// if any of the tile
+						// variants has it.
+						gt = append([]int8(nil), gt...)
+						for j, a := range call.gt {
+							if gt[j] < a {
+								gt[j] = a
+							}
+						}
+						phased = phased && call.phased
+					}
+				}
+				if len(pvalues) > 0 {
+					info += ";PHET=" + strings.Join(phet, ",") + ";PHOM=" + strings.Join(phom, ",")
+				}
+				if haveCaseControl {
+					info += ";OR=" + allelicOddsRatio(samples, gt)
 				}
 				deletion := call.deletion
 				if len(deletion) == 0 {
@@ -254,7 +429,27 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 				if len(insertion) == 0 {
 					insertion = placeholder
 				}
-				_, err = fmt.Fprintf(bufw, "%s\t%d\t%s\t%s\t%s\t.\t.\t%s\n", seq, call.position, call.hgvsID, deletion, insertion, info)
+				id := string(call.hgvsID)
+				if known != nil {
+					kvs := known.LookupAnchored(seq, refseqs[seq], hgvs.Variant{Position: call.position, Ref: string(call.deletion), New: string(call.insertion)})
+					for _, kv := range kvs {
+						if kv.ID != "" {
+							id += ";" + kv.ID
+						}
+					}
+					info += known.VCFInfo(kvs)
+				}
+				_, err = fmt.Fprintf(bufw, "%s\t%d\t%s\t%s\t%s\t.\t.\t%s", seq, call.position, id, deletion, insertion, info)
+				if err != nil {
+					return err
+				}
+				if *genotypes {
+					_, err = bufw.WriteString("\tGT" + formatGenotypes(gt, phased))
+					if err != nil {
+						return err
+					}
+				}
+				_, err = bufw.WriteString("\n")
 				if err != nil {
 					return err
 				}
@@ -277,3 +472,283 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 	return 0
 }
+
+// absentAllele is the second allele of a sample that has only one
+// copy of the sequence (e.g., chrX in a male sample).
+const absentAllele int8 = -2
+
+// setHaploid replaces the 2 alleles of each haploid sample in gt
+// with one allele followed by absentAllele. slice-numpy codes a
+// hemizygous call as 2 phases with the same variant (matrix) or as
+// heterozygous (onehot), so the sample has the variant if either
+// allele is 1.
+func setHaploid(gt []int8, haploid []bool) {
+	for i, h := range haploid {
+		if !h {
+			continue
+		}
+		if gt[i*2] < gt[i*2+1] {
+			gt[i*2] = gt[i*2+1]
+		}
+		gt[i*2+1] = absentAllele
+	}
+}
+
+// genotypeSource provides per-sample genotypes for the tile variants
+// listed in a slice-numpy annotations file.
+type genotypeSource interface {
+	// genotypes returns 2 alleles per sample (1 = has the given
+	// tile variant, 0 = does not, -1 = unknown) and whether the
+	// alleles are phased. col is the column number from the
+	// annotations file.
+	genotypes(tag, variant, col int) ([]int8, bool)
+}
+
+// tileVariantMatrix is a slice-numpy matrix.npy or matrix.NNNN.npy
+// file, with 2 columns (one per phase) per tile position, and one
+// row per sample. Values are tile variant numbers, 0 for no-call, -1
+// for low quality.
+type tileVariantMatrix struct {
+	*variantMatrix
+}
+
+// loadRefSequences returns the (upper case) sequences in the given
+// fasta file, keyed by sequence name.
+func loadRefSequences(fnm string) (map[string]string, error) {
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seqs := map[string]*bytes.Buffer{}
+	var buf *bytes.Buffer
+	scanner := bufio.NewScanner(bufio.NewReaderSize(f, 8*1024*1024))
+	scanner.Buffer(make([]byte, 256), 1<<29) // in case fasta does not have line breaks
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) > 0 && line[0] == '>' {
+			name := strings.SplitN(strings.TrimSpace(string(line[1:])), " ", 2)[0]
+			buf = &bytes.Buffer{}
+			seqs[name] = buf
+		} else if buf != nil {
+			buf.Write(bytes.ToUpper(bytes.TrimSpace(line)))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	refseqs := make(map[string]string, len(seqs))
+	for name, buf := range seqs {
+		refseqs[name] = buf.String()
+	}
+	log.Infof("%s: loaded %d sequences", fnm, len(refseqs))
+	return refseqs, nil
+}
+
+func loadTileVariantMatrix(fnm string, rows int) (*tileVariantMatrix, error) {
+	log.Printf("reading %s", fnm)
+	m, err := loadVariantMatrix(fnm)
+	if err != nil {
+		return nil, err
+	}
+	if m.rows != rows {
+		return nil, fmt.Errorf("%s: shape [%d %d] does not match %d samples", fnm, m.rows, m.cols, rows)
+	}
+	return &tileVariantMatrix{m}, nil
+}
+
+func (m *tileVariantMatrix) genotypes(tag, variant, col int) ([]int8, bool) {
+	gt := make([]int8, m.rows*2)
+	for row := 0; row < m.rows; row++ {
+		for ph := 0; ph < 2; ph++ {
+			v := m.At(row*m.cols + col*2 + ph)
+			if v == variant {
+				gt[row*2+ph] = 1
+			} else if v <= 0 {
+				gt[row*2+ph] = -1
+			}
+		}
+	}
+	return gt, true
+}
+
+// onehotGenotypes are hom/het columns from a slice-numpy onehot.npy
+// or onehot.NNNN.npy file. Phase is unknown, and genotypes are
+// unknown for tile variants that were filtered out by slice-numpy.
+type onehotGenotypes struct {
+	rows int
+	cols map[onehotKey][]int8
+}
+
+// loadOnehotGenotypes reads a one-hot matrix and its corresponding
+// onehot-columns file. If sparse is true, the matrix is in the
+// [2][n] (row, column) coordinate format produced by slice-numpy
+// -single-onehot, otherwise it is a dense [rows][cols] matrix.
+func loadOnehotGenotypes(fnm, columnsfnm string, rows int, sparse bool) (*onehotGenotypes, error) {
+	xrefs, xcols, err := readNumpyInt32(columnsfnm)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("reading %s", fnm)
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	npy, err := gonpy.NewReader(bufio.NewReaderSize(f, 1<<26))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	og := &onehotGenotypes{rows: rows, cols: make(map[onehotKey][]int8, xcols)}
+	keys := make([]onehotKey, xcols)
+	for i := range keys {
+		keys[i] = onehotKey{tag: int(xrefs[i]), variant: int(xrefs[xcols+i]), hom: xrefs[xcols*2+i] != 0}
+		og.cols[keys[i]] = make([]int8, rows)
+	}
+	if sparse {
+		coords, err := npy.GetUint32()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fnm, err)
+		}
+		nz := len(coords) / 2
+		for i := 0; i < nz; i++ {
+			row, col := int(coords[i]), int(coords[nz+i])
+			if row >= rows || col >= xcols {
+				return nil, fmt.Errorf("%s: coordinates (%d, %d) out of range", fnm, row, col)
+			}
+			og.cols[keys[col]][row] = 1
+		}
+	} else {
+		if len(npy.Shape) != 2 || npy.Shape[0] != rows || npy.Shape[1] != xcols {
+			return nil, fmt.Errorf("%s: shape %v does not match %d samples, %d columns", fnm, npy.Shape, rows, xcols)
+		}
+		data, err := npy.GetInt8()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fnm, err)
+		}
+		for row := 0; row < rows; row++ {
+			for col, key := range keys {
+				og.cols[key][row] = data[row*xcols+col]
+			}
+		}
+	}
+	return og, nil
+}
+
+func (og *onehotGenotypes) genotypes(tag, variant, col int) ([]int8, bool) {
+	gt := make([]int8, og.rows*2)
+	hom := og.cols[onehotKey{tag, variant, true}]
+	het := og.cols[onehotKey{tag, variant, false}]
+	for row := 0; row < og.rows; row++ {
+		if hom == nil && het == nil {
+			gt[row*2], gt[row*2+1] = -1, -1
+		} else if hom != nil && hom[row] != 0 {
+			gt[row*2], gt[row*2+1] = 1, 1
+		} else if het != nil && het[row] != 0 {
+			gt[row*2+1] = 1
+		}
+	}
+	return gt, false
+}
+
+// readNumpyInt32 reads a 2-dimensional numpy file written by
+// writeNumpyInt32, and returns the data and the number of columns.
+func readNumpyInt32(fnm string) ([]int32, int, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	npy, err := gonpy.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(npy.Shape) != 2 {
+		return nil, 0, fmt.Errorf("%s: shape %v is not 2-dimensional", fnm, npy.Shape)
+	}
+	data, err := npy.GetInt32()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return data, npy.Shape[1], nil
+}
+
+// loadOnehotPvalues adds the p-values from a slice-numpy
+// onehot-columns file to pvalues.
+func loadOnehotPvalues(fnm string, pvalues map[onehotKey]float64) error {
+	xrefs, xcols, err := readNumpyInt32(fnm)
+	if err != nil {
+		return err
+	}
+	if len(xrefs) < xcols*4 {
+		return fmt.Errorf("%s: not enough rows (%d < 4)", fnm, len(xrefs)/xcols)
+	}
+	for i := 0; i < xcols; i++ {
+		key := onehotKey{tag: int(xrefs[i]), variant: int(xrefs[xcols+i]), hom: xrefs[xcols*2+i] != 0}
+		pvalues[key] = float64(xrefs[xcols*3+i]) / 1000000
+	}
+	return nil
+}
+
+func formatPvalue(pvalues map[onehotKey]float64, tag, variant int, hom bool) string {
+	if p, ok := pvalues[onehotKey{tag, variant, hom}]; ok {
+		return strconv.FormatFloat(p, 'g', 6, 64)
+	}
+	return "."
+}
+
+// formatGenotypes returns a tab-separated GT value for each sample,
+// with a leading tab. Haploid samples (see setHaploid) have a single
+// allele.
+func formatGenotypes(gt []int8, phased bool) string {
+	sep := byte('/')
+	if phased {
+		sep = '|'
+	}
+	buf := make([]byte, 0, len(gt)*2)
+	for i, a := range gt {
+		if i%2 == 0 {
+			buf = append(buf, '\t')
+		} else if a == absentAllele {
+			continue
+		} else {
+			buf = append(buf, sep)
+		}
+		switch a {
+		case 1:
+			buf = append(buf, '1')
+		case 0:
+			buf = append(buf, '0')
+		default:
+			buf = append(buf, '.')
+		}
+	}
+	return string(buf)
+}
+
+// allelicOddsRatio returns the odds ratio of the variant allele in
+// cases vs. controls, using a 0.5 continuity correction if any count
+// is zero. Unknown alleles are not counted, and haploid samples (see
+// setHaploid) contribute one allele.
+func allelicOddsRatio(samples []sampleInfo, gt []int8) string {
+	var caseAlt, caseRef, ctrlAlt, ctrlRef float64
+	for i, si := range samples {
+		for _, a := range gt[i*2 : i*2+2] {
+			switch {
+			case a < 0:
+			case si.isCase && a == 1:
+				caseAlt++
+			case si.isCase:
+				caseRef++
+			case si.isControl && a == 1:
+				ctrlAlt++
+			case si.isControl:
+				ctrlRef++
+			}
+		}
+	}
+	if caseAlt == 0 || caseRef == 0 || ctrlAlt == 0 || ctrlRef == 0 {
+		caseAlt, caseRef, ctrlAlt, ctrlRef = caseAlt+0.5, caseRef+0.5, ctrlAlt+0.5, ctrlRef+0.5
+	}
+	return strconv.FormatFloat(caseAlt*ctrlRef/(caseRef*ctrlAlt), 'g', 6, 64)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type anno2vcfSuite struct{}
+
+var _ = check.Suite(&anno2vcfSuite{})
+
+func (s *anno2vcfSuite) TestGenotypesAndStats(c *check.C) {
+	indir := c.MkDir()
+	outdir := c.MkDir()
+	err := ioutil.WriteFile(indir+"/samples.csv", []byte(`Index,SampleID,CaseControl,TrainingValidation
+0,sample0,1,1
+1,sample1,0,1
+2,sample2,0,1
+`), 0666)
+	c.Assert(err, check.IsNil)
+	// tag 3 is column 0, tag 4 is column 1. Tile variants 2
+	// and 3 of tag 3 both have chr1:g.12A>G.
+	err = ioutil.WriteFile(indir+"/matrix.0000.annotations.csv", []byte(`3,0,1,=,chr1,0,,,
+3,0,2,chr1:g.12A>G,chr1,12,A,G,C
+3,0,3,chr1:g.12A>G,chr1,12,A,G,C
+3,0,3,chr1:g.20del,chr1,20,T,,G
+4,1,2,chr1:g.40C>T,chr1,40,C,T,A
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt16(indir+"/matrix.0000.npy", []int16{
+		2, 3, 1, 0,
+		1, 1, 2, 2,
+		3, 1, -1, 1,
+	}, 3, 4)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt32(indir+"/onehot-columns.0000.npy", onehotXref2int32([]onehotXref{
+		{tag: 3, variant: 2, hom: false, pvalue: 0.25},
+		{tag: 4, variant: 2, hom: true, pvalue: 0.5},
+	}), 5, 2)
+	c.Assert(err, check.IsNil)
+
+	exited := (&anno2vcf{}).RunCommand("anno2vcf", []string{
+		"-local=true",
+		"-input-dir=" + indir,
+		"-output-dir=" + outdir,
+		"-genotypes",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	vcf, err := ioutil.ReadFile(outdir + "/annotations.chr1.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(string(vcf), check.Equals, `##fileformat=VCFv4.0
+##INFO=<ID=TV,Number=.,Type=String,Description="tile-variant">
+##INFO=<ID=PHET,Number=.,Type=String,Description="association p-value for heterozygous tile variant, for each TV (slice-numpy)">
+##INFO=<ID=PHOM,Number=.,Type=String,Description="association p-value for homozygous tile variant, for each TV (slice-numpy)">
+##INFO=<ID=OR,Number=1,Type=Float,Description="allelic odds ratio, cases vs. controls">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample0	sample1	sample2
+chr1	12	chr1:g.12A>G	A	G	.	.	TV=,3-2,3-3,;PHET=0.25,.;PHOM=.,.;OR=11.6667	GT	1|1	0|0	1|0
+chr1	19	chr1:g.20del	GT	G	.	.	TV=,3-3,;PHET=.;PHOM=.;OR=3	GT	0|1	0|0	1|0
+chr1	40	chr1:g.40C>T	C	T	.	.	TV=,4-2,;PHET=.;PHOM=0.5;OR=0.2	GT	0|.	1|1	.|0
+`)
+}
+
+func (s *anno2vcfSuite) TestHaploid(c *check.C) {
+	indir := c.MkDir()
+	outdir := c.MkDir()
+	err := ioutil.WriteFile(indir+"/samples.csv", []byte(`Index,SampleID,CaseControl,TrainingValidation
+0,sample0,1,1
+1,sample1,0,1
+2,sample2,0,1
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(indir+"/ploidy.csv", []byte("# genome,sequence,ploidy\nsample0,chr1,1\nsample2,chr1,1\n"), 0666)
+	c.Assert(err, check.IsNil)
+	// Genotypes for tag 3 come from a matrix, where a
+	// hemizygous call has the same variant in both phases.
+	err = ioutil.WriteFile(indir+"/matrix.0000.annotations.csv", []byte(`3,0,2,chr1:g.12A>G,chr1,12,A,G,C
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt16(indir+"/matrix.0000.npy", []int16{
+		2, 2,
+		2, 1,
+		1, 1,
+	}, 3, 2)
+	c.Assert(err, check.IsNil)
+	// Genotypes for tag 5 come from a onehot matrix, where a
+	// hemizygous call is coded as heterozygous.
+	err = ioutil.WriteFile(indir+"/matrix.0001.annotations.csv", []byte(`5,0,2,chr1:g.50C>T,chr1,50,C,T,A
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt32(indir+"/onehot-columns.0001.npy", onehotXref2int32([]onehotXref{
+		{tag: 5, variant: 2, hom: false, pvalue: 0.25},
+		{tag: 5, variant: 2, hom: true, pvalue: 0.5},
+	}), 5, 2)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt8(indir+"/onehot.0001.npy", []int8{
+		1, 0,
+		0, 1,
+		0, 0,
+	}, 3, 2)
+	c.Assert(err, check.IsNil)
+
+	exited := (&anno2vcf{}).RunCommand("anno2vcf", []string{
+		"-local=true",
+		"-input-dir=" + indir,
+		"-output-dir=" + outdir,
+		"-genotypes",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	vcf, err := ioutil.ReadFile(outdir + "/annotations.chr1.vcf")
+	c.Assert(err, check.IsNil)
+	// Odds ratios count one allele for each haploid sample:
+	// (1.5*2.5)/(0.5*1.5) at chr1:12, (1.5*1.5)/(0.5*2.5) at
+	// chr1:50.
+	c.Check(string(vcf), check.Matches, `(?ms).*
+chr1	12	chr1:g.12A>G	A	G	.	.	TV=,3-2,;PHET=.;PHOM=.;OR=5	GT	1	1\|0	0
+chr1	50	chr1:g.50C>T	C	T	.	.	TV=,5-2,;PHET=0.25;PHOM=0.5;OR=1.8	GT	1	1/1	0
+`)
+}
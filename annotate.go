@@ -6,6 +6,7 @@ package lightning
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -31,6 +32,9 @@ type annotatecmd struct {
 	variantHash      bool
 	maxTileSize      int
 	tag2tagid        map[string]tagID
+	transcripts      *transcriptModel
+	knownOptions     knownVariantOptions
+	known            *knownVariantDB
 	reportAnnotation func(tag tagID, outcol int, variant tileVariantID, refname string, seqname string, pdi hgvs.Variant)
 }
 
@@ -50,7 +54,9 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	inputFilename := flags.String("i", "-", "input `file` (library)")
 	outputFilename := flags.String("o", "-", "output `file`")
 	flags.BoolVar(&cmd.variantHash, "variant-hash", false, "output variant hash instead of index")
-	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
+	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "use banded alignment instead of a full diff for tiles bigger than given `size`")
+	gtfFilename := flags.String("gtf", "", "transcript model `file` (GTF or GFF3) for gene/transcript/consequence annotation")
+	cmd.knownOptions.Flags(flags)
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
 		err = nil
@@ -80,11 +86,16 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 			VCPUs:       16,
 			Priority:    *priority,
 		}
-		err = runner.TranslatePaths(inputFilename)
+		err = runner.TranslatePaths(inputFilename, gtfFilename)
 		if err != nil {
 			return 1
 		}
-		runner.Args = []string{"annotate", "-local=true", fmt.Sprintf("-variant-hash=%v", cmd.variantHash), "-max-tile-size", strconv.Itoa(cmd.maxTileSize), "-i", *inputFilename, "-o", "/mnt/output/tilevariants.csv"}
+		err = cmd.knownOptions.TranslatePaths(&runner)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"annotate", "-local=true", fmt.Sprintf("-variant-hash=%v", cmd.variantHash), "-max-tile-size", strconv.Itoa(cmd.maxTileSize), "-gtf", *gtfFilename, "-i", *inputFilename, "-o", "/mnt/output/tilevariants.csv"}
+		runner.Args = append(runner.Args, cmd.knownOptions.Args()...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -117,6 +128,17 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	}
 	bufw := bufio.NewWriterSize(output, 4*1024*1024)
 
+	if *gtfFilename != "" {
+		cmd.transcripts, err = loadTranscriptModel(*gtfFilename)
+		if err != nil {
+			return 1
+		}
+	}
+	cmd.known, err = cmd.knownOptions.Load()
+	if err != nil {
+		return 1
+	}
+
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
 		retainTileSequences: true,
@@ -156,7 +178,7 @@ func (cmd *annotatecmd) exportTileDiffs(outw io.Writer, tilelib *tileLibrary) er
 	}
 	cmd.tag2tagid = make(map[string]tagID, len(tagset))
 	for tagid, tagseq := range tagset {
-		cmd.tag2tagid[string(tagseq)] = tagID(tagid)
+		cmd.tag2tagid[strings.ToLower(string(tagseq))] = tagID(tagid)
 	}
 	sort.Strings(refs)
 	log.Infof("len(refs) %d", len(refs))
@@ -232,6 +254,14 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 		tileend[libref.Tag] = len(refseq)
 	}
 	log.Infof("seq %s len(refseq) %d len(tilestart) %d", seqname, len(refseq), len(tilestart))
+	var conseq *consequenceAnnotator
+	if cmd.transcripts != nil {
+		conseq = cmd.transcripts.annotator(seqname, refseq)
+	}
+	var refstr string
+	if cmd.known != nil {
+		refstr = strings.ToUpper(string(refseq))
+	}
 	// outtag is tag's index in the subset of tags that aren't
 	// dropped. If there are 10M tags and half are dropped by
 	// dropTiles, tag ranges from 0 to 10M-1 and outtag ranges
@@ -266,10 +296,12 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 				return fmt.Errorf("tilevar %d,%d has sequence len %d < taglen %d", tag, variant, len(tileseq), taglen)
 			}
 			var refpart []byte
+			terminal := false
 			endtag := string(tileseq[len(tileseq)-taglen:])
-			if endtagid, ok := cmd.tag2tagid[endtag]; !ok {
+			if endtagid, ok := approxTagID(cmd.tag2tagid, bytes.ToLower(tileseq[len(tileseq)-taglen:]), tilelib.TileVariantApproxEndTag(tileLibRef{Tag: tag, Variant: variant}, taglen)); !ok {
 				// Tile variant doesn't end on a tag, so it can only place at the end of a chromosome.
 				refpart = refseq[refstart:]
+				terminal = true
 				log.Warnf("%x tilevar %d,%d endtag not in ref: %s", hash[:13], tag, variant, endtag)
 			} else if refendtagstart, ok := tilestart[endtagid]; !ok {
 				// Ref ends a chromsome with a (possibly very large) variant of this tile, but genomes with this tile don't.
@@ -281,20 +313,31 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 				refpart = refseq[refstart : refendtagstart+taglen]
 				log.Tracef("\n%x tilevar %d,%d endtag %s endtagid %d refendtagstart %d", hash[:13], tag, variant, endtag, endtagid, refendtagstart)
 			}
-			if len(refpart) > cmd.maxTileSize {
-				log.Warnf("%x tilevar %d,%d skipping long diff, ref %s seq %s pos %d ref len %d", hash[:13], tag, variant, refname, seqname, refstart, len(refpart))
-				continue
-			}
-			if len(tileseq) > cmd.maxTileSize {
-				log.Warnf("%x tilevar %d,%d skipping long diff, ref %s seq %s variant len %d", hash[:13], tag, variant, refname, seqname, len(tileseq))
+			long := len(refpart) > cmd.maxTileSize || len(tileseq) > cmd.maxTileSize
+			if long && terminal {
+				// refpart is the entire remainder of
+				// the reference chromosome, which
+				// isn't a meaningful comparison.
+				log.Warnf("%x tilevar %d,%d skipping long diff at end of chromosome, ref %s seq %s pos %d ref len %d", hash[:13], tag, variant, refname, seqname, refstart, len(refpart))
 				continue
+			} else if long {
+				log.Infof("%x tilevar %d,%d using banded alignment for long diff, ref %s seq %s pos %d ref len %d variant len %d", hash[:13], tag, variant, refname, seqname, refstart, len(refpart), len(tileseq))
 			}
 			// log.Printf("\n%x @ refstart %d \n< %s\n> %s\n", tv.Blake2b, refstart, refpart, tileseq)
 
 			throttle.Acquire()
 			go func() {
 				defer throttle.Release()
-				diffs, _ := hgvs.Diff(strings.ToUpper(string(refpart)), strings.ToUpper(string(tileseq)), 0)
+				var diffs []hgvs.Variant
+				if long {
+					var truncated bool
+					diffs, truncated = hgvs.DiffBanded(strings.ToUpper(string(refpart)), strings.ToUpper(string(tileseq)), hgvs.DefaultBandwidth)
+					if truncated {
+						log.Warnf("%x tilevar %d,%d diff too large to align, reporting as a single event", hash[:13], tag, variant)
+					}
+				} else {
+					diffs, _ = hgvs.Diff(strings.ToUpper(string(refpart)), strings.ToUpper(string(tileseq)), 0)
+				}
 				for _, diff := range diffs {
 					diff.Position += refstart
 					var varid string
@@ -303,7 +346,15 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 					} else {
 						varid = fmt.Sprintf("%d", variant)
 					}
-					outch <- fmt.Sprintf("%d,%d,%s%s,%s:g.%s\n", tag, outcol, varid, refnamefield, seqname, diff.String())
+					knownfields := ""
+					if cmd.known != nil {
+						knownfields = "," + cmd.known.CSV(cmd.known.LookupNormalize(seqname, refstr, diff))
+					}
+					if conseq == nil {
+						outch <- fmt.Sprintf("%d,%d,%s%s,%s:g.%s%s\n", tag, outcol, varid, refnamefield, seqname, diff.String(), knownfields)
+					} else {
+						outch <- fmt.Sprintf("%d,%d,%s%s,%s:g.%s,%s%s\n", tag, outcol, varid, refnamefield, seqname, diff.String(), consequencesCSV(conseq.Annotate(diff)), knownfields)
+					}
 					if cmd.reportAnnotation != nil {
 						cmd.reportAnnotation(tag, outcol, variant, refname, seqname, diff)
 					}
@@ -0,0 +1,668 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arvados/lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkIdentity compares genomes in a library to external genotypes
+// (e.g., from a genotyping array) for the same participants, to
+// detect sample swaps and contamination.
+type checkIdentity struct {
+	refName           string
+	minConcordance    float64
+	maxHetDiscordance float64
+	minSites          int
+}
+
+func (cmd *checkIdentity) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputDir := flags.String("input-dir", "./in", "input `directory` (a single library, e.g., output of slice)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	genotypesFilename := flags.String("genotypes", "", "external genotypes `file` (VCF, optionally gzipped, or PLINK .ped with corresponding .map)")
+	flags.StringVar(&cmd.refName, "ref", "", "reference genome `name` (default: the only reference genome in the library)")
+	flags.Float64Var(&cmd.minConcordance, "min-concordance", 0.9, "flag samples whose genotype concordance with the expected genome is below `P`")
+	flags.Float64Var(&cmd.maxHetDiscordance, "max-het-discordance", 0.05, "flag possible contamination if more than `P` of externally homozygous sites are heterozygous in the genome")
+	flags.IntVar(&cmd.minSites, "min-sites", 20, "minimum number of sites called in both a genome and an external sample to compare them")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if *genotypesFilename == "" {
+		err = fmt.Errorf("-genotypes file must be specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning check-identity",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: *projectUUID,
+			RAM:         120000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		mapFilename := strings.TrimSuffix(*genotypesFilename, ".ped") + ".map"
+		err = runner.TranslatePaths(inputDir, genotypesFilename, &mapFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"check-identity", "-local=true",
+			"-pprof=:6060",
+			"-input-dir=" + *inputDir,
+			"-output-dir=/mnt/output",
+			"-genotypes=" + *genotypesFilename,
+			"-ref=" + cmd.refName,
+			fmt.Sprintf("-min-concordance=%f", cmd.minConcordance),
+			fmt.Sprintf("-max-het-discordance=%f", cmd.maxHetDiscordance),
+			fmt.Sprintf("-min-sites=%d", cmd.minSites),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	prov := startProvenance(prog, args, *inputDir, *genotypesFilename)
+	ext, err := loadExternalGenotypes(*genotypesFilename)
+	if err != nil {
+		return 1
+	}
+	gg, err := cmd.genomeGenotypes(*inputDir, ext)
+	if err != nil {
+		return 1
+	}
+	results := cmd.compare(ext, gg)
+	err = writeIdentityResults(*outputDir+"/identity.tsv", results)
+	if err != nil {
+		return 1
+	}
+	err = prov.writeJSON(*outputDir)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// genotype is a pair of alleles (upper case bases), 0 if not called.
+type genotype [2]byte
+
+func (gt genotype) called() bool {
+	return gt[0] != 0 && gt[1] != 0
+}
+
+func (gt genotype) het() bool {
+	return gt[0] != gt[1]
+}
+
+// same returns true if both genotypes are called and have the same
+// alleles, regardless of phase.
+func (gt genotype) same(other genotype) bool {
+	return gt.called() && other.called() &&
+		((gt[0] == other[0] && gt[1] == other[1]) || (gt[0] == other[1] && gt[1] == other[0]))
+}
+
+// externalGenotypes are SNV genotypes loaded from a VCF or PLINK
+// file.
+type externalGenotypes struct {
+	samples []string
+	sites   []genotypeSite
+}
+
+type genotypeSite struct {
+	seqname string // without "chr" prefix
+	pos     int    // 1-based
+	ref     byte   // reference base, or 0 if unknown
+	calls   []genotype
+}
+
+func loadExternalGenotypes(fnm string) (*externalGenotypes, error) {
+	var ext *externalGenotypes
+	var err error
+	if strings.HasSuffix(fnm, ".ped") {
+		ext, err = loadGenotypesPLINK(fnm, strings.TrimSuffix(fnm, ".ped")+".map")
+	} else {
+		ext, err = loadGenotypesVCF(fnm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("loaded %d samples, %d sites from %s", len(ext.samples), len(ext.sites), fnm)
+	return ext, nil
+}
+
+// loadGenotypesVCF loads SNV sites (REF and ALT are single bases)
+// from a VCF file. Other sites are ignored.
+func loadGenotypesVCF(fnm string) (*externalGenotypes, error) {
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ext := &externalGenotypes{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 1<<28)
+	for lineIdx := 1; scanner.Scan(); lineIdx++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#CHROM") {
+			fields := strings.Split(line, "\t")
+			if len(fields) > 9 {
+				ext.samples = fields[9:]
+			}
+			continue
+		} else if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9+len(ext.samples) {
+			return nil, fmt.Errorf("%s line %d: wrong number of fields (%d != %d)", fnm, lineIdx, len(fields), 9+len(ext.samples))
+		}
+		pos, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: cannot parse POS %q: %w", fnm, lineIdx, fields[1], err)
+		}
+		ref := strings.ToUpper(fields[3])
+		alleles := []string{ref}
+		for _, alt := range strings.Split(strings.ToUpper(fields[4]), ",") {
+			if alt != "." {
+				alleles = append(alleles, alt)
+			}
+		}
+		snv := true
+		for _, a := range alleles {
+			if len(a) != 1 || !isbase[a[0]] {
+				snv = false
+			}
+		}
+		if !snv {
+			continue
+		}
+		gtIdx := -1
+		for i, key := range strings.Split(fields[8], ":") {
+			if key == "GT" {
+				gtIdx = i
+			}
+		}
+		if gtIdx < 0 {
+			continue
+		}
+		site := genotypeSite{
+			seqname: strings.TrimPrefix(fields[0], "chr"),
+			pos:     pos,
+			ref:     ref[0],
+			calls:   make([]genotype, len(ext.samples)),
+		}
+		for i, sample := range fields[9:] {
+			sf := strings.Split(sample, ":")
+			if len(sf) <= gtIdx {
+				continue
+			}
+			gt := strings.FieldsFunc(sf[gtIdx], func(r rune) bool { return r == '/' || r == '|' })
+			if len(gt) == 1 {
+				// haploid
+				gt = append(gt, gt[0])
+			}
+			if len(gt) != 2 {
+				continue
+			}
+			for phase, a := range gt {
+				if idx, err := strconv.Atoi(a); err == nil && idx >= 0 && idx < len(alleles) {
+					site.calls[i][phase] = alleles[idx][0]
+				}
+			}
+		}
+		ext.sites = append(ext.sites, site)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return ext, nil
+}
+
+// loadGenotypesPLINK loads genotypes from a PLINK text fileset
+// (.ped and .map). Alleles must be coded as bases (ACGT, 0 for
+// missing).
+func loadGenotypesPLINK(pedFilename, mapFilename string) (*externalGenotypes, error) {
+	buf, err := readAll(mapFilename)
+	if err != nil {
+		return nil, err
+	}
+	ext := &externalGenotypes{}
+	for lineIdx, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 4 {
+			return nil, fmt.Errorf("%s line %d: wrong number of fields (%d != 4)", mapFilename, lineIdx+1, len(fields))
+		}
+		pos, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: cannot parse position %q: %w", mapFilename, lineIdx+1, fields[3], err)
+		}
+		ext.sites = append(ext.sites, genotypeSite{
+			seqname: strings.TrimPrefix(fields[0], "chr"),
+			pos:     pos,
+		})
+	}
+	buf, err = readAll(pedFilename)
+	if err != nil {
+		return nil, err
+	}
+	for lineIdx, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 6+2*len(ext.sites) {
+			return nil, fmt.Errorf("%s line %d: wrong number of fields (%d != %d)", pedFilename, lineIdx+1, len(fields), 6+2*len(ext.sites))
+		}
+		ext.samples = append(ext.samples, fields[1])
+		for i := range ext.sites {
+			var gt genotype
+			for phase := 0; phase < 2; phase++ {
+				if a := strings.ToUpper(fields[6+i*2+phase]); len(a) == 1 && isbase[a[0]] {
+					gt[phase] = a[0]
+				}
+			}
+			ext.sites[i].calls = append(ext.sites[i].calls, gt)
+		}
+	}
+	return ext, nil
+}
+
+func readAll(fnm string) ([]byte, error) {
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// genomeGenotypes returns the genotypes of each genome in the
+// library at the external genotype sites. The returned map has one
+// entry per genome name; each value has one genotype per site (in
+// ext.sites order).
+func (cmd *checkIdentity) genomeGenotypes(inputDir string, ext *externalGenotypes) (map[string][]genotype, error) {
+	infiles, err := allFiles(inputDir, matchGobFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(infiles) == 0 {
+		return nil, fmt.Errorf("no input files found in %s", inputDir)
+	}
+
+	// First pass: reference tile positions.
+	var mtx sync.Mutex
+	var tagset [][]byte
+	refs := map[string]map[string][]tileLibRef{}
+	reftiledata := map[tileLibRef][]byte{}
+	err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
+		}
+		for _, cseq := range ent.CompactSequences {
+			refs[cseq.Name] = cseq.TileSequences
+		}
+		for _, tv := range ent.TileVariants {
+			if tv.Ref {
+				reftiledata[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tv.Sequence
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tagset) == 0 {
+		return nil, fmt.Errorf("tagset not found")
+	}
+	refName := cmd.refName
+	if refName == "" {
+		if len(refs) != 1 {
+			return nil, fmt.Errorf("library has %d reference genomes, need -ref to choose one", len(refs))
+		}
+		for name := range refs {
+			refName = name
+		}
+	}
+	refseq, ok := refs[refName]
+	if !ok {
+		return nil, fmt.Errorf("reference genome %q not found in library", refName)
+	}
+	taglen := len(tagset[0])
+
+	// siteTile[i] is the reference tile containing ext.sites[i],
+	// or nil.
+	type refTile struct {
+		libref tileLibRef
+		start  int // 0-based position in reference sequence
+		seq    []byte
+	}
+	siteTile := make([]*refTile, len(ext.sites))
+	sitesBySeq := map[string][]int{}
+	for i, site := range ext.sites {
+		sitesBySeq[site.seqname] = append(sitesBySeq[site.seqname], i)
+	}
+	refMismatch := 0
+	for seqname, path := range refseq {
+		sites := sitesBySeq[strings.TrimPrefix(seqname, "chr")]
+		if len(sites) == 0 {
+			continue
+		}
+		var tiles []*refTile
+		pos := 0
+		for _, libref := range path {
+			seq := reftiledata[libref]
+			if len(seq) == 0 {
+				return nil, fmt.Errorf("missing tiledata for tag %d variant %d in %s in ref", libref.Tag, libref.Variant, seqname)
+			}
+			tiles = append(tiles, &refTile{libref: libref, start: pos, seq: seq})
+			pos += len(seq) - taglen
+		}
+		for _, i := range sites {
+			// Find the last tile that starts at or before
+			// the site. (A site in the tag at the end of a
+			// tile is assigned to the following tile.)
+			p := ext.sites[i].pos - 1
+			t := sort.Search(len(tiles), func(t int) bool { return tiles[t].start > p }) - 1
+			if t < 0 || p >= tiles[t].start+len(tiles[t].seq) {
+				continue
+			}
+			if ref := ext.sites[i].ref; ref != 0 && ref != upperBase(tiles[t].seq[p-tiles[t].start]) {
+				refMismatch++
+				continue
+			}
+			siteTile[i] = tiles[t]
+		}
+	}
+	if refMismatch > 0 {
+		log.Warnf("skipping %d sites where the external REF allele does not match reference genome %q", refMismatch, refName)
+	}
+
+	tagSites := map[tagID][]int{}
+	for i, rt := range siteTile {
+		if rt != nil {
+			tagSites[rt.libref.Tag] = append(tagSites[rt.libref.Tag], i)
+		}
+	}
+	log.Infof("%d of %d sites are in %d reference tiles", func() (n int) {
+		for _, sites := range tagSites {
+			n += len(sites)
+		}
+		return
+	}(), len(ext.sites), len(tagSites))
+
+	// Second pass: genome tile variants at the tags containing
+	// sites.
+	tileseq := map[tileLibRef][]byte{}
+	cgs := map[string]map[tagID][2]tileVariantID{}
+	err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, tv := range ent.TileVariants {
+			if _, ok := tagSites[tv.Tag]; ok {
+				tileseq[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tv.Sequence
+			}
+		}
+		for _, cg := range ent.CompactGenomes {
+			calls := cgs[cg.Name]
+			if calls == nil {
+				calls = map[tagID][2]tileVariantID{}
+				cgs[cg.Name] = calls
+			}
+			for tag := range tagSites {
+				if idx := int(tag-cg.StartTag) * 2; idx >= 0 && idx+1 < len(cg.Variants) {
+					calls[tag] = [2]tileVariantID{cg.Variants[idx], cg.Variants[idx+1]}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// alleles[libref][i] is the base at site i in tile variant
+	// libref (0 if unknown).
+	alleles := map[tileLibRef]map[int]byte{}
+	for libref, seq := range tileseq {
+		sites := tagSites[libref.Tag]
+		rt := siteTile[sites[0]]
+		refstr := strings.ToUpper(string(rt.seq))
+		a := map[int]byte{}
+		alleles[libref] = a
+		if len(seq) == 0 {
+			continue
+		}
+		diffs, _ := hgvs.Diff(refstr, strings.ToUpper(string(seq)), time.Second)
+	SITE:
+		for _, i := range sites {
+			p := ext.sites[i].pos - rt.start // 1-based position in tile
+			for _, diff := range diffs {
+				if diff.Position > p || diff.Position+len(diff.Ref) <= p {
+					continue
+				}
+				// Substitutions (including
+				// multi-base) determine the allele;
+				// indels and no-calls leave it
+				// unknown.
+				if len(diff.Ref) == len(diff.New) && isbase[diff.New[p-diff.Position]] {
+					a[i] = diff.New[p-diff.Position]
+				}
+				continue SITE
+			}
+			if isbase[refstr[p-1]] {
+				a[i] = refstr[p-1]
+			}
+		}
+	}
+
+	ret := make(map[string][]genotype, len(cgs))
+	for name, calls := range cgs {
+		gts := make([]genotype, len(ext.sites))
+		for tag, sites := range tagSites {
+			for phase, v := range calls[tag] {
+				if v == 0 {
+					continue
+				}
+				a := alleles[tileLibRef{Tag: tag, Variant: v}]
+				for _, i := range sites {
+					gts[i][phase] = a[i]
+				}
+			}
+		}
+		ret[name] = gts
+	}
+	return ret, nil
+}
+
+// decodeAllFiles calls cb for each library entry in the given files,
+// decoding several files concurrently.
+func decodeAllFiles(infiles []string, cb func(*LibraryEntry) error) error {
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, infile := range infiles {
+		infile := infile
+		throttle.Go(func() error {
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			log.Infof("reading %s", infile)
+			err = DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), cb)
+			if err != nil {
+				return fmt.Errorf("%s: %w", infile, err)
+			}
+			return nil
+		})
+	}
+	return throttle.Wait()
+}
+
+func upperBase(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - 'a' + 'A'
+	}
+	return b
+}
+
+// identityResult is the comparison of one external sample to the
+// genomes in the library.
+type identityResult struct {
+	SampleID        string
+	Genome          string // genome with the same sample ID, if any
+	Sites           int    // sites called in both
+	Concordance     float64
+	BestGenome      string // genome with highest concordance
+	BestSites       int
+	BestConcordance float64
+	HetDiscordance  float64 // fraction of externally homozygous sites that are heterozygous in Genome
+	Flags           []string
+}
+
+// concordance returns the number of sites called in both a and b,
+// and the fraction of those sites where the genotypes are the same.
+func concordance(a, b []genotype) (int, float64) {
+	sites, same := 0, 0
+	for i := range a {
+		if a[i].called() && b[i].called() {
+			sites++
+			if a[i].same(b[i]) {
+				same++
+			}
+		}
+	}
+	if sites == 0 {
+		return 0, 0
+	}
+	return sites, float64(same) / float64(sites)
+}
+
+func (cmd *checkIdentity) compare(ext *externalGenotypes, gg map[string][]genotype) []identityResult {
+	names := make([]string, 0, len(gg))
+	for name := range gg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]identityResult, len(ext.samples))
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for s, sampleID := range ext.samples {
+		s, sampleID := s, sampleID
+		throttle.Go(func() error {
+			extgts := make([]genotype, len(ext.sites))
+			for i, site := range ext.sites {
+				extgts[i] = site.calls[s]
+			}
+			res := identityResult{SampleID: sampleID}
+			for _, name := range names {
+				sites, conc := concordance(extgts, gg[name])
+				if sites >= cmd.minSites && (res.BestGenome == "" || conc > res.BestConcordance) {
+					res.BestGenome, res.BestSites, res.BestConcordance = name, sites, conc
+				}
+				if name != sampleID && trimFilenameForLabel(name) != sampleID {
+					continue
+				}
+				res.Genome, res.Sites, res.Concordance = name, sites, conc
+				hom, het := 0, 0
+				for i, gt := range gg[name] {
+					if gt.called() && extgts[i].called() && !extgts[i].het() {
+						hom++
+						if gt.het() {
+							het++
+						}
+					}
+				}
+				if hom > 0 {
+					res.HetDiscordance = float64(het) / float64(hom)
+				}
+			}
+			switch {
+			case res.Genome == "":
+				res.Flags = append(res.Flags, "no-genome")
+			case res.Sites < cmd.minSites:
+				res.Flags = append(res.Flags, "too-few-sites")
+			case res.Concordance < cmd.minConcordance:
+				res.Flags = append(res.Flags, "mismatch")
+			}
+			if res.BestGenome != "" && res.BestGenome != res.Genome && res.BestConcordance >= cmd.minConcordance && res.BestConcordance > res.Concordance {
+				res.Flags = append(res.Flags, "swap")
+			}
+			if res.Genome != "" && res.Sites >= cmd.minSites && res.HetDiscordance > cmd.maxHetDiscordance {
+				res.Flags = append(res.Flags, "contamination")
+			}
+			if len(res.Flags) > 0 {
+				log.Warnf("%s: %v (genome %q concordance %f, best match %q concordance %f)", sampleID, res.Flags, res.Genome, res.Concordance, res.BestGenome, res.BestConcordance)
+			}
+			results[s] = res
+			return nil
+		})
+	}
+	throttle.Wait()
+	return results
+}
+
+func writeIdentityResults(fnm string, results []identityResult) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprint(w, "SampleID\tGenome\tSites\tConcordance\tBestGenome\tBestSites\tBestConcordance\tHetDiscordance\tFlags\n")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%f\t%s\t%d\t%f\t%f\t%s\n", r.SampleID, r.Genome, r.Sites, r.Concordance, r.BestGenome, r.BestSites, r.BestConcordance, r.HetDiscordance, strings.Join(r.Flags, ","))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,145 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type checkIdentitySuite struct{}
+
+var _ = check.Suite(&checkIdentitySuite{})
+
+// SNVs in testdata/pipeline1 (relative to testdata/ref.fasta), with
+// genotypes for input1 and input2. Each genome has a no-call or an
+// indel at two of the sites, so only 4 sites are compared.
+var checkIdentityTestSites = []struct {
+	chr    string
+	pos    int
+	ref    string
+	alt    string
+	input1 string
+	input2 string
+}{
+	{"chr1", 41, "T", "A", "1|0", "0|0"},
+	{"chr1", 161, "A", "T", "0|1", "0|0"},
+	{"chr2", 126, "T", "A", "0|0", "1|1"},
+	{"chr2", 127, "T", "A", "0|0", "1|1"},
+	{"chr2", 241, "T", "A", "1|0", "0|0"},
+	{"chr2", 291, "C", "A", "1|0", "0|0"},
+}
+
+func (s *checkIdentitySuite) TestCheckIdentity(c *check.C) {
+	tmpdir := c.MkDir()
+	importAndSlice(c, tmpdir)
+
+	for _, trial := range []struct {
+		label   string
+		samples []string
+		gt      func(input1, input2 string) []string
+		plink   bool
+		expect  []string
+	}{
+		{
+			label:   "correct",
+			samples: []string{"input1", "input2"},
+			gt:      func(input1, input2 string) []string { return []string{input1, input2} },
+			expect: []string{
+				"input1\ttestdata/pipeline1/input1.1.fasta\t4\t1.000000\ttestdata/pipeline1/input1.1.fasta\t4\t1.000000\t0.000000\t",
+				"input2\ttestdata/pipeline1/input2.1.fasta\t4\t1.000000\ttestdata/pipeline1/input2.1.fasta\t4\t1.000000\t0.000000\t",
+			},
+		},
+		{
+			label:   "plink",
+			samples: []string{"input1", "input2"},
+			gt:      func(input1, input2 string) []string { return []string{input1, input2} },
+			plink:   true,
+			expect: []string{
+				"input1\ttestdata/pipeline1/input1.1.fasta\t4\t1.000000\ttestdata/pipeline1/input1.1.fasta\t4\t1.000000\t0.000000\t",
+				"input2\ttestdata/pipeline1/input2.1.fasta\t4\t1.000000\ttestdata/pipeline1/input2.1.fasta\t4\t1.000000\t0.000000\t",
+			},
+		},
+		{
+			label:   "swapped",
+			samples: []string{"input2", "input1"},
+			gt:      func(input1, input2 string) []string { return []string{input1, input2} },
+			expect: []string{
+				"input2\ttestdata/pipeline1/input2.1.fasta\t4\t0.000000\ttestdata/pipeline1/input1.1.fasta\t4\t1.000000\t0.000000\tmismatch,swap",
+				"input1\ttestdata/pipeline1/input1.1.fasta\t4\t0.000000\ttestdata/pipeline1/input2.1.fasta\t4\t1.000000\t0.500000\tmismatch,swap,contamination",
+			},
+		},
+		{
+			label:   "contaminated",
+			samples: []string{"input1"},
+			gt: func(input1, input2 string) []string {
+				if input1 == "1|0" || input1 == "0|1" {
+					// genome is heterozygous,
+					// external sample is not
+					return []string{"0/0"}
+				}
+				return []string{input1}
+			},
+			expect: []string{
+				"input1\ttestdata/pipeline1/input1.1.fasta\t4\t0.500000\ttestdata/pipeline1/input1.1.fasta\t4\t0.500000\t0.500000\tmismatch,contamination",
+			},
+		},
+	} {
+		c.Logf("=== %s", trial.label)
+		outdir := tmpdir + "/" + trial.label
+		err := os.Mkdir(outdir, 0777)
+		c.Assert(err, check.IsNil)
+		var genotypes string
+		if trial.plink {
+			genotypes = outdir + "/genotypes.ped"
+			var mapfile, pedfile string
+			peds := make([]string, len(trial.samples))
+			for i, sample := range trial.samples {
+				peds[i] = "fam " + sample + " 0 0 0 -9"
+			}
+			for _, site := range checkIdentityTestSites {
+				mapfile += fmt.Sprintf("%s\trs%d\t0\t%d\n", site.chr, site.pos, site.pos)
+				for i, gt := range trial.gt(site.input1, site.input2) {
+					for _, allele := range strings.Split(gt, "|") {
+						if allele == "0" {
+							peds[i] += " " + site.ref
+						} else {
+							peds[i] += " " + site.alt
+						}
+					}
+				}
+			}
+			pedfile = strings.Join(peds, "\n") + "\n"
+			err = ioutil.WriteFile(outdir+"/genotypes.map", []byte(mapfile), 0666)
+			c.Assert(err, check.IsNil)
+			err = ioutil.WriteFile(genotypes, []byte(pedfile), 0666)
+			c.Assert(err, check.IsNil)
+		} else {
+			genotypes = outdir + "/genotypes.vcf"
+			vcf := "##fileformat=VCFv4.2\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t" + strings.Join(trial.samples, "\t") + "\n"
+			for _, site := range checkIdentityTestSites {
+				vcf += fmt.Sprintf("%s\t%d\t.\t%s\t%s\t.\tPASS\t.\tGT\t%s\n", site.chr, site.pos, site.ref, site.alt, strings.Join(trial.gt(site.input1, site.input2), "\t"))
+			}
+			err = ioutil.WriteFile(genotypes, []byte(vcf), 0666)
+			c.Assert(err, check.IsNil)
+		}
+		exited := (&checkIdentity{}).RunCommand("check-identity", []string{
+			"-local=true",
+			"-input-dir", tmpdir + "/sliced",
+			"-output-dir", outdir,
+			"-genotypes", genotypes,
+			"-min-sites", "4",
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		buf, err := ioutil.ReadFile(outdir + "/identity.tsv")
+		c.Assert(err, check.IsNil)
+		lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+		c.Check(lines[1:], check.DeepEquals, trial.expect)
+	}
+}
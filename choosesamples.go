@@ -48,6 +48,7 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 	caseControlFilename := flags.String("case-control-file", "", "tsv file or directory indicating cases and controls (if directory, all .tsv files will be read)")
 	caseControlColumn := flags.String("case-control-column", "", "name of case/control column in case-control files (value must be 0 for control, 1 for case)")
 	randSeed := flags.Int64("random-seed", 0, "PRNG seed")
+	sampleQCFilename := flags.String("sample-qc-file", "", "tsv file written by sample-qc (exclude samples that did not pass)")
 	cmd.filter.Flags(flags)
 	err := flags.Parse(args)
 	if err == flag.ErrHelp {
@@ -78,7 +79,7 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 			KeepCache:   2,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir, caseControlFilename)
+		err = runner.TranslatePaths(inputDir, caseControlFilename, sampleQCFilename)
 		if err != nil {
 			return err
 		}
@@ -90,6 +91,7 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 			"-case-control-column=" + *caseControlColumn,
 			"-training-set-size=" + fmt.Sprintf("%f", *trainingSetSize),
 			"-random-seed=" + fmt.Sprintf("%d", *randSeed),
+			"-sample-qc-file=" + *sampleQCFilename,
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
@@ -122,9 +124,21 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 		return err
 	}
 
+	var qcFailed map[string]bool
+	if *sampleQCFilename != "" {
+		qcFailed, err = loadSampleQCFailures(*sampleQCFilename)
+		if err != nil {
+			return err
+		}
+	}
+
 	var sampleIDs []string
 	err = DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
 		for _, cg := range ent.CompactGenomes {
+			if qcFailed[trimFilenameForLabel(cg.Name)] {
+				log.Infof("excluding %s: failed sample QC", cg.Name)
+				continue
+			}
 			if matchGenome.MatchString(cg.Name) {
 				sampleIDs = append(sampleIDs, cg.Name)
 			}
@@ -26,9 +26,11 @@ var (
 
 		"ref2genome":         &ref2genome{},
 		"vcf2fasta":          &vcf2fasta{},
+		"make-tags":          &makeTags{},
 		"import":             &importer{},
 		"annotate":           &annotatecmd{},
 		"export":             &exporter{},
+		"allele-freq":        &exporter{defaultOutputFormat: "sites-vcf"},
 		"export-numpy":       &exportNumpy{},
 		"flake":              &flakecmd{},
 		"slice":              &slicecmd{},
@@ -41,12 +43,20 @@ var (
 		"plot":               &pythonPlot{},
 		"pca-plot":           &pythonPlot{},
 		"manhattan-plot":     &manhattanPlot{},
+		"fst":                &fstCmd{},
 		"diff-fasta":         &diffFasta{},
+		"diff-library":       &diffLibrary{},
 		"stats":              &statscmd{},
 		"merge":              &merger{},
+		"retile":             &retiler{},
+		"fsck":               &fsckCmd{},
+		"remove-genomes":     &removeGenomes{},
 		"dump":               &dump{},
 		"dumpgob":            &dumpGob{},
 		"choose-samples":     &chooseSamples{},
+		"sample-qc":          &sampleQC{},
+		"check-identity":     &checkIdentity{},
+		"impute":             &impute{},
 	})
 )
 
@@ -0,0 +1,746 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arvados/lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// span is a range of 1-based positions on a reference sequence,
+// including both ends.
+type span struct {
+	start, end int
+}
+
+type transcript struct {
+	id      string
+	gene    string
+	seqname string // without "chr" prefix
+	strand  byte   // '+' or '-'
+	exons   []span // sorted by position
+	cds     []span // sorted by position, including stop codon
+	start   int    // start of first exon
+	end     int    // end of last exon
+}
+
+func (tx *transcript) coding() bool {
+	return len(tx.cds) > 0
+}
+
+// transcriptModel is a set of transcripts loaded from a GTF or GFF3
+// file.
+type transcriptModel struct {
+	bySeq  map[string][]*transcript // sorted by start
+	maxLen map[string]int           // longest transcript on each seq
+}
+
+// loadTranscriptModel reads transcripts from a GTF or GFF3 file
+// (optionally gzipped). Exon and CDS features are grouped by
+// transcript ID. In GTF, start_codon and stop_codon features are
+// treated as part of the CDS.
+func loadTranscriptModel(filename string) (*transcriptModel, error) {
+	log.Printf("loadTranscriptModel: reading %s", filename)
+	f, err := zopen(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	txs := map[string]*transcript{}
+	// GFF3: transcript ID -> gene ID, gene ID -> gene name
+	txgene := map[string]string{}
+	genename := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		rec, err := parseGFFLine(line)
+		if err != nil {
+			return nil, err
+		}
+		feature, start, end := rec.feature, rec.start, rec.end
+		attrs := parseGFFAttributes(rec.attributes)
+		if feature == "gene" {
+			if id, ok := attrs["ID"]; ok {
+				if name, ok := attrs["Name"]; ok {
+					genename[id] = name
+				} else {
+					genename[id] = strings.TrimPrefix(id, "gene:")
+				}
+			}
+			continue
+		}
+		if id, ok := attrs["ID"]; ok && attrs["Parent"] != "" && feature != "exon" && feature != "CDS" {
+			// GFF3 transcript (mRNA, lnc_RNA, etc.)
+			txgene[id] = attrs["Parent"]
+			continue
+		}
+		var cds bool
+		switch feature {
+		case "exon":
+		case "CDS", "start_codon", "stop_codon":
+			cds = true
+		default:
+			continue
+		}
+		var txids []string
+		gene := ""
+		if id, ok := attrs["transcript_id"]; ok {
+			// GTF
+			txids = []string{id}
+			gene = attrs["gene_name"]
+			if gene == "" {
+				gene = attrs["gene_id"]
+			}
+		} else {
+			// GFF3
+			txids = strings.Split(attrs["Parent"], ",")
+		}
+		for _, txid := range txids {
+			if txid == "" {
+				continue
+			}
+			tx := txs[txid]
+			if tx == nil {
+				tx = &transcript{
+					id:      strings.TrimPrefix(txid, "transcript:"),
+					gene:    gene,
+					seqname: strings.TrimPrefix(rec.seqname, "chr"),
+					strand:  rec.strand,
+				}
+				txs[txid] = tx
+			}
+			if cds {
+				tx.cds = append(tx.cds, span{start, end})
+			} else {
+				tx.exons = append(tx.exons, span{start, end})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	tm := &transcriptModel{
+		bySeq:  map[string][]*transcript{},
+		maxLen: map[string]int{},
+	}
+	for txid, tx := range txs {
+		if len(tx.exons) == 0 {
+			continue
+		}
+		if tx.gene == "" {
+			tx.gene = genename[txgene[txid]]
+		}
+		tx.exons = mergeSpans(tx.exons)
+		tx.cds = mergeSpans(tx.cds)
+		tx.start, tx.end = tx.exons[0].start, tx.exons[len(tx.exons)-1].end
+		tm.bySeq[tx.seqname] = append(tm.bySeq[tx.seqname], tx)
+		if l := tx.end - tx.start + 1; l > tm.maxLen[tx.seqname] {
+			tm.maxLen[tx.seqname] = l
+		}
+	}
+	ntx := 0
+	for _, txs := range tm.bySeq {
+		sort.Slice(txs, func(i, j int) bool {
+			if txs[i].start != txs[j].start {
+				return txs[i].start < txs[j].start
+			}
+			return txs[i].id < txs[j].id
+		})
+		ntx += len(txs)
+	}
+	log.Printf("loadTranscriptModel: loaded %d transcripts on %d sequences", ntx, len(tm.bySeq))
+	return tm, nil
+}
+
+// gffRecord is a feature line of a GTF or GFF3 file.
+type gffRecord struct {
+	seqname    string
+	feature    string
+	start      int // 1-based
+	end        int // 1-based, inclusive
+	strand     byte
+	attributes string
+}
+
+// parseGFFLine parses a feature line of a GTF or GFF3 file.
+func parseGFFLine(line []byte) (gffRecord, error) {
+	fields := bytes.Split(line, []byte{'\t'})
+	if len(fields) < 9 {
+		return gffRecord{}, fmt.Errorf("cannot parse input line as GFF/GTF: %q", line)
+	}
+	start, err1 := strconv.Atoi(string(fields[3]))
+	end, err2 := strconv.Atoi(string(fields[4]))
+	if err1 != nil || err2 != nil || len(fields[6]) == 0 {
+		return gffRecord{}, fmt.Errorf("cannot parse input line as GFF/GTF: %q", line)
+	}
+	return gffRecord{
+		seqname:    string(fields[0]),
+		feature:    string(fields[2]),
+		start:      start,
+		end:        end,
+		strand:     fields[6][0],
+		attributes: string(fields[8]),
+	}, nil
+}
+
+// parseGFFAttributes parses the attributes column of a GTF line
+// (`key "value"; key "value"`) or GFF3 line (`key=value;key=value`).
+//
+// An attribute is parsed as GTF if its key (the text before the
+// first space) does not contain "=", so a quoted GTF value can
+// contain "=" or ";".
+func parseGFFAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for len(s) > 0 {
+		// Find the end of this attribute: the first ";"
+		// that is not inside a quoted value.
+		end, quoted := len(s), false
+		for i := 0; i < len(s); i++ {
+			if s[i] == '"' {
+				quoted = !quoted
+			} else if s[i] == ';' && !quoted {
+				end = i
+				break
+			}
+		}
+		kv := strings.TrimSpace(s[:end])
+		if end < len(s) {
+			s = s[end+1:]
+		} else {
+			s = ""
+		}
+		var k, v string
+		if i := strings.IndexByte(kv, ' '); i > 0 && !strings.Contains(kv[:i], "=") {
+			// GTF
+			k, v = kv[:i], strings.Trim(strings.TrimSpace(kv[i+1:]), `"`)
+		} else if i := strings.IndexByte(kv, '='); i > 0 {
+			// GFF3
+			k, v = kv[:i], kv[i+1:]
+		} else {
+			continue
+		}
+		if _, dup := attrs[k]; !dup {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// mergeSpans sorts the given spans and merges overlapping/adjacent
+// ones.
+func mergeSpans(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var out []span
+	for _, s := range spans {
+		if n := len(out); n > 0 && s.start <= out[n-1].end+1 {
+			if s.end > out[n-1].end {
+				out[n-1].end = s.end
+			}
+		} else {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// consequence describes the effect of a variant on one transcript.
+type consequence struct {
+	Gene       string
+	Transcript string
+	HGVSc      string // "c.123A>G" or "n.45del"
+	HGVSp      string // "p.Arg41Trp", or "" if not applicable
+	Term       string // Sequence Ontology term, e.g., "missense_variant"
+}
+
+// CSV returns the consequence as 5 comma-separated fields.
+func (c consequence) CSV() string {
+	return c.Gene + "," + c.Transcript + "," + c.HGVSc + "," + c.HGVSp + "," + c.Term
+}
+
+// consequencesCSV returns the same 5 fields as consequence.CSV, but
+// with values from multiple consequences (transcripts) separated by
+// ";" within each field.
+func consequencesCSV(csqs []consequence) string {
+	if len(csqs) == 1 {
+		return csqs[0].CSV()
+	}
+	var fields [5][]string
+	for _, c := range csqs {
+		for i, val := range []string{c.Gene, c.Transcript, c.HGVSc, c.HGVSp, c.Term} {
+			fields[i] = append(fields[i], val)
+		}
+	}
+	var joined [5]string
+	for i := range fields {
+		joined[i] = strings.Join(fields[i], ";")
+	}
+	return strings.Join(joined[:], ",")
+}
+
+// emptyConsequenceCSV is a placeholder for the consequence fields
+// in annotation rows that don't describe a variant.
+const emptyConsequenceCSV = ",,,,"
+
+// consequenceAnnotator computes consequences of variants on a single
+// reference sequence (chromosome).
+type consequenceAnnotator struct {
+	txs    []*transcript
+	maxLen int
+	refseq []byte // entire reference sequence, any case
+
+	cdsMtx sync.Mutex
+	cds    map[*transcript]string
+}
+
+// annotator returns a consequenceAnnotator for the given reference
+// sequence. seqname may have a "chr" prefix.
+func (tm *transcriptModel) annotator(seqname string, refseq []byte) *consequenceAnnotator {
+	seqname = strings.TrimPrefix(seqname, "chr")
+	return &consequenceAnnotator{
+		txs:    tm.bySeq[seqname],
+		maxLen: tm.maxLen[seqname],
+		refseq: refseq,
+		cds:    map[*transcript]string{},
+	}
+}
+
+// Annotate returns the consequences of v (whose Position is relative
+// to the start of the reference sequence) on each overlapping
+// transcript. If v does not overlap any transcript, Annotate returns
+// a single intergenic_variant consequence.
+func (ca *consequenceAnnotator) Annotate(v hgvs.Variant) []consequence {
+	vs, ve := v.Position, v.Position+len(v.Ref)-1
+	if len(v.Ref) == 0 {
+		// insertion between vs-1 and vs
+		vs, ve = v.Position-1, v.Position
+	}
+	var out []consequence
+	i := sort.Search(len(ca.txs), func(i int) bool { return ca.txs[i].start > ve })
+	for i--; i >= 0 && ca.txs[i].start >= vs-ca.maxLen; i-- {
+		tx := ca.txs[i]
+		if tx.end < vs || tx.start > ve {
+			continue
+		}
+		out = append(out, ca.annotateTranscript(tx, v, vs, ve))
+	}
+	if len(out) == 0 {
+		return []consequence{{Term: "intergenic_variant"}}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Transcript < out[j].Transcript })
+	return out
+}
+
+func (ca *consequenceAnnotator) annotateTranscript(tx *transcript, v hgvs.Variant, vs, ve int) consequence {
+	c := consequence{
+		Gene:       tx.gene,
+		Transcript: tx.id,
+		HGVSc:      ca.hgvsc(tx, v),
+	}
+	var term string
+	for pos := vs; pos <= ve; pos++ {
+		if t := spliceSite(tx, pos); t != "" && (term == "" || t != "splice_region_variant") {
+			term = t
+		}
+	}
+	if term == "splice_donor_variant" || term == "splice_acceptor_variant" {
+		c.Term = term
+		return c
+	}
+	if overlaps(tx.cds, vs, ve) {
+		if cdsvar, cdsseq, ok := ca.cdsVariant(tx, v); ok {
+			c.HGVSc = "c." + cdsvar.String()
+			c.HGVSp, c.Term = proteinChange(cdsseq, cdsvar)
+		} else {
+			c.Term = "coding_sequence_variant"
+		}
+		return c
+	}
+	switch {
+	case term != "":
+		c.Term = term
+	case overlaps(tx.exons, vs, ve) && !tx.coding():
+		c.Term = "non_coding_transcript_exon_variant"
+	case overlaps(tx.exons, vs, ve) && (vs < tx.cds[0].start) == (tx.strand == '+'):
+		c.Term = "5_prime_UTR_variant"
+	case overlaps(tx.exons, vs, ve):
+		c.Term = "3_prime_UTR_variant"
+	default:
+		c.Term = "intron_variant"
+	}
+	return c
+}
+
+func overlaps(spans []span, start, end int) bool {
+	for _, s := range spans {
+		if s.start <= end && s.end >= start {
+			return true
+		}
+	}
+	return false
+}
+
+// spliceSite returns "splice_donor_variant" or
+// "splice_acceptor_variant" if pos is in the first/last 2 bases of
+// an intron, "splice_region_variant" if pos is within 3-8 bases of
+// an exon in an intron or 1-3 bases of an intron in an exon,
+// otherwise "".
+func spliceSite(tx *transcript, pos int) string {
+	region := false
+	for k := 0; k+1 < len(tx.exons); k++ {
+		// intron between exons k and k+1
+		istart, iend := tx.exons[k].end+1, tx.exons[k+1].start-1
+		if pos >= istart && pos <= istart+1 {
+			if tx.strand == '+' {
+				return "splice_donor_variant"
+			}
+			return "splice_acceptor_variant"
+		}
+		if pos <= iend && pos >= iend-1 {
+			if tx.strand == '+' {
+				return "splice_acceptor_variant"
+			}
+			return "splice_donor_variant"
+		}
+		if (pos >= istart-3 && pos <= istart+7) || (pos >= iend-7 && pos <= iend+3) {
+			region = true
+		}
+	}
+	if region {
+		return "splice_region_variant"
+	}
+	return ""
+}
+
+// cdsSequence returns the spliced coding sequence of tx (reverse
+// complemented if tx is on the minus strand), in upper case.
+func (ca *consequenceAnnotator) cdsSequence(tx *transcript) string {
+	ca.cdsMtx.Lock()
+	defer ca.cdsMtx.Unlock()
+	if seq, ok := ca.cds[tx]; ok {
+		return seq
+	}
+	var buf []byte
+	for _, s := range tx.cds {
+		if s.start < 1 || s.end > len(ca.refseq) {
+			buf = nil
+			break
+		}
+		buf = append(buf, ca.refseq[s.start-1:s.end]...)
+	}
+	seq := strings.ToUpper(string(buf))
+	if tx.strand == '-' {
+		seq = hgvs.ReverseComplement(seq)
+	}
+	ca.cds[tx] = seq
+	return seq
+}
+
+// cdsOffset returns the 0-based offset of genomic position pos in
+// the spliced CDS of tx, in transcript orientation, or -1 if pos is
+// not in the CDS.
+func cdsOffset(tx *transcript, pos int) int {
+	offset := 0
+	for _, s := range tx.cds {
+		if pos >= s.start && pos <= s.end {
+			offset += pos - s.start
+			if tx.strand == '-' {
+				total := 0
+				for _, s := range tx.cds {
+					total += s.end - s.start + 1
+				}
+				offset = total - 1 - offset
+			}
+			return offset
+		}
+		offset += s.end - s.start + 1
+	}
+	return -1
+}
+
+// cdsVariant returns v translated to CDS coordinates (1-based, in
+// transcript orientation, 3'-normalized), and the CDS sequence. It
+// returns false if v is not entirely within a single CDS segment,
+// or the reference sequence doesn't match the transcript model.
+func (ca *consequenceAnnotator) cdsVariant(tx *transcript, v hgvs.Variant) (hgvs.Variant, string, bool) {
+	cdsseq := ca.cdsSequence(tx)
+	if len(cdsseq) == 0 {
+		return hgvs.Variant{}, "", false
+	}
+	first, last := v.Position, v.Position+len(v.Ref)-1
+	if len(v.Ref) == 0 {
+		first, last = v.Position-1, v.Position
+	}
+	var seg *span
+	for i, s := range tx.cds {
+		if first >= s.start && last <= s.end {
+			seg = &tx.cds[i]
+		}
+	}
+	if seg == nil {
+		return hgvs.Variant{}, "", false
+	}
+	ref, alt := strings.ToUpper(v.Ref), strings.ToUpper(v.New)
+	var cv hgvs.Variant
+	if tx.strand == '+' {
+		if len(v.Ref) == 0 {
+			cv = hgvs.Variant{Position: cdsOffset(tx, v.Position) + 1, New: alt}
+		} else {
+			cv = hgvs.Variant{Position: cdsOffset(tx, first) + 1, Ref: ref, New: alt}
+		}
+	} else {
+		if len(v.Ref) == 0 {
+			cv = hgvs.Variant{Position: cdsOffset(tx, v.Position-1) + 1, New: hgvs.ReverseComplement(alt)}
+		} else {
+			cv = hgvs.Variant{Position: cdsOffset(tx, last) + 1, Ref: hgvs.ReverseComplement(ref), New: hgvs.ReverseComplement(alt)}
+		}
+	}
+	if cv.Position-1+len(cv.Ref) > len(cdsseq) || cdsseq[cv.Position-1:cv.Position-1+len(cv.Ref)] != cv.Ref {
+		return hgvs.Variant{}, "", false
+	}
+	return cv.Normalize3Prime(cdsseq), cdsseq, true
+}
+
+// hgvsc returns the c. (or n.) HGVS notation for v relative to tx.
+// It is used for variants that are not entirely within the CDS;
+// see cdsVariant for the others.
+func (ca *consequenceAnnotator) hgvsc(tx *transcript, v hgvs.Variant) string {
+	prefix := "n."
+	if tx.coding() {
+		prefix = "c."
+	}
+	ref, alt := strings.ToUpper(v.Ref), strings.ToUpper(v.New)
+	first, last := v.Position, v.Position+len(v.Ref)-1
+	if tx.strand == '-' {
+		first, last = last, first
+		ref, alt = hgvs.ReverseComplement(ref), hgvs.ReverseComplement(alt)
+	}
+	switch {
+	case len(v.Ref) == 0:
+		a, b := v.Position-1, v.Position
+		if tx.strand == '-' {
+			a, b = b, a
+		}
+		return prefix + txPos(tx, a) + "_" + txPos(tx, b) + "ins" + alt
+	case len(ref) == 1 && len(alt) == 1:
+		return prefix + txPos(tx, first) + ref + ">" + alt
+	case len(alt) == 0 && len(ref) == 1:
+		return prefix + txPos(tx, first) + "del"
+	case len(alt) == 0:
+		return prefix + txPos(tx, first) + "_" + txPos(tx, last) + "del"
+	case len(ref) == 1:
+		return prefix + txPos(tx, first) + "delins" + alt
+	default:
+		return prefix + txPos(tx, first) + "_" + txPos(tx, last) + "delins" + alt
+	}
+}
+
+// txPos returns the HGVS c. (or n.) position corresponding to the
+// given genomic position, e.g., "123", "-12", "*30", "88+5", or
+// "89-2".
+func txPos(tx *transcript, pos int) string {
+	// Exonic position in transcript orientation, 1-based.
+	exonic := func(pos int) int {
+		t := 0
+		for _, e := range tx.exons {
+			if pos >= e.start && pos <= e.end {
+				t += pos - e.start + 1
+			} else if e.end < pos {
+				t += e.end - e.start + 1
+			}
+		}
+		if tx.strand == '-' {
+			total := 0
+			for _, e := range tx.exons {
+				total += e.end - e.start + 1
+			}
+			t = total + 1 - t
+		}
+		return t
+	}
+	// Convert transcript position to c./n. position.
+	format := func(t int) string {
+		if !tx.coding() {
+			return strconv.Itoa(t)
+		}
+		cdsStart, cdsEnd := exonic(tx.cds[0].start), exonic(tx.cds[len(tx.cds)-1].end)
+		if tx.strand == '-' {
+			cdsStart, cdsEnd = cdsEnd, cdsStart
+		}
+		switch {
+		case t < cdsStart:
+			return "-" + strconv.Itoa(cdsStart-t)
+		case t > cdsEnd:
+			return "*" + strconv.Itoa(t-cdsEnd)
+		default:
+			return strconv.Itoa(t - cdsStart + 1)
+		}
+	}
+	if pos < tx.start || pos > tx.end {
+		// Outside the transcript. Use the nearest end, with
+		// an offset.
+		if pos < tx.start {
+			return format(exonic(tx.start)) + offsetString(tx.start-pos, tx.strand == '-')
+		}
+		return format(exonic(tx.end)) + offsetString(pos-tx.end, tx.strand == '+')
+	}
+	for k, e := range tx.exons {
+		if pos >= e.start && pos <= e.end {
+			return format(exonic(pos))
+		}
+		if k+1 < len(tx.exons) && pos > e.end && pos < tx.exons[k+1].start {
+			// Intronic: offset from the nearest exon,
+			// preferring "+" (the preceding exon in
+			// transcript orientation) on a tie.
+			d5, d3 := pos-e.end, tx.exons[k+1].start-pos
+			if tx.strand == '+' {
+				if d5 <= d3 {
+					return format(exonic(e.end)) + "+" + strconv.Itoa(d5)
+				}
+				return format(exonic(tx.exons[k+1].start)) + "-" + strconv.Itoa(d3)
+			}
+			if d3 <= d5 {
+				return format(exonic(tx.exons[k+1].start)) + "+" + strconv.Itoa(d3)
+			}
+			return format(exonic(e.end)) + "-" + strconv.Itoa(d5)
+		}
+	}
+	return "?"
+}
+
+func offsetString(d int, downstream bool) string {
+	if downstream {
+		return "+" + strconv.Itoa(d)
+	}
+	return "-" + strconv.Itoa(d)
+}
+
+var codonTable = func() map[string]byte {
+	// Standard genetic code, codons in TCAG order.
+	const bases = "TCAG"
+	const aas = "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"
+	table := map[string]byte{}
+	for i, aa := range []byte(aas) {
+		codon := string([]byte{bases[i/16], bases[i/4%4], bases[i%4]})
+		table[codon] = aa
+	}
+	return table
+}()
+
+var aaThreeLetter = map[byte]string{
+	'A': "Ala", 'R': "Arg", 'N': "Asn", 'D': "Asp", 'C': "Cys",
+	'E': "Glu", 'Q': "Gln", 'G': "Gly", 'H': "His", 'I': "Ile",
+	'L': "Leu", 'K': "Lys", 'M': "Met", 'F': "Phe", 'P': "Pro",
+	'S': "Ser", 'T': "Thr", 'W': "Trp", 'Y': "Tyr", 'V': "Val",
+	'*': "Ter", 'X': "Xaa",
+}
+
+func aa3(aas string) string {
+	var out strings.Builder
+	for i := 0; i < len(aas); i++ {
+		out.WriteString(aaThreeLetter[aas[i]])
+	}
+	return out.String()
+}
+
+// translate returns the protein sequence encoded by cds, up to and
+// including the first stop codon ("*"). Unknown codons are
+// translated as "X".
+func translate(cds string) string {
+	var out []byte
+	for i := 0; i+3 <= len(cds); i += 3 {
+		aa, ok := codonTable[cds[i:i+3]]
+		if !ok {
+			aa = 'X'
+		}
+		out = append(out, aa)
+		if aa == '*' {
+			break
+		}
+	}
+	return string(out)
+}
+
+// proteinChange returns the p. HGVS notation and Sequence Ontology
+// term for the given variant in CDS coordinates.
+func proteinChange(cdsseq string, cv hgvs.Variant) (string, string) {
+	alt := cdsseq[:cv.Position-1] + cv.New + cdsseq[cv.Position-1+len(cv.Ref):]
+	refp, altp := translate(cdsseq), translate(alt)
+	if (len(cv.New)-len(cv.Ref))%3 != 0 {
+		i := 0
+		for i < len(refp) && i < len(altp) && refp[i] == altp[i] {
+			i++
+		}
+		if i >= len(refp) {
+			return "p.?", "frameshift_variant"
+		}
+		return fmt.Sprintf("p.%s%dfs", aa3(refp[i:i+1]), i+1), "frameshift_variant"
+	}
+	if refp == altp {
+		n := (cv.Position-1)/3 + 1
+		if n > len(refp) {
+			return "p.=", "synonymous_variant"
+		}
+		if refp[n-1] == '*' {
+			return fmt.Sprintf("p.%s%d=", aa3(refp[n-1:n]), n), "stop_retained_variant"
+		}
+		return fmt.Sprintf("p.%s%d=", aa3(refp[n-1:n]), n), "synonymous_variant"
+	}
+	// Common prefix and (non-overlapping) suffix
+	i := 0
+	for i < len(refp) && i < len(altp) && refp[i] == altp[i] {
+		i++
+	}
+	j := 0
+	for j < len(refp)-i && j < len(altp)-i && refp[len(refp)-1-j] == altp[len(altp)-1-j] {
+		j++
+	}
+	del, ins := refp[i:len(refp)-j], altp[i:len(altp)-j]
+	switch {
+	case i == 0 && len(refp) > 0 && refp[0] == 'M':
+		return "p.Met1?", "start_lost"
+	case strings.HasSuffix(altp, "*") && len(altp) == i+1 && len(del) > 0 && del[0] != '*':
+		return fmt.Sprintf("p.%s%dTer", aa3(del[:1]), i+1), "stop_gained"
+	case len(del) > 0 && strings.HasSuffix(del, "*") || len(altp) > 0 && !strings.HasSuffix(altp, "*") && strings.HasSuffix(refp, "*"):
+		if len(ins) > 0 {
+			return fmt.Sprintf("p.Ter%d%sext*?", i+1, aa3(ins[:1])), "stop_lost"
+		}
+		return fmt.Sprintf("p.Ter%d?", i+1), "stop_lost"
+	case len(del) == 1 && len(ins) == 1:
+		return fmt.Sprintf("p.%s%d%s", aa3(del), i+1, aa3(ins)), "missense_variant"
+	case len(ins) == 0:
+		if len(del) == 1 {
+			return fmt.Sprintf("p.%s%ddel", aa3(del), i+1), "inframe_deletion"
+		}
+		return fmt.Sprintf("p.%s%d_%s%ddel", aa3(del[:1]), i+1, aa3(del[len(del)-1:]), i+len(del)), "inframe_deletion"
+	case len(del) == 0:
+		if i == 0 || i >= len(refp) {
+			return "p.?", "inframe_insertion"
+		}
+		return fmt.Sprintf("p.%s%d_%s%dins%s", aa3(refp[i-1:i]), i, aa3(refp[i:i+1]), i+1, aa3(ins)), "inframe_insertion"
+	default:
+		term := "missense_variant"
+		if len(ins) > len(del) {
+			term = "inframe_insertion"
+		} else if len(ins) < len(del) {
+			term = "inframe_deletion"
+		}
+		if len(del) == 1 {
+			return fmt.Sprintf("p.%s%ddelins%s", aa3(del), i+1, aa3(ins)), term
+		}
+		return fmt.Sprintf("p.%s%d_%s%ddelins%s", aa3(del[:1]), i+1, aa3(del[len(del)-1:]), i+len(del), aa3(ins)), term
+	}
+}
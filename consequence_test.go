@@ -0,0 +1,122 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/arvados/lightning/hgvs"
+	"gopkg.in/check.v1"
+)
+
+type consequenceSuite struct{}
+
+var _ = check.Suite(&consequenceSuite{})
+
+func (s *consequenceSuite) setup(c *check.C, gtf string) (*transcriptModel, []byte) {
+	ref := []byte(strings.Repeat("c", 300))
+	put := func(pos int, seq string) { copy(ref[pos-1:], seq) }
+	// TX1 (+): exons 11-40 and 61-90, CDS 21-40 and 61-76
+	cds1 := "ATGGCTCGTAAAGAATGGCTGCCTGGATTCGGCTAA"
+	put(21, cds1[:20])
+	put(41, "gtaagt")
+	put(59, "ag")
+	put(61, cds1[20:])
+	// TX2 (-): exon 101-150, CDS 111-140
+	cds2 := "ATGAAACCCGGGTTTCAAGAGCTTACCTGA"
+	put(111, hgvs.ReverseComplement(cds2))
+
+	fnm := c.MkDir() + "/test.gtf"
+	err := ioutil.WriteFile(fnm, []byte(gtf), 0600)
+	c.Assert(err, check.IsNil)
+	tm, err := loadTranscriptModel(fnm)
+	c.Assert(err, check.IsNil)
+	return tm, ref
+}
+
+const testGTF = `#comment
+chr1	test	transcript	11	90	.	+	.	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	exon	11	40	.	+	.	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	exon	61	90	.	+	.	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	CDS	21	40	.	+	0	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	CDS	61	73	.	+	1	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	stop_codon	74	76	.	+	0	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr1	test	exon	101	150	.	-	.	gene_id "G2"; transcript_id "TX2"; gene_name "GENE2";
+chr1	test	CDS	111	140	.	-	0	gene_id "G2"; transcript_id "TX2"; gene_name "GENE2";
+`
+
+const testGFF3 = `##gff-version 3
+chr1	test	gene	11	90	.	+	.	ID=gene:G1;Name=GENE1
+chr1	test	mRNA	11	90	.	+	.	ID=transcript:TX1;Parent=gene:G1
+chr1	test	exon	11	40	.	+	.	Parent=transcript:TX1
+chr1	test	exon	61	90	.	+	.	Parent=transcript:TX1
+chr1	test	CDS	21	40	.	+	0	ID=CDS:TX1;Parent=transcript:TX1
+chr1	test	CDS	61	76	.	+	1	ID=CDS:TX1;Parent=transcript:TX1
+chr1	test	gene	101	150	.	-	.	ID=gene:G2;Name=GENE2
+chr1	test	mRNA	101	150	.	-	.	ID=transcript:TX2;Parent=gene:G2
+chr1	test	exon	101	150	.	-	.	Parent=transcript:TX2
+chr1	test	CDS	111	140	.	-	0	ID=CDS:TX2;Parent=transcript:TX2
+`
+
+func (s *consequenceSuite) TestParseGFFAttributes(c *check.C) {
+	for _, trial := range []struct {
+		in     string
+		expect map[string]string
+	}{
+		{`gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";`, map[string]string{"gene_id": "G1", "transcript_id": "TX1", "gene_name": "GENE1"}},
+		{`gene_id "G1"; note "a=b; c=d"; transcript_id "TX1"`, map[string]string{"gene_id": "G1", "note": "a=b; c=d", "transcript_id": "TX1"}},
+		{`gene_id "G1"; exon_number 2;`, map[string]string{"gene_id": "G1", "exon_number": "2"}},
+		{`ID=transcript:TX1;Parent=gene:G1;Note=a b`, map[string]string{"ID": "transcript:TX1", "Parent": "gene:G1", "Note": "a b"}},
+		{`Name=A=B;ID=G1`, map[string]string{"Name": "A=B", "ID": "G1"}},
+	} {
+		c.Check(parseGFFAttributes(trial.in), check.DeepEquals, trial.expect, check.Commentf("%s", trial.in))
+	}
+
+	// A GTF attribute value can contain "=".
+	tm, _ := s.setup(c, strings.Replace(testGTF, `gene_name "GENE1"`, `gene_name "GENE1=A"`, -1))
+	if c.Check(tm.bySeq["1"], check.HasLen, 2) {
+		c.Check(tm.bySeq["1"][0].id, check.Equals, "TX1")
+		c.Check(tm.bySeq["1"][0].gene, check.Equals, "GENE1=A")
+	}
+}
+
+func (s *consequenceSuite) TestConsequences(c *check.C) {
+	for _, gtf := range []string{testGTF, testGFF3} {
+		tm, ref := s.setup(c, gtf)
+		ca := tm.annotator("chr1", ref)
+		for _, trial := range []struct {
+			v      hgvs.Variant
+			expect string
+		}{
+			{hgvs.Variant{Position: 25, Ref: "C", New: "A"}, "GENE1,TX1,c.5C>A,p.Ala2Asp,missense_variant"},
+			{hgvs.Variant{Position: 26, Ref: "T", New: "C"}, "GENE1,TX1,c.6T>C,p.Ala2=,synonymous_variant"},
+			{hgvs.Variant{Position: 30, Ref: "A", New: "T"}, "GENE1,TX1,c.10A>T,p.Lys4Ter,stop_gained"},
+			{hgvs.Variant{Position: 33, Ref: "G"}, "GENE1,TX1,c.13del,p.Glu5fs,frameshift_variant"},
+			{hgvs.Variant{Position: 30, Ref: "AAA"}, "GENE1,TX1,c.10_12del,p.Lys4del,inframe_deletion"},
+			{hgvs.Variant{Position: 21, Ref: "A", New: "G"}, "GENE1,TX1,c.1A>G,p.Met1?,start_lost"},
+			{hgvs.Variant{Position: 50, Ref: "C", New: "T"}, "GENE1,TX1,c.20+10C>T,,intron_variant"},
+			{hgvs.Variant{Position: 41, Ref: "G", New: "A"}, "GENE1,TX1,c.20+1G>A,,splice_donor_variant"},
+			{hgvs.Variant{Position: 60, Ref: "G", New: "A"}, "GENE1,TX1,c.21-1G>A,,splice_acceptor_variant"},
+			{hgvs.Variant{Position: 45, Ref: "C", New: "A"}, "GENE1,TX1,c.20+5C>A,,splice_region_variant"},
+			{hgvs.Variant{Position: 15, Ref: "C", New: "G"}, "GENE1,TX1,c.-6C>G,,5_prime_UTR_variant"},
+			{hgvs.Variant{Position: 80, Ref: "C", New: "G"}, "GENE1,TX1,c.*4C>G,,3_prime_UTR_variant"},
+			{hgvs.Variant{Position: 200, Ref: "C", New: "G"}, ",,,,intergenic_variant"},
+			{hgvs.Variant{Position: 137, Ref: "T", New: "A"}, "GENE2,TX2,c.4A>T,p.Lys2Ter,stop_gained"},
+			{hgvs.Variant{Position: 145, Ref: "C", New: "A"}, "GENE2,TX2,c.-5G>T,,5_prime_UTR_variant"},
+		} {
+			var got []string
+			for _, csq := range ca.Annotate(trial.v) {
+				got = append(got, csq.CSV())
+			}
+			c.Check(got, check.DeepEquals, []string{trial.expect}, check.Commentf("%+v", trial.v))
+		}
+	}
+
+	// CDS too short to encode any amino acids
+	p, term := proteinChange("AT", hgvs.Variant{Position: 2, New: "GGG"})
+	c.Check(p, check.Equals, "p.?")
+	c.Check(term, check.Equals, "inframe_insertion")
+}
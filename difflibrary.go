@@ -0,0 +1,473 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// diffLibrary compares two libraries (e.g., two imports of the same
+// samples with different versions or options). Tiles are compared
+// by sequence hash, so the libraries don't need to use the same
+// variant numbers, or even the same tag set.
+type diffLibrary struct {
+	inputA      string
+	inputB      string
+	outputFile  string
+	maxDetails  int
+	projectUUID string
+	runLocal    bool
+}
+
+func (cmd *diffLibrary) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.inputA, "a", "", "first library `directory` (or file)")
+	flags.StringVar(&cmd.inputB, "b", "", "second library `directory` (or file)")
+	flags.StringVar(&cmd.outputFile, "o", "-", "output report `file` (json)")
+	flags.IntVar(&cmd.maxDetails, "max-details", 100, "maximum number of changed tiles to list for each genome")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.inputA == "" || cmd.inputB == "" {
+		err = errors.New("two libraries (-a and -b) must be specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputFile != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning diff-library",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         240000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+		}
+		err = runner.TranslatePaths(&cmd.inputA, &cmd.inputB)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"diff-library", "-local=true",
+			"-pprof", ":6060",
+			"-a", cmd.inputA,
+			"-b", cmd.inputB,
+			"-o", "/mnt/output/diff.json",
+			fmt.Sprintf("-max-details=%d", cmd.maxDetails),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/diff.json")
+		return 0
+	}
+
+	var libs [2]*libraryContents
+	for i, path := range []string{cmd.inputA, cmd.inputB} {
+		libs[i], err = readLibraryContents(path)
+		if err != nil {
+			return 1
+		}
+	}
+	report := diffLibraries(libs[0], libs[1], cmd.maxDetails)
+
+	var out io.WriteCloser
+	if cmd.outputFile == "-" {
+		out = nopCloser{stdout}
+	} else {
+		out, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			return 1
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return 1
+	}
+	err = out.Close()
+	if err != nil {
+		return 1
+	}
+	if !report.Identical {
+		err = errors.New("libraries differ")
+		return 1
+	}
+	return 0
+}
+
+// Tile changes reported by diff-library.
+const (
+	tileChanged      = "changed"        // different tile sequence
+	tileGainedNoCall = "gained-no-call" // called in a, no-call in b
+	tileLostNoCall   = "lost-no-call"   // no-call in a, called in b
+	tileUnplaced     = "unplaced"       // tag placed in a, not in b
+	tilePlaced       = "placed"         // tag not placed in a, placed in b
+	tileMissing      = "missing"        // genome refers to a tile variant that is not in its library
+)
+
+type libraryDiffReport struct {
+	A            string
+	B            string
+	Identical    bool
+	Tagset       tagsetDiff
+	GenomesOnlyA []string `json:",omitempty"`
+	GenomesOnlyB []string `json:",omitempty"`
+	References   []referenceDiff
+	Genomes      []genomeDiff
+}
+
+type tagsetDiff struct {
+	Identical bool
+	TagsA     int
+	TagsB     int
+	Common    int // tags (sequences) that appear in both
+}
+
+type referenceDiff struct {
+	Name     string
+	Sequence string
+	Only     string `json:",omitempty"` // "a" or "b" if the sequence is only in one library
+	TilesA   int
+	TilesB   int
+	Changed  int // tiles (by tag) that differ or are only in one path
+}
+
+type genomeDiff struct {
+	Name    string // label, see trimFilenameForLabel
+	NameA   string
+	NameB   string
+	Same    int
+	Counts  map[string]int
+	Details []tileDiff `json:",omitempty"`
+}
+
+type tileDiff struct {
+	Tag      tagID // tag number in a (or in b, if change is "placed" and the tag is not in a)
+	Phase    int
+	Change   string
+	VariantA tileVariantID
+	VariantB tileVariantID
+}
+
+// libraryContents is what diff-library needs to know about a
+// library, with genomes indexed by label and tile variants
+// represented by hash.
+type libraryContents struct {
+	path     string
+	tagset   [][]byte
+	variants map[tileLibRef]tileHash
+	genomes  map[string][]tileVariantID // label -> variants (2 per tag)
+	names    map[string]string          // label -> genome name
+	refs     map[string]map[string][]tileLibRef
+}
+
+type tileHash struct {
+	hash   [blake2b.Size256]byte
+	nocall bool
+}
+
+func readLibraryContents(path string) (*libraryContents, error) {
+	files, err := allFiles(path, matchGobFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no input files found in %s", path)
+	}
+	lib := &libraryContents{
+		path:     path,
+		variants: map[tileLibRef]tileHash{},
+		genomes:  map[string][]tileVariantID{},
+		names:    map[string]string{},
+		refs:     map[string]map[string][]tileLibRef{},
+	}
+	var mtx sync.Mutex
+	throttle := throttle{Max: 8}
+	for _, fnm := range files {
+		fnm := fnm
+		throttle.Go(func() error {
+			f, err := open(fnm)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			log.Printf("reading %s", fnm)
+			err = DecodeLibrary(f, strings.HasSuffix(fnm, ".gz"), func(ent *LibraryEntry) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				if len(ent.TagSet) > 0 {
+					if lib.tagset == nil {
+						lib.tagset = ent.TagSet
+					} else if !sameTagset(lib.tagset, ent.TagSet) {
+						return errors.New("tagset does not match other files in the same library")
+					}
+				}
+				for _, tv := range ent.TileVariants {
+					length, nocalls := tv.noCallCounts()
+					lib.variants[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tileHash{
+						hash:   tv.Blake2b,
+						nocall: length == 0 || nocalls > 0,
+					}
+				}
+				for _, cg := range ent.CompactGenomes {
+					label := trimFilenameForLabel(cg.Name)
+					if name, ok := lib.names[label]; ok && name != cg.Name {
+						return fmt.Errorf("genome names %q and %q have the same label %q", name, cg.Name, label)
+					}
+					lib.names[label] = cg.Name
+					variants := lib.genomes[label]
+					if need := int(cg.StartTag)*2 + len(cg.Variants); len(variants) < need {
+						variants = append(variants, make([]tileVariantID, need-len(variants))...)
+					}
+					copy(variants[int(cg.StartTag)*2:], cg.Variants)
+					lib.genomes[label] = variants
+				}
+				for _, cseq := range ent.CompactSequences {
+					lib.refs[cseq.Name] = cseq.TileSequences
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", fnm, err)
+			}
+			return nil
+		})
+	}
+	err = throttle.Wait()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s: %d tags, %d tile variants, %d genomes, %d reference genomes", path, len(lib.tagset), len(lib.variants), len(lib.genomes), len(lib.refs))
+	return lib, nil
+}
+
+func diffLibraries(a, b *libraryContents, maxDetails int) *libraryDiffReport {
+	report := &libraryDiffReport{A: a.path, B: b.path}
+
+	// tagAB[tagA] is the corresponding tag in b, or -1.
+	tagAB := make([]tagID, len(a.tagset))
+	tagsB := make(map[string]tagID, len(b.tagset))
+	for tag, seq := range b.tagset {
+		tagsB[string(seq)] = tagID(tag)
+	}
+	report.Tagset = tagsetDiff{
+		Identical: sameTagset(a.tagset, b.tagset),
+		TagsA:     len(a.tagset),
+		TagsB:     len(b.tagset),
+	}
+	inA := make([]bool, len(b.tagset))
+	for tag, seq := range a.tagset {
+		if tagB, ok := tagsB[string(seq)]; ok {
+			tagAB[tag] = tagB
+			inA[tagB] = true
+			report.Tagset.Common++
+		} else {
+			tagAB[tag] = -1
+		}
+	}
+
+	for _, name := range sortedKeys(a.refs) {
+		for _, seqname := range sortedKeys(a.refs[name]) {
+			rd := referenceDiff{Name: name, Sequence: seqname}
+			pathA := a.refs[name][seqname]
+			pathB, ok := b.refs[name][seqname]
+			if !ok {
+				rd.Only = "a"
+			}
+			rd.TilesA, rd.TilesB = len(pathA), len(pathB)
+			// Count tiles that are in one path but not the
+			// other (compared by tag and hash).
+			type tile struct {
+				tag  tagID
+				hash [blake2b.Size256]byte
+			}
+			inB := map[tile]int{}
+			for _, libref := range pathB {
+				inB[tile{libref.Tag, b.variants[libref].hash}]++
+			}
+			for _, libref := range pathA {
+				t := tile{-1, a.variants[libref].hash}
+				if int(libref.Tag) < len(tagAB) {
+					t.tag = tagAB[libref.Tag]
+				}
+				if inB[t] > 0 {
+					inB[t]--
+				} else {
+					rd.Changed++
+				}
+			}
+			for _, n := range inB {
+				rd.Changed += n
+			}
+			report.References = append(report.References, rd)
+		}
+	}
+	for _, name := range sortedKeys(b.refs) {
+		for _, seqname := range sortedKeys(b.refs[name]) {
+			if _, ok := a.refs[name][seqname]; !ok {
+				report.References = append(report.References, referenceDiff{
+					Name:     name,
+					Sequence: seqname,
+					Only:     "b",
+					TilesB:   len(b.refs[name][seqname]),
+					Changed:  len(b.refs[name][seqname]),
+				})
+			}
+		}
+	}
+
+	for _, label := range sortedKeys(a.genomes) {
+		if _, ok := b.genomes[label]; !ok {
+			report.GenomesOnlyA = append(report.GenomesOnlyA, a.names[label])
+		}
+	}
+	for _, label := range sortedKeys(b.genomes) {
+		variantsB, ok := b.genomes[label]
+		if !ok {
+			continue
+		}
+		variantsA, ok := a.genomes[label]
+		if !ok {
+			report.GenomesOnlyB = append(report.GenomesOnlyB, b.names[label])
+			continue
+		}
+		gd := genomeDiff{Name: label, NameA: a.names[label], NameB: b.names[label], Counts: map[string]int{}}
+		addDiff := func(td tileDiff) {
+			gd.Counts[td.Change]++
+			if len(gd.Details) < maxDetails {
+				gd.Details = append(gd.Details, td)
+			}
+		}
+		for tag := range a.tagset {
+			tagB := tagAB[tag]
+			for phase := 0; phase < 2; phase++ {
+				var va, vb tileVariantID
+				if i := tag*2 + phase; i < len(variantsA) {
+					va = variantsA[i]
+				}
+				if i := int(tagB)*2 + phase; tagB >= 0 && i < len(variantsB) {
+					vb = variantsB[i]
+				}
+				td := tileDiff{Tag: tagID(tag), Phase: phase, VariantA: va, VariantB: vb}
+				ha, oka := a.variants[tileLibRef{Tag: tagID(tag), Variant: va}]
+				hb, okb := b.variants[tileLibRef{Tag: tagB, Variant: vb}]
+				switch {
+				case va == 0 && vb == 0:
+					gd.Same++
+				case vb == 0:
+					td.Change = tileUnplaced
+					addDiff(td)
+				case va == 0:
+					td.Change = tilePlaced
+					addDiff(td)
+				case !oka || !okb:
+					td.Change = tileMissing
+					addDiff(td)
+				case ha.hash == hb.hash:
+					gd.Same++
+				case hb.nocall && !ha.nocall:
+					td.Change = tileGainedNoCall
+					addDiff(td)
+				case ha.nocall && !hb.nocall:
+					td.Change = tileLostNoCall
+					addDiff(td)
+				default:
+					td.Change = tileChanged
+					addDiff(td)
+				}
+			}
+		}
+		// Tags that are only in b
+		for tagB, ok := range inA {
+			if ok {
+				continue
+			}
+			for phase := 0; phase < 2; phase++ {
+				if i := tagB*2 + phase; i < len(variantsB) && variantsB[i] > 0 {
+					addDiff(tileDiff{Tag: tagID(tagB), Phase: phase, Change: tilePlaced, VariantB: variantsB[i]})
+				}
+			}
+		}
+		report.Genomes = append(report.Genomes, gd)
+	}
+
+	report.Identical = report.Tagset.Identical && len(report.GenomesOnlyA) == 0 && len(report.GenomesOnlyB) == 0
+	for _, rd := range report.References {
+		if rd.Changed > 0 || rd.Only != "" {
+			report.Identical = false
+		}
+	}
+	for _, gd := range report.Genomes {
+		if len(gd.Counts) > 0 {
+			report.Identical = false
+		}
+		log.Printf("%s: %d same, %v", gd.Name, gd.Same, gd.Counts)
+	}
+	return report
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string][]tileVariantID:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string][]tileLibRef:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][]tileLibRef:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type diffLibrarySuite struct{}
+
+var _ = check.Suite(&diffLibrarySuite{})
+
+func (s *diffLibrarySuite) runDiff(c *check.C, a, b string) (int, libraryDiffReport) {
+	var stdout bytes.Buffer
+	exited := (&diffLibrary{}).RunCommand("diff-library", []string{
+		"-local=true",
+		"-a", a,
+		"-b", b,
+	}, nil, &stdout, os.Stderr)
+	var report libraryDiffReport
+	err := json.Unmarshal(stdout.Bytes(), &report)
+	c.Assert(err, check.IsNil, check.Commentf("%s", stdout.String()))
+	return exited, report
+}
+
+func (s *diffLibrarySuite) TestIdentical(c *check.C) {
+	tmpdir := c.MkDir()
+	importLibrary(c, tmpdir+"/a/library.gob", "testdata/pipeline1")
+	importLibrary(c, tmpdir+"/b/library.gob", "testdata/pipeline1")
+	exited, report := s.runDiff(c, tmpdir+"/a", tmpdir+"/b")
+	c.Check(exited, check.Equals, 0)
+	c.Check(report.Identical, check.Equals, true)
+	c.Check(report.Tagset.Identical, check.Equals, true)
+	c.Check(report.Tagset.Common, check.Equals, 9)
+	c.Assert(report.Genomes, check.HasLen, 2)
+	for _, gd := range report.Genomes {
+		c.Check(gd.Counts, check.HasLen, 0)
+		c.Check(gd.Same, check.Equals, 18)
+	}
+}
+
+func (s *diffLibrarySuite) TestChanges(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.Mkdir(tmpdir+"/modified", 0777)
+	c.Assert(err, check.IsNil)
+	files, err := ioutil.ReadDir("testdata/pipeline1")
+	c.Assert(err, check.IsNil)
+	for _, fi := range files {
+		buf, err := ioutil.ReadFile("testdata/pipeline1/" + fi.Name())
+		c.Assert(err, check.IsNil)
+		if fi.Name() == "input1.1.fasta" {
+			lines := strings.Split(string(buf), "\n")
+			// Line 3 is tag 0, so line 4 is in tile 0.
+			c.Assert(lines[2], check.Equals, "ggagaactgtgctccgccttcaga")
+			seq := []byte(lines[3])
+			if seq[10] == 'a' {
+				seq[10] = 'c'
+			} else {
+				seq[10] = 'a'
+			}
+			lines[3] = string(seq)
+			// Tile 1 becomes a no-call.
+			lines[5] = "nnnnnnnnnn" + lines[5][10:]
+			// Tag 3 is unrecognizable, so tile 2 is
+			// extended to tag 4, and tag 3 is not placed.
+			lines[8] = "tttttttttttttttttttttttt"
+			buf = []byte(strings.Join(lines, "\n"))
+		}
+		err = ioutil.WriteFile(tmpdir+"/modified/"+fi.Name(), buf, 0666)
+		c.Assert(err, check.IsNil)
+	}
+	importLibrary(c, tmpdir+"/a/library.gob", "testdata/pipeline1")
+	importLibrary(c, tmpdir+"/b/library.gob", tmpdir+"/modified")
+
+	exited, report := s.runDiff(c, tmpdir+"/a", tmpdir+"/b")
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.Identical, check.Equals, false)
+	c.Check(report.Tagset.Identical, check.Equals, true)
+	c.Assert(report.Genomes, check.HasLen, 2)
+	c.Check(report.Genomes[0].Name, check.Equals, "input1")
+	c.Check(report.Genomes[0].Counts, check.DeepEquals, map[string]int{
+		tileChanged:      2,
+		tileGainedNoCall: 1,
+		tileUnplaced:     1,
+	})
+	for _, td := range report.Genomes[0].Details {
+		c.Check(td.Phase, check.Equals, 0)
+		switch td.Change {
+		case tileChanged:
+			c.Check(td.Tag == 0 || td.Tag == 2, check.Equals, true)
+		case tileGainedNoCall:
+			c.Check(td.Tag, check.Equals, tagID(1))
+		case tileUnplaced:
+			c.Check(td.Tag, check.Equals, tagID(3))
+		}
+	}
+	c.Check(report.Genomes[1].Name, check.Equals, "input2")
+	c.Check(report.Genomes[1].Counts, check.HasLen, 0)
+
+	// Reversing a and b reverses the changes.
+	exited, report = s.runDiff(c, tmpdir+"/b", tmpdir+"/a")
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.Genomes[0].Counts, check.DeepEquals, map[string]int{
+		tileChanged:    2,
+		tileLostNoCall: 1,
+		tilePlaced:     1,
+	})
+}
@@ -34,6 +34,12 @@ import (
 type tvVariant struct {
 	hgvs.Variant
 	librefs map[tileLibRef]bool
+	// absent is true for the second phase of a genome that is
+	// haploid on this sequence.
+	absent bool
+	// unphased is true if the genome's two phases are an
+	// unordered pair on this sequence.
+	unphased bool
 }
 
 type outputFormat interface {
@@ -53,10 +59,16 @@ var outputFormats = map[string]func() outputFormat{
 	"hgvs":        func() outputFormat { return formatHGVS{} },
 	"pvcf":        func() outputFormat { return formatPVCF{} },
 	"vcf":         func() outputFormat { return formatVCF{} },
+	"sites-vcf":   func() outputFormat { return &formatAlleleFreq{} },
+	"sites-tsv":   func() outputFormat { return &formatAlleleFreq{tsv: true} },
 }
 
 type exporter struct {
+	// default -output-format (if empty, "hgvs")
+	defaultOutputFormat string
+
 	outputFormat   outputFormat
+	outputGFA      bool
 	outputPerChrom bool
 	compress       bool
 	maxTileSize    int
@@ -84,12 +96,18 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 	cases := flags.String("cases", "", "file indicating which genomes are positive cases (for computing p-values)")
 	flags.Float64Var(&cmd.maxPValue, "p-value", 1, "do chi square test and omit columns with p-value above this threshold")
 	outputDir := flags.String("output-dir", ".", "output `directory`")
-	outputFormatStr := flags.String("output-format", "hgvs", "output `format`: hgvs, pvcf, or vcf")
+	if cmd.defaultOutputFormat == "" {
+		cmd.defaultOutputFormat = "hgvs"
+	}
+	outputFormatStr := flags.String("output-format", cmd.defaultOutputFormat, "output `format`: hgvs, pvcf, vcf, sites-vcf, sites-tsv, or gfa")
+	groupsFilename := flags.String("groups", "", "for sites-vcf and sites-tsv formats, output per-group counts for groups defined in csv `file` with SampleID column")
+	groupBy := flags.String("group-by", "", "comma-separated `columns` of -groups file to use (default all)")
+	minCellCount := flags.Int("min-cell-count", 0, "for sites-vcf and sites-tsv formats, suppress counts below `N` and omit sites with overall AC below N")
 	outputBed := flags.String("output-bed", "", "also output bed `file`")
 	flags.BoolVar(&cmd.outputPerChrom, "output-per-chromosome", true, "output one file per chromosome")
 	flags.BoolVar(&cmd.compress, "z", false, "write gzip-compressed output files")
 	labelsFilename := flags.String("output-labels", "", "also output genome labels csv `file`")
-	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
+	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "use banded alignment instead of a full diff for tiles bigger than given `size`")
 	cmd.filter.Flags(flags)
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
@@ -102,12 +120,22 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 2
 	}
 
-	if f, ok := outputFormats[*outputFormatStr]; !ok {
+	if *outputFormatStr == "gfa" {
+		// Not an outputFormat: the whole library is
+		// written by exportGFA instead of eachVariant.
+		cmd.outputGFA = true
+	} else if f, ok := outputFormats[*outputFormatStr]; !ok {
 		err = fmt.Errorf("invalid output format %q", *outputFormatStr)
 		return 2
 	} else {
 		cmd.outputFormat = f()
 	}
+	if af, ok := cmd.outputFormat.(*formatAlleleFreq); ok {
+		af.minCellCount = *minCellCount
+	} else if *groupsFilename != "" {
+		err = fmt.Errorf("cannot use -groups with output format %q", *outputFormatStr)
+		return 2
+	}
 
 	if *pprof != "" {
 		go func() {
@@ -132,7 +160,7 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 			Priority:    *priority,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir, cases)
+		err = runner.TranslatePaths(inputDir, cases, groupsFilename, &cmd.filter.HWEControls)
 		if err != nil {
 			return 1
 		}
@@ -157,6 +185,9 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
 			"-z=" + fmt.Sprintf("%v", cmd.compress),
+			"-groups=" + *groupsFilename,
+			"-group-by=" + *groupBy,
+			"-min-cell-count=" + fmt.Sprintf("%d", *minCellCount),
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
@@ -168,6 +199,8 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 0
 	}
 
+	prov := startProvenance(prog, args, *inputDir, *cases, *groupsFilename)
+
 	var cgs []CompactGenome
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
@@ -178,6 +211,7 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 	if err != nil {
 		return 1
 	}
+	prov.addParents(tilelib.provenance)
 
 	refseq, ok := tilelib.refseqs[*refname]
 	if !ok {
@@ -190,12 +224,40 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 1
 	}
 
-	log.Infof("filtering: %+v", cmd.filter)
-	cmd.filter.Apply(tilelib)
+	log.Infof("filtering: %v", cmd.filter.Args())
+	err = cmd.filter.Apply(tilelib)
+	if err != nil {
+		return 1
+	}
+	err = cmd.filter.writeReport()
+	if err != nil {
+		return 1
+	}
 
 	names := cgnames(tilelib)
 	for _, name := range names {
-		cgs = append(cgs, CompactGenome{Name: name, Variants: tilelib.compactGenomes[name]})
+		cgs = append(cgs, tilelib.compactGenome(name))
+	}
+	if af, ok := cmd.outputFormat.(*formatAlleleFreq); ok {
+		var cols []string
+		if *groupBy != "" {
+			cols = strings.Split(*groupBy, ",")
+		}
+		err = af.loadGroups(*groupsFilename, names, cols)
+		if err != nil {
+			return 1
+		}
+	}
+	if cmd.outputGFA {
+		err = cmd.exportGFA(*outputDir, tilelib, *refname, refseq, cgs)
+		if err != nil {
+			return 1
+		}
+		err = prov.writeJSON(*outputDir)
+		if err != nil {
+			return 1
+		}
+		return 0
 	}
 	if *labelsFilename != "" {
 		log.Infof("writing labels to %s", *labelsFilename)
@@ -284,6 +346,10 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 			return 1
 		}
 	}
+	err = prov.writeJSON(*outputDir)
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
@@ -425,6 +491,15 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 	defer outmtx.Lock()
 	refpos := 0
 	variantAt := map[int][]tvVariant{} // variantAt[chromOffset][genomeIndex*2+phase]
+	// noCallAt[genomeIndex*2+phase] holds [start,end) ranges of
+	// no-call bases in partially called tiles
+	noCallAt := make([][][2]int, len(cgs)*2)
+	haploid := make([]bool, len(cgs))
+	unphased := make([]bool, len(cgs))
+	for i := range cgs {
+		haploid[i] = cgs[i].ploidy(seqname) == 1
+		unphased[i] = cgs[i].Unphased[seqname]
+	}
 	for refstep, libref := range reftiles {
 		select {
 		case <-progressbar.C:
@@ -442,7 +517,7 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 		refseq := tilelib.TileVariantSequence(libref)
 		tagcoverage := 0 // number of times the start tag was found in genomes -- max is len(cgs)*2
 		for cgidx, cg := range cgs {
-			for phase := 0; phase < 2; phase++ {
+			for phase := 0; phase < cg.ploidy(seqname); phase++ {
 				var variant tileVariantID
 				if i := int(libref.Tag)*2 + phase; len(cg.Variants) > i {
 					variant = cg.Variants[i]
@@ -463,31 +538,67 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 						// was false during import
 						continue
 					}
-					if len(genomeseq) > maxTileSize {
-						continue
-					}
 					refSequence := refseq
 					// If needed, extend the
 					// reference sequence up to
 					// the tag at the end of the
-					// genomeseq sequence.
+					// genomeseq sequence. (The
+					// genome's tag might have a
+					// mismatch, see
+					// tileLibrary.approxTags.)
+					approx := tilelib.TileVariantApproxEndTag(glibref, taglen)
 					refstepend := refstep + 1
-					for refstepend < len(reftiles) && len(refSequence) >= taglen && !bytes.EqualFold(refSequence[len(refSequence)-taglen:], genomeseq[len(genomeseq)-taglen:]) && len(refSequence) <= maxTileSize {
+					for refstepend < len(reftiles) && len(refSequence) >= taglen && !matchTag(refSequence[len(refSequence)-taglen:], genomeseq[len(genomeseq)-taglen:], approx) && len(refSequence) <= len(genomeseq)+maxTileSize {
 						if &refSequence[0] == &refseq[0] {
 							refSequence = append([]byte(nil), refSequence...)
 						}
 						refSequence = append(refSequence, tilelib.TileVariantSequence(reftiles[refstepend])...)
 						refstepend++
 					}
-					// (TODO: handle no-calls)
-					if len(refSequence) <= maxTileSize {
-						refstr := strings.ToUpper(string(refSequence))
-						genomestr := strings.ToUpper(string(genomeseq))
-						vars, _ = hgvs.Diff(refstr, genomestr, time.Second)
+					refstr := strings.ToUpper(string(refSequence))
+					genomestr := strings.ToUpper(string(genomeseq))
+					if len(refSequence) <= maxTileSize && len(genomeseq) <= maxTileSize {
+						var timedOut bool
+						vars, timedOut = hgvs.Diff(refstr, genomestr, time.Second)
+						if timedOut {
+							// Use a slower but
+							// deterministic
+							// alignment instead of
+							// whatever diffmatchpatch
+							// had found so far.
+							vars, _ = hgvs.DiffBanded(refstr, genomestr, hgvs.DefaultBandwidth)
+						}
+					} else if refstepend == len(reftiles) || matchTag(refSequence[len(refSequence)-taglen:], genomeseq[len(genomeseq)-taglen:], approx) {
+						var truncated bool
+						vars, truncated = hgvs.DiffBanded(refstr, genomestr, hgvs.DefaultBandwidth)
+						if truncated {
+							log.Warnf("exportSeq: %s: tile variant %d,%d diff too large to align, reporting as a single event", seqname, glibref.Tag, glibref.Variant)
+						}
+					} else {
+						log.Warnf("exportSeq: %s: skipping tile variant %d,%d: end tag not found within %d bases of reference", seqname, glibref.Tag, glibref.Variant, len(refSequence))
+					}
+					if vars != nil {
+						if padLeft {
+							// VCF expects
+							// left-normalized
+							// indels.
+							vars = hgvs.LeftAlign(refstr, vars)
+						}
 					}
 					diffs[glibref] = vars
 				}
 				for _, v := range vars {
+					if isNoCallVariant(v) {
+						// Don't report no-call
+						// bases as a variant, but
+						// remember where they are
+						// so this genome is reported
+						// as a no-call (rather than
+						// =ref) there.
+						span := variantSpan(v)
+						noCallAt[cgidx*2+phase] = append(noCallAt[cgidx*2+phase], [2]int{span[0] + refpos, span[1] + refpos})
+						continue
+					}
 					if padLeft {
 						v = v.PadLeft()
 					}
@@ -526,6 +637,7 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 			// Check for uninitialized (zero-value)
 			// elements in varslice
 			for i := range varslice {
+				varslice[i].unphased = unphased[i/2]
 				if varslice[i].Position != 0 {
 					// Not a zero-value element
 					continue
@@ -533,6 +645,10 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 				// Set the position so
 				// varslice[*].Position are all equal
 				varslice[i].Position = pos
+				if i%2 == 1 && haploid[i/2] {
+					varslice[i].absent = true
+					continue
+				}
 				// This could be either =ref or a
 				// missing/low-quality tile. Figure
 				// out which.
@@ -546,10 +662,30 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 				if v < 1 || len(tilelib.TileVariantSequence(tileLibRef{Tag: libref.Tag, Variant: v})) == 0 {
 					// Missing/low-quality tile.
 					varslice[i].New = "-" // fasta "gap of indeterminate length"
+					continue
+				}
+				for _, r := range noCallAt[i] {
+					if pos >= r[0] && pos < r[1] {
+						// No-call bases in a
+						// partially called tile.
+						varslice[i].New = "-"
+						break
+					}
 				}
 			}
 			flushvariants[i] = varslice
 		}
+		// Forget no-call ranges that end before any position
+		// we haven't flushed yet.
+		for i, ranges := range noCallAt {
+			keep := ranges[:0]
+			for _, r := range ranges {
+				if r[1] > refpos+1 {
+					keep = append(keep, r)
+				}
+			}
+			noCallAt[i] = keep
+		}
 		outmtx.Lock()
 		go func() {
 			defer outmtx.Unlock()
@@ -584,6 +720,28 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 	}
 }
 
+// isNoCallVariant returns true if the new allele of v includes
+// no-call bases, i.e., the genome sequence was not called at (some
+// of) the variant's reference positions.
+func isNoCallVariant(v hgvs.Variant) bool {
+	for i := 0; i < len(v.New); i++ {
+		if !isbase[v.New[i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// variantSpan returns the half-open [start,end) range of reference
+// positions affected by v. An insertion affects the position where
+// it is inserted.
+func variantSpan(v hgvs.Variant) [2]int {
+	if len(v.Ref) == 0 {
+		return [2]int{v.Position, v.Position + 1}
+	}
+	return [2]int{v.Position, v.Position + len(v.Ref)}
+}
+
 func bucketVarsliceByRef(varslice []tvVariant) map[string]map[string]int {
 	byref := map[string]map[string]int{}
 	for _, v := range varslice {
@@ -605,6 +763,77 @@ func bucketVarsliceByRef(varslice []tvVariant) map[string]map[string]int {
 	return byref
 }
 
+// vcfSVHeader defines the INFO fields and symbolic ALT alleles used
+// for structural variants.
+const vcfSVHeader = `##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+`
+
+// vcfRecord is a VCF output line: a REF allele and the ALT alleles
+// that share it.
+type vcfRecord struct {
+	pos    int
+	ref    string   // REF column
+	altcol []string // ALT column
+	info   string   // SV fields for INFO column, or ""
+	vref   string   // tvVariant.Ref corresponding to ref
+	alts   []string // tvVariant.New corresponding to altcol
+}
+
+// vcfRecords groups the given variants (which all have the same
+// position) into VCF records. Structural variants (see
+// hgvs.Variant.SVType) get a separate record each, with a symbolic
+// ALT allele.
+func vcfRecords(varslice []tvVariant) []vcfRecord {
+	var records []vcfRecord
+	for ref, alts := range bucketVarsliceByRef(varslice) {
+		altslice := make([]string, 0, len(alts))
+		for alt := range alts {
+			altslice = append(altslice, alt)
+		}
+		sort.Strings(altslice)
+		literal := vcfRecord{pos: varslice[0].Position, ref: ref, vref: ref}
+		for _, alt := range altslice {
+			var v hgvs.Variant
+			for _, tv := range varslice {
+				if tv.Ref == ref && tv.New == alt {
+					v = tv.Variant
+					break
+				}
+			}
+			svtype := v.SVType()
+			if svtype == "" {
+				literal.alts = append(literal.alts, alt)
+				literal.altcol = append(literal.altcol, alt)
+				continue
+			}
+			rec := vcfRecord{
+				pos:    v.Position,
+				ref:    v.Ref[:1],
+				altcol: []string{"<" + svtype + ">"},
+				info:   fmt.Sprintf("SVTYPE=%s;SVLEN=%d;END=%d", svtype, v.SVLen(), v.End()),
+				vref:   ref,
+				alts:   []string{alt},
+			}
+			if svtype != "DEL" && v.Left != "" {
+				// Unlike a deletion, a duplication or
+				// inversion is not already padded with
+				// the preceding base.
+				rec.pos, rec.ref = v.Position-1, v.Left
+			}
+			records = append(records, rec)
+		}
+		if len(literal.alts) > 0 {
+			records = append(records, literal)
+		}
+	}
+	return records
+}
+
 type formatVCF struct{}
 
 func (formatVCF) MaxGoroutines() int                     { return 0 }
@@ -612,25 +841,23 @@ func (formatVCF) Filename() string                       { return "out.vcf" }
 func (formatVCF) PadLeft() bool                          { return true }
 func (formatVCF) Finish(string, io.Writer, string) error { return nil }
 func (formatVCF) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float64) error {
-	_, err := fmt.Fprint(out, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
+	_, err := fmt.Fprint(out, vcfSVHeader+"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
 	return err
 }
 func (formatVCF) Print(out io.Writer, seqname string, varslice []tvVariant) error {
-	for ref, alts := range bucketVarsliceByRef(varslice) {
-		altslice := make([]string, 0, len(alts))
-		for alt := range alts {
-			altslice = append(altslice, alt)
-		}
-		sort.Strings(altslice)
-
+	byref := bucketVarsliceByRef(varslice)
+	for _, rec := range vcfRecords(varslice) {
 		info := "AC="
-		for i, a := range altslice {
+		for i, a := range rec.alts {
 			if i > 0 {
 				info += ","
 			}
-			info += strconv.Itoa(alts[a])
+			info += strconv.Itoa(byref[rec.vref][a])
+		}
+		if rec.info != "" {
+			info = rec.info + ";" + info
 		}
-		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t%s\n", seqname, varslice[0].Position, ref, strings.Join(altslice, ","), info)
+		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t%s\n", seqname, rec.pos, rec.ref, strings.Join(rec.altcol, ","), info)
 		if err != nil {
 			return err
 		}
@@ -645,6 +872,7 @@ func (formatPVCF) Filename() string                       { return "out.vcf" }
 func (formatPVCF) PadLeft() bool                          { return true }
 func (formatPVCF) Finish(string, io.Writer, string) error { return nil }
 func (formatPVCF) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float64) error {
+	fmt.Fprint(out, vcfSVHeader)
 	fmt.Fprintln(out, `##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">`)
 	fmt.Fprintf(out, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT")
 	for _, cg := range cgs {
@@ -655,32 +883,43 @@ func (formatPVCF) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float
 }
 
 func (formatPVCF) Print(out io.Writer, seqname string, varslice []tvVariant) error {
-	for ref, alts := range bucketVarsliceByRef(varslice) {
-		altslice := make([]string, 0, len(alts))
-		for alt := range alts {
-			altslice = append(altslice, alt)
-		}
-		sort.Strings(altslice)
-		for i, a := range altslice {
+	for _, rec := range vcfRecords(varslice) {
+		alts := map[string]int{}
+		for i, a := range rec.alts {
 			alts[a] = i + 1
 		}
-		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t.\tGT", seqname, varslice[0].Position, ref, strings.Join(altslice, ","))
+		info := "."
+		if rec.info != "" {
+			info = rec.info
+		}
+		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t%s\tGT", seqname, rec.pos, rec.ref, strings.Join(rec.altcol, ","), info)
 		if err != nil {
 			return err
 		}
 		for i := 0; i < len(varslice); i += 2 {
 			v1, v2 := varslice[i], varslice[i+1]
 			a1, a2 := alts[v1.New], alts[v2.New]
-			if v1.Ref != ref {
+			if v1.Ref != rec.vref {
 				// variant on allele 0 belongs on a
 				// different output line -- same
 				// chr,pos but different "ref" length
 				a1 = 0
 			}
-			if v2.Ref != ref {
+			if v2.Ref != rec.vref {
 				a2 = 0
 			}
-			_, err := fmt.Fprintf(out, "\t%d/%d", a1, a2)
+			var err error
+			if v2.absent {
+				// hemizygous
+				_, err = fmt.Fprintf(out, "\t%d", a1)
+			} else if v1.unphased {
+				if a1 > a2 {
+					a1, a2 = a2, a1
+				}
+				_, err = fmt.Fprintf(out, "\t%d/%d", a1, a2)
+			} else {
+				_, err = fmt.Fprintf(out, "\t%d|%d", a1, a2)
+			}
 			if err != nil {
 				return err
 			}
@@ -706,6 +945,10 @@ func (formatHGVS) Print(out io.Writer, seqname string, varslice []tvVariant) err
 			out.Write([]byte{'\t'})
 		}
 		var1, var2 := varslice[i*2], varslice[i*2+1]
+		if var2.absent {
+			// hemizygous
+			var2 = var1
+		}
 		if var1.New == "-" || var2.New == "-" {
 			_, err := out.Write([]byte{'N'})
 			if err != nil {
@@ -725,6 +968,18 @@ func (formatHGVS) Print(out io.Writer, seqname string, varslice []tvVariant) err
 					return err
 				}
 			}
+		} else if var1.unphased {
+			// "(;)" means phase is unknown. Sort the
+			// alleles so the output doesn't depend on
+			// which was tiled as phase 1.
+			s1, s2 := var1.String(), var2.String()
+			if s1 > s2 {
+				s1, s2 = s2, s1
+			}
+			_, err := fmt.Fprintf(out, "%s:g.[%s](;)[%s]", seqname, s1, s2)
+			if err != nil {
+				return err
+			}
 		} else {
 			_, err := fmt.Fprintf(out, "%s:g.[%s];[%s]", seqname, var1.String(), var2.String())
 			if err != nil {
@@ -822,7 +1077,9 @@ func (f *formatHGVSNumpy) Print(outw io.Writer, seqname string, varslice []tvVar
 		chi2x, chi2y := chi2x, chi2y
 		newrow := make([]int8, len(varslice))
 		for i, allele := range varslice {
-			if allele.Variant == v {
+			if allele.absent {
+				continue
+			} else if allele.Variant == v {
 				newrow[i] = 1
 				chi2x = append(chi2x, true)
 				chi2y = append(chi2y, f.cases[i/2])
@@ -5,10 +5,15 @@
 package lightning
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/arvados/lightning/hgvs"
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
 )
@@ -103,29 +108,41 @@ chr2.472G>A	1	0
 	output, err = ioutil.ReadFile(tmpdir + "/out.chr1.vcf")
 	c.Check(err, check.IsNil)
 	c.Log(string(output))
-	c.Check(sortLines(string(output)), check.Equals, sortLines(`##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
 #CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	testdata/pipeline1/input1.1.fasta	testdata/pipeline1/input2.1.fasta
-chr1	1	.	NNN	GGC	.	.	.	GT	1/1	0/0
-chr1	41	.	T	A	.	.	.	GT	1/0	0/0
-chr1	42	.	T	A	.	.	.	GT	1/0	0/0
-chr1	161	.	A	T	.	.	.	GT	0/1	0/0
-chr1	178	.	A	T	.	.	.	GT	0/1	0/0
-chr1	221	.	TCCA	T	.	.	.	GT	1/1	0/0
-chr1	302	.	TTTT	AAAA	.	.	.	GT	0/1	0/0
+chr1	1	.	NNN	GGC	.	.	.	GT	1|1	0|0
+chr1	41	.	T	A	.	.	.	GT	1|0	0|0
+chr1	42	.	T	A	.	.	.	GT	1|0	0|0
+chr1	161	.	A	T	.	.	.	GT	0|1	0|0
+chr1	178	.	A	T	.	.	.	GT	0|1	0|0
+chr1	221	.	TCCA	T	.	.	.	GT	1|1	0|0
+chr1	302	.	TTTT	AAAA	.	.	.	GT	0|1	0|0
 `))
 	output, err = ioutil.ReadFile(tmpdir + "/out.chr2.vcf")
 	c.Check(err, check.IsNil)
 	c.Log(string(output))
-	c.Check(sortLines(string(output)), check.Equals, sortLines(`##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
 #CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	testdata/pipeline1/input1.1.fasta	testdata/pipeline1/input2.1.fasta
-chr2	1	.	TTT	AAA	.	.	.	GT	0/0	0/1
-chr2	125	.	CTT	AAA	.	.	.	GT	0/0	1/1
-chr2	240	.	ATTTTTCTTGCTCTC	A	.	.	.	GT	1/0	0/0
-chr2	258	.	CCTTGTATTTTT	AA	.	.	.	GT	1/0	0/0
-chr2	315	.	C	A	.	.	.	GT	1/0	0/0
-chr2	469	.	GTGG	G	.	.	.	GT	1/0	0/0
-chr2	471	.	G	A	.	.	.	GT	0/1	0/0
-chr2	472	.	G	A	.	.	.	GT	0/1	0/0
+chr2	1	.	TTT	AAA	.	.	.	GT	0|0	0|1
+chr2	125	.	CTT	AAA	.	.	.	GT	0|0	1|1
+chr2	240	.	ATTTTTCTTGCTCTC	A	.	.	.	GT	1|0	0|0
+chr2	258	.	CCTTGTATTTTT	AA	.	.	.	GT	1|0	0|0
+chr2	315	.	C	A	.	.	.	GT	1|0	0|0
+chr2	468	.	CGTG	C	.	.	.	GT	1|0	0|0
+chr2	471	.	G	A	.	.	.	GT	0|1	0|0
+chr2	472	.	G	A	.	.	.	GT	0|1	0|0
 `))
 
 	exited = (&exporter{}).RunCommand("export", []string{
@@ -139,7 +156,13 @@ chr2	472	.	G	A	.	.	.	GT	0/1	0/0
 	output, err = ioutil.ReadFile(tmpdir + "/out.chr1.vcf")
 	c.Check(err, check.IsNil)
 	c.Log(string(output))
-	c.Check(sortLines(string(output)), check.Equals, sortLines(`#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
 chr1	1	.	NNN	GGC	.	.	AC=2
 chr1	41	.	T	A	.	.	AC=1
 chr1	42	.	T	A	.	.	AC=1
@@ -151,13 +174,19 @@ chr1	302	.	TTTT	AAAA	.	.	AC=1
 	output, err = ioutil.ReadFile(tmpdir + "/out.chr2.vcf")
 	c.Check(err, check.IsNil)
 	c.Log(string(output))
-	c.Check(sortLines(string(output)), check.Equals, sortLines(`#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
 chr2	1	.	TTT	AAA	.	.	AC=1
 chr2	125	.	CTT	AAA	.	.	AC=2
 chr2	240	.	ATTTTTCTTGCTCTC	A	.	.	AC=1
 chr2	258	.	CCTTGTATTTTT	AA	.	.	AC=1
 chr2	315	.	C	A	.	.	AC=1
-chr2	469	.	GTGG	G	.	.	AC=1
+chr2	468	.	CGTG	C	.	.	AC=1
 chr2	471	.	G	A	.	.	AC=1
 chr2	472	.	G	A	.	.	AC=1
 `))
@@ -240,3 +269,599 @@ chr2	472	.	G	A	.	.	AC=1
 	c.Check(exited, check.Equals, 0)
 
 }
+
+func (s *exportSuite) TestGFA(c *check.C) {
+	tmpdir := c.MkDir()
+	for i, infile := range []string{"testdata/ref.fasta", "testdata/spanningtile"} {
+		exited := (&importer{}).RunCommand("import", []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-save-incomplete-tiles",
+			"-o", fmt.Sprintf("%s/library%d.gob", tmpdir, i),
+			infile,
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/library.gob",
+		tmpdir + "/library0.gob",
+		tmpdir + "/library1.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	outdir := c.MkDir()
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + outdir,
+		"-output-format=gfa",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err := ioutil.ReadFile(outdir + "/out.gfa")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", output)
+
+	segments := map[string]string{}
+	links := map[string]bool{}
+	var walks [][]string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "S":
+			segments[fields[1]] = fields[2]
+		case "L":
+			links[fields[1]+" "+fields[3]] = true
+		case "W":
+			walks = append(walks, fields)
+		}
+	}
+	c.Check(len(segments) > 0, check.Equals, true)
+
+	// Each walk must follow links between known segments, and
+	// the reference walks must spell out the reference
+	// sequence.
+	refseqs := map[string]string{}
+	for _, walk := range walks {
+		steps := strings.Split(walk[6], ">")[1:]
+		var seq string
+		for i, step := range steps {
+			_, ok := segments[step]
+			c.Check(ok, check.Equals, true, check.Commentf("segment %s", step))
+			if i > 0 {
+				c.Check(links[steps[i-1]+" "+step], check.Equals, true, check.Commentf("link %s %s", steps[i-1], step))
+			}
+			seq += segments[step]
+		}
+		c.Check(walk[5], check.Equals, fmt.Sprintf("%d", len(seq)))
+		if walk[1] == "ref" {
+			refseqs[walk[3]] = seq
+		}
+	}
+	fasta, err := ioutil.ReadFile("testdata/ref.fasta")
+	c.Assert(err, check.IsNil)
+	for _, chunk := range strings.Split(string(fasta), ">")[1:] {
+		lines := strings.SplitN(chunk, "\n", 2)
+		seqname := strings.Fields(lines[0])[0]
+		c.Check(refseqs[seqname], check.Equals, strings.ToUpper(strings.Replace(lines[1], "\n", "", -1)))
+	}
+
+	// The spanning tile for tag 5 in input2.2 links directly
+	// to a variant of tag 7.
+	spanning := false
+	for link := range links {
+		if strings.HasPrefix(link, "5-") && strings.Contains(link, " 7-") {
+			spanning = true
+		}
+	}
+	c.Check(spanning, check.Equals, true)
+}
+
+func (s *exportSuite) TestVCFStructuralVariants(c *check.C) {
+	seq := strings.Repeat("ACGTTGCA", 10)
+	varslice := []tvVariant{
+		{Variant: hgvs.Variant{Position: 100, Ref: "C" + seq, New: "C"}},
+		{Variant: hgvs.Variant{Position: 100}},
+		{Variant: hgvs.Variant{Position: 100, Ref: seq, New: seq + seq, Left: "C"}},
+		{Variant: hgvs.Variant{Position: 100, Ref: "C", New: "CT"}},
+	}
+	var buf bytes.Buffer
+	err := formatPVCF{}.Print(&buf, "chr1", varslice)
+	c.Check(err, check.IsNil)
+	c.Check(sortLines(buf.String()), check.Equals, sortLines(`chr1	100	.	C	<DEL>	.	.	SVTYPE=DEL;SVLEN=-80;END=180	GT	1|0	0|0
+chr1	99	.	C	<DUP>	.	.	SVTYPE=DUP;SVLEN=80;END=179	GT	0|0	1|0
+chr1	100	.	C	CT	.	.	.	GT	0|0	0|1
+`))
+
+	buf.Reset()
+	err = formatVCF{}.Print(&buf, "chr1", varslice)
+	c.Check(err, check.IsNil)
+	c.Check(sortLines(buf.String()), check.Equals, sortLines(`chr1	100	.	C	<DEL>	.	.	SVTYPE=DEL;SVLEN=-80;END=180;AC=1
+chr1	99	.	C	<DUP>	.	.	SVTYPE=DUP;SVLEN=80;END=179;AC=1
+chr1	100	.	C	CT	.	.	AC=1
+`))
+}
+
+func (s *exportSuite) TestBandedAlignFallback(c *check.C) {
+	tmpdir := c.MkDir()
+	for i, infile := range []string{"testdata/ref.fasta", "testdata/pipeline1"} {
+		args := []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-o", fmt.Sprintf("%s/library%d.gob", tmpdir, i),
+		}
+		if i == 0 {
+			args = append(args, "-save-incomplete-tiles")
+		}
+		args = append(args, infile)
+		exited := (&importer{}).RunCommand("import", args, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/library.gob",
+		tmpdir + "/library0.gob",
+		tmpdir + "/library1.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	export := func(outdir string) string {
+		err := os.Mkdir(outdir, 0777)
+		c.Assert(err, check.IsNil)
+		exited := (&exporter{}).RunCommand("export", []string{
+			"-local=true",
+			"-input-dir=" + tmpdir + "/library.gob",
+			"-output-dir=" + outdir,
+			"-output-format=hgvs",
+			"-max-tile-size=1",
+			"-ref=testdata/ref.fasta",
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		output, err := ioutil.ReadFile(outdir + "/out.chr2.tsv")
+		c.Assert(err, check.IsNil)
+		return string(output)
+	}
+	c.Check(export(tmpdir+"/aligned"), check.Equals, `.	chr2:g.[1=];[1_3delinsAAA]
+.	chr2:g.125_127delinsAAA
+chr2:g.[241_254del];[241=]	.
+chr2:g.[258_269delinsAA];[258=]	.
+chr2:g.[315C>A];[315=]	.
+chr2:g.[470_472del];[470=]	.
+chr2:g.[471=];[471G>A]	.
+chr2:g.[472=];[472G>A]	.
+`)
+
+	// With -max-tile-size=1, every tile is aligned with
+	// DiffBanded, and with MaxAlignCells=1, every alignment
+	// falls back to reporting the differing region as a single
+	// event.
+	defer func(orig int) { hgvs.MaxAlignCells = orig }(hgvs.MaxAlignCells)
+	hgvs.MaxAlignCells = 1
+	c.Check(export(tmpdir+"/unaligned"), check.Equals, `.	chr2:g.[1=];[1_127delinsAAATTATAGCAGTAGCGGTTGCGATAATGCGCACTAAGGTGGCCATAACTTAGCCACACAGACTGCGACCTCGGTGTCAATCTTTAGGCGATGACTAGTGGTTATTAATAATAACTTATCATCAAAA]
+.	chr2:g.[125_127delinsAAA];[125=]
+chr2:g.[241_269delinsAAAAA];[241=]	.
+chr2:g.[315C>A];[315=]	.
+chr2:g.[470_472del];[470=]	.
+chr2:g.[471=];[471G>A]	.
+chr2:g.[472=];[472G>A]	.
+`)
+}
+
+func (s *exportSuite) TestAlleleFreq(c *check.C) {
+	tmpdir := c.MkDir()
+	for i, infile := range []string{"testdata/ref.fasta", "testdata/pipeline1"} {
+		args := []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-o", fmt.Sprintf("%s/library%d.gob", tmpdir, i),
+		}
+		if i == 0 {
+			args = append(args, "-save-incomplete-tiles")
+		}
+		args = append(args, infile)
+		exited := (&importer{}).RunCommand("import", args, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/library.gob",
+		tmpdir + "/library0.gob",
+		tmpdir + "/library1.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	err := ioutil.WriteFile(tmpdir+"/groups.csv", []byte("Index,SampleID,ancestry,site\n0,input1,afr,x\n1,input2,eur,x\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	exited = (&exporter{defaultOutputFormat: "sites-vcf"}).RunCommand("allele-freq", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=sites-tsv",
+		"-groups=" + tmpdir + "/groups.csv",
+		"-group-by=ancestry",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err := ioutil.ReadFile(tmpdir + "/sites.chr2.tsv")
+	c.Assert(err, check.IsNil)
+	c.Log(string(output))
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`CHROM	POS	REF	ALT	AC	AN	AF	nhomalt	AC_ancestry_afr	AN_ancestry_afr	AF_ancestry_afr	nhomalt_ancestry_afr	AC_ancestry_eur	AN_ancestry_eur	AF_ancestry_eur	nhomalt_ancestry_eur
+chr2	1	TTT	AAA	1	4	0.25	0	0	2	0	0	1	2	0.5	0
+chr2	125	CTT	AAA	2	4	0.5	1	0	2	0	0	2	2	1	1
+chr2	240	ATTTTTCTTGCTCTC	A	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+chr2	258	CCTTGTATTTTT	AA	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+chr2	315	C	A	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+chr2	468	CGTG	C	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+chr2	471	G	A	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+chr2	472	G	A	1	4	0.25	0	1	2	0.5	0	0	2	0	0
+`))
+
+	exited = (&exporter{defaultOutputFormat: "sites-vcf"}).RunCommand("allele-freq", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-groups=" + tmpdir + "/groups.csv",
+		"-min-cell-count=2",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(tmpdir + "/sites.chr2.vcf")
+	c.Assert(err, check.IsNil)
+	c.Log(string(output))
+	c.Check(string(output), check.Matches, `(?ms).*##INFO=<ID=AC_site_x,Number=A,Type=Integer,Description="Alternate allele count in group site_x">\n.*##minCellCount=2\n.*`)
+	// Only chr2:125 has AC >= 2. Its nhomalt=1 is suppressed.
+	c.Check(string(output), check.Matches, `(?ms).*\n#CHROM[^\n]*\n`+
+		`chr2\t125\t\.\tCTT\tAAA\t\.\t\.\tAC=2;AN=4;AF=0\.5;nhomalt=\.;`+
+		`AC_ancestry_afr=0;AN_ancestry_afr=2;AF_ancestry_afr=0;nhomalt_ancestry_afr=0;`+
+		`AC_ancestry_eur=2;AN_ancestry_eur=2;AF_ancestry_eur=1;nhomalt_ancestry_eur=\.;`+
+		`AC_site_x=2;AN_site_x=4;AF_site_x=0\.5;nhomalt_site_x=\.\n$`)
+}
+
+func (s *exportSuite) TestAlleleFreqSuppression(c *check.C) {
+	f := &formatAlleleFreq{
+		minCellCount: 3,
+		groups:       []string{"ancestry_afr", "ancestry_eur", "ancestry_sas", "site_x", "site_y"},
+		groupColumn:  []string{"ancestry", "ancestry", "ancestry", "site", "site"},
+	}
+	for _, trial := range []struct {
+		cells  []int // overall, afr, eur, sas, x, y
+		expect []bool
+	}{
+		// nothing below minCellCount
+		{[]int{20, 10, 5, 5, 10, 10}, []bool{false, false, false, false, false, false}},
+		// afr is suppressed, so the next smallest ancestry
+		// count (sas) is too
+		{[]int{20, 2, 10, 8, 10, 10}, []bool{false, true, false, true, false, false}},
+		// two ancestry counts are suppressed already
+		{[]int{20, 2, 16, 2, 10, 10}, []bool{false, true, false, true, false, false}},
+		// site_x is suppressed, and the only other site count
+		// is zero, so the overall count is suppressed
+		{[]int{5, 0, 5, 0, 2, 0}, []bool{true, false, false, false, true, false}},
+		// zero counts are not suppressed
+		{[]int{20, 0, 20, 0, 10, 10}, []bool{false, false, false, false, false, false}},
+	} {
+		c.Check(f.suppressed(trial.cells), check.DeepEquals, trial.expect, check.Commentf("%v", trial.cells))
+	}
+}
+
+// writePartiallyCalledInput writes a copy of
+// testdata/pipeline1/input2.*.fasta to dir, with edits in a single
+// tile on chr1: phase 1 has two no-call bases (chr1:130-131) and a
+// SNP (chr1:135), and phase 2 has a SNP at chr1:130.
+func writePartiallyCalledInput(c *check.C, dir string) {
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, check.IsNil)
+	for phase, edits := range []map[int]byte{{5: 'n', 6: 'n', 10: 'c'}, {5: 'c'}} {
+		fnm := fmt.Sprintf("input2.%d.fasta", phase+1)
+		buf, err := ioutil.ReadFile("testdata/pipeline1/" + fnm)
+		c.Assert(err, check.IsNil)
+		lines := strings.Split(string(buf), "\n")
+		line := []byte(lines[3])
+		for pos, b := range edits {
+			line[pos] = b
+		}
+		lines[3] = string(line)
+		err = ioutil.WriteFile(dir+"/"+fnm, []byte(strings.Join(lines, "\n")), 0644)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *exportSuite) TestPartiallyCalledTiles(c *check.C) {
+	tmpdir := c.MkDir()
+	writePartiallyCalledInput(c, tmpdir+"/input")
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		tmpdir + "/input",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=hgvs",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err := ioutil.ReadFile(tmpdir + "/out.chr1.tsv")
+	c.Assert(err, check.IsNil)
+	// The called SNP is reported, and phase 1 is a no-call at
+	// chr1:130 (not =ref, and not T>N).
+	c.Check(string(output), check.Equals, "N\nchr1:g.[135A>C];[135=]\n")
+
+	// With a lower tolerance for no-calls, phase 1's tile (5
+	// no-calls in 248 bases, including 3 at the start of chr1)
+	// is treated as a no-call, but phase 2's tile (3 no-calls)
+	// is not.
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=hgvs",
+		"-max-nocall-fraction=0.015",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(tmpdir + "/out.chr1.tsv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(output), check.Equals, "N\n")
+}
+
+func (s *exportSuite) TestHaploid(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/ploidy.csv", []byte("# genome,sequence,ploidy\ninput2,chr2,1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	for i, infile := range []string{"testdata/ref.fasta", "testdata/pipeline1"} {
+		args := []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-ploidy", tmpdir + "/ploidy.csv",
+			"-o", fmt.Sprintf("%s/library%d.gob", tmpdir, i),
+		}
+		if i == 0 {
+			args = append(args, "-save-incomplete-tiles")
+		}
+		args = append(args, infile)
+		exited := (&importer{}).RunCommand("import", args, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/library.gob",
+		tmpdir + "/library0.gob",
+		tmpdir + "/library1.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=pvcf",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	// input2 is haploid on chr2, so its chr2 genotypes come
+	// from input2.1.fasta only.
+	output, err := ioutil.ReadFile(tmpdir + "/out.chr2.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(string(output), check.Matches, `(?ms).*\n#CHROM[^\n]*\n`+
+		`chr2\t125\t\.\tCTT\tAAA\t\.\t\.\t\.\tGT\t0\|0\t1\n`+
+		`chr2\t240\t\.\tATTTTTCTTGCTCTC\tA\t\.\t\.\t\.\tGT\t1\|0\t0\n.*`)
+	c.Check(string(output), check.Not(check.Matches), `(?ms).*\nchr2\t1\t.*`)
+
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), tmpdir+"/library.gob")
+	c.Assert(err, check.IsNil)
+	// input2.2.fasta's chr2 is not tiled.
+	for _, variants := range tilelib.variant {
+		for _, hash := range variants {
+			c.Check(string(tilelib.hashSequence(hash)), check.Not(check.Matches), `aaattatagcagtagc.*`)
+		}
+	}
+	// In the numpy matrix, input2's chr2 calls have one
+	// haplotype.
+	names := cgnames(tilelib)
+	c.Assert(names, check.HasLen, 2)
+	out := cgs2array(tilelib, names, lowqual(tilelib), nil, 0, len(tilelib.variant))
+	for _, refseq := range tilelib.refseqs {
+		for seqname, librefs := range refseq {
+			for _, libref := range librefs {
+				col := int(libref.Tag) * 2
+				c.Check(out.At(col+1) != 0, check.Equals, true)
+				c.Check(out.At(out.cols+col) != 0, check.Equals, true)
+				c.Check(out.At(out.cols+col+1) != 0, check.Equals, seqname != "chr2", check.Commentf("%s tag %d", seqname, libref.Tag))
+			}
+		}
+	}
+	output, err = ioutil.ReadFile(tmpdir + "/out.chr1.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(string(output), check.Matches, `(?ms).*\nchr1\t1\t\.\tNNN\tGGC\t\.\t\.\t\.\tGT\t1\|1\t0\|0\n.*`)
+
+	exited = (&exporter{defaultOutputFormat: "sites-vcf"}).RunCommand("allele-freq", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=sites-tsv",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(tmpdir + "/sites.chr2.tsv")
+	c.Assert(err, check.IsNil)
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`CHROM	POS	REF	ALT	AC	AN	AF	nhomalt
+chr2	125	CTT	AAA	1	3	0.333333	0
+chr2	240	ATTTTTCTTGCTCTC	A	1	3	0.333333	0
+chr2	258	CCTTGTATTTTT	AA	1	3	0.333333	0
+chr2	315	C	A	1	3	0.333333	0
+chr2	468	CGTG	C	1	3	0.333333	0
+chr2	471	G	A	1	3	0.333333	0
+chr2	472	G	A	1	3	0.333333	0
+`))
+
+	// In GFA output, input2 has no second haplotype walk on chr2.
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-output-format=gfa",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(tmpdir + "/out.gfa")
+	c.Assert(err, check.IsNil)
+	walks := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Split(line, "\t"); fields[0] == "W" {
+			walks[fields[1]+" "+fields[2]+" "+fields[3]] = true
+		}
+	}
+	c.Check(walks["input1 2 chr2"], check.Equals, true)
+	c.Check(walks["input2 1 chr2"], check.Equals, true)
+	c.Check(walks["input2 2 chr2"], check.Equals, false)
+	c.Check(walks["input2 2 chr1"], check.Equals, true)
+
+	// slice-numpy records input2's haploid chr2 in ploidy.csv,
+	// and anno2vcf writes single-allele genotypes for it.
+	slicedir := c.MkDir()
+	exited = (&slicecmd{}).RunCommand("slice", []string{
+		"-local=true",
+		"-output-dir=" + slicedir,
+		"-tags-per-file=2",
+		tmpdir + "/library0.gob",
+		tmpdir + "/library1.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	npydir := c.MkDir()
+	exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+		"-local=true",
+		"-input-dir=" + slicedir,
+		"-output-dir=" + npydir,
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(npydir + "/ploidy.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(output), check.Equals, "# genome,sequence,ploidy\ninput2,chr2,1\n")
+	vcfdir := c.MkDir()
+	exited = (&anno2vcf{}).RunCommand("anno2vcf", []string{
+		"-local=true",
+		"-input-dir=" + npydir,
+		"-output-dir=" + vcfdir,
+		"-genotypes",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(vcfdir + "/annotations.chr2.vcf")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", output)
+	c.Check(string(output), check.Matches, `(?ms).*\nchr2\t125\t[^\n]*\tGT\t0\|0\t1\n.*`)
+	output, err = ioutil.ReadFile(vcfdir + "/annotations.chr1.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(string(output), check.Not(check.Matches), `(?ms).*\tGT\t[01.]\t.*`)
+}
+
+func (s *exportSuite) TestHaploidFlag(c *check.C) {
+	tmpdir := c.MkDir()
+	err := exec.Command("cp", "testdata/pipeline1/input1.1.fasta", tmpdir+"/hap1.1.fasta").Run()
+	c.Assert(err, check.IsNil)
+	args := []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-o", tmpdir + "/library.gob",
+		tmpdir + "/hap1.1.fasta",
+	}
+	// hap1.2.fasta is missing, and the genome is not declared
+	// haploid.
+	exited := (&importer{}).RunCommand("import", args, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Not(check.Equals), 0)
+
+	exited = (&importer{}).RunCommand("import", append([]string{"-haploid"}, args...), nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	err = ioutil.WriteFile(tmpdir+"/ploidy.csv", []byte("hap1,*,1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exited = (&importer{}).RunCommand("import", append([]string{"-ploidy", tmpdir + "/ploidy.csv"}, args...), nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	f, err := os.Open(tmpdir + "/library.gob")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	var cgs []CompactGenome
+	err = DecodeLibrary(f, false, func(ent *LibraryEntry) error {
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Ploidy, check.DeepEquals, map[string]int{"chr1": 1, "chr2": 1})
+}
+
+func (s *exportSuite) TestPloidySpec(c *check.C) {
+	spec := ploidySpec{
+		"*":      {"chrM": 1},
+		"male1":  {"chrX": 1, "chrY": 1},
+		"yeast1": {"*": 1},
+	}
+	c.Check(spec.ploidy("female1", "chrX"), check.Equals, 2)
+	c.Check(spec.ploidy("female1", "chrM"), check.Equals, 1)
+	c.Check(spec.ploidy("male1", "chrX"), check.Equals, 1)
+	c.Check(spec.ploidy("male1", "chrM"), check.Equals, 1)
+	c.Check(spec.ploidy("male1", "chr1"), check.Equals, 2)
+	c.Check(spec.ploidy("yeast1", "chrIV"), check.Equals, 1)
+	c.Check(flatten([][]tileVariantID{{1, 2, 0, 3}}), check.DeepEquals, []tileVariantID{1, 1, 2, 2, 0, 0, 3, 3})
+	c.Check(flatten([][]tileVariantID{{1, 2}, {3}}), check.DeepEquals, []tileVariantID{1, 3, 2, 0})
+}
+
+func (s *exportSuite) TestUnphased(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/test.vcf", []byte(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample1
+chr1	10	.	A	G	.	PASS	.	GT	1|0
+chr1	20	.	A	G	.	PASS	.	GT:DP	1/1:12
+chr2	10	.	A	G	.	PASS	.	DP:GT	9:0/1
+chrX	10	.	A	G	.	PASS	.	GT	1
+chrY	10	.	A	G	.	PASS	.	GT	./1
+`), 0644)
+	c.Assert(err, check.IsNil)
+	unphased, phased, err := vcfPhasing(tmpdir + "/test.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(unphased, check.DeepEquals, map[string]bool{"chr2": true})
+	c.Check(phased, check.DeepEquals, map[string]bool{"chr1": true})
+
+	// Genotypes of a second sample would be ignored, so
+	// multi-sample input is rejected.
+	err = ioutil.WriteFile(tmpdir+"/multi.vcf", []byte(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample1	sample2
+chr1	10	.	A	G	.	PASS	.	GT	1|1	0/1
+`), 0644)
+	c.Assert(err, check.IsNil)
+	_, _, err = vcfPhasing(tmpdir + "/multi.vcf")
+	c.Check(err, check.ErrorMatches, `.*multi-sample VCF \(2 samples\)`)
+
+	varslice := []tvVariant{
+		{Variant: hgvs.Variant{Position: 100, Ref: "C", New: "T"}, unphased: true},
+		{Variant: hgvs.Variant{Position: 100}, unphased: true},
+		{Variant: hgvs.Variant{Position: 100, Ref: "C", New: "T"}},
+		{Variant: hgvs.Variant{Position: 100}},
+	}
+	var buf bytes.Buffer
+	err = formatPVCF{}.Print(&buf, "chr1", varslice)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, "chr1\t100\t.\tC\tT\t.\t.\t.\tGT\t0/1\t1|0\n")
+
+	buf.Reset()
+	err = formatHGVS{}.Print(&buf, "chr1", varslice)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, "chr1:g.[100=](;)[100C>T]\tchr1:g.[100C>T];[100=]\n")
+}
@@ -0,0 +1,248 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportGFA writes the tile library as a GFA 1.1 graph:
+//
+// One S (segment) line for each tile variant, named "{tag}-{variant}",
+// with the trailing tag removed so consecutive segments in a walk
+// concatenate to the original sequence with no overlap.
+//
+// One L (link) line for each pair of adjacent tile variants observed
+// in the reference or in any genome. A spanning tile links directly
+// to the tile variant at its end tag, skipping the tags in between.
+//
+// One W (walk) line for each contiguous run of tiles on each
+// reference sequence and each genome haplotype.
+func (cmd *exporter) exportGFA(outdir string, tilelib *tileLibrary, refname string, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+	fnm := filepath.Join(outdir, "out.gfa")
+	if cmd.compress {
+		fnm += ".gz"
+	}
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Infof("writing %q", fnm)
+	var out io.WriteCloser = nopCloser{f}
+	if cmd.compress {
+		out = pgzip.NewWriter(f)
+	}
+	bufw := bufio.NewWriterSize(out, 8*1024*1024)
+	g := gfaGraph{
+		tilelib: tilelib,
+		taglen:  tilelib.taglib.TagLen(),
+		tag2id:  map[string]tagID{},
+		links:   map[[2]tileLibRef]bool{},
+	}
+	for id, tagseq := range tilelib.taglib.Tags() {
+		g.tag2id[strings.ToLower(string(tagseq))] = tagID(id)
+	}
+	err = g.write(bufw, trimFilenameForLabel(refname), refseq, cgs)
+	if err != nil {
+		return err
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type gfaGraph struct {
+	tilelib *tileLibrary
+	taglen  int
+	tag2id  map[string]tagID
+	links   map[[2]tileLibRef]bool
+}
+
+// endTag returns the tag at the end of the given tile variant, or -1
+// if the tile variant does not end with a tag (e.g., it is the last
+// tile on a chromosome, or its sequence is not known).
+func (g *gfaGraph) endTag(libref tileLibRef) tagID {
+	seq := g.tilelib.TileVariantSequence(libref)
+	if len(seq) < g.taglen*2 {
+		return -1
+	}
+	if id, ok := approxTagID(g.tag2id, bytes.ToLower(seq[len(seq)-g.taglen:]), g.tilelib.TileVariantApproxEndTag(libref, g.taglen)); ok && id > libref.Tag {
+		return id
+	}
+	return -1
+}
+
+func (g *gfaGraph) segmentName(libref tileLibRef) string {
+	return fmt.Sprintf("%d-%d", libref.Tag, libref.Variant)
+}
+
+// segmentSeq returns the tile variant sequence with its end tag (if
+// any) removed, or nil if the sequence is not known.
+func (g *gfaGraph) segmentSeq(libref tileLibRef) []byte {
+	seq := g.tilelib.TileVariantSequence(libref)
+	if g.endTag(libref) >= 0 {
+		seq = seq[:len(seq)-g.taglen]
+	}
+	return seq
+}
+
+func (g *gfaGraph) write(out io.Writer, refname string, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+	_, err := fmt.Fprint(out, "H\tVN:Z:1.1\n")
+	if err != nil {
+		return err
+	}
+
+	log.Info("gfa: writing segments")
+	for tag, variants := range g.tilelib.variant {
+		for v := range variants {
+			libref := tileLibRef{Tag: tagID(tag), Variant: tileVariantID(v + 1)}
+			seq := g.segmentSeq(libref)
+			if len(seq) == 0 {
+				_, err = fmt.Fprintf(out, "S\t%s\t*\n", g.segmentName(libref))
+			} else {
+				_, err = fmt.Fprintf(out, "S\t%s\t%s\tLN:i:%d\n", g.segmentName(libref), strings.ToUpper(string(seq)), len(seq))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("gfa: computing links")
+	g.eachWalk(refname, refseq, cgs, func(sample string, hap int, seqname string, walk []tileLibRef) error {
+		for i := 1; i < len(walk); i++ {
+			g.links[[2]tileLibRef{walk[i-1], walk[i]}] = true
+		}
+		return nil
+	})
+	log.Infof("gfa: writing %d links", len(g.links))
+	links := make([][2]tileLibRef, 0, len(g.links))
+	for link := range g.links {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		for k := 0; k < 2; k++ {
+			if links[i][k].Tag != links[j][k].Tag {
+				return links[i][k].Tag < links[j][k].Tag
+			} else if links[i][k].Variant != links[j][k].Variant {
+				return links[i][k].Variant < links[j][k].Variant
+			}
+		}
+		return false
+	})
+	for _, link := range links {
+		_, err = fmt.Fprintf(out, "L\t%s\t+\t%s\t+\t0M\n", g.segmentName(link[0]), g.segmentName(link[1]))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("gfa: writing walks")
+	return g.eachWalk(refname, refseq, cgs, func(sample string, hap int, seqname string, walk []tileLibRef) error {
+		// Walk coordinates are offsets into the concatenated
+		// (end-tag-trimmed) tile sequences.
+		var path strings.Builder
+		seqlen := 0
+		for _, libref := range walk {
+			path.WriteString(">")
+			path.WriteString(g.segmentName(libref))
+			seqlen += len(g.segmentSeq(libref))
+		}
+		_, err := fmt.Fprintf(out, "W\t%s\t%d\t%s\t0\t%d\t%s\n", sample, hap, seqname, seqlen, path.String())
+		return err
+	})
+}
+
+// eachWalk calls fn for each contiguous run of tiles on each
+// reference sequence (hap=0) and each genome haplotype (hap=1 or 2).
+//
+// A genome walk follows each tile variant to the tag at its end, so
+// a spanning tile is followed directly by the tile at the tag it
+// spans to. The walk ends when the genome has no tile variant at
+// that tag, or the end tag is unknown.
+//
+// A genome has no hap=2 walks on sequences where it is haploid (see
+// CompactGenome.Ploidy).
+func (g *gfaGraph) eachWalk(refname string, refseq map[string][]tileLibRef, cgs []CompactGenome, fn func(sample string, hap int, seqname string, walk []tileLibRef) error) error {
+	var seqnames []string
+	for seqname := range refseq {
+		seqnames = append(seqnames, seqname)
+	}
+	sort.Strings(seqnames)
+
+	// tag2seqname[tag] is the reference sequence where the
+	// given tag is placed, used to label genome walks.
+	tag2seqname := map[tagID]string{}
+	for _, seqname := range seqnames {
+		walk := refseq[seqname]
+		for _, libref := range walk {
+			tag2seqname[libref.Tag] = seqname
+		}
+		if len(walk) == 0 {
+			continue
+		}
+		err := fn(refname, 0, seqname, walk)
+		if err != nil {
+			return err
+		}
+	}
+
+	var walk []tileLibRef
+	for _, cg := range cgs {
+		for phase := 0; phase < 2; phase++ {
+			variantAt := func(tag tagID) tileVariantID {
+				if phase == 1 && cg.ploidy(tag2seqname[tag]) == 1 {
+					return 0
+				}
+				if i := int(tag-cg.StartTag)*2 + phase; tag >= cg.StartTag && i < len(cg.Variants) {
+					return cg.Variants[i]
+				}
+				return 0
+			}
+			ntags := tagID(len(cg.Variants)/2) + cg.StartTag
+			for tag := cg.StartTag; tag < ntags; tag++ {
+				if variantAt(tag) == 0 {
+					continue
+				}
+				walk = walk[:0]
+				for {
+					libref := tileLibRef{Tag: tag, Variant: variantAt(tag)}
+					walk = append(walk, libref)
+					next := g.endTag(libref)
+					if next < 0 || next >= ntags || variantAt(next) == 0 {
+						break
+					}
+					tag = next
+				}
+				seqname := tag2seqname[walk[0].Tag]
+				if seqname == "" {
+					seqname = "unplaced"
+				}
+				err := fn(trimFilenameForLabel(cg.Name), phase+1, seqname, walk)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -5,7 +5,6 @@
 package lightning
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -25,7 +24,6 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/arvados/lightning/hgvs"
 	"github.com/kshedden/gonpy"
-	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -234,12 +232,18 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 			for row, name := range names {
 				cg := tilelib.compactGenomes[name]
 				rowstart := row * len(pdis) * 2
+				// A hemizygous call has one copy of
+				// the variant, in the first column.
+				nphases := 2
+				if tilelib.cgmeta[name].Ploidy[seqname] == 1 {
+					nphases = 1
+				}
 				for col, pdi := range pdis {
 					for _, libref := range pdivars[pdi] {
 						if len(cg) <= int(libref.Tag)*2+1 {
 							continue
 						}
-						for phase := 0; phase < 2; phase++ {
+						for phase := 0; phase < nphases; phase++ {
 							if cg[int(libref.Tag)*2+phase] == libref.Variant {
 								data[rowstart+col*2+phase] = 1
 							}
@@ -287,28 +291,15 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 		if tagend > len(tilelib.variant) {
 			tagend = len(tilelib.variant)
 		}
-		out, rows, cols := cgs2array(tilelib, names, lowqual, dropTiles, tagstart, tagend)
+		out := cgs2array(tilelib, names, lowqual, dropTiles, tagstart, tagend)
 
-		var npw *gonpy.NpyWriter
-		var output io.WriteCloser
 		fnm := *outputDir + "/matrix.npy"
 		if *chunks > 1 {
 			fnm = fmt.Sprintf("%s/matrix.%d.npy", *outputDir, chunk)
 		}
-		output, err = os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY, 0777)
-		if err != nil {
-			return 1
-		}
-		defer output.Close()
-		bufw := bufio.NewWriter(output)
-		npw, err = gonpy.NewWriter(nopCloser{bufw})
-		if err != nil {
-			return 1
-		}
 		if *onehot {
 			log.Info("recoding to onehot")
-			recoded, librefs, recodedcols := recodeOnehot(out, cols)
-			out, cols = recoded, recodedcols
+			recoded, librefs, recodedcols := recodeOnehot(out)
 			if *librefsFilename != "" {
 				log.Infof("writing onehot column mapping")
 				err = cmd.writeLibRefs(*librefsFilename, tilelib, librefs)
@@ -316,19 +307,10 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 					return 1
 				}
 			}
+			err = writeNumpyInt16(fnm, recoded, out.rows, recodedcols)
+		} else {
+			err = out.writeNumpy(fnm)
 		}
-		log.WithFields(logrus.Fields{
-			"filename": fnm,
-			"rows":     rows,
-			"cols":     cols,
-		}).Info("writing numpy")
-		npw.Shape = []int{rows, cols}
-		npw.WriteInt16(out)
-		err = bufw.Flush()
-		if err != nil {
-			return 1
-		}
-		err = output.Close()
 		if err != nil {
 			return 1
 		}
@@ -378,14 +360,19 @@ func lowqual(tilelib *tileLibrary) (lowqual []map[tileVariantID]bool) {
 	return
 }
 
-func cgs2array(tilelib *tileLibrary, names []string, lowqual []map[tileVariantID]bool, dropTiles []bool, tagstart, tagend int) (data []int16, rows, cols int) {
-	rows = len(tilelib.compactGenomes)
+// cgs2array returns a matrix with one row per genome and two columns
+// per tag. On haploid sequences (see CompactGenome.Ploidy), the
+// first column holds the single haplotype and the second is 0.
+func cgs2array(tilelib *tileLibrary, names []string, lowqual []map[tileVariantID]bool, dropTiles []bool, tagstart, tagend int) *variantMatrix {
+	haploid := tilelib.haploidFunc()
+	rows := len(tilelib.compactGenomes)
+	cols := 0
 	for tag := tagstart; tag < tagend; tag++ {
 		if len(dropTiles) <= tag || !dropTiles[tag] {
 			cols += 2
 		}
 	}
-	data = make([]int16, rows*cols)
+	data := newVariantMatrix(rows, cols)
 	for row, name := range names {
 		cg := tilelib.compactGenomes[name]
 		outidx := 0
@@ -395,16 +382,19 @@ func cgs2array(tilelib *tileLibrary, names []string, lowqual []map[tileVariantID
 			}
 			for phase := 0; phase < 2; phase++ {
 				v := cg[tag*2+phase]
+				if phase == 1 && haploid != nil && haploid(name, tag) {
+					v = 0
+				}
 				if v > 0 && lowqual[tag][v] {
-					data[row*cols+outidx] = -1
+					data.Set(row*cols+outidx, -1)
 				} else {
-					data[row*cols+outidx] = int16(v)
+					data.Set(row*cols+outidx, int(v))
 				}
 				outidx++
 			}
 		}
 	}
-	return
+	return data
 }
 
 func makeMask(regionsFilename string, expandRegions int) (*mask, error) {
@@ -437,15 +427,11 @@ func makeMask(regionsFilename string, expandRegions int) (*mask, error) {
 		end, err2 := strconv.Atoi(string(fields[2]))
 		if err1 == nil && err2 == nil {
 			// BED
+		} else if rec, err := parseGFFLine(line); err == nil {
+			// GFF/GTF
+			start, end = rec.start, rec.end+1
 		} else {
-			start, err1 = strconv.Atoi(string(fields[3]))
-			end, err2 = strconv.Atoi(string(fields[4]))
-			if err1 == nil && err2 == nil {
-				// GFF/GTF
-				end++
-			} else {
-				return nil, fmt.Errorf("cannot parse input line as BED or GFF/GTF: %q", line)
-			}
+			return nil, fmt.Errorf("cannot parse input line as BED or GFF/GTF: %q", line)
 		}
 		mask.Add(refseqname, start-expandRegions, end+expandRegions)
 	}
@@ -517,12 +503,12 @@ func chooseTiles(tilelib *tileLibrary, regionsFilename string, expandRegions int
 	return
 }
 
-func recodeOnehot(in []int16, incols int) (out []int16, librefs []tileLibRef, outcols int) {
-	rows := len(in) / incols
-	maxvalue := make([]int16, incols)
+func recodeOnehot(in *variantMatrix) (out []int16, librefs []tileLibRef, outcols int) {
+	rows, incols := in.rows, in.cols
+	maxvalue := make([]int, incols)
 	for row := 0; row < rows; row++ {
 		for col := 0; col < incols; col++ {
-			if v := in[row*incols+col]; maxvalue[col] < v {
+			if v := in.At(row*incols + col); maxvalue[col] < v {
 				maxvalue[col] = v
 			}
 		}
@@ -534,7 +520,7 @@ func recodeOnehot(in []int16, incols int) (out []int16, librefs []tileLibRef, ou
 		if maxv == 0 {
 			dropped++
 		}
-		for v := 1; v <= int(maxv); v++ {
+		for v := 1; v <= maxv; v++ {
 			librefs = append(librefs, tileLibRef{Tag: tagID(incol), Variant: tileVariantID(v)})
 			outcols++
 		}
@@ -545,8 +531,8 @@ func recodeOnehot(in []int16, incols int) (out []int16, librefs []tileLibRef, ou
 	for inidx, row := 0, 0; row < rows; row++ {
 		outrow := out[row*outcols:]
 		for col := 0; col < incols; col++ {
-			if v := in[inidx]; v > 0 {
-				outrow[outcol[col]+int(v)-1] = 1
+			if v := in.At(inidx); v > 0 {
+				outrow[outcol[col]+v-1] = 1
 			}
 			inidx++
 		}
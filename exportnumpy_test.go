@@ -87,8 +87,43 @@ func (s *exportNumpySuite) TestOnehot(c *check.C) {
 			},
 		},
 	} {
-		out, _, outcols := recodeOnehot(trial.in, trial.incols)
+		in := &variantMatrix{rows: len(trial.in) / trial.incols, cols: trial.incols, int16s: trial.in}
+		out, _, outcols := recodeOnehot(in)
 		c.Check(out, check.DeepEquals, trial.out)
 		c.Check(outcols, check.Equals, trial.outcols)
 	}
 }
+
+func (s *exportNumpySuite) TestVariantMatrixWiden(c *check.C) {
+	tmpdir := c.MkDir()
+	m := newVariantMatrix(2, 2)
+	m.Set(0, 1)
+	m.Set(3, -1)
+	c.Check(m.int32s, check.IsNil)
+	err := m.writeNumpy(tmpdir + "/narrow.npy")
+	c.Assert(err, check.IsNil)
+	m.Set(1, 40000)
+	c.Check(m.int16s, check.IsNil)
+	err = m.writeNumpy(tmpdir + "/wide.npy")
+	c.Assert(err, check.IsNil)
+
+	for fnm, expect := range map[string][]int{
+		"narrow.npy": {1, 0, 0, -1},
+		"wide.npy":   {1, 40000, 0, -1},
+	} {
+		loaded, err := loadVariantMatrix(tmpdir + "/" + fnm)
+		c.Assert(err, check.IsNil)
+		c.Check(loaded.int32s == nil, check.Equals, fnm == "narrow.npy")
+		var got []int
+		for i := 0; i < loaded.Len(); i++ {
+			got = append(got, loaded.At(i))
+		}
+		c.Check(got, check.DeepEquals, expect, check.Commentf("%s", fnm))
+	}
+
+	merged := newVariantMatrix(2, 4)
+	merged.copyFrom(0, m, 0, 2)
+	merged.copyFrom(4, m, 2, 2)
+	c.Check(merged.At(1), check.Equals, 40000)
+	c.Check(merged.At(5), check.Equals, -1)
+}
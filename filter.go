@@ -12,96 +12,425 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	log "github.com/sirupsen/logrus"
 )
 
 type filter struct {
-	MaxVariants int
-	MinCoverage float64
-	MaxTag      int
-	MatchGenome string
+	MaxVariants       int
+	MinCoverage       float64
+	MaxTag            int
+	MatchGenome       string
+	MinCallRate       float64
+	MinMinorFrequency float64
+	HWEPValue         float64
+	HWEControls       string
+	MaxTileLength     int
+	MaxNoCallFraction float64
+	ReportFile        string
+
+	report filterReport
 }
 
 func (f *filter) Flags(flags *flag.FlagSet) {
 	flags.IntVar(&f.MaxVariants, "max-variants", -1, "drop tiles with more than `N` variants")
-	flags.Float64Var(&f.MinCoverage, "min-coverage", 0, "drop tiles with coverage less than `P` across all haplotypes (0 < P ≤ 1)")
+	flags.Float64Var(&f.MinCoverage, "min-coverage", 0, "drop tiles with coverage less than or equal to `P` across all haplotypes (0 < P < 1)")
 	flags.IntVar(&f.MaxTag, "max-tag", -1, "drop tiles with tag ID > `N`")
 	flags.StringVar(&f.MatchGenome, "match-genome", "", "keep genomes whose names contain `regexp`, drop the rest")
+	flags.Float64Var(&f.MinCallRate, "min-call-rate", 0, "drop genomes with tile variants called at less than `P` of tile positions (0 < P ≤ 1, computed before other filters)")
+	flags.Float64Var(&f.MinMinorFrequency, "min-minor-frequency", 0, "drop tiles where variants other than the most common one account for less than `P` of called haplotypes")
+	flags.Float64Var(&f.HWEPValue, "hwe-p-value", 0, "drop tile variants whose Hardy-Weinberg equilibrium exact test p-value in controls is below `P`")
+	flags.StringVar(&f.HWEControls, "hwe-controls", "", "`file` listing control sample IDs for -hwe-p-value, one per line (default: all genomes)")
+	flags.IntVar(&f.MaxTileLength, "max-tile-length", -1, "drop tile variants longer than `N` bases")
+	flags.Float64Var(&f.MaxNoCallFraction, "max-nocall-fraction", 1, "drop tile variants with more than `P` no-call bases (0 ≤ P < 1)")
+	flags.StringVar(&f.ReportFile, "filter-report", "", "write a report of what each filter removed to `file` (json)")
 }
 
+// Args returns command line arguments that reproduce the current
+// filter settings. In container mode, the caller is responsible for
+// translating f.HWEControls first, and the report (if any) is
+// written to the container's output directory.
 func (f *filter) Args() []string {
-	return []string{
+	args := []string{
 		fmt.Sprintf("-max-variants=%d", f.MaxVariants),
-		fmt.Sprintf("-min-coverage=%f", f.MinCoverage),
+		fmt.Sprintf("-min-coverage=%g", f.MinCoverage),
 		fmt.Sprintf("-max-tag=%d", f.MaxTag),
 		fmt.Sprintf("-match-genome=%s", f.MatchGenome),
+		fmt.Sprintf("-min-call-rate=%g", f.MinCallRate),
+		fmt.Sprintf("-min-minor-frequency=%g", f.MinMinorFrequency),
+		fmt.Sprintf("-hwe-p-value=%g", f.HWEPValue),
+		fmt.Sprintf("-hwe-controls=%s", f.HWEControls),
+		fmt.Sprintf("-max-tile-length=%d", f.MaxTileLength),
+		fmt.Sprintf("-max-nocall-fraction=%g", f.MaxNoCallFraction),
+	}
+	if f.ReportFile != "" {
+		args = append(args, "-filter-report=/mnt/output/filter-report.json")
 	}
+	return args
 }
 
-func (f *filter) Apply(tilelib *tileLibrary) {
-	// Zero out variants at tile positions that have more than
-	// f.MaxVariants tile variants.
-	if f.MaxVariants >= 0 {
-		for tag, variants := range tilelib.variant {
-			if f.MaxTag >= 0 && tag >= f.MaxTag {
-				break
+// filterReport records what each filter removed. Maps are keyed by
+// filter (flag) name.
+type filterReport struct {
+	// Tags where all calls were dropped
+	Tags map[string]int
+	// Tile variants whose calls were dropped
+	TileVariants map[string]int
+	// Individual calls (one per haplotype) dropped by the tag and
+	// tile variant filters
+	Calls map[string]int
+	// Genomes dropped
+	Genomes map[string][]string
+
+	mtx sync.Mutex
+}
+
+func (r *filterReport) add(tags, tileVariants, calls int, filter string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.Tags == nil {
+		r.Tags = map[string]int{}
+		r.TileVariants = map[string]int{}
+		r.Calls = map[string]int{}
+	}
+	r.Tags[filter] += tags
+	r.TileVariants[filter] += tileVariants
+	r.Calls[filter] += calls
+}
+
+func (r *filterReport) addGenome(name, filter string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.Genomes == nil {
+		r.Genomes = map[string][]string{}
+	}
+	r.Genomes[filter] = append(r.Genomes[filter], name)
+}
+
+// writeReport logs a summary of the filter report, and writes the
+// full report to f.ReportFile if specified.
+func (f *filter) writeReport() error {
+	r := &f.report
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for name, n := range r.Tags {
+		log.Infof("filter %s: dropped %d tags, %d tile variants, %d calls", name, n, r.TileVariants[name], r.Calls[name])
+	}
+	for name, genomes := range r.Genomes {
+		log.Infof("filter %s: dropped %d genomes", name, len(genomes))
+	}
+	if f.ReportFile == "" {
+		return nil
+	}
+	for _, genomes := range r.Genomes {
+		sort.Strings(genomes)
+	}
+	return writeJSONFile(f.ReportFile, r)
+}
+
+// loadHWEControls returns a function that reports whether the named
+// genome is a control for the purpose of the HWE test.
+func (f *filter) loadHWEControls() (func(name string) bool, error) {
+	if f.HWEControls == "" {
+		return func(string) bool { return true }, nil
+	}
+	ids, err := readSampleIDs(f.HWEControls)
+	if err != nil {
+		return nil, err
+	}
+	controls := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		controls[id] = true
+	}
+	return func(name string) bool {
+		return controls[name] || controls[trimFilenameForLabel(name)]
+	}, nil
+}
+
+// lowCallRate returns true if a genome with the given number of
+// called haplotypes at ntags tags should be dropped by the
+// -min-call-rate filter.
+func (f *filter) lowCallRate(called, ntags int) bool {
+	return f.MinCallRate > 0 && float64(called) < f.MinCallRate*float64(ntags*2)
+}
+
+// tagFilters returns true if any of the filters handled by applyTag
+// are enabled.
+func (f *filter) tagFilters() bool {
+	return f.MaxTileLength >= 0 || f.MaxNoCallFraction < 1 || f.MinMinorFrequency > 0 || f.HWEPValue > 0
+}
+
+// applyTag applies the tile variant and tag filters to the calls at
+// a single tag. calls[i*2] and calls[i*2+1] are the variants called
+// for genome i; filtered calls are set to 0. noCalls returns the
+// length of a tile variant and the number of no-call bases in it, or
+// a zero length if unknown (in which case the length and no-call
+// filters don't apply). isControl[i] indicates whether genome i is a
+// control for the HWE test. haploid[i] (if haploid is not nil)
+// indicates genome i is haploid at this tag: its hemizygous call is
+// stored as v,v, so it is left out of the HWE test.
+func (f *filter) applyTag(calls []tileVariantID, noCalls func(tileVariantID) (length, nocalls int), isControl []bool, haploid []bool) {
+	dropVariant := func(drop tileVariantID, filter string) {
+		n := 0
+		for i, v := range calls {
+			if v == drop {
+				calls[i] = 0
+				n++
 			}
-			if len(variants) <= f.MaxVariants {
+		}
+		f.report.add(0, 1, n, filter)
+	}
+
+	if f.MaxTileLength >= 0 || f.MaxNoCallFraction < 1 {
+		checked := map[tileVariantID]bool{}
+		for _, v := range calls {
+			if v == 0 || checked[v] {
 				continue
 			}
-			for _, cg := range tilelib.compactGenomes {
-				if len(cg) > tag*2 {
-					cg[tag*2] = 0
-					cg[tag*2+1] = 0
-				}
+			checked[v] = true
+			length, nocalls := noCalls(v)
+			if length == 0 {
+				continue
+			}
+			if f.MaxTileLength >= 0 && length > f.MaxTileLength {
+				dropVariant(v, "max-tile-length")
+			} else if f.MaxNoCallFraction < 1 && float64(nocalls) > f.MaxNoCallFraction*float64(length) {
+				dropVariant(v, "max-nocall-fraction")
 			}
 		}
 	}
 
-	// Zero out variants at tile positions that have less than
-	// f.MinCoverage.
-	mincov := int(2*f.MinCoverage*float64(len(tilelib.compactGenomes)) + 1)
-TAG:
-	for tag := 0; tag < len(tilelib.variant) && (tag < f.MaxTag || f.MaxTag < 0); tag++ {
-		tagcov := 0
-		for _, cg := range tilelib.compactGenomes {
-			if len(cg) < tag*2+2 {
+	if f.MinMinorFrequency > 0 {
+		count := map[tileVariantID]int{}
+		called, maxcount := 0, 0
+		for _, v := range calls {
+			if v == 0 {
 				continue
 			}
-			if cg[tag*2] > 0 {
-				tagcov++
+			called++
+			count[v]++
+			if maxcount < count[v] {
+				maxcount = count[v]
 			}
-			if cg[tag*2+1] > 0 {
-				tagcov++
+		}
+		if called > 0 && float64(called-maxcount) < f.MinMinorFrequency*float64(called) {
+			for i := range calls {
+				calls[i] = 0
 			}
-			if tagcov >= mincov {
-				continue TAG
+			f.report.add(1, len(count), called, "min-minor-frequency")
+			return
+		}
+	}
+
+	if f.HWEPValue > 0 {
+		// Genotype counts in diploid controls with both
+		// haplotypes called: hom[v] = v/v, het[v] = v/other.
+		hom := map[tileVariantID]int{}
+		het := map[tileVariantID]int{}
+		genotypes := 0
+		for i := 0; i*2+1 < len(calls); i++ {
+			a, b := calls[i*2], calls[i*2+1]
+			if !isControl[i] || a == 0 || b == 0 || (haploid != nil && haploid[i]) {
+				continue
+			}
+			genotypes++
+			if a == b {
+				hom[a]++
+			} else {
+				het[a]++
+				het[b]++
+			}
+		}
+		var drop []tileVariantID
+		for v := range het {
+			if hweExactPValue(het[v], hom[v], genotypes-het[v]-hom[v]) < f.HWEPValue {
+				drop = append(drop, v)
 			}
 		}
-		for _, cg := range tilelib.compactGenomes {
-			if len(cg) > tag*2 {
-				cg[tag*2] = 0
-				cg[tag*2+1] = 0
+		for v := range hom {
+			if het[v] == 0 && hweExactPValue(0, hom[v], genotypes-hom[v]) < f.HWEPValue {
+				drop = append(drop, v)
 			}
 		}
+		for _, v := range drop {
+			dropVariant(v, "hwe-p-value")
+		}
+	}
+}
+
+// hweExactPValue returns the p-value of the exact test for
+// Hardy-Weinberg equilibrium (Wigginton, Cutler, and Abecasis 2005)
+// given the number of heterozygous and homozygous genotypes.
+func hweExactPValue(hets, hom1, hom2 int) float64 {
+	if hom1 < hom2 {
+		hom1, hom2 = hom2, hom1
+	}
+	n := hets + hom1 + hom2
+	rare := hom2*2 + hets
+	if n == 0 || rare == 0 {
+		return 1
+	}
+	// probs[h] is proportional to the probability of h
+	// heterozygotes, given n genotypes and the observed allele
+	// counts. Start at the most likely value and work outward.
+	probs := make([]float64, rare+1)
+	mid := rare * (2*n - rare) / (2 * n)
+	if mid%2 != rare%2 {
+		mid++
+	}
+	probs[mid] = 1
+	sum := 1.0
+	for h, homr, homc := mid, (rare-mid)/2, n-mid-(rare-mid)/2; h > 1; h, homr, homc = h-2, homr+1, homc+1 {
+		probs[h-2] = probs[h] * float64(h) * float64(h-1) / (4 * float64(homr+1) * float64(homc+1))
+		sum += probs[h-2]
+	}
+	for h, homr, homc := mid, (rare-mid)/2, n-mid-(rare-mid)/2; h <= rare-2; h, homr, homc = h+2, homr-1, homc-1 {
+		probs[h+2] = probs[h] * 4 * float64(homr) * float64(homc) / (float64(h+2) * float64(h+1))
+		sum += probs[h+2]
+	}
+	p := 0.0
+	for _, prob := range probs {
+		if prob <= probs[hets]*(1+1e-8) {
+			p += prob
+		}
 	}
+	return math.Min(1, p/sum)
+}
 
-	// Truncate genomes and tile data to f.MaxTag (TODO: truncate
-	// refseqs too)
+func (f *filter) Apply(tilelib *tileLibrary) error {
+	err := f.apply(tilelib.compactGenomes, len(tilelib.variant), func(tag int) int {
+		return len(tilelib.variant[tag])
+	}, tilelib.TileVariantNoCalls, tilelib.haploidFunc())
+	if err != nil {
+		return err
+	}
+	for name, cg := range tilelib.cgmeta {
+		variants, ok := tilelib.compactGenomes[name]
+		if !ok {
+			delete(tilelib.cgmeta, name)
+			continue
+		}
+		cg.Variants = variants
+		cg.trimImputed()
+		cg.Variants = nil
+		tilelib.cgmeta[name] = cg
+	}
+	// Truncate tile data and reference sequences to f.MaxTag
+	// (apply has already truncated the genomes)
 	if f.MaxTag >= 0 {
 		if len(tilelib.variant) > f.MaxTag {
 			tilelib.variant = tilelib.variant[:f.MaxTag]
 		}
-		for name, cg := range tilelib.compactGenomes {
+		for _, refseq := range tilelib.refseqs {
+			for seqname, librefs := range refseq {
+				keep := librefs[:0]
+				for _, libref := range librefs {
+					if int(libref.Tag) < f.MaxTag {
+						keep = append(keep, libref)
+					}
+				}
+				refseq[seqname] = keep
+			}
+		}
+	}
+	return nil
+}
+
+// apply applies all filters to cgs (genome name -> variants, 2 per
+// tag). ntags is the number of tags in the library, nvariants(tag)
+// is the number of tile variants at a tag, and noCalls returns the
+// length and number of no-call bases of a tile variant (or a zero
+// length if unknown). haploid (if not nil) reports whether the named
+// genome is haploid at the given tag (see haploidFunc).
+func (f *filter) apply(cgs map[string][]tileVariantID, ntags int, nvariants func(int) int, noCalls func(tileLibRef) (length, nocalls int), haploid func(name string, tag int) bool) error {
+	if f.MaxTag >= 0 && ntags > f.MaxTag {
+		ntags = f.MaxTag
+	}
+
+	// Call rates are computed before other filters drop any
+	// calls.
+	var lowCallRate []string
+	if f.MinCallRate > 0 {
+		for name, cg := range cgs {
+			called := 0
+			for i := 0; i < len(cg) && i < ntags*2; i++ {
+				if cg[i] > 0 {
+					called++
+				}
+			}
+			if f.lowCallRate(called, ntags) {
+				lowCallRate = append(lowCallRate, name)
+			}
+		}
+	}
+
+	// Zero out variants at tile positions that have more than
+	// f.MaxVariants tile variants.
+	if f.MaxVariants >= 0 {
+		for tag := 0; tag < ntags; tag++ {
+			if nvariants(tag) <= f.MaxVariants {
+				continue
+			}
+			calls := 0
+			for _, cg := range cgs {
+				if len(cg) > tag*2 {
+					calls += countNonzero(cg[tag*2 : tag*2+2])
+					cg[tag*2] = 0
+					cg[tag*2+1] = 0
+				}
+			}
+			f.report.add(1, nvariants(tag), calls, "max-variants")
+		}
+	}
+
+	// Zero out variants at tile positions that have less than
+	// f.MinCoverage. A tag is kept only if more than
+	// f.MinCoverage*2N haplotypes have calls, so a tag with
+	// coverage of exactly f.MinCoverage is dropped.
+	if f.MinCoverage > 0 {
+		mincov := int(2*f.MinCoverage*float64(len(cgs)) + 1)
+	TAG:
+		for tag := 0; tag < ntags; tag++ {
+			tagcov := 0
+			for _, cg := range cgs {
+				if len(cg) < tag*2+2 {
+					continue
+				}
+				tagcov += countNonzero(cg[tag*2 : tag*2+2])
+				if tagcov >= mincov {
+					continue TAG
+				}
+			}
+			if tagcov == 0 {
+				// nothing to drop
+				continue
+			}
+			for _, cg := range cgs {
+				if len(cg) > tag*2 {
+					cg[tag*2] = 0
+					cg[tag*2+1] = 0
+				}
+			}
+			f.report.add(1, 0, tagcov, "min-coverage")
+		}
+	}
+
+	// Truncate genomes to f.MaxTag (Apply truncates tile data and
+	// reference sequences too)
+	if f.MaxTag >= 0 {
+		for name, cg := range cgs {
 			if len(cg) > 2*f.MaxTag {
-				tilelib.compactGenomes[name] = cg[:2*f.MaxTag]
+				cgs[name] = cg[:2*f.MaxTag]
 			}
 		}
 	}
@@ -110,11 +439,150 @@ TAG:
 	if err != nil {
 		log.Errorf("invalid regexp %q does not match anything, dropping all genomes", f.MatchGenome)
 	}
-	for name := range tilelib.compactGenomes {
+	for name := range cgs {
 		if !re.MatchString(name) {
-			delete(tilelib.compactGenomes, name)
+			delete(cgs, name)
+			f.report.addGenome(name, "match-genome")
 		}
 	}
+
+	for _, name := range lowCallRate {
+		if _, ok := cgs[name]; ok {
+			delete(cgs, name)
+			f.report.addGenome(name, "min-call-rate")
+		}
+	}
+
+	if !f.tagFilters() {
+		return nil
+	}
+	isControlName, err := f.loadHWEControls()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(cgs))
+	for name := range cgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	isControl := make([]bool, len(names))
+	for i, name := range names {
+		isControl[i] = isControlName(name)
+	}
+	var haploidAtTag []bool
+	if haploid != nil {
+		haploidAtTag = make([]bool, len(names))
+	}
+	calls := make([]tileVariantID, len(names)*2)
+	for tag := 0; tag < ntags; tag++ {
+		for i, name := range names {
+			cg := cgs[name]
+			if len(cg) >= tag*2+2 {
+				copy(calls[i*2:], cg[tag*2:tag*2+2])
+			} else {
+				calls[i*2], calls[i*2+1] = 0, 0
+			}
+			if haploidAtTag != nil {
+				haploidAtTag[i] = haploid(name, tag)
+			}
+		}
+		f.applyTag(calls, func(v tileVariantID) (int, int) {
+			return noCalls(tileLibRef{Tag: tagID(tag), Variant: v})
+		}, isControl, haploidAtTag)
+		for i, name := range names {
+			if cg := cgs[name]; len(cg) >= tag*2+2 {
+				copy(cg[tag*2:tag*2+2], calls[i*2:])
+			}
+		}
+	}
+	return nil
+}
+
+// haploidFunc returns a function that reports whether the named
+// genome is haploid at the given tag, according to the genome's
+// ploidy (see CompactGenome.Ploidy) of the reference sequence where
+// the tag appears. It returns nil if no genome has a haploid
+// sequence.
+func haploidFunc(refseqs []tileSeq, ploidy map[string]map[string]int) func(name string, tag int) bool {
+	haveHaploid := false
+	for _, p := range ploidy {
+		for _, n := range p {
+			haveHaploid = haveHaploid || n == 1
+		}
+	}
+	if !haveHaploid {
+		return nil
+	}
+	tag2seqname := map[tagID]string{}
+	for _, refseq := range refseqs {
+		for seqname, librefs := range refseq {
+			for _, libref := range librefs {
+				tag2seqname[libref.Tag] = seqname
+			}
+		}
+	}
+	return func(name string, tag int) bool {
+		seqname, ok := tag2seqname[tagID(tag)]
+		return ok && ploidy[name][seqname] == 1
+	}
+}
+
+// lowCallRateGenomes returns the names of genomes (among the given
+// names) that fail the -min-call-rate filter, reading the library
+// one file at a time. Only the first ntags tags are considered.
+func (f *filter) lowCallRateGenomes(infiles []string, names map[string]bool, ntags int) (map[string]bool, error) {
+	var mtx sync.Mutex
+	called := map[string]int{}
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, infile := range infiles {
+		infile := infile
+		throttle.Go(func() error {
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+				for _, cg := range ent.CompactGenomes {
+					if !names[cg.Name] {
+						continue
+					}
+					n := 0
+					for i, v := range cg.Variants {
+						if v > 0 && int(cg.StartTag)+i/2 < ntags {
+							n++
+						}
+					}
+					mtx.Lock()
+					called[cg.Name] += n
+					mtx.Unlock()
+				}
+				return nil
+			})
+		})
+	}
+	err := throttle.Wait()
+	if err != nil {
+		return nil, err
+	}
+	low := map[string]bool{}
+	for name := range names {
+		if f.lowCallRate(called[name], ntags) {
+			low[name] = true
+			f.report.addGenome(name, "min-call-rate")
+		}
+	}
+	return low, nil
+}
+
+func countNonzero(variants []tileVariantID) int {
+	n := 0
+	for _, v := range variants {
+		if v > 0 {
+			n++
+		}
+	}
+	return n
 }
 
 type filtercmd struct {
@@ -169,17 +637,15 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 			VCPUs:       2,
 			Priority:    *priority,
 		}
-		err = runner.TranslatePaths(inputFilename)
+		err = runner.TranslatePaths(inputFilename, &cmd.HWEControls)
 		if err != nil {
 			return 1
 		}
 		runner.Args = []string{"filter", "-local=true",
 			"-i", *inputFilename,
 			"-o", "/mnt/output/library.gob",
-			"-max-variants", fmt.Sprintf("%d", cmd.MaxVariants),
-			"-min-coverage", fmt.Sprintf("%f", cmd.MinCoverage),
-			"-max-tag", fmt.Sprintf("%d", cmd.MaxTag),
 		}
+		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -189,6 +655,8 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 		return 0
 	}
 
+	prov := startProvenance(prog, args, *inputFilename)
+
 	var infile io.ReadCloser
 	if *inputFilename == "-" {
 		infile = ioutil.NopCloser(stdin)
@@ -200,7 +668,23 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 		defer infile.Close()
 	}
 	log.Print("reading")
-	cgs, err := ReadCompactGenomes(infile, strings.HasSuffix(*inputFilename, ".gz"))
+	var cgs []CompactGenome
+	var refseqs []tileSeq
+	tilenocalls := map[tileLibRef][2]int{}
+	err = DecodeLibrary(infile, strings.HasSuffix(*inputFilename, ".gz"), func(ent *LibraryEntry) error {
+		cgs = append(cgs, ent.CompactGenomes...)
+		for _, cseq := range ent.CompactSequences {
+			refseqs = append(refseqs, cseq.TileSequences)
+		}
+		if cmd.MaxTileLength >= 0 || cmd.MaxNoCallFraction < 1 {
+			for _, tv := range ent.TileVariants {
+				length, nocalls := tv.noCallCounts()
+				tilenocalls[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = [2]int{length, nocalls}
+			}
+		}
+		prov.addParents(ent.Provenance)
+		return nil
+	})
 	if err != nil {
 		return 1
 	}
@@ -212,57 +696,50 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 
 	log.Print("filtering")
 	ntags := 0
+	var maxvariant []int
+	genomes := make(map[string][]tileVariantID, len(cgs))
+	ploidy := map[string]map[string]int{}
 	for _, cg := range cgs {
+		ploidy[cg.Name] = cg.Ploidy
 		if ntags < len(cg.Variants)/2 {
 			ntags = len(cg.Variants) / 2
-		}
-		if cmd.MaxVariants < 0 {
-			continue
+			maxvariant = append(maxvariant, make([]int, ntags-len(maxvariant))...)
 		}
 		for idx, variant := range cg.Variants {
-			if variant > tileVariantID(cmd.MaxVariants) {
-				for _, cg := range cgs {
-					if len(cg.Variants) > idx {
-						cg.Variants[idx & ^1] = 0
-						cg.Variants[idx|1] = 0
-					}
-				}
+			if maxvariant[idx/2] < int(variant) {
+				maxvariant[idx/2] = int(variant)
 			}
 		}
+		genomes[cg.Name] = cg.Variants
 	}
-
-	if cmd.MaxTag >= 0 && ntags > cmd.MaxTag {
-		ntags = cmd.MaxTag
-		for i, cg := range cgs {
-			if len(cg.Variants) > cmd.MaxTag*2 {
-				cgs[i].Variants = cg.Variants[:cmd.MaxTag*2]
-			}
-		}
+	err = cmd.filter.apply(genomes, ntags, func(tag int) int {
+		return maxvariant[tag]
+	}, func(libref tileLibRef) (int, int) {
+		counts := tilenocalls[libref]
+		return counts[0], counts[1]
+	}, haploidFunc(refseqs, ploidy))
+	if err != nil {
+		return 1
 	}
-
-	if cmd.MinCoverage > 0 {
-		mincov := int(cmd.MinCoverage * float64(len(cgs)*2))
-		cov := make([]int, ntags)
-		for _, cg := range cgs {
-			for idx, variant := range cg.Variants {
-				if variant > 0 {
-					cov[idx>>1]++
-				}
-			}
-		}
-		for tag, c := range cov {
-			if c < mincov {
-				for _, cg := range cgs {
-					if len(cg.Variants) > tag*2 {
-						cg.Variants[tag*2] = 0
-						cg.Variants[tag*2+1] = 0
-					}
-				}
-			}
+	kept := cgs[:0]
+	for _, cg := range cgs {
+		if variants, ok := genomes[cg.Name]; ok {
+			cg.Variants = variants
+			cg.trimImputed()
+			kept = append(kept, cg)
 		}
 	}
-
+	cgs = kept
 	log.Print("filtering done")
+	err = cmd.filter.writeReport()
+	if err != nil {
+		return 1
+	}
+
+	p, err := prov.finish()
+	if err != nil {
+		return 1
+	}
 
 	var outfile io.WriteCloser
 	if *outputFilename == "-" {
@@ -279,6 +756,7 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 	log.Print("writing")
 	err = enc.Encode(LibraryEntry{
 		CompactGenomes: cgs,
+		Provenance:     []Provenance{p},
 	})
 	if err != nil {
 		return 1
@@ -0,0 +1,334 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/check.v1"
+)
+
+type filterSuite struct{}
+
+var _ = check.Suite(&filterSuite{})
+
+func (s *filterSuite) TestHWEExactPValue(c *check.C) {
+	c.Check(hweExactPValue(50, 25, 25) > 0.9, check.Equals, true)
+	c.Check(hweExactPValue(0, 50, 50) < 1e-20, check.Equals, true)
+	c.Check(hweExactPValue(100, 0, 0) < 1e-20, check.Equals, true)
+	c.Check(hweExactPValue(0, 0, 0), check.Equals, 1.0)
+	c.Check(hweExactPValue(0, 100, 0), check.Equals, 1.0)
+	// Order of homozygote counts doesn't matter
+	c.Check(hweExactPValue(10, 5, 30), check.Equals, hweExactPValue(10, 30, 5))
+	// p-values are never above 1, despite rounding errors
+	c.Check(hweExactPValue(12, 44, 44) <= 1, check.Equals, true)
+	p := hweExactPValue(30, 10, 10)
+	c.Check(p > 0.05 && p < 1, check.Equals, true, check.Commentf("p=%v", p))
+}
+
+func (s *filterSuite) TestApply(c *check.C) {
+	cgs := map[string][]tileVariantID{
+		"g1": {1, 1, 1, 2, 1, 1},
+		"g2": {1, 1, 1, 1, 1, 2},
+		"g3": {1, 1, 2, 2, 2, 4},
+		"g4": {1, 1, 1, 2, 3, 1},
+		"g5": {0, 0, 0, 0, 1, 0},
+	}
+	seq := func(libref tileLibRef) []byte {
+		if libref.Tag == 2 && libref.Variant == 3 {
+			return []byte(strings.Repeat("acgt", 10))
+		}
+		if libref.Tag == 2 && libref.Variant == 2 {
+			return []byte("acgtnnnn")
+		}
+		return []byte("acgtacgt")
+	}
+	f := filter{
+		MaxVariants:       -1,
+		MaxTag:            -1,
+		MinCallRate:       0.5,
+		MinMinorFrequency: 0.1,
+		MaxTileLength:     20,
+		MaxNoCallFraction: 0.25,
+	}
+	err := f.apply(cgs, 3, func(int) int { return 3 }, func(libref tileLibRef) (int, int) {
+		return sequenceNoCalls(seq(libref))
+	}, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, map[string][]tileVariantID{
+		"g1": {0, 0, 1, 2, 1, 1},
+		"g2": {0, 0, 1, 1, 1, 0},
+		"g3": {0, 0, 2, 2, 0, 4},
+		"g4": {0, 0, 1, 2, 0, 1},
+	})
+	c.Check(f.report.Genomes, check.DeepEquals, map[string][]string{"min-call-rate": {"g5"}})
+	c.Check(f.report.Tags["min-minor-frequency"], check.Equals, 1)
+	c.Check(f.report.Calls["min-minor-frequency"], check.Equals, 8)
+	c.Check(f.report.TileVariants["max-tile-length"], check.Equals, 1)
+	c.Check(f.report.Calls["max-tile-length"], check.Equals, 1)
+	c.Check(f.report.TileVariants["max-nocall-fraction"], check.Equals, 1)
+	c.Check(f.report.Calls["max-nocall-fraction"], check.Equals, 2)
+}
+
+func (s *filterSuite) TestMinCoverage(c *check.C) {
+	// Nobody has a call at tag 2, so there is nothing for
+	// -min-coverage to drop there.
+	cgs := map[string][]tileVariantID{
+		"g1": {1, 1, 1, 0, 0, 0},
+		"g2": {1, 1, 0, 0, 0, 0},
+	}
+	f := filter{MaxVariants: -1, MaxTag: -1, MaxTileLength: -1, MaxNoCallFraction: 1}
+	err := f.apply(cgs, 3, func(int) int { return 1 }, func(tileLibRef) (int, int) { return 0, 0 }, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs["g1"], check.DeepEquals, []tileVariantID{1, 1, 1, 0, 0, 0})
+	c.Check(f.report.Tags["min-coverage"], check.Equals, 0)
+
+	f.MinCoverage = 0.5
+	err = f.apply(cgs, 3, func(int) int { return 1 }, func(tileLibRef) (int, int) { return 0, 0 }, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs["g1"], check.DeepEquals, []tileVariantID{1, 1, 0, 0, 0, 0})
+	c.Check(f.report.Tags["min-coverage"], check.Equals, 1)
+	c.Check(f.report.Calls["min-coverage"], check.Equals, 1)
+
+	// With 2 genomes and P=0.5, a tag needs calls on more than 2
+	// of the 4 haplotypes.
+	cgs = map[string][]tileVariantID{
+		"g1": {1, 1, 1, 1, 1, 1},
+		"g2": {1, 1, 1, 0, 0, 0},
+	}
+	f.report = filterReport{}
+	err = f.apply(cgs, 3, func(int) int { return 1 }, func(tileLibRef) (int, int) { return 0, 0 }, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs["g1"], check.DeepEquals, []tileVariantID{1, 1, 1, 1, 0, 0})
+	c.Check(cgs["g2"], check.DeepEquals, []tileVariantID{1, 1, 1, 0, 0, 0})
+	c.Check(f.report.Tags["min-coverage"], check.Equals, 1)
+}
+
+func (s *filterSuite) TestHWE(c *check.C) {
+	tmpdir := c.MkDir()
+	// 20 genomes homozygous for variant 1, 20 homozygous for
+	// variant 2, none heterozygous. Half of each are controls.
+	var controls []string
+	cgs := map[string][]tileVariantID{}
+	for i := 0; i < 40; i++ {
+		name := string(rune('A'+i%20)) + string(rune('a'+i/20))
+		v := tileVariantID(1 + i/20)
+		cgs[name] = []tileVariantID{v, v, 1, 1}
+		if i%2 == 0 {
+			controls = append(controls, name)
+		}
+	}
+	err := ioutil.WriteFile(tmpdir+"/controls.txt", []byte(strings.Join(controls, "\n")+"\n"), 0666)
+	c.Assert(err, check.IsNil)
+	f := filter{
+		MaxVariants:       -1,
+		MaxTag:            -1,
+		MaxTileLength:     -1,
+		MaxNoCallFraction: 1,
+		HWEPValue:         1e-4,
+		HWEControls:       tmpdir + "/controls.txt",
+		ReportFile:        tmpdir + "/report.json",
+	}
+	err = f.apply(cgs, 2, func(int) int { return 2 }, func(tileLibRef) (int, int) { return 0, 0 }, nil)
+	c.Assert(err, check.IsNil)
+	for _, cg := range cgs {
+		c.Check(cg, check.DeepEquals, []tileVariantID{0, 0, 1, 1})
+	}
+	err = f.writeReport()
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadFile(tmpdir + "/report.json")
+	c.Assert(err, check.IsNil)
+	var report filterReport
+	err = json.Unmarshal(buf, &report)
+	c.Assert(err, check.IsNil)
+	c.Check(report.TileVariants["hwe-p-value"], check.Equals, 2)
+	c.Check(report.Calls["hwe-p-value"], check.Equals, 80)
+
+	// If the genomes are haploid at tag 0 (e.g., chrX in
+	// males), their calls are hemizygous, not homozygous, so
+	// they are left out of the HWE test.
+	ploidy := map[string]map[string]int{}
+	for i := 0; i < 40; i++ {
+		name := string(rune('A'+i%20)) + string(rune('a'+i/20))
+		v := tileVariantID(1 + i/20)
+		cgs[name] = []tileVariantID{v, v, 1, 1}
+		ploidy[name] = map[string]int{"chrX": 1}
+	}
+	haploid := haploidFunc([]tileSeq{{"chrX": {{Tag: 0, Variant: 1}}, "chr1": {{Tag: 1, Variant: 1}}}}, ploidy)
+	c.Check(haploid("Aa", 0), check.Equals, true)
+	c.Check(haploid("Aa", 1), check.Equals, false)
+	f.report = filterReport{}
+	err = f.apply(cgs, 2, func(int) int { return 2 }, func(tileLibRef) (int, int) { return 0, 0 }, haploid)
+	c.Assert(err, check.IsNil)
+	for name, cg := range cgs {
+		c.Check(cg[:2], check.DeepEquals, []tileVariantID{cg[0], cg[0]}, check.Commentf("%s", name))
+		c.Check(cg[0], check.Not(check.Equals), tileVariantID(0), check.Commentf("%s", name))
+	}
+	c.Check(f.report.Calls["hwe-p-value"], check.Equals, 0)
+	c.Check(haploidFunc(nil, map[string]map[string]int{"Aa": {"chrX": 2}}), check.IsNil)
+}
+
+func (s *filterSuite) TestFilterCommand(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&filtercmd{}).RunCommand("filter", []string{
+		"-local=true",
+		"-i", tmpdir + "/library.gob",
+		"-o", tmpdir + "/filtered.gob",
+		"-max-tile-length", "200",
+		"-filter-report", tmpdir + "/report.json",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	tilelen := map[tileLibRef]int{}
+	f, err := os.Open(tmpdir + "/library.gob")
+	c.Assert(err, check.IsNil)
+	err = DecodeLibrary(f, false, func(ent *LibraryEntry) error {
+		for _, tv := range ent.TileVariants {
+			tilelen[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = len(tv.Sequence)
+		}
+		return nil
+	})
+	f.Close()
+	c.Assert(err, check.IsNil)
+
+	var cgs []CompactGenome
+	f, err = os.Open(tmpdir + "/filtered.gob")
+	c.Assert(err, check.IsNil)
+	err = DecodeLibrary(f, false, func(ent *LibraryEntry) error {
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	f.Close()
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.HasLen, 2)
+	kept := 0
+	for _, cg := range cgs {
+		for i, v := range cg.Variants {
+			if v > 0 {
+				kept++
+				c.Check(tilelen[tileLibRef{Tag: tagID(i / 2), Variant: v}] <= 200, check.Equals, true)
+			}
+		}
+	}
+	c.Check(kept > 0, check.Equals, true)
+
+	buf, err := ioutil.ReadFile(tmpdir + "/report.json")
+	c.Assert(err, check.IsNil)
+	var report filterReport
+	err = json.Unmarshal(buf, &report)
+	c.Assert(err, check.IsNil)
+	c.Check(report.TileVariants["max-tile-length"] > 0, check.Equals, true)
+
+	exited = (&filtercmd{}).RunCommand("filter", []string{
+		"-local=true",
+		"-i", tmpdir + "/library.gob",
+		"-o", tmpdir + "/matched.gob",
+		"-match-genome", "input1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs = nil
+	f, err = os.Open(tmpdir + "/matched.gob")
+	c.Assert(err, check.IsNil)
+	err = DecodeLibrary(f, false, func(ent *LibraryEntry) error {
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	f.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Name, check.Matches, `.*input1.*`)
+}
+
+func (s *filterSuite) TestFlakeMaxTag(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"in", "out"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/in/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	// Tidy keeps tile variants used by reference sequences, so
+	// reference tiles past -max-tag are only dropped if the tile
+	// data is truncated.
+	exited = (&flakecmd{}).RunCommand("flake", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/in",
+		"-output-dir", tmpdir + "/out",
+		"-max-tag", "2",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	infiles, err := allFiles(tmpdir+"/out", matchGobFile)
+	c.Assert(err, check.IsNil)
+	var mtx sync.Mutex
+	var tags []tagID
+	var cgs []CompactGenome
+	err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, tv := range ent.TileVariants {
+			tags = append(tags, tv.Tag)
+		}
+		for _, cs := range ent.CompactSequences {
+			for _, librefs := range cs.TileSequences {
+				for _, libref := range librefs {
+					tags = append(tags, libref.Tag)
+				}
+			}
+		}
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tags, check.Not(check.HasLen), 0)
+	for _, tag := range tags {
+		c.Check(tag < 2, check.Equals, true, check.Commentf("tag %d", tag))
+	}
+	c.Check(cgs, check.HasLen, 2)
+	for _, cg := range cgs {
+		c.Check(len(cg.Variants) <= 4, check.Equals, true)
+	}
+}
+
+func (s *filterSuite) TestArgs(c *check.C) {
+	var f filter
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	f.Flags(flags)
+	err := flags.Parse([]string{
+		"-min-coverage=1e-7",
+		"-min-call-rate=2e-7",
+		"-min-minor-frequency=3e-7",
+		"-hwe-p-value=4e-7",
+		"-max-nocall-fraction=5e-7",
+	})
+	c.Assert(err, check.IsNil)
+	var g filter
+	flags = flag.NewFlagSet("", flag.ContinueOnError)
+	g.Flags(flags)
+	err = flags.Parse(f.Args())
+	c.Assert(err, check.IsNil)
+	c.Check(&g, check.DeepEquals, &f)
+}
@@ -64,7 +64,7 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			KeepCache:   2,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir)
+		err = runner.TranslatePaths(inputDir, &cmd.filter.HWEControls)
 		if err != nil {
 			return 1
 		}
@@ -72,10 +72,8 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-pprof", ":6060",
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
-			"-max-variants", fmt.Sprintf("%d", cmd.filter.MaxVariants),
-			"-min-coverage", fmt.Sprintf("%f", cmd.filter.MinCoverage),
-			"-max-tag", fmt.Sprintf("%d", cmd.filter.MaxTag),
 		}
+		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -85,6 +83,7 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 0
 	}
 
+	prov := startProvenance(prog, args, *inputDir)
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
 		retainTileSequences: true,
@@ -94,11 +93,24 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	if err != nil {
 		return 1
 	}
+	prov.addParents(tilelib.provenance)
 
 	log.Info("filtering")
-	cmd.filter.Apply(tilelib)
+	err = cmd.filter.Apply(tilelib)
+	if err != nil {
+		return 1
+	}
+	err = cmd.filter.writeReport()
+	if err != nil {
+		return 1
+	}
 	log.Info("tidying")
 	tilelib.Tidy()
+	p, err := prov.finish()
+	if err != nil {
+		return 1
+	}
+	tilelib.provenance = []Provenance{p}
 	err = tilelib.WriteDir(*outputDir)
 	if err != nil {
 		return 1
@@ -0,0 +1,472 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// fsckCmd checks a library (a single file, or a directory of files
+// such as the output of slice) for internal inconsistencies that
+// would otherwise only surface partway through export or
+// slice-numpy.
+type fsckCmd struct {
+	inputDir    string
+	outputFile  string
+	projectUUID string
+	runLocal    bool
+}
+
+func (cmd *fsckCmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.inputDir, "input-dir", "", "input library `directory` (or file)")
+	flags.StringVar(&cmd.outputFile, "o", "-", "output report `file` (json)")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.inputDir == "" {
+		err = errors.New("input library (-input-dir) not specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputFile != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning fsck",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+		}
+		err = runner.TranslatePaths(&cmd.inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"fsck", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", cmd.inputDir,
+			"-o", "/mnt/output/fsck.json",
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/fsck.json")
+		return 0
+	}
+
+	files, err := allFiles(cmd.inputDir, matchGobFile)
+	if err != nil {
+		return 1
+	}
+	chk := &fsckChecker{}
+	report := chk.check(files)
+
+	var out io.WriteCloser
+	if cmd.outputFile == "-" {
+		out = nopCloser{stdout}
+	} else {
+		out, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			return 1
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return 1
+	}
+	err = out.Close()
+	if err != nil {
+		return 1
+	}
+	if len(report.Problems) > 0 {
+		err = fmt.Errorf("%d problems found", len(report.Problems))
+		return 1
+	}
+	return 0
+}
+
+// Problem types reported by fsck.
+const (
+	fsckDecodeError       = "decode-error"       // file could not be read to the end
+	fsckInvalidTagset     = "invalid-tagset"     // tagset has duplicate or invalid tags
+	fsckTagsetMismatch    = "tagset-mismatch"    // file's tagset differs from the first tagset seen
+	fsckNoTagset          = "no-tagset"          // no file has a tagset
+	fsckTagOutOfRange     = "tag-out-of-range"   // tag ID >= number of tags in tagset
+	fsckInvalidVariantID  = "invalid-variant-id" // tile variant has ID 0
+	fsckHashMismatch      = "hash-mismatch"      // tile variant's Blake2b is not the hash of its Sequence
+	fsckDuplicateVariant  = "duplicate-variant"  // same tag and variant ID with different hashes
+	fsckMissingVariant    = "missing-variant"    // genome or reference uses a tile variant that is not in the library
+	fsckRefFlagMissing    = "ref-flag-missing"   // reference uses a tile variant that does not have Ref=true
+	fsckOddVariants       = "odd-variants"       // genome has an odd number of Variants
+	fsckBeyondEndTag      = "beyond-end-tag"     // genome has variants at or beyond its EndTag
+	fsckOverlappingSlices = "overlapping-slices" // genome has more than one entry for the same tag
+	fsckMissingSlice      = "missing-slice"      // sliced genome has no entry for some tags
+)
+
+type fsckProblem struct {
+	Type    string
+	File    string        `json:",omitempty"`
+	Name    string        `json:",omitempty"` // genome or reference name
+	Tag     *tagID        `json:",omitempty"`
+	Variant tileVariantID `json:",omitempty"`
+	// Number of genome entries and reference tiles using a
+	// missing-variant
+	Count   int `json:",omitempty"`
+	Message string
+}
+
+type fsckReport struct {
+	Files         int
+	Tags          int
+	TileVariants  int
+	Genomes       int
+	References    int
+	ProblemCounts map[string]int
+	Problems      []fsckProblem
+}
+
+type fsckVariant struct {
+	hash uint64 // first 8 bytes of Blake2b
+	ref  bool
+}
+
+type fsckChecker struct {
+	mtx        sync.Mutex
+	tagset     [][]byte
+	tagsetFile string
+	variants   map[tileLibRef]fsckVariant
+	// genome name => tag ranges [start,end) covered by its
+	// entries, and whether the entries came from a slice
+	slices     map[string][][2]int
+	sliced     map[string]bool
+	missing    map[tileLibRef]*fsckProblem
+	refs       map[string]bool
+	unreadable map[string]bool
+	report     fsckReport
+}
+
+func (chk *fsckChecker) problem(p fsckProblem) {
+	chk.mtx.Lock()
+	defer chk.mtx.Unlock()
+	chk.report.Problems = append(chk.report.Problems, p)
+}
+
+// check reads the given files twice: first to collect the tagset
+// and tile variants, then to check the genomes and reference
+// sequences against them.
+func (chk *fsckChecker) check(files []string) fsckReport {
+	chk.variants = map[tileLibRef]fsckVariant{}
+	chk.slices = map[string][][2]int{}
+	chk.sliced = map[string]bool{}
+	chk.missing = map[tileLibRef]*fsckProblem{}
+	chk.refs = map[string]bool{}
+	chk.unreadable = map[string]bool{}
+	chk.report.Files = len(files)
+
+	log.Printf("fsck: reading tagsets and tile variants from %d files", len(files))
+	chk.eachFile(files, chk.checkTileVariants)
+	ntags := len(chk.tagset)
+	chk.report.Tags = ntags
+	chk.report.TileVariants = len(chk.variants)
+	if chk.tagsetFile == "" {
+		chk.problem(fsckProblem{Type: fsckNoTagset, Message: "no tagset found in any input file"})
+	} else {
+		var taglib tagLibrary
+		if err := taglib.setTags(chk.tagset); err != nil {
+			chk.problem(fsckProblem{Type: fsckInvalidTagset, File: chk.tagsetFile, Message: err.Error()})
+		}
+		for libref := range chk.variants {
+			if int(libref.Tag) >= ntags {
+				tag := libref.Tag
+				chk.problem(fsckProblem{Type: fsckTagOutOfRange, Tag: &tag, Variant: libref.Variant, Message: fmt.Sprintf("tile variant tag %d is out of range (tagset has %d tags)", tag, ntags)})
+			}
+		}
+	}
+
+	log.Printf("fsck: checking genomes and reference sequences")
+	chk.eachFile(files, chk.checkGenomes)
+	for _, p := range chk.missing {
+		chk.report.Problems = append(chk.report.Problems, *p)
+	}
+	chk.report.Genomes = len(chk.slices)
+	chk.report.References = len(chk.refs)
+	chk.checkCoverage(ntags)
+
+	sort.Slice(chk.report.Problems, func(i, j int) bool {
+		pi, pj := chk.report.Problems[i], chk.report.Problems[j]
+		if pi.Type != pj.Type {
+			return pi.Type < pj.Type
+		} else if pi.Name != pj.Name {
+			return pi.Name < pj.Name
+		} else if (pi.Tag == nil) != (pj.Tag == nil) {
+			return pi.Tag == nil
+		} else if pi.Tag != nil && *pi.Tag != *pj.Tag {
+			return *pi.Tag < *pj.Tag
+		} else if pi.Variant != pj.Variant {
+			return pi.Variant < pj.Variant
+		} else {
+			return pi.File < pj.File
+		}
+	})
+	chk.report.ProblemCounts = map[string]int{}
+	for _, p := range chk.report.Problems {
+		chk.report.ProblemCounts[p.Type]++
+	}
+	log.Printf("fsck: %d problems found", len(chk.report.Problems))
+	return chk.report
+}
+
+// eachFile calls fn for each entry in each file, reading files
+// concurrently. A file that cannot be read to the end is reported
+// (once) as a decode-error.
+func (chk *fsckChecker) eachFile(files []string, fn func(file string, ent *LibraryEntry)) {
+	throttle := throttle{Max: runtime.NumCPU()}
+	for _, file := range files {
+		file := file
+		throttle.Acquire()
+		go func() {
+			defer throttle.Release()
+			f, err := open(file)
+			if err == nil {
+				defer f.Close()
+				err = DecodeLibrary(f, strings.HasSuffix(file, ".gz"), func(ent *LibraryEntry) error {
+					fn(file, ent)
+					return nil
+				})
+			}
+			if err != nil {
+				chk.mtx.Lock()
+				defer chk.mtx.Unlock()
+				if !chk.unreadable[file] {
+					chk.unreadable[file] = true
+					chk.report.Problems = append(chk.report.Problems, fsckProblem{Type: fsckDecodeError, File: file, Message: err.Error()})
+				}
+			}
+		}()
+	}
+	throttle.Wait()
+}
+
+func (chk *fsckChecker) checkTileVariants(file string, ent *LibraryEntry) {
+	if len(ent.TagSet) > 0 {
+		chk.mtx.Lock()
+		if chk.tagsetFile == "" {
+			chk.tagset, chk.tagsetFile = ent.TagSet, file
+		} else if !sameTagset(chk.tagset, ent.TagSet) {
+			chk.report.Problems = append(chk.report.Problems, fsckProblem{Type: fsckTagsetMismatch, File: file, Message: fmt.Sprintf("tagset (%d tags) differs from tagset in %s (%d tags)", len(ent.TagSet), chk.tagsetFile, len(chk.tagset))})
+		}
+		chk.mtx.Unlock()
+	}
+	for _, tv := range ent.TileVariants {
+		tag := tv.Tag
+		if tv.Variant == 0 {
+			chk.problem(fsckProblem{Type: fsckInvalidVariantID, File: file, Tag: &tag, Message: "tile variant has ID 0"})
+			continue
+		}
+		if len(tv.Sequence) > 0 && blake2b.Sum256(tv.Sequence) != tv.Blake2b {
+			chk.problem(fsckProblem{Type: fsckHashMismatch, File: file, Tag: &tag, Variant: tv.Variant, Message: "Blake2b does not match Sequence"})
+		}
+		libref := tileLibRef{Tag: tv.Tag, Variant: tv.Variant}
+		fv := fsckVariant{hash: binary.BigEndian.Uint64(tv.Blake2b[:8]), ref: tv.Ref}
+		chk.mtx.Lock()
+		if old, ok := chk.variants[libref]; !ok {
+			chk.variants[libref] = fv
+		} else if old.hash != fv.hash {
+			chk.report.Problems = append(chk.report.Problems, fsckProblem{Type: fsckDuplicateVariant, File: file, Tag: &tag, Variant: tv.Variant, Message: "more than one tile variant with this tag and variant ID"})
+		} else if fv.ref && !old.ref {
+			old.ref = true
+			chk.variants[libref] = old
+		}
+		chk.mtx.Unlock()
+	}
+}
+
+func (chk *fsckChecker) checkGenomes(file string, ent *LibraryEntry) {
+	for _, cg := range ent.CompactGenomes {
+		start := int(cg.StartTag)
+		end := start + len(cg.Variants)/2
+		if len(cg.Variants)%2 != 0 {
+			chk.problem(fsckProblem{Type: fsckOddVariants, File: file, Name: cg.Name, Message: fmt.Sprintf("genome has an odd number of variants (%d)", len(cg.Variants))})
+		}
+		if cg.EndTag > 0 {
+			if end > int(cg.EndTag) {
+				tag := cg.EndTag
+				chk.problem(fsckProblem{Type: fsckBeyondEndTag, File: file, Name: cg.Name, Tag: &tag, Message: fmt.Sprintf("genome has variants for tags %d-%d but EndTag is %d", start, end-1, cg.EndTag)})
+			}
+			end = int(cg.EndTag)
+		}
+		for i, v := range cg.Variants {
+			if v == 0 {
+				continue
+			}
+			libref := tileLibRef{Tag: cg.StartTag + tagID(i/2), Variant: v}
+			if _, ok := chk.variants[libref]; !ok {
+				chk.missingVariant(libref, file, cg.Name)
+			}
+		}
+		for i, v := range cg.Imputed {
+			if v == 0 {
+				continue
+			}
+			libref := tileLibRef{Tag: cg.StartTag + tagID(i/2), Variant: v}
+			if _, ok := chk.variants[libref]; !ok {
+				chk.missingVariant(libref, file, cg.Name)
+			}
+		}
+		chk.mtx.Lock()
+		chk.slices[cg.Name] = append(chk.slices[cg.Name], [2]int{start, end})
+		if cg.EndTag > 0 {
+			chk.sliced[cg.Name] = true
+		}
+		chk.mtx.Unlock()
+	}
+	for _, cseq := range ent.CompactSequences {
+		chk.mtx.Lock()
+		chk.refs[cseq.Name] = true
+		chk.mtx.Unlock()
+		var seqnames []string
+		for seqname := range cseq.TileSequences {
+			seqnames = append(seqnames, seqname)
+		}
+		sort.Strings(seqnames)
+		for _, seqname := range seqnames {
+			notref := map[tileLibRef]bool{}
+			for _, libref := range cseq.TileSequences[seqname] {
+				if libref.Variant == 0 {
+					continue
+				}
+				if fv, ok := chk.variants[libref]; !ok {
+					chk.missingVariant(libref, file, cseq.Name)
+				} else if !fv.ref && !notref[libref] {
+					notref[libref] = true
+					tag := libref.Tag
+					chk.problem(fsckProblem{Type: fsckRefFlagMissing, File: file, Name: cseq.Name, Tag: &tag, Variant: libref.Variant, Message: fmt.Sprintf("tile variant used by reference sequence %s does not have Ref=true", seqname)})
+				}
+			}
+		}
+	}
+}
+
+// missingVariant records that genome or reference name uses a tile
+// variant that is not in the library. Each missing variant is
+// reported once, with a count of genomes/references using it.
+func (chk *fsckChecker) missingVariant(libref tileLibRef, file, name string) {
+	chk.mtx.Lock()
+	defer chk.mtx.Unlock()
+	if p, ok := chk.missing[libref]; ok {
+		p.Count++
+		return
+	}
+	tag := libref.Tag
+	chk.missing[libref] = &fsckProblem{
+		Type:    fsckMissingVariant,
+		File:    file,
+		Name:    name,
+		Tag:     &tag,
+		Variant: libref.Variant,
+		Count:   1,
+		Message: fmt.Sprintf("%s uses tag %d variant %d, which is not in the library", name, libref.Tag, libref.Variant),
+	}
+}
+
+// checkCoverage checks that each genome's entries don't overlap,
+// and (if the genome was sliced) that together they cover all tags.
+func (chk *fsckChecker) checkCoverage(ntags int) {
+	var names []string
+	for name := range chk.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ranges := chk.slices[name]
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+		covered := 0
+		for _, r := range ranges {
+			if r[0] < covered && r[1] > r[0] {
+				tag := tagID(r[0])
+				end := covered
+				if end > r[1] {
+					end = r[1]
+				}
+				chk.problem(fsckProblem{Type: fsckOverlappingSlices, Name: name, Tag: &tag, Message: fmt.Sprintf("more than one entry has variants for tags %d-%d", r[0], end-1)})
+			} else if r[0] > covered && chk.sliced[name] {
+				tag := tagID(covered)
+				chk.problem(fsckProblem{Type: fsckMissingSlice, Name: name, Tag: &tag, Message: fmt.Sprintf("no entry for tags %d-%d", covered, r[0]-1)})
+			}
+			if covered < r[1] {
+				covered = r[1]
+			}
+		}
+		if ntags > 0 && chk.sliced[name] && covered < ntags {
+			tag := tagID(covered)
+			chk.problem(fsckProblem{Type: fsckMissingSlice, Name: name, Tag: &tag, Message: fmt.Sprintf("no entry for tags %d-%d", covered, ntags-1)})
+		}
+		if last := ranges[len(ranges)-1]; ntags > 0 && !chk.sliced[name] && last[1] > ntags {
+			tag := tagID(ntags)
+			chk.problem(fsckProblem{Type: fsckTagOutOfRange, Name: name, Tag: &tag, Message: fmt.Sprintf("genome has variants for tags up to %d (tagset has %d tags)", last[1]-1, ntags)})
+		}
+	}
+}
+
+func sameTagset(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+	"gopkg.in/check.v1"
+)
+
+type fsckSuite struct{}
+
+var _ = check.Suite(&fsckSuite{})
+
+func (s *fsckSuite) runFsck(c *check.C, input string) (int, fsckReport) {
+	var stdout bytes.Buffer
+	exited := (&fsckCmd{}).RunCommand("fsck", []string{
+		"-local=true",
+		"-input-dir", input,
+	}, nil, &stdout, os.Stderr)
+	var report fsckReport
+	err := json.Unmarshal(stdout.Bytes(), &report)
+	c.Assert(err, check.IsNil, check.Commentf("%s", stdout.String()))
+	return exited, report
+}
+
+func (s *fsckSuite) TestSliced(c *check.C) {
+	tmpdir := c.MkDir()
+	importAndSlice(c, tmpdir)
+
+	exited, report := s.runFsck(c, tmpdir+"/sliced")
+	c.Check(exited, check.Equals, 0)
+	c.Check(report.Problems, check.HasLen, 0)
+	c.Check(report.Files, check.Equals, 3)
+	c.Check(report.Tags, check.Equals, 9)
+	c.Check(report.Genomes, check.Equals, 2)
+	c.Check(report.References, check.Equals, 1)
+
+	err := os.Remove(tmpdir + "/sliced/library0001.gob.gz")
+	c.Assert(err, check.IsNil)
+	exited, report = s.runFsck(c, tmpdir+"/sliced")
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.ProblemCounts, check.DeepEquals, map[string]int{fsckMissingSlice: 2})
+	for _, p := range report.Problems {
+		c.Check(p.Type, check.Equals, fsckMissingSlice)
+		c.Check(*p.Tag, check.Equals, tagID(4))
+	}
+}
+
+func (s *fsckSuite) TestProblems(c *check.C) {
+	tmpdir := c.MkDir()
+	tagset := [][]byte{
+		[]byte("ggagaactgtgctccgccttcaga"),
+		[]byte("acacatgctagcgcgtcggggtgg"),
+		[]byte("gactctagcagagtggccagccac"),
+	}
+	tv := func(tag tagID, variant tileVariantID, seq string, ref bool) TileVariant {
+		return TileVariant{Tag: tag, Variant: variant, Ref: ref, Sequence: []byte(seq), Blake2b: blake2b.Sum256([]byte(seq))}
+	}
+	badhash := tv(1, 1, "acgt", false)
+	badhash.Sequence = []byte("acgg")
+	for fnm, ents := range map[string][]LibraryEntry{
+		"/library1.gob": {
+			{TagSet: tagset},
+			{TileVariants: []TileVariant{
+				tv(0, 1, "acgt", false),
+				badhash,
+				tv(2, 1, "aaaa", true),
+			}},
+			{CompactSequences: []CompactSequence{{
+				Name:          "ref",
+				TileSequences: map[string][]tileLibRef{"chr1": {{0, 1}, {1, 1}, {2, 2}}},
+			}}},
+			{CompactGenomes: []CompactGenome{{
+				Name:     "genome1",
+				Variants: []tileVariantID{1, 1, 0, 0, 3, 0},
+			}}},
+		},
+		"/library2.gob": {
+			{TagSet: tagset[:2]},
+			{TileVariants: []TileVariant{
+				tv(2, 1, "aaaa", false),
+				tv(2, 3, "cccc", false),
+				tv(2, 2, "gggg", true),
+				tv(2, 2, "tttt", false),
+			}},
+		},
+	} {
+		f, err := os.Create(tmpdir + fnm)
+		c.Assert(err, check.IsNil)
+		enc := gob.NewEncoder(f)
+		for _, ent := range ents {
+			err = enc.Encode(ent)
+			c.Assert(err, check.IsNil)
+		}
+		c.Assert(f.Close(), check.IsNil)
+	}
+	exited, report := s.runFsck(c, tmpdir)
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.ProblemCounts, check.DeepEquals, map[string]int{
+		fsckTagsetMismatch:   1,
+		fsckHashMismatch:     1,
+		fsckDuplicateVariant: 1,
+		fsckRefFlagMissing:   2,
+	})
+	for _, p := range report.Problems {
+		c.Logf("%+v", p)
+		if p.Type == fsckRefFlagMissing {
+			c.Check(p.Name, check.Equals, "ref")
+			c.Check(*p.Tag == 0 || *p.Tag == 1, check.Equals, true)
+		}
+	}
+
+	// Without library2, the genome and reference use tile
+	// variants that don't exist.
+	err := os.Remove(tmpdir + "/library2.gob")
+	c.Assert(err, check.IsNil)
+	exited, report = s.runFsck(c, tmpdir)
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.ProblemCounts, check.DeepEquals, map[string]int{
+		fsckHashMismatch:   1,
+		fsckMissingVariant: 2,
+		fsckRefFlagMissing: 2,
+	})
+	for _, p := range report.Problems {
+		if p.Type == fsckMissingVariant {
+			c.Check(*p.Tag, check.Equals, tagID(2))
+			c.Check(p.Variant == 2 && p.Name == "ref" || p.Variant == 3 && p.Name == "genome1", check.Equals, true)
+		}
+	}
+}
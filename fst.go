@@ -0,0 +1,477 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// fstCmd computes population differentiation (Fst) between sample
+// groups, using the tile variant matrices and annotations written by
+// slice-numpy.
+type fstCmd struct {
+	estimator string
+	window    int
+	threads   int
+}
+
+func (cmd *fstCmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	err := cmd.run(prog, args, stdin, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (cmd *fstCmd) run(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputDir := flags.String("input-dir", "./in", "input `directory` (output of slice-numpy, with matrix.*.npy, *.annotations.csv, and samples.csv files)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	groupsFilename := flags.String("groups", "", "csv `file` with SampleID column and grouping column (default: samples.csv in input directory)")
+	groupBy := flags.String("group-by", "CaseControl", "grouping `column` in groups file")
+	flags.StringVar(&cmd.estimator, "estimator", "wc", "Fst `estimator`: wc (Weir-Cockerham, 2 or more groups) or hudson (exactly 2 groups)")
+	flags.IntVar(&cmd.window, "window", 100000, "window size (`bp`) for windowed Fst, based on reference tile positions")
+	flags.IntVar(&cmd.threads, "threads", 4, "number of matrix files to process concurrently")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+	}
+	if cmd.estimator != "wc" && cmd.estimator != "hudson" {
+		return fmt.Errorf("invalid estimator %q", cmd.estimator)
+	}
+	if cmd.window < 1 {
+		return fmt.Errorf("invalid window size %d", cmd.window)
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning fst",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         200000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		err = runner.TranslatePaths(inputDir, groupsFilename)
+		if err != nil {
+			return err
+		}
+		runner.Args = []string{"fst", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-groups", *groupsFilename,
+			"-group-by", *groupBy,
+			"-estimator", cmd.estimator,
+			"-window", fmt.Sprintf("%d", cmd.window),
+			"-threads", fmt.Sprintf("%d", cmd.threads),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, output)
+		return nil
+	}
+
+	samples, err := loadSampleInfo(*inputDir + "/samples.csv")
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(samples))
+	for i, si := range samples {
+		ids[i] = si.id
+	}
+	if *groupsFilename == "" {
+		*groupsFilename = *inputDir + "/samples.csv"
+	}
+	groups, _, sampleGroups, err := loadSampleGroups(*groupsFilename, ids, []string{*groupBy})
+	if err != nil {
+		return err
+	}
+	if len(groups) < 2 {
+		return fmt.Errorf("need at least 2 groups, found %d (%v) in column %q of %s", len(groups), groups, *groupBy, *groupsFilename)
+	} else if cmd.estimator == "hudson" && len(groups) != 2 {
+		return fmt.Errorf("hudson estimator needs exactly 2 groups, found %d (%v) in column %q of %s", len(groups), groups, *groupBy, *groupsFilename)
+	}
+	// sampleGroup[i] is the group index of sample i, or -1
+	sampleGroup := make([]int, len(samples))
+	for i, g := range sampleGroups {
+		sampleGroup[i] = -1
+		if len(g) > 0 {
+			sampleGroup[i] = g[0]
+		}
+	}
+
+	d, err := open(*inputDir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	fis, err := d.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	d.Close()
+	var prefixes []string
+	for _, fi := range fis {
+		if prefix := strings.TrimSuffix(fi.Name(), "annotations.csv"); prefix != fi.Name() && strings.HasPrefix(prefix, "matrix.") {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	if len(prefixes) == 0 {
+		return errors.New("no matrix annotations files found in input directory")
+	}
+
+	var mtx sync.Mutex
+	var tvResults, hgvsResults []fstResult
+	thr := throttle{Max: cmd.threads}
+	for _, prefix := range prefixes {
+		prefix := prefix
+		thr.Go(func() error {
+			tvr, hr, err := cmd.processMatrix(*inputDir+"/"+prefix, len(samples), len(groups), sampleGroup)
+			if err != nil {
+				return err
+			}
+			mtx.Lock()
+			tvResults = append(tvResults, tvr...)
+			hgvsResults = append(hgvsResults, hr...)
+			mtx.Unlock()
+			return nil
+		})
+	}
+	err = thr.Wait()
+	if err != nil {
+		return err
+	}
+	sortFstResults(tvResults)
+	sortFstResults(hgvsResults)
+
+	err = writeFstCSV(*outputDir+"/fst-tile-variants.csv", "tag,variant,chrom,pos,fst", tvResults, func(r fstResult) string {
+		return fmt.Sprintf("%d,%d,%s,%d", r.tag, r.variant, r.seqname, r.pos)
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFstCSV(*outputDir+"/fst-hgvs.csv", "tag,hgvs,chrom,pos,fst", hgvsResults, func(r fstResult) string {
+		return fmt.Sprintf("%d,%s,%s,%d", r.tag, r.hgvsID, r.seqname, r.pos)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Windowed and genome-wide summaries use the ratio of sums
+	// over all tile variants.
+	var windows []fstResult
+	var total fstComponents
+	for _, r := range tvResults {
+		total.num += r.num
+		total.den += r.den
+		start := r.pos / cmd.window * cmd.window
+		if n := len(windows); n == 0 || windows[n-1].seqname != r.seqname || windows[n-1].pos != start {
+			windows = append(windows, fstResult{seqname: r.seqname, pos: start})
+		}
+		w := &windows[len(windows)-1]
+		w.num += r.num
+		w.den += r.den
+		w.variant++
+	}
+	err = writeFstCSV(*outputDir+"/fst-windows.csv", "chrom,start,end,n,fst", windows, func(r fstResult) string {
+		return fmt.Sprintf("%s,%d,%d,%d", r.seqname, r.pos, r.pos+cmd.window, r.variant)
+	})
+	if err != nil {
+		return err
+	}
+	fnm := *outputDir + "/fst.json"
+	log.Infof("writing %s", fnm)
+	j, err := json.MarshalIndent(map[string]interface{}{
+		"estimator":    cmd.estimator,
+		"groups":       groups,
+		"window":       cmd.window,
+		"tileVariants": len(tvResults),
+		"genomeWide":   total.fst(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fnm, append(j, '\n'), 0666)
+}
+
+// fstComponents are the numerator and denominator of an Fst
+// estimate. Estimates for multiple variants are combined as a ratio
+// of sums.
+type fstComponents struct {
+	num, den float64
+}
+
+func (c fstComponents) fst() float64 {
+	if c.den <= 0 {
+		return math.NaN()
+	}
+	return c.num / c.den
+}
+
+type fstResult struct {
+	tag     tagID
+	variant int // tile variant, or number of tile variants in a window
+	hgvsID  string
+	seqname string
+	pos     int
+	fstComponents
+}
+
+func sortFstResults(results []fstResult) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.seqname != b.seqname {
+			return a.seqname < b.seqname
+		} else if a.pos != b.pos {
+			return a.pos < b.pos
+		} else if a.tag != b.tag {
+			return a.tag < b.tag
+		} else if a.variant != b.variant {
+			return a.variant < b.variant
+		}
+		return a.hgvsID < b.hgvsID
+	})
+}
+
+func writeFstCSV(fnm, header string, results []fstResult, label func(fstResult) string) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	fmt.Fprintln(bufw, header)
+	for _, r := range results {
+		fst := r.fst()
+		if math.IsNaN(fst) {
+			continue
+		}
+		fmt.Fprintf(bufw, "%s,%s\n", label(r), strconv.FormatFloat(fst, 'g', 6, 64))
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// processMatrix computes Fst components for each tile variant and
+// each HGVS variant listed in {prefix}annotations.csv, using
+// genotypes from {prefix}npy.
+func (cmd *fstCmd) processMatrix(prefix string, nsamples, ngroups int, sampleGroup []int) ([]fstResult, []fstResult, error) {
+	m, err := loadTileVariantMatrix(prefix+"npy", nsamples)
+	if err != nil {
+		return nil, nil, err
+	}
+	fnm := prefix + "annotations.csv"
+	log.Infof("reading %s", fnm)
+	f, err := open(fnm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+
+	var tvResults, hgvsResults []fstResult
+	// State for the current tag. Annotation lines for a given
+	// tag are consecutive, starting with the "=" line for the
+	// reference tile.
+	curtag, curcol := -1, -1
+	var seqname string
+	var pos int
+	hgvsVariants := map[string]map[int]bool{}
+	flush := func() {
+		if curtag < 0 {
+			return
+		}
+		present := map[int]bool{}
+		for row := 0; row < m.rows; row++ {
+			for ph := 0; ph < 2; ph++ {
+				if v := m.At(row*m.cols + curcol*2 + ph); v > 0 {
+					present[v] = true
+				}
+			}
+		}
+		for v := range present {
+			c := cmd.components(m, curcol, sampleGroup, ngroups, map[int]bool{v: true})
+			tvResults = append(tvResults, fstResult{tag: tagID(curtag), variant: v, seqname: seqname, pos: pos, fstComponents: c})
+		}
+		for hgvsID, variants := range hgvsVariants {
+			c := cmd.components(m, curcol, sampleGroup, ngroups, variants)
+			hgvsResults = append(hgvsResults, fstResult{tag: tagID(curtag), hgvsID: hgvsID, seqname: seqname, pos: pos, fstComponents: c})
+		}
+		hgvsVariants = map[string]map[int]bool{}
+	}
+	for lineIdx, line := range bytes.Split(buf, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{','}, 10)
+		if len(fields) < 9 {
+			return nil, nil, fmt.Errorf("%s line %d: wrong number of fields (%d < %d)", fnm, lineIdx+1, len(fields), 9)
+		}
+		tag, _ := strconv.Atoi(string(fields[0]))
+		col, _ := strconv.Atoi(string(fields[1]))
+		variant, _ := strconv.Atoi(string(fields[2]))
+		hgvsID := string(fields[3])
+		if tag != curtag {
+			flush()
+			curtag, curcol = tag, col
+			seqname = string(fields[4])
+			pos, _ = strconv.Atoi(string(fields[5]))
+		}
+		if col*2+1 >= m.cols {
+			return nil, nil, fmt.Errorf("%s line %d: column %d out of range for matrix with %d columns", fnm, lineIdx+1, col, m.cols)
+		}
+		if hgvsID == "=" {
+			pos, _ = strconv.Atoi(string(fields[5]))
+		} else if hgvsID != "" {
+			if hgvsVariants[hgvsID] == nil {
+				hgvsVariants[hgvsID] = map[int]bool{}
+			}
+			hgvsVariants[hgvsID][variant] = true
+		}
+	}
+	flush()
+	return tvResults, hgvsResults, nil
+}
+
+// components returns the Fst numerator and denominator for the
+// allele "tile variant is in variants" at the given matrix column
+// pair. Only samples with both alleles called are counted.
+func (cmd *fstCmd) components(m *tileVariantMatrix, col int, sampleGroup []int, ngroups int, variants map[int]bool) fstComponents {
+	n := make([]float64, ngroups)   // individuals
+	x := make([]float64, ngroups)   // alleles
+	het := make([]float64, ngroups) // heterozygous individuals
+	for row := 0; row < m.rows; row++ {
+		g := sampleGroup[row]
+		if g < 0 {
+			continue
+		}
+		v0, v1 := m.At(row*m.cols+col*2), m.At(row*m.cols+col*2+1)
+		if v0 <= 0 || v1 <= 0 {
+			continue
+		}
+		n[g]++
+		a0, a1 := variants[v0], variants[v1]
+		if a0 {
+			x[g]++
+		}
+		if a1 {
+			x[g]++
+		}
+		if a0 != a1 {
+			het[g]++
+		}
+	}
+	if cmd.estimator == "hudson" {
+		return fstHudson(n, x)
+	}
+	return fstWeirCockerham(n, x, het)
+}
+
+// fstHudson returns the components of Hudson's Fst estimator (as
+// described by Bhatia et al. 2013) for 2 groups with n[i]
+// individuals and x[i] copies of the allele.
+func fstHudson(n, x []float64) fstComponents {
+	if n[0] < 1 || n[1] < 1 || n[0]+n[1] < 3 {
+		return fstComponents{}
+	}
+	n1, n2 := 2*n[0], 2*n[1]
+	p1, p2 := x[0]/n1, x[1]/n2
+	num := (p1-p2)*(p1-p2) - p1*(1-p1)/(n1-1) - p2*(1-p2)/(n2-1)
+	den := p1*(1-p2) + p2*(1-p1)
+	return fstComponents{num: num, den: den}
+}
+
+// fstWeirCockerham returns the components a and a+b+c of the Weir
+// and Cockerham (1984) Fst estimator for diploid individuals, given
+// n[i] individuals, x[i] copies of the allele, and het[i]
+// heterozygous individuals in each group. Groups with no
+// individuals are ignored.
+func fstWeirCockerham(n, x, het []float64) fstComponents {
+	var r, sumn, sumn2 float64
+	for _, ni := range n {
+		if ni > 0 {
+			r++
+			sumn += ni
+			sumn2 += ni * ni
+		}
+	}
+	if r < 2 {
+		return fstComponents{}
+	}
+	nbar := sumn / r
+	if nbar <= 1 {
+		return fstComponents{}
+	}
+	nc := (r*nbar - sumn2/(r*nbar)) / (r - 1)
+	var pbar, hbar float64
+	for i, ni := range n {
+		if ni > 0 {
+			pbar += x[i] / 2
+			hbar += het[i]
+		}
+	}
+	pbar /= r * nbar
+	hbar /= r * nbar
+	var s2 float64
+	for i, ni := range n {
+		if ni > 0 {
+			pi := x[i] / (2 * ni)
+			s2 += ni * (pi - pbar) * (pi - pbar)
+		}
+	}
+	s2 /= (r - 1) * nbar
+	pq := pbar * (1 - pbar)
+	a := nbar / nc * (s2 - 1/(nbar-1)*(pq-(r-1)/r*s2-hbar/4))
+	b := nbar / (nbar - 1) * (pq - (r-1)/r*s2 - (2*nbar-1)/(4*nbar)*hbar)
+	c := hbar / 2
+	return fstComponents{num: a, den: a + b + c}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type fstSuite struct{}
+
+var _ = check.Suite(&fstSuite{})
+
+func (s *fstSuite) TestEstimators(c *check.C) {
+	// fixed difference
+	c.Check(fstHudson([]float64{10, 10}, []float64{20, 0}).fst(), check.Equals, 1.0)
+	wc := fstWeirCockerham([]float64{10, 10}, []float64{20, 0}, []float64{0, 0}).fst()
+	c.Check(wc, check.Equals, 1.0)
+
+	// no difference: estimates are close to zero (slightly
+	// negative due to sample size correction)
+	for _, fst := range []float64{
+		fstHudson([]float64{10, 10}, []float64{10, 10}).fst(),
+		fstWeirCockerham([]float64{10, 10}, []float64{10, 10}, []float64{10, 10}).fst(),
+		fstWeirCockerham([]float64{10, 10, 20}, []float64{10, 10, 20}, []float64{4, 4, 8}).fst(),
+	} {
+		c.Check(fst <= 0 && fst > -0.1, check.Equals, true, check.Commentf("fst %f", fst))
+	}
+
+	// intermediate
+	h := fstHudson([]float64{50, 50}, []float64{80, 20}).fst()
+	c.Check(math.Abs(h-0.5247) < 0.001, check.Equals, true, check.Commentf("fst %f", h))
+
+	// undefined
+	c.Check(math.IsNaN(fstHudson([]float64{0, 10}, []float64{0, 5}).fst()), check.Equals, true)
+	c.Check(math.IsNaN(fstWeirCockerham([]float64{10, 0}, []float64{5, 0}, []float64{1, 0}).fst()), check.Equals, true)
+}
+
+func (s *fstSuite) TestCommand(c *check.C) {
+	indir := c.MkDir()
+	outdir := c.MkDir()
+	err := ioutil.WriteFile(indir+"/samples.csv", []byte(`Index,SampleID,CaseControl,TrainingValidation
+0,sample0,1,1
+1,sample1,1,1
+2,sample2,0,1
+3,sample3,0,1
+`), 0666)
+	c.Assert(err, check.IsNil)
+	// tag 3 @ chr1:0 (column 0): variant 2 only in cases
+	// tag 4 @ chr1:150 (column 1): same frequencies in both groups
+	err = ioutil.WriteFile(indir+"/matrix.0000.annotations.csv", []byte(`3,0,1,=,chr1,0,,,
+3,0,2,chr1:g.12A>G,chr1,12,A,G,C
+4,1,1,=,chr1,150,,,
+4,1,2,chr1:g.170C>T,chr1,170,C,T,A
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = writeNumpyInt16(indir+"/matrix.0000.npy", []int16{
+		2, 2, 1, 2,
+		2, 2, 2, 1,
+		1, 1, 1, 2,
+		1, 1, 2, 1,
+	}, 4, 4)
+	c.Assert(err, check.IsNil)
+
+	exited := (&fstCmd{}).RunCommand("fst", []string{
+		"-local=true",
+		"-input-dir=" + indir,
+		"-output-dir=" + outdir,
+		"-estimator=hudson",
+		"-window=100",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	buf, err := ioutil.ReadFile(outdir + "/fst-tile-variants.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `tag,variant,chrom,pos,fst
+3,1,chr1,0,1
+3,2,chr1,0,1
+4,1,chr1,150,-0.333333
+4,2,chr1,150,-0.333333
+`)
+	buf, err = ioutil.ReadFile(outdir + "/fst-hgvs.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `tag,hgvs,chrom,pos,fst
+3,chr1:g.12A>G,chr1,0,1
+4,chr1:g.170C>T,chr1,150,-0.333333
+`)
+	buf, err = ioutil.ReadFile(outdir + "/fst-windows.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `chrom,start,end,n,fst
+chr1,0,100,2,1
+chr1,100,200,2,-0.333333
+`)
+	buf, err = ioutil.ReadFile(outdir + "/fst.json")
+	c.Assert(err, check.IsNil)
+	var summary struct {
+		Groups     []string
+		GenomeWide float64
+	}
+	err = json.Unmarshal(buf, &summary)
+	c.Assert(err, check.IsNil)
+	c.Check(summary.Groups, check.DeepEquals, []string{"CaseControl_0", "CaseControl_1"})
+	c.Check(summary.GenomeWide > 0.3 && summary.GenomeWide < 1, check.Equals, true, check.Commentf("%f", summary.GenomeWide))
+}
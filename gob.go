@@ -20,6 +20,32 @@ type CompactGenome struct {
 	Variants []tileVariantID
 	StartTag tagID
 	EndTag   tagID
+	// Ploidy of each sequence (e.g., "chrX": 1) that is not
+	// diploid in this genome. Variants always has two entries
+	// per tag; on a haploid sequence, both entries are the
+	// single haplotype, so code that isn't ploidy-aware sees a
+	// homozygous genotype.
+	Ploidy map[string]int
+	// Unphased sequences in this genome. On these sequences,
+	// the two entries for each tag are an unordered pair, e.g.,
+	// tiled from an unphased VCF.
+	Unphased map[string]bool
+	// Tile variants imputed in place of no-calls (see impute).
+	// If not nil, Imputed and ImputedConfidence have one entry
+	// per entry in Variants: Imputed[i] is the tile variant
+	// imputed for Variants[i] (0 if not imputed), and
+	// ImputedConfidence[i] is its posterior probability.
+	Imputed           []tileVariantID
+	ImputedConfidence []float32
+}
+
+// ploidy returns the number of haplotypes of the given sequence in
+// cg (2 unless specified otherwise in cg.Ploidy).
+func (cg *CompactGenome) ploidy(seqname string) int {
+	if p, ok := cg.Ploidy[seqname]; ok {
+		return p
+	}
+	return 2
 }
 
 type CompactSequence struct {
@@ -33,6 +59,46 @@ type TileVariant struct {
 	Variant  tileVariantID
 	Blake2b  [blake2b.Size256]byte
 	Sequence []byte
+	// Length of the tile sequence, and half-open [start,end)
+	// ranges of no-call (non-ACGT) positions in it. These are
+	// recorded even if Sequence is omitted (see import
+	// -save-incomplete-tiles). Length is zero in libraries
+	// written before these fields were added.
+	Length  int
+	NoCalls [][2]int
+	// Positions in the tile sequence where its leading or
+	// trailing tag differs from the tag library, if import
+	// found the tag with one mismatch (see -approx-tags).
+	TagMismatches []int
+}
+
+// approxEndTag returns true if import found the tile variant's
+// trailing tag (its last taglen bases) with a mismatch (see
+// TagMismatches).
+func (tv *TileVariant) approxEndTag(taglen int) bool {
+	length := tv.Length
+	if length == 0 {
+		length = len(tv.Sequence)
+	}
+	for _, pos := range tv.TagMismatches {
+		if pos >= length-taglen {
+			return true
+		}
+	}
+	return false
+}
+
+// noCallCounts returns the length of the tile variant and the number
+// of no-call bases in it, using the recorded NoCalls if available,
+// otherwise the sequence. If neither is available, length is zero.
+func (tv *TileVariant) noCallCounts() (length, nocalls int) {
+	if tv.Length == 0 {
+		return sequenceNoCalls(tv.Sequence)
+	}
+	for _, r := range tv.NoCalls {
+		nocalls += r[1] - r[0]
+	}
+	return tv.Length, nocalls
 }
 
 type LibraryEntry struct {
@@ -40,6 +106,7 @@ type LibraryEntry struct {
 	CompactGenomes   []CompactGenome
 	CompactSequences []CompactSequence
 	TileVariants     []TileVariant
+	Provenance       []Provenance
 }
 
 func ReadCompactGenomes(rdr io.Reader, gz bool) ([]CompactGenome, error) {
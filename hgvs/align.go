@@ -0,0 +1,271 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package hgvs
+
+import (
+	"sync"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Alignment scores (costs) used by DiffBanded. These are similar to
+// the defaults used by common short-read aligners: a gap of length
+// n costs gapOpen + n*gapExtend.
+const (
+	alignMismatch  = 4
+	alignGapOpen   = 6
+	alignGapExtend = 1
+	alignInf       = int32(1 << 30)
+)
+
+// DefaultBandwidth is a reasonable bandwidth argument for
+// DiffBanded.
+const DefaultBandwidth = 128
+
+// MaxAlignCells limits the memory used by a DiffBanded call: the
+// traceback matrix uses one byte per cell, and has (len(a)+1) *
+// (len(b)-len(a)+2*bandwidth+1) cells after removing the common
+// prefix and suffix of a and b.
+var MaxAlignCells = 1 << 24
+
+// MaxAlignCellsInUse limits the total size of the traceback matrices
+// of concurrent DiffBanded calls. A call that would exceed it waits
+// until other calls finish, so the result does not depend on how
+// many calls are running.
+var MaxAlignCellsInUse = 1 << 28
+
+var (
+	alignCellsMtx   sync.Mutex
+	alignCellsCond  = sync.NewCond(&alignCellsMtx)
+	alignCellsInUse int
+)
+
+// acquireAlignCells waits until n more cells fit in
+// MaxAlignCellsInUse, or no other call is using any cells.
+func acquireAlignCells(n int) {
+	alignCellsMtx.Lock()
+	defer alignCellsMtx.Unlock()
+	for alignCellsInUse > 0 && alignCellsInUse+n > MaxAlignCellsInUse {
+		alignCellsCond.Wait()
+	}
+	alignCellsInUse += n
+}
+
+func releaseAlignCells(n int) {
+	alignCellsMtx.Lock()
+	defer alignCellsMtx.Unlock()
+	alignCellsInUse -= n
+	alignCellsCond.Broadcast()
+}
+
+// DiffBanded is like Diff, but uses a deterministic banded global
+// alignment with affine gap costs instead of diffmatchpatch. It is
+// suitable for long sequences: its time and memory use are
+// proportional to the length of the sequences times
+// (bandwidth*2 + the difference in their lengths).
+//
+// The common prefix and suffix of a and b are removed before
+// aligning, so a single large insertion or deletion is reported
+// exactly regardless of bandwidth.
+//
+// If aligning the remaining parts of a and b would need more than
+// MaxAlignCells cells, the entire differing region is reported as a
+// single variant (typically a large delins), and the returned bool
+// is true.
+func DiffBanded(a, b string, bandwidth int) ([]Variant, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var diffs []diffmatchpatch.Diff
+	if prefix > 0 {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: a[:prefix]})
+	}
+	amid, bmid := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	truncated := false
+	if len(amid) == 0 || len(bmid) == 0 {
+		diffs = append(diffs,
+			diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: amid},
+			diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: bmid})
+	} else if middle, ok := alignBanded(amid, bmid, bandwidth); ok {
+		diffs = append(diffs, middle...)
+	} else {
+		diffs = append(diffs,
+			diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: amid},
+			diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: bmid})
+		truncated = true
+	}
+	if suffix > 0 {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: a[len(a)-suffix:]})
+	}
+	var nonempty []diffmatchpatch.Diff
+	for _, d := range diffs {
+		if len(d.Text) > 0 {
+			nonempty = append(nonempty, d)
+		}
+	}
+	return diffsToVariants(a, cleanup(nonempty)), truncated
+}
+
+// Alignment states. In the traceback matrix (one byte per cell),
+// bits 0-1 indicate the predecessor of the match/mismatch state,
+// bits 2-3 the predecessor of the deletion state, and bits 4-5 the
+// predecessor of the insertion state.
+const (
+	stateM = 0 // a[i-1] aligned to b[j-1]
+	stateD = 1 // a[i-1] deleted
+	stateI = 2 // b[j-1] inserted
+)
+
+// alignBanded returns the diff with the lowest alignment cost among
+// those whose path stays within the band. It returns false if the
+// band would exceed MaxAlignCells.
+func alignBanded(a, b string, bandwidth int) ([]diffmatchpatch.Diff, bool) {
+	la, lb := len(a), len(b)
+	// Row i contains columns j in [i+lo, i+lo+width).
+	lo, hi := -bandwidth, bandwidth
+	if lb < la {
+		lo -= la - lb
+	} else {
+		hi += lb - la
+	}
+	width := hi - lo + 1
+	if (la+1)*width > MaxAlignCells {
+		return nil, false
+	}
+	acquireAlignCells((la + 1) * width)
+	defer releaseAlignCells((la + 1) * width)
+	tb := make([]byte, (la+1)*width)
+	// cost[state][k] for the previous and current rows
+	var prev, cur [3][]int32
+	for s := range prev {
+		prev[s] = make([]int32, width)
+		cur[s] = make([]int32, width)
+	}
+	min3 := func(m, d, i int32) (int32, byte) {
+		// Ties are broken in favor of M, then D, then I, to
+		// keep results deterministic.
+		best, src := m, byte(stateM)
+		if d < best {
+			best, src = d, stateD
+		}
+		if i < best {
+			best, src = i, stateI
+		}
+		return best, src
+	}
+	for i := 0; i <= la; i++ {
+		for k := 0; k < width; k++ {
+			j := i + lo + k
+			cur[stateM][k], cur[stateD][k], cur[stateI][k] = alignInf, alignInf, alignInf
+			if j < 0 || j > lb {
+				continue
+			}
+			var flags byte
+			if i == 0 && j == 0 {
+				cur[stateM][k] = 0
+				continue
+			}
+			if i > 0 && j > 0 {
+				// previous row, column j-1 is at k
+				cost, src := min3(prev[stateM][k], prev[stateD][k], prev[stateI][k])
+				if cost < alignInf {
+					if a[i-1] != b[j-1] {
+						cost += alignMismatch
+					}
+					cur[stateM][k] = cost
+					flags |= src
+				}
+			}
+			if i > 0 && k+1 < width {
+				// previous row, column j is at k+1
+				cost, src := min3(prev[stateM][k+1]+alignGapOpen, prev[stateD][k+1], prev[stateI][k+1]+alignGapOpen)
+				if cost < alignInf {
+					cur[stateD][k] = cost + alignGapExtend
+					flags |= src << 2
+				}
+			}
+			if j > 0 && k > 0 {
+				// current row, column j-1 is at k-1
+				cost, src := min3(cur[stateM][k-1]+alignGapOpen, cur[stateD][k-1]+alignGapOpen, cur[stateI][k-1])
+				if cost < alignInf {
+					cur[stateI][k] = cost + alignGapExtend
+					flags |= src << 4
+				}
+			}
+			tb[i*width+k] = flags
+		}
+		prev, cur = cur, prev
+	}
+	// prev now holds row la.
+	kend := lb - la - lo
+	_, state := min3(prev[stateM][kend], prev[stateD][kend], prev[stateI][kend])
+
+	// Trace back from (la,lb) to (0,0), noting for each step
+	// whether it consumes a base from a (opDel), b (opIns), or
+	// both (opEqual or opDel|opIns).
+	const (
+		opEqual = 0
+		opDel   = 1
+		opIns   = 2
+	)
+	ops := make([]byte, 0, la+lb)
+	for i, j := la, lb; i > 0 || j > 0; {
+		flags := tb[i*width+j-i-lo]
+		switch state {
+		case stateM:
+			if a[i-1] == b[j-1] {
+				ops = append(ops, opEqual)
+			} else {
+				ops = append(ops, opDel|opIns)
+			}
+			state = flags & 3
+			i--
+			j--
+		case stateD:
+			ops = append(ops, opDel)
+			state = (flags >> 2) & 3
+			i--
+		case stateI:
+			ops = append(ops, opIns)
+			state = (flags >> 4) & 3
+			j--
+		}
+	}
+	// Convert each run of equal bases to an equal diff, and each
+	// run of other ops to a delete diff and an insert diff.
+	var diffs []diffmatchpatch.Diff
+	i, j := 0, 0
+	for x := len(ops) - 1; x >= 0; {
+		i0, j0 := i, j
+		if ops[x] == opEqual {
+			for ; x >= 0 && ops[x] == opEqual; x-- {
+				i++
+				j++
+			}
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: a[i0:i]})
+			continue
+		}
+		for ; x >= 0 && ops[x] != opEqual; x-- {
+			if ops[x]&opDel != 0 {
+				i++
+			}
+			if ops[x]&opIns != 0 {
+				j++
+			}
+		}
+		if i > i0 {
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: a[i0:i]})
+		}
+		if j > j0 {
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: b[j0:j]})
+		}
+	}
+	return diffs, true
+}
@@ -0,0 +1,183 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package hgvs
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+
+	"gopkg.in/check.v1"
+)
+
+type alignSuite struct{}
+
+var _ = check.Suite(&alignSuite{})
+
+func randomSequence(rnd *rand.Rand, n int) string {
+	seq := make([]byte, n)
+	for i := range seq {
+		seq[i] = "ACGT"[rnd.Intn(4)]
+	}
+	return string(seq)
+}
+
+// applyVariants returns the sequence obtained by applying the given
+// (sorted, non-overlapping) variants to ref.
+func applyVariants(c *check.C, ref string, vars []Variant) string {
+	var out strings.Builder
+	pos := 1
+	for _, v := range vars {
+		c.Assert(v.Position >= pos, check.Equals, true, check.Commentf("%+v", vars))
+		out.WriteString(ref[pos-1 : v.Position-1])
+		c.Check(ref[v.Position-1:v.Position-1+len(v.Ref)], check.Equals, v.Ref)
+		out.WriteString(v.New)
+		pos = v.Position + len(v.Ref)
+	}
+	out.WriteString(ref[pos-1:])
+	return out.String()
+}
+
+func (s *alignSuite) TestShort(c *check.C) {
+	for _, trial := range []struct {
+		a      string
+		b      string
+		expect []string
+	}{
+		{"aaaaaaaaaa", "aaaaCaaaaa", []string{"5A>C"}},
+		{"aaaacGcaaa", "aaaaccaaa", []string{"6del"}},
+		{"aaaa", "aaCaa", []string{"2_3insC"}},
+		{"aaGGGtt", "aaCCCtt", []string{"3_5delinsCCC"}},
+		{"acgtacgtacgtTTTTacgtacgtacgt", "acgtacgtacgtacgtacgtacgt", []string{"13_16del"}},
+		{"acgtacgtGacgtacgtTacgtacgt", "acgtacgtCacgtacgtacgtacgt", []string{"9G>C", "18del"}},
+	} {
+		vars, truncated := DiffBanded(strings.ToUpper(trial.a), strings.ToUpper(trial.b), DefaultBandwidth)
+		c.Check(truncated, check.Equals, false)
+		var strs []string
+		for _, v := range vars {
+			strs = append(strs, v.String())
+		}
+		c.Check(strs, check.DeepEquals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *alignSuite) TestLong(c *check.C) {
+	rnd := rand.New(rand.NewSource(1))
+	a := randomSequence(rnd, 20000)
+
+	// Scattered SNPs and small indels.
+	b := a[:1000] + "T" + a[1001:5000] + a[5003:9000] + "GGA" + a[9000:15000] + "C" + a[15001:]
+	vars, truncated := DiffBanded(a, b, DefaultBandwidth)
+	c.Check(truncated, check.Equals, false)
+	c.Check(applyVariants(c, a, vars), check.Equals, b)
+	c.Check(len(vars) <= 4, check.Equals, true, check.Commentf("%+v", vars))
+
+	// A large deletion is reported as a single variant.
+	b = a[:3000] + a[13000:]
+	vars, truncated = DiffBanded(a, b, DefaultBandwidth)
+	c.Check(truncated, check.Equals, false)
+	c.Check(applyVariants(c, a, vars), check.Equals, b)
+	if c.Check(vars, check.HasLen, 1) {
+		c.Check(len(vars[0].Ref), check.Equals, 10000)
+		c.Check(vars[0].New, check.Equals, "")
+	}
+
+	// Same result every time.
+	again, _ := DiffBanded(a, b, DefaultBandwidth)
+	c.Check(again, check.DeepEquals, vars)
+}
+
+func (s *alignSuite) TestMaxAlignCells(c *check.C) {
+	defer func(orig int) { MaxAlignCells = orig }(MaxAlignCells)
+	MaxAlignCells = 1000
+	rnd := rand.New(rand.NewSource(1))
+	a := randomSequence(rnd, 2000)
+	b := a[:100] + "T" + a[101:1900] + "T" + a[1901:]
+	vars, truncated := DiffBanded(a, b, DefaultBandwidth)
+	c.Check(truncated, check.Equals, true)
+	c.Check(applyVariants(c, a, vars), check.Equals, b)
+	// The unaligned region is reported as a delins, which
+	// cleanup() then splits into two SNPs because the rest of the
+	// region is identical.
+	if c.Check(vars, check.HasLen, 2) {
+		c.Check(vars[0].Position, check.Equals, 101)
+		c.Check(vars[1].Position, check.Equals, 1901)
+	}
+}
+
+func (s *alignSuite) TestSV(c *check.C) {
+	rnd := rand.New(rand.NewSource(2))
+	a := randomSequence(rnd, 3000)
+	for _, trial := range []struct {
+		b      string
+		svtype string
+		expect string
+	}{
+		{a[:1000] + a[1200:], "DEL", "1001_1200del"},
+		{a[:1200] + a[1000:], "DUP", "1001_1200dup"},
+		{a[:1000] + ReverseComplement(a[1000:1200]) + a[1200:], "INV", "1001_1200inv"},
+	} {
+		for _, diff := range []func(a, b string) []Variant{
+			func(a, b string) []Variant { v, _ := DiffBanded(a, b, DefaultBandwidth); return v },
+			func(a, b string) []Variant { v, _ := Diff(a, b, 0); return v },
+		} {
+			vars := diff(a, trial.b)
+			c.Check(applyVariants(c, a, vars), check.Equals, trial.b)
+			if !c.Check(vars, check.HasLen, 1) {
+				continue
+			}
+			c.Check(vars[0].SVType(), check.Equals, trial.svtype)
+			c.Check(vars[0].String(), check.Equals, trial.expect)
+		}
+	}
+}
+
+func (s *alignSuite) TestDetectSVManyVariants(c *check.C) {
+	rnd := rand.New(rand.NewSource(3))
+	a := randomSequence(rnd, 50000)
+	var vars []Variant
+	for pos := 10; pos < len(a); pos += 10 {
+		vars = append(vars, Variant{Position: pos, Ref: a[pos-1 : pos], New: string("ACGT"[(strings.IndexByte("ACGT", a[pos-1])+1)%4])})
+	}
+	// With 5000 SNPs, each one is only checked against the
+	// following SNPs within SVMaxInversionLength.
+	c.Check(detectSV(a, vars), check.DeepEquals, vars)
+
+	b := a[:1000] + ReverseComplement(a[1000:1200]) + a[1200:]
+	vars = []Variant{{Position: 1001, Ref: a[1000:1200], New: b[1000:1200]}}
+	c.Check(detectSV(a, vars)[0].String(), check.Equals, "1001_1200inv")
+	defer func(orig int) { SVMaxInversionLength = orig }(SVMaxInversionLength)
+	SVMaxInversionLength = 100
+	c.Check(detectSV(a, vars), check.DeepEquals, vars)
+}
+
+func (s *alignSuite) TestMaxAlignCellsInUse(c *check.C) {
+	defer func(orig int) { MaxAlignCellsInUse = orig }(MaxAlignCellsInUse)
+	rnd := rand.New(rand.NewSource(4))
+	a := randomSequence(rnd, 2000)
+	b := a[:100] + "T" + a[101:1900] + "T" + a[1901:]
+	expect, truncated := DiffBanded(a, b, DefaultBandwidth)
+	c.Assert(truncated, check.Equals, false)
+
+	// Each call needs ~500K cells, so only one runs at a time;
+	// the others wait instead of falling back to a single
+	// event.
+	MaxAlignCellsInUse = 600000
+	var wg sync.WaitGroup
+	results := make([][]Variant, 8)
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = DiffBanded(a, b, DefaultBandwidth)
+		}()
+	}
+	wg.Wait()
+	for _, vars := range results {
+		c.Check(vars, check.DeepEquals, expect)
+	}
+	c.Check(alignCellsInUse, check.Equals, 0)
+}
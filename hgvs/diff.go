@@ -20,6 +20,12 @@ type Variant struct {
 }
 
 func (v *Variant) String() string {
+	switch v.SVType() {
+	case "DUP":
+		return fmt.Sprintf("%d_%ddup", v.Position, v.End())
+	case "INV":
+		return fmt.Sprintf("%d_%dinv", v.Position, v.End())
+	}
 	switch {
 	case len(v.New) == 0 && len(v.Ref) == 0:
 		return fmt.Sprintf("%d=", v.Position)
@@ -60,18 +66,157 @@ func (v *Variant) PadLeft() Variant {
 	}
 }
 
+// Normalize3Prime returns a Variant that is equivalent to v but, if
+// v is an insertion or deletion in a repetitive region of ref, has
+// been shifted as far as possible toward the 3' end, as required by
+// HGVS nomenclature.
+//
+// ref is the reference sequence that v.Position refers to, i.e.,
+// v.Ref == ref[v.Position-1:v.Position-1+len(v.Ref)].
+//
+// For example, given ref "CAAAG", {Position: 2, Ref: "A"} is
+// normalized to {Position: 4, Ref: "A", Left: "A"}.
+func (v *Variant) Normalize3Prime(ref string) Variant {
+	return v.shift3Prime(ref, len(ref))
+}
+
+// NormalizeLeft returns a Variant that is equivalent to v but, if v
+// is an insertion or deletion in a repetitive region of ref, has
+// been shifted as far as possible toward the 5' end, as expected in
+// VCF.
+//
+// For example, given ref "CAAAG", {Position: 4, Ref: "A"} is
+// normalized to {Position: 2, Ref: "A", Left: "C"}.
+func (v *Variant) NormalizeLeft(ref string) Variant {
+	return v.shiftLeft(ref, 0)
+}
+
+// shift3Prime is Normalize3Prime, but refuses to shift the variant
+// onto ref[limit] or beyond.
+func (v *Variant) shift3Prime(ref string, limit int) Variant {
+	out := *v
+	if len(out.Ref) > 0 && len(out.New) > 0 {
+		return out
+	}
+	if limit > len(ref) {
+		limit = len(ref)
+	}
+	shifted := false
+	if len(out.Ref) > 0 {
+		// deletion: ref[i] moves from after the deleted
+		// part to the end of the deleted part
+		for i := out.Position - 1 + len(out.Ref); i < limit && ref[i] == out.Ref[0]; i++ {
+			out.Ref = out.Ref[1:] + ref[i:i+1]
+			out.Position++
+			shifted = true
+		}
+	} else if len(out.New) > 0 {
+		// insertion before ref[i]
+		for i := out.Position - 1; i < limit && ref[i] == out.New[0]; i++ {
+			out.New = out.New[1:] + ref[i:i+1]
+			out.Position++
+			shifted = true
+		}
+	}
+	if shifted {
+		out.Left = ref[out.Position-2 : out.Position-1]
+	}
+	return out
+}
+
+// shiftLeft is NormalizeLeft, but refuses to shift the variant onto
+// ref[floor] or before.
+func (v *Variant) shiftLeft(ref string, floor int) Variant {
+	out := *v
+	if len(out.Ref) > 0 && len(out.New) > 0 {
+		return out
+	}
+	if floor < 0 {
+		floor = 0
+	}
+	shifted := false
+	if len(out.Ref) > 0 {
+		for i := out.Position - 2; i >= floor && i < len(ref) && ref[i] == out.Ref[len(out.Ref)-1]; i-- {
+			out.Ref = ref[i:i+1] + out.Ref[:len(out.Ref)-1]
+			out.Position--
+			shifted = true
+		}
+	} else if len(out.New) > 0 {
+		for i := out.Position - 2; i >= floor && i < len(ref) && ref[i] == out.New[len(out.New)-1]; i-- {
+			out.New = ref[i:i+1] + out.New[:len(out.New)-1]
+			out.Position--
+			shifted = true
+		}
+	}
+	if shifted {
+		if out.Position >= 2 {
+			out.Left = ref[out.Position-2 : out.Position-1]
+		} else {
+			out.Left = ""
+		}
+	}
+	return out
+}
+
+// LeftAlign returns a copy of variants (which must be sorted and
+// non-overlapping, as returned by Diff) with each insertion and
+// deletion shifted as far toward the 5' end of ref as possible
+// without crossing the preceding variant or the unchanged base
+// following it (which is needed as the Left base).
+func LeftAlign(ref string, variants []Variant) []Variant {
+	out := make([]Variant, 0, len(variants))
+	floor := 0
+	for _, v := range variants {
+		v = v.shiftLeft(ref, floor)
+		if n := len(out); n > 0 && out[n-1] == v {
+			continue
+		}
+		out = append(out, v)
+		floor = v.Position + len(v.Ref)
+	}
+	return out
+}
+
 func Diff(a, b string, timeout time.Duration) ([]Variant, bool) {
 	dmp := diffmatchpatch.New()
 	var deadline time.Time
 	if timeout > 0 {
 		deadline = time.Now().Add(timeout)
 	}
-	diffs := dmp.DiffBisect(a, b, deadline)
+	// Diff only the part between the common prefix and suffix,
+	// so a large insertion or deletion is reported as a single
+	// event rather than whatever DiffBisect happens to find.
+	prefix := dmp.DiffCommonPrefix(a, b)
+	suffix := dmp.DiffCommonSuffix(a[prefix:], b[prefix:])
+	var diffs []diffmatchpatch.Diff
+	if prefix > 0 {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: a[:prefix]})
+	}
+	if amid, bmid := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]; len(amid) < 2 || len(bmid) < 2 {
+		// Trivial (and DiffBisect crashes on some very short
+		// inputs)
+		if amid != "" {
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: amid})
+		}
+		if bmid != "" {
+			diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: bmid})
+		}
+	} else {
+		diffs = append(diffs, dmp.DiffBisect(amid, bmid, deadline)...)
+	}
+	if suffix > 0 {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: a[len(a)-suffix:]})
+	}
 	timedOut := false
 	if timeout > 0 && time.Now().After(deadline) {
 		timedOut = true
 	}
-	diffs = cleanup(dmp.DiffCleanupEfficiency(diffs))
+	return diffsToVariants(a, cleanup(dmp.DiffCleanupEfficiency(diffs))), timedOut
+}
+
+// diffsToVariants converts a cleaned-up diff between a and some other
+// sequence to a list of normalized variants.
+func diffsToVariants(a string, diffs []diffmatchpatch.Diff) []Variant {
 	pos := 1
 	var variants []Variant
 	for i := 0; i < len(diffs); {
@@ -108,7 +253,26 @@ func Diff(a, b string, timeout time.Duration) ([]Variant, bool) {
 		variants = append(variants, v)
 		left = ""
 	}
-	return variants, timedOut
+	return detectSV(a, normalize3Prime(a, variants))
+}
+
+// normalize3Prime shifts each insertion and deletion as far toward
+// the 3' end of ref as possible without crossing the following
+// variant, and removes duplicates.
+func normalize3Prime(ref string, variants []Variant) []Variant {
+	out := variants[:0]
+	for i, v := range variants {
+		limit := len(ref)
+		if i+1 < len(variants) {
+			limit = variants[i+1].Position - 1
+		}
+		v = v.shift3Prime(ref, limit)
+		if n := len(out); n > 0 && out[n-1] == v {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
 }
 
 func cleanup(in []diffmatchpatch.Diff) (out []diffmatchpatch.Diff) {
@@ -149,28 +149,28 @@ func (s *diffSuite) TestDiff(c *check.C) {
 			expect: []string{"3A>G", "4T>C", "7del"},
 		},
 		{
-			// should delete leftmost
+			// should delete rightmost (3')
 			a:      "acgacaTTtttacac",
 			b:      "acgacatttacac",
-			expect: []string{"7_8del"},
+			expect: []string{"10_11del"},
 		},
 		{
-			// should delete leftmost
+			// should delete rightmost (3')
 			a:      "acgacATatatacac",
 			b:      "acgacatatacac",
-			expect: []string{"6_7del"},
+			expect: []string{"11_12del"},
 		},
 		{
-			// should insert leftmost
+			// should insert rightmost (3')
 			a:      "acgacatttacac",
 			b:      "acgacaTTtttacac",
-			expect: []string{"6_7insTT"},
+			expect: []string{"9_10insTT"},
 		},
 		{
-			// should insert leftmost
+			// should insert rightmost (3')
 			a:      "acgacatatacac",
 			b:      "acgacATatatacac",
-			expect: []string{"5_6insAT"},
+			expect: []string{"10_11insTA"},
 		},
 		{
 			a:      "cccacGATAtatcc",
@@ -195,27 +195,27 @@ func (s *diffSuite) TestDiff(c *check.C) {
 		{
 			a:      "aGACGGACAGGGCCCggatgcaa",
 			b:      "aggatgcaa",
-			expect: []string{"2_15del"},
+			expect: []string{"3_16del"},
 		},
 		{
 			a:      "aGACGGACAGGGCCCgt",
 			b:      "agt",
-			expect: []string{"2_15del"},
+			expect: []string{"3_16del"},
 		},
 		{
 			a:      "aGACGGACAGGGCCCgacggacagggccctag",
 			b:      "agacggacagggccctag",
-			expect: []string{"2_15del"},
+			expect: []string{"16_29del"},
 		},
 		{
 			a:      "cagacggacgtggggacccaGACGGACAGGGCCCggtaacc",
 			b:      "cagacggacgtggggacccaggtaacc",
-			expect: []string{"21_34del"},
+			expect: []string{"22_35del"},
 		},
 		{
 			a:      "cagacggacgtggggacccaggtaacc",
 			b:      "cagacggacgtggggacccaGACGGACAGGGCCCggtaacc",
-			expect: []string{"20_21insGACGGACAGGGCCC"},
+			expect: []string{"21_22insACGGACAGGGCCCG"},
 		},
 		{
 			a:      "aggGac",
@@ -235,17 +235,17 @@ func (s *diffSuite) TestDiff(c *check.C) {
 		{
 			a:      "gtaacccc",
 			b:      "gTAAtaacccc",
-			expect: []string{"1_2insTAA"},
+			expect: []string{"4_5insTAA"},
 		},
 		{
 			a:      "cttaaa",
 			b:      "cTTCGttaaa",
-			expect: []string{"1_2insTTCG"},
+			expect: []string{"3_4insCGTT"},
 		},
 		{
 			a:      "tCAACAggg",
 			b:      "tCAggg",
-			expect: []string{"2_4del"},
+			expect: []string{"4_6del"},
 		},
 		{
 			a:      "caaAc",
@@ -255,7 +255,7 @@ func (s *diffSuite) TestDiff(c *check.C) {
 		{
 			a:      "aGGgaca",
 			b:      "agaca",
-			expect: []string{"2_3del"},
+			expect: []string{"3_4del"},
 		},
 	} {
 		c.Log(trial)
@@ -268,3 +268,66 @@ func (s *diffSuite) TestDiff(c *check.C) {
 		c.Check(vars, check.DeepEquals, trial.expect)
 	}
 }
+
+func (s *diffSuite) TestNormalize(c *check.C) {
+	for _, trial := range []struct {
+		ref   string
+		in    Variant
+		right Variant
+		left  Variant
+	}{
+		{
+			ref:   "CAAAG",
+			in:    Variant{Position: 3, Ref: "A", Left: "A"},
+			right: Variant{Position: 4, Ref: "A", Left: "A"},
+			left:  Variant{Position: 2, Ref: "A", Left: "C"},
+		},
+		{
+			ref:   "CAAAG",
+			in:    Variant{Position: 2, New: "A", Left: "C"},
+			right: Variant{Position: 5, New: "A", Left: "A"},
+			left:  Variant{Position: 2, New: "A", Left: "C"},
+		},
+		{
+			ref:   "TCACACAG",
+			in:    Variant{Position: 4, Ref: "CA", Left: "A"},
+			right: Variant{Position: 6, Ref: "CA", Left: "A"},
+			left:  Variant{Position: 2, Ref: "CA", Left: "T"},
+		},
+		{
+			ref:   "ACACG",
+			in:    Variant{Position: 3, New: "AC", Left: "C"},
+			right: Variant{Position: 5, New: "AC", Left: "C"},
+			left:  Variant{Position: 1, New: "AC"},
+		},
+		{
+			ref:   "CAAAG",
+			in:    Variant{Position: 3, Ref: "A", New: "T", Left: "A"},
+			right: Variant{Position: 3, Ref: "A", New: "T", Left: "A"},
+			left:  Variant{Position: 3, Ref: "A", New: "T", Left: "A"},
+		},
+	} {
+		c.Check(trial.in.Normalize3Prime(trial.ref), check.DeepEquals, trial.right)
+		c.Check(trial.in.NormalizeLeft(trial.ref), check.DeepEquals, trial.left)
+		c.Check(trial.right.NormalizeLeft(trial.ref), check.DeepEquals, trial.left)
+		c.Check(trial.left.Normalize3Prime(trial.ref), check.DeepEquals, trial.right)
+	}
+}
+
+func (s *diffSuite) TestLeftAlign(c *check.C) {
+	// The deletion can't be shifted onto the preceding SNP, or
+	// onto the base that would become its Left padding base.
+	ref := "ACCCCG"
+	vars := []Variant{
+		{Position: 2, Ref: "C", New: "T", Left: "A"},
+		{Position: 5, Ref: "C", Left: "C"},
+	}
+	c.Check(LeftAlign(ref, vars), check.DeepEquals, []Variant{
+		{Position: 2, Ref: "C", New: "T", Left: "A"},
+		{Position: 4, Ref: "C", Left: "C"},
+	})
+	// Without the SNP, it can.
+	c.Check(LeftAlign(ref, vars[1:]), check.DeepEquals, []Variant{
+		{Position: 2, Ref: "C", Left: "A"},
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package hgvs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	parseRange  = regexp.MustCompile(`^(\d+)(?:_(\d+))?(.*)$`)
+	parseSubst  = regexp.MustCompile(`^([A-Za-z])>([A-Za-z])$`)
+	parseInsSeq = regexp.MustCompile(`^[A-Za-z]+$`)
+)
+
+// Parse parses a variant in the notation produced by
+// (*Variant).String(), optionally prefixed by "{seqname}:g." or
+// "g.", e.g., "chr1:g.123A>G", "g.10_12del", or "5_6insT".
+//
+// Where the notation does not include the reference sequence (e.g.,
+// "10_12del" or "10_12="), Ref (and, for "=" and "dup", New) is
+// filled in with the appropriate number of "N" bases. For "inv", Ref
+// is filled in with "A" bases and New with "T" bases. Left is always
+// empty.
+//
+// The diploid forms "[a];[b]" and "[a](;)[b]" are rejected; use
+// ParseDiploid.
+func Parse(s string) (seqname string, v Variant, err error) {
+	seqname, s = splitSeqname(s)
+	if strings.HasPrefix(s, "[") {
+		return "", Variant{}, fmt.Errorf("cannot parse diploid variant %q with Parse, use ParseDiploid", s)
+	}
+	v, err = parseVariant(s)
+	return
+}
+
+// ParseDiploid parses a pair of variants in the notation produced by
+// the "hgvs" export format: either "{seqname}:g.[a];[b]" (two
+// alleles), "{seqname}:g.[a](;)[b]" (two alleles, phase unknown), or
+// "{seqname}:g.a" (homozygous, same as "[a];[a]").
+func ParseDiploid(s string) (seqname string, alleles [2]Variant, err error) {
+	seqname, s = splitSeqname(s)
+	if !strings.HasPrefix(s, "[") {
+		alleles[0], err = parseVariant(s)
+		alleles[1] = alleles[0]
+		return
+	}
+	sep := ";"
+	if strings.Contains(s, "(;)") {
+		sep = "(;)"
+	}
+	parts := strings.Split(s, sep)
+	if len(parts) != 2 {
+		return "", alleles, fmt.Errorf("cannot parse diploid variant %q: expected 2 alleles, found %d", s, len(parts))
+	}
+	for i, part := range parts {
+		if len(part) < 2 || part[0] != '[' || part[len(part)-1] != ']' {
+			return "", alleles, fmt.Errorf("cannot parse diploid variant %q: allele %q is not enclosed in []", s, part)
+		}
+		alleles[i], err = parseVariant(part[1 : len(part)-1])
+		if err != nil {
+			return "", alleles, err
+		}
+	}
+	return
+}
+
+// splitSeqname removes the "{seqname}:g." or "g." prefix from s, if
+// present.
+func splitSeqname(s string) (seqname, rest string) {
+	if i := strings.Index(s, ":g."); i >= 0 {
+		return s[:i], s[i+3:]
+	}
+	return "", strings.TrimPrefix(s, "g.")
+}
+
+func parseVariant(s string) (Variant, error) {
+	m := parseRange.FindStringSubmatch(s)
+	if m == nil {
+		return Variant{}, fmt.Errorf("cannot parse variant %q: no position", s)
+	}
+	start, err := strconv.Atoi(m[1])
+	if err != nil {
+		return Variant{}, fmt.Errorf("cannot parse variant %q: %w", s, err)
+	}
+	end := start
+	if m[2] != "" {
+		end, err = strconv.Atoi(m[2])
+		if err != nil {
+			return Variant{}, fmt.Errorf("cannot parse variant %q: %w", s, err)
+		}
+		if end < start {
+			return Variant{}, fmt.Errorf("cannot parse variant %q: end position %d is before start position %d", s, end, start)
+		}
+	}
+	reflen := end - start + 1
+	op := m[3]
+	switch {
+	case op == "=":
+		if m[2] == "" {
+			return Variant{Position: start}, nil
+		}
+		n := strings.Repeat("N", reflen)
+		return Variant{Position: start, Ref: n, New: n}, nil
+	case op == "dup":
+		n := strings.Repeat("N", reflen)
+		return Variant{Position: start, Ref: n, New: n + n}, nil
+	case op == "inv":
+		return Variant{Position: start, Ref: strings.Repeat("A", reflen), New: strings.Repeat("T", reflen)}, nil
+	case op == "del":
+		return Variant{Position: start, Ref: strings.Repeat("N", reflen)}, nil
+	case strings.HasPrefix(op, "delins"):
+		ins := op[6:]
+		if !parseInsSeq.MatchString(ins) {
+			return Variant{}, fmt.Errorf("cannot parse variant %q: invalid inserted sequence %q", s, ins)
+		}
+		return Variant{Position: start, Ref: strings.Repeat("N", reflen), New: ins}, nil
+	case strings.HasPrefix(op, "ins"):
+		ins := op[3:]
+		if !parseInsSeq.MatchString(ins) {
+			return Variant{}, fmt.Errorf("cannot parse variant %q: invalid inserted sequence %q", s, ins)
+		}
+		if end != start+1 {
+			return Variant{}, fmt.Errorf("cannot parse variant %q: insertion must be between adjacent positions", s)
+		}
+		return Variant{Position: end, New: ins}, nil
+	case m[2] == "":
+		if sm := parseSubst.FindStringSubmatch(op); sm != nil {
+			return Variant{Position: start, Ref: sm[1], New: sm[2]}, nil
+		}
+	}
+	return Variant{}, fmt.Errorf("cannot parse variant %q: unrecognized operation %q", s, op)
+}
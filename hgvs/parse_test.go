@@ -0,0 +1,129 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package hgvs
+
+import (
+	"math/rand"
+
+	"gopkg.in/check.v1"
+)
+
+type parseSuite struct{}
+
+var _ = check.Suite(&parseSuite{})
+
+func (s *parseSuite) TestParse(c *check.C) {
+	for _, trial := range []struct {
+		in      string
+		seqname string
+		expect  Variant
+	}{
+		{"chr1:g.123A>G", "chr1", Variant{Position: 123, Ref: "A", New: "G"}},
+		{"g.10_12del", "", Variant{Position: 10, Ref: "NNN"}},
+		{"7del", "", Variant{Position: 7, Ref: "N"}},
+		{"chr2:g.5_6insTT", "chr2", Variant{Position: 6, New: "TT"}},
+		{"chrX:g.3delinsGC", "chrX", Variant{Position: 3, Ref: "N", New: "GC"}},
+		{"chrX:g.3_4delinsGCA", "chrX", Variant{Position: 3, Ref: "NN", New: "GCA"}},
+		{"chr1:g.469=", "chr1", Variant{Position: 469}},
+		{"chr1:g.469_470=", "chr1", Variant{Position: 469, Ref: "NN", New: "NN"}},
+		{"chr1:g.10_12dup", "chr1", Variant{Position: 10, Ref: "NNN", New: "NNNNNN"}},
+		{"chr1:g.10_12inv", "chr1", Variant{Position: 10, Ref: "AAA", New: "TTT"}},
+	} {
+		seqname, v, err := Parse(trial.in)
+		c.Check(err, check.IsNil, check.Commentf("%s", trial.in))
+		c.Check(seqname, check.Equals, trial.seqname)
+		c.Check(v, check.DeepEquals, trial.expect)
+	}
+	for _, bad := range []string{
+		"",
+		"chr1:g.",
+		"chr1:g.A>G",
+		"chr1:g.12_10del",
+		"chr1:g.12_14insA",
+		"chr1:g.12_13ins",
+		"chr1:g.12_13A>G",
+		"chr1:g.12foo",
+		"chr1:g.[1del];[1=]",
+	} {
+		_, _, err := Parse(bad)
+		c.Check(err, check.NotNil, check.Commentf("%q", bad))
+	}
+}
+
+func (s *parseSuite) TestParseDiploid(c *check.C) {
+	seqname, alleles, err := ParseDiploid("chr2:g.[470_472del];[470=]")
+	c.Check(err, check.IsNil)
+	c.Check(seqname, check.Equals, "chr2")
+	c.Check(alleles, check.DeepEquals, [2]Variant{{Position: 470, Ref: "NNN"}, {Position: 470}})
+
+	seqname, alleles, err = ParseDiploid("chr2:g.[470=](;)[470_472del]")
+	c.Check(err, check.IsNil)
+	c.Check(seqname, check.Equals, "chr2")
+	c.Check(alleles, check.DeepEquals, [2]Variant{{Position: 470}, {Position: 470, Ref: "NNN"}})
+
+	seqname, alleles, err = ParseDiploid("chr2:g.471G>A")
+	c.Check(err, check.IsNil)
+	c.Check(seqname, check.Equals, "chr2")
+	c.Check(alleles, check.DeepEquals, [2]Variant{{Position: 471, Ref: "G", New: "A"}, {Position: 471, Ref: "G", New: "A"}})
+
+	for _, bad := range []string{
+		"chr2:g.[470_472del]",
+		"chr2:g.[470_472del];[470=];[470=]",
+		"chr2:g.[470_472del];470=",
+		"chr2:g.[470_472del];[foo]",
+		"chr2:g.[470_472del](;)[470=](;)[470=]",
+		"chr2:g.[470_472del];[470=](;)[470=]",
+	} {
+		_, _, err := ParseDiploid(bad)
+		c.Check(err, check.NotNil, check.Commentf("%q", bad))
+	}
+}
+
+// Parse(v.String()) should produce a variant whose String() is
+// identical to v.String().
+func (s *parseSuite) TestRoundTrip(c *check.C) {
+	randseq := func(n int) string {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "ACGT"[rand.Intn(4)]
+		}
+		return string(seq)
+	}
+	rand.Seed(1)
+	for i := 0; i < 10000; i++ {
+		v := Variant{
+			Position: 2 + rand.Intn(1000),
+			Ref:      randseq(rand.Intn(4)),
+			New:      randseq(rand.Intn(4)),
+		}
+		switch rand.Intn(8) {
+		case 0, 1:
+			v.New = v.Ref
+		case 2:
+			v.Ref = randseq(SVMinLength + rand.Intn(100))
+			v.New = v.Ref + v.Ref
+		case 3:
+			v.Ref = randseq(SVMinLength + rand.Intn(100))
+			v.New = ReverseComplement(v.Ref)
+		}
+		str := v.String()
+		seqname, parsed, err := Parse("chr1:g." + str)
+		if !c.Check(err, check.IsNil, check.Commentf("%+v %q", v, str)) {
+			continue
+		}
+		c.Check(seqname, check.Equals, "chr1")
+		c.Check(parsed.String(), check.Equals, str, check.Commentf("%+v", v))
+
+		v2 := Variant{Position: v.Position, Ref: v.Ref, New: randseq(1 + rand.Intn(3))}
+		str2 := v2.String()
+		for _, sep := range []string{";", "(;)"} {
+			_, alleles, err := ParseDiploid("chr1:g.[" + str + "]" + sep + "[" + str2 + "]")
+			if c.Check(err, check.IsNil, check.Commentf("%q", sep)) {
+				c.Check(alleles[0].String(), check.Equals, str)
+				c.Check(alleles[1].String(), check.Equals, str2)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package hgvs
+
+import (
+	"strings"
+)
+
+// SVMinLength is the minimum size of an event that is reported as a
+// structural variant (dup or inv notation in HGVS, and a symbolic
+// allele in VCF). Smaller events are spelled out in full.
+var SVMinLength = 50
+
+// SVMaxInversionLength is the maximum size of the reference region
+// that is checked for an inversion that was diffed as a series of
+// smaller variants.
+var SVMaxInversionLength = 10000
+
+// SVType returns "DEL", "DUP", or "INV" if v is a deletion,
+// duplication, or inversion of at least SVMinLength bases, otherwise
+// "".
+//
+// A duplication is represented as {Ref: X, New: X+X}, and an
+// inversion as {Ref: X, New: reverse complement of X}. Diff returns
+// variants in this form when it detects a large duplication or
+// inversion.
+//
+// A deletion can be either plain ({Ref: X, New: ""}) or left-padded
+// as returned by PadLeft ({Ref: Left+X, New: Left}).
+func (v *Variant) SVType() string {
+	switch {
+	case len(v.New) <= 1 && len(v.Ref)-len(v.New) >= SVMinLength && strings.HasPrefix(v.Ref, v.New):
+		return "DEL"
+	case len(v.Ref) >= SVMinLength && len(v.New) == len(v.Ref)*2 && v.New[:len(v.Ref)] == v.Ref && v.New[len(v.Ref):] == v.Ref:
+		return "DUP"
+	case len(v.Ref) >= SVMinLength && len(v.New) == len(v.Ref) && v.New != v.Ref && v.New == ReverseComplement(v.Ref):
+		return "INV"
+	default:
+		return ""
+	}
+}
+
+// SVLen returns the SVLEN value for a structural variant in VCF:
+// negative for a deletion, otherwise the length of the affected
+// reference region.
+func (v *Variant) SVLen() int {
+	if v.SVType() == "DEL" {
+		return len(v.New) - len(v.Ref)
+	}
+	return len(v.Ref)
+}
+
+// End returns the position of the last reference base affected by v
+// (for an insertion, the base before the insertion point).
+func (v *Variant) End() int {
+	return v.Position + len(v.Ref) - 1
+}
+
+var complement = [256]byte{
+	'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A', 'N': 'N',
+	'a': 't', 'c': 'g', 'g': 'c', 't': 'a', 'n': 'n',
+}
+
+// ReverseComplement returns the reverse complement of a nucleotide
+// sequence. Bases other than ACGTN are left as is.
+func ReverseComplement(seq string) string {
+	out := make([]byte, len(seq))
+	for i := 0; i < len(seq); i++ {
+		c := complement[seq[len(seq)-1-i]]
+		if c == 0 {
+			c = seq[len(seq)-1-i]
+		}
+		out[i] = c
+	}
+	return string(out)
+}
+
+// detectSV returns variants, with large tandem duplications and
+// inversions (including inversions that were diffed as a series of
+// smaller variants) replaced by their compact form.
+//
+// variants must be sorted, non-overlapping, and 3'-normalized.
+func detectSV(ref string, variants []Variant) []Variant {
+	out := make([]Variant, 0, len(variants))
+	for i := 0; i < len(variants); i++ {
+		v := variants[i]
+		// An insertion immediately following an identical
+		// copy of the inserted sequence is a duplication.
+		if n := len(v.New); len(v.Ref) == 0 && n >= SVMinLength && v.Position-1 >= n && ref[v.Position-1-n:v.Position-1] == v.New {
+			dup := Variant{Position: v.Position - n, Ref: v.New, New: v.New + v.New}
+			if dup.Position >= 2 {
+				dup.Left = ref[dup.Position-2 : dup.Position-1]
+			}
+			out = append(out, dup)
+			continue
+		}
+		// Find the longest run of variants i..j such that the
+		// affected reference region (possibly excluding a few
+		// unchanged bases at either end, where the diff may
+		// have aligned the inverted sequence differently) is
+		// inverted.
+		var newseq strings.Builder
+		best, bestStart, bestEnd := -1, 0, 0
+		for j := i; j < len(variants); j++ {
+			start, end := v.Position, variants[j].End()
+			if end-start+1 > SVMaxInversionLength {
+				break
+			}
+			if j > i {
+				newseq.WriteString(ref[variants[j-1].End() : variants[j].Position-1])
+			}
+			newseq.WriteString(variants[j].New)
+			if end-start+1 < SVMinLength || newseq.Len() != end-start+1 {
+				continue
+			}
+			if istart, iend, ok := findInversion(ref[start-1:end], newseq.String()); ok {
+				best, bestStart, bestEnd = j, start+istart, start+iend-1
+			}
+		}
+		if best < 0 {
+			out = append(out, v)
+			continue
+		}
+		inv := Variant{Position: bestStart, Ref: ref[bestStart-1 : bestEnd], New: ReverseComplement(ref[bestStart-1 : bestEnd])}
+		if bestStart >= 2 {
+			inv.Left = ref[bestStart-2 : bestStart-1]
+		}
+		out = append(out, inv)
+		i = best
+	}
+	return out
+}
+
+// findInversion returns start, end such that newseq[start:end] is
+// the reverse complement of refseq[start:end], refseq and newseq are
+// otherwise identical, and end-start >= SVMinLength.
+func findInversion(refseq, newseq string) (int, int, bool) {
+	const maxFlank = 16
+	n := len(refseq)
+	prefix := 0
+	for prefix < n && prefix < maxFlank && refseq[prefix] == newseq[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < maxFlank && refseq[n-1-suffix] == newseq[n-1-suffix] {
+		suffix++
+	}
+	for start := 0; start <= prefix; start++ {
+		for end := n; end >= n-suffix; end-- {
+			if end-start < SVMinLength {
+				break
+			}
+			if isReverseComplement(refseq[start:end], newseq[start:end]) && refseq[start:end] != newseq[start:end] {
+				return start, end, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// isReverseComplement returns true if b == ReverseComplement(a).
+// Unlike ReverseComplement, it does not allocate, and it returns as
+// soon as it finds a difference.
+func isReverseComplement(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		c := complement[a[len(a)-1-i]]
+		if c == 0 {
+			c = a[len(a)-1-i]
+		}
+		if c != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -23,6 +23,7 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -43,7 +44,11 @@ type importer struct {
 	skipOOO             bool
 	outputTiles         bool
 	saveIncompleteTiles bool
+	approxTags          bool
 	outputStats         string
+	ploidyFile          string
+	ploidy              ploidySpec
+	haploid             bool
 	matchChromosome     *regexp.Regexp
 	encoder             *gob.Encoder
 	retainAfterEncoding bool // keep imported genomes/refseqs in memory after writing to disk
@@ -66,8 +71,11 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
 	flags.BoolVar(&cmd.skipOOO, "skip-ooo", false, "skip out-of-order tags")
 	flags.BoolVar(&cmd.outputTiles, "output-tiles", false, "include tile variant sequences in output file")
-	flags.BoolVar(&cmd.saveIncompleteTiles, "save-incomplete-tiles", false, "treat tiles with no-calls as regular tiles")
+	flags.BoolVar(&cmd.saveIncompleteTiles, "save-incomplete-tiles", false, "save sequences of tiles with no-calls (otherwise only their no-call positions are saved), so downstream tools can use the called bases")
+	flags.BoolVar(&cmd.approxTags, "approx-tags", false, "allow one mismatch (e.g., SNP or no-call) in a tag that is expected between two exactly matching tags")
 	flags.StringVar(&cmd.outputStats, "output-stats", "", "output stats to `file` (json)")
+	flags.StringVar(&cmd.ploidyFile, "ploidy", "", "csv `file` with genome,sequence,ploidy lines for non-diploid sequences, e.g., \"*,chrM,1\" (genome/sequence \"*\" matches all)")
+	flags.BoolVar(&cmd.haploid, "haploid", false, "import genomes that have a .1.fa file but no .2.fa file as haploid")
 	cmd.batchArgs.Flags(flags)
 	matchChromosome := flags.String("match-chromosome", "^(chr)?([0-9]+|X|Y|MT?)$", "import chromosomes that match the given `regexp`")
 	flags.IntVar(&cmd.priority, "priority", 500, "container request priority")
@@ -118,6 +126,15 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 	infiles = cmd.batchArgs.Slice(infiles)
 
+	if cmd.ploidyFile != "" {
+		cmd.ploidy, err = loadPloidySpec(cmd.ploidyFile)
+		if err != nil {
+			return 1
+		}
+	}
+
+	prov := startProvenance(prog, args, append([]string{cmd.tagLibraryFile, cmd.refFile, cmd.ploidyFile}, infiles...)...)
+
 	taglib, err := cmd.loadTagLibrary()
 	if err != nil {
 		return 1
@@ -141,7 +158,7 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	bufw := bufio.NewWriterSize(outw, 64*1024*1024)
 	cmd.encoder = gob.NewEncoder(bufw)
 
-	tilelib := &tileLibrary{taglib: taglib, retainNoCalls: cmd.saveIncompleteTiles, skipOOO: cmd.skipOOO}
+	tilelib := &tileLibrary{taglib: taglib, retainNoCalls: cmd.saveIncompleteTiles, skipOOO: cmd.skipOOO, approxTags: cmd.approxTags}
 	if cmd.outputTiles {
 		cmd.encoder.Encode(LibraryEntry{TagSet: taglib.Tags()})
 		tilelib.encoder = cmd.encoder
@@ -156,6 +173,14 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	if err != nil {
 		return 1
 	}
+	p, err := prov.finish()
+	if err != nil {
+		return 1
+	}
+	err = cmd.encoder.Encode(LibraryEntry{Provenance: []Provenance{p}})
+	if err != nil {
+		return 1
+	}
 	err = bufw.Flush()
 	if err != nil {
 		return 1
@@ -190,7 +215,7 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 		Priority:    cmd.priority,
 		KeepCache:   1,
 	}
-	err := runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.outputFile)
+	err := runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.outputFile, &cmd.ploidyFile)
 	if err != nil {
 		return err
 	}
@@ -213,8 +238,11 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 			fmt.Sprintf("-skip-ooo=%v", cmd.skipOOO),
 			fmt.Sprintf("-output-tiles=%v", cmd.outputTiles),
 			fmt.Sprintf("-save-incomplete-tiles=%v", cmd.saveIncompleteTiles),
+			fmt.Sprintf("-approx-tags=%v", cmd.approxTags),
 			"-match-chromosome", cmd.matchChromosome.String(),
 			"-output-stats", "/mnt/output/stats.json",
+			"-ploidy", cmd.ploidyFile,
+			fmt.Sprintf("-haploid=%v", cmd.haploid),
 			"-tag-library", cmd.tagLibraryFile,
 			"-ref", cmd.refFile,
 			"-o", "/mnt/output/library.gob.gz",
@@ -234,7 +262,7 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 	return nil
 }
 
-func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string, isRef bool) (tileSeq, []importStats, error) {
+func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string, matchChromosome sequenceMatcher, isRef bool) (tileSeq, []importStats, error) {
 	var input io.ReadCloser
 	input, err := open(infile)
 	if err != nil {
@@ -249,7 +277,7 @@ func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string, isRef bool)
 		}
 		defer input.Close()
 	}
-	return tilelib.TileFasta(infile, input, cmd.matchChromosome, isRef)
+	return tilelib.TileFasta(infile, input, matchChromosome, isRef)
 }
 
 func (cmd *importer) loadTagLibrary() (*tagLibrary, error) {
@@ -344,29 +372,43 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 		var phases sync.WaitGroup
 		phases.Add(2)
 		variants := make([][]tileVariantID, 2)
+		tseqs := make([]tileSeq, 2)
+		haploidInput := false
+		unphased := func() map[string]bool { return nil }
 		if fasta1FilenameRe.MatchString(infile) {
 			todo <- func() error {
 				defer phases.Done()
 				log.Printf("%s starting", infile)
 				defer log.Printf("%s done", infile)
-				tseqs, stats, err := cmd.tileFasta(tilelib, infile, false)
+				tseq, stats, err := cmd.tileFasta(tilelib, infile, cmd.matchChromosome, false)
 				allstats[idx*2] = stats
 				var kept, dropped int
-				variants[0], kept, dropped = tseqs.Variants()
+				variants[0], kept, dropped = tseq.Variants()
+				tseqs[0] = tseq
 				log.Printf("%s found %d unique tags plus %d repeats", infile, kept, dropped)
 				return err
 			}
 			infile2 := fasta1FilenameRe.ReplaceAllString(infile, `.2.fa$1$2`)
-			todo <- func() error {
-				defer phases.Done()
-				log.Printf("%s starting", infile2)
-				defer log.Printf("%s done", infile2)
-				tseqs, stats, err := cmd.tileFasta(tilelib, infile2, false)
-				allstats[idx*2+1] = stats
-				var kept, dropped int
-				variants[1], kept, dropped = tseqs.Variants()
-				log.Printf("%s found %d unique tags plus %d repeats", infile2, kept, dropped)
-				return err
+			if _, err := os.Stat(infile2); os.IsNotExist(err) && (cmd.haploid || cmd.ploidy.ploidy(trimFilenameForLabel(infile), "*") == 1) {
+				// Only one haplotype is provided, and
+				// the whole genome is declared
+				// haploid.
+				log.Printf("%s not found, importing %s as haploid", infile2, infile)
+				haploidInput = true
+				phases.Done()
+			} else {
+				todo <- func() error {
+					defer phases.Done()
+					log.Printf("%s starting", infile2)
+					defer log.Printf("%s done", infile2)
+					tseq, stats, err := cmd.tileFasta(tilelib, infile2, cmd.matchDiploid(infile), false)
+					allstats[idx*2+1] = stats
+					var kept, dropped int
+					variants[1], kept, dropped = tseq.Variants()
+					tseqs[1] = tseq
+					log.Printf("%s found %d unique tags plus %d repeats", infile2, kept, dropped)
+					return err
+				}
 			}
 		} else if fastaFilenameRe.MatchString(infile) {
 			todo <- func() error {
@@ -374,7 +416,7 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 				defer phases.Done()
 				log.Printf("%s starting", infile)
 				defer log.Printf("%s done", infile)
-				tseqs, stats, err := cmd.tileFasta(tilelib, infile, true)
+				tseqs, stats, err := cmd.tileFasta(tilelib, infile, cmd.matchChromosome, true)
 				allstats[idx*2] = stats
 				if err != nil {
 					return err
@@ -401,20 +443,68 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 			// Don't write out a CompactGenomes entry
 			continue
 		} else if vcfFilenameRe.MatchString(infile) {
+			var phasingOnce sync.Once
+			var phasingErr error
+			unphasedSeqs, phasedSeqs := map[string]bool{}, map[string]bool{}
 			for phase := 0; phase < 2; phase++ {
 				phase := phase
 				todo <- func() error {
 					defer phases.Done()
+					phasingOnce.Do(func() {
+						unphasedSeqs, phasedSeqs, phasingErr = vcfPhasing(infile)
+						if len(unphasedSeqs) > 0 {
+							log.Printf("%s has unphased heterozygous genotypes on %d sequences", infile, len(unphasedSeqs))
+						}
+					})
+					if phasingErr != nil {
+						return phasingErr
+					}
 					log.Printf("%s phase %d starting", infile, phase+1)
 					defer log.Printf("%s phase %d done", infile, phase+1)
-					tseqs, stats, err := cmd.tileGVCF(tilelib, infile, phase)
+					var match sequenceMatcher = cmd.matchChromosome
+					if phase > 0 {
+						match = cmd.matchDiploid(infile)
+					}
+					var tseq tileSeq
+					var stats []importStats
+					var err error
+					if len(unphasedSeqs) == 0 || len(phasedSeqs) > 0 {
+						tseq, stats, err = cmd.tileGVCF(tilelib, infile, phase, fmt.Sprint(phase+1), match)
+						if err != nil {
+							return err
+						}
+					}
+					if len(unphasedSeqs) > 0 {
+						// On unphased sequences, put
+						// the REF allele of each het
+						// genotype in phase 1 and the
+						// ALT allele in phase 2, so
+						// the same unphased genotype
+						// always yields the same pair
+						// of tile variants.
+						useq, ustats, err := cmd.tileGVCF(tilelib, infile, phase, []string{"R", "A"}[phase], match)
+						if err != nil {
+							return err
+						}
+						if tseq == nil {
+							tseq, stats = useq, ustats
+						} else {
+							for seqname := range unphasedSeqs {
+								if _, ok := useq[seqname]; ok {
+									tseq[seqname] = useq[seqname]
+								}
+							}
+						}
+					}
 					allstats[idx*2] = stats
 					var kept, dropped int
-					variants[phase], kept, dropped = tseqs.Variants()
+					variants[phase], kept, dropped = tseq.Variants()
+					tseqs[phase] = tseq
 					log.Printf("%s phase %d found %d unique tags plus %d repeats", infile, phase+1, kept, dropped)
-					return err
+					return nil
 				}
 			}
+			unphased = func() map[string]bool { return unphasedSeqs }
 		} else {
 			panic(fmt.Sprintf("bug: unhandled filename %q", infile))
 		}
@@ -425,9 +515,44 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 			if len(errs) > 0 {
 				return
 			}
-			variants := flatten(variants)
-			err := cmd.encoder.Encode(LibraryEntry{
-				CompactGenomes: []CompactGenome{{Name: infile, Variants: variants}},
+			ploidy, err := cmd.genomePloidy(infile, tseqs, haploidInput)
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+				return
+			}
+			if haploidInput {
+				variants = variants[:1]
+			} else {
+				// Replace the second haplotype of
+				// each haploid sequence with the
+				// first.
+				for seqname, p := range ploidy {
+					if p != 1 {
+						continue
+					}
+					for _, libref := range tseqs[0][seqname] {
+						for len(variants[1]) <= int(libref.Tag) {
+							variants[1] = append(variants[1], 0)
+						}
+						variants[1][libref.Tag] = libref.Variant
+					}
+				}
+			}
+			var unphasedSeqs map[string]bool
+			for seqname := range unphased() {
+				if _, ok := tseqs[0][seqname]; ok && ploidy[seqname] != 1 {
+					if unphasedSeqs == nil {
+						unphasedSeqs = map[string]bool{}
+					}
+					unphasedSeqs[seqname] = true
+				}
+			}
+			cg := CompactGenome{Name: infile, Variants: flatten(variants), Ploidy: ploidy, Unphased: unphasedSeqs}
+			err = cmd.encoder.Encode(LibraryEntry{
+				CompactGenomes: []CompactGenome{cg},
 			})
 			if err != nil {
 				select {
@@ -440,7 +565,8 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 				if tilelib.compactGenomes == nil {
 					tilelib.compactGenomes = make(map[string][]tileVariantID)
 				}
-				tilelib.compactGenomes[infile] = variants
+				tilelib.compactGenomes[infile] = cg.Variants
+				tilelib.setGenomeMeta(cg)
 				tilelib.mtx.Unlock()
 			}
 		}()
@@ -508,12 +634,15 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 	return nil
 }
 
-func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (tileseq tileSeq, stats []importStats, err error) {
+// tileGVCF tiles the given haplotype ("1", "2", or another bcftools
+// consensus -H argument) of the sequences in infile that match
+// matchChromosome. The phase argument is used in log messages only.
+func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int, haplotype string, matchChromosome sequenceMatcher) (tileseq tileSeq, stats []importStats, err error) {
 	if cmd.refFile == "" {
 		err = errors.New("cannot import vcf: reference data (-ref) not specified")
 		return
 	}
-	args := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", fmt.Sprint(phase + 1), infile}
+	args := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", haplotype, infile}
 	indexsuffix := ".tbi"
 	if _, err := os.Stat(infile + ".csi"); err == nil {
 		indexsuffix = ".csi"
@@ -540,7 +669,7 @@ func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (t
 		return
 	}
 	defer consensus.Wait()
-	tileseq, stats, err = tilelib.TileFasta(fmt.Sprintf("%s phase %d", infile, phase+1), stdout, cmd.matchChromosome, false)
+	tileseq, stats, err = tilelib.TileFasta(fmt.Sprintf("%s phase %d", infile, phase+1), stdout, matchChromosome, false)
 	if err != nil {
 		return
 	}
@@ -556,6 +685,82 @@ func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (t
 	return
 }
 
+// vcfPhasing returns the names of sequences that have unphased
+// heterozygous genotypes (e.g., "0/1") and the names of sequences
+// that have phased heterozygous genotypes (e.g., "1|0") in the given
+// VCF file.
+//
+// Each VCF file is imported as a single genome, so it is an error
+// if the file has more than one sample.
+func vcfPhasing(infile string) (unphased, phased map[string]bool, err error) {
+	f, err := open(infile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var rdr io.Reader = bufio.NewReaderSize(f, 8*1024*1024)
+	if strings.HasSuffix(infile, ".gz") {
+		zrdr, err := pgzip.NewReader(rdr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", infile, err)
+		}
+		defer zrdr.Close()
+		rdr = zrdr
+	}
+	unphased, phased = map[string]bool{}, map[string]bool{}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#CHROM") {
+			if n := len(strings.Split(line, "\t")) - 9; n > 1 {
+				return nil, nil, fmt.Errorf("%s: cannot import multi-sample VCF (%d samples)", infile, n)
+			}
+			continue
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 11)
+		if len(fields) < 10 {
+			continue
+		}
+		gtidx := -1
+		for i, key := range strings.Split(fields[8], ":") {
+			if key == "GT" {
+				gtidx = i
+				break
+			}
+		}
+		sample := strings.Split(fields[9], ":")
+		if gtidx < 0 || gtidx >= len(sample) {
+			continue
+		}
+		gt := sample[gtidx]
+		sep := "|"
+		if strings.Contains(gt, "/") {
+			sep = "/"
+		}
+		alleles := strings.Split(gt, sep)
+		if len(alleles) != 2 || alleles[0] == alleles[1] || alleles[0] == "." || alleles[1] == "." {
+			// haploid, homozygous, or no-call
+			continue
+		}
+		if sep == "/" {
+			unphased[fields[0]] = true
+		} else {
+			phased[fields[0]] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", infile, err)
+	}
+	return unphased, phased, nil
+}
+
+// flatten interleaves per-haplotype variants into the
+// CompactGenome.Variants layout. If only one haplotype is given, it
+// is used for both entries.
 func flatten(variants [][]tileVariantID) []tileVariantID {
 	ntags := 0
 	for _, v := range variants {
@@ -566,10 +771,99 @@ func flatten(variants [][]tileVariantID) []tileVariantID {
 	flat := make([]tileVariantID, ntags*2)
 	for i := 0; i < ntags; i++ {
 		for hap := 0; hap < 2; hap++ {
-			if i < len(variants[hap]) {
-				flat[i*2+hap] = variants[hap][i]
+			if vs := variants[hap%len(variants)]; i < len(vs) {
+				flat[i*2+hap] = vs[i]
 			}
 		}
 	}
 	return flat
 }
+
+// matchDiploid returns a sequenceMatcher that matches the sequences
+// that match cmd.matchChromosome and are not haploid in the given
+// input file according to cmd.ploidy. It is used when tiling the
+// second haplotype, which haploid sequences don't have.
+func (cmd *importer) matchDiploid(infile string) sequenceMatcher {
+	label := trimFilenameForLabel(infile)
+	return matchFunc(func(seqname string) bool {
+		return cmd.matchChromosome.MatchString(seqname) && cmd.ploidy.ploidy(label, seqname) != 1
+	})
+}
+
+// genomePloidy returns the CompactGenome.Ploidy map for the given
+// input file: the non-diploid sequences according to cmd.ploidy, or
+// all sequences if haploid is true.
+func (cmd *importer) genomePloidy(infile string, tseqs []tileSeq, haploid bool) (map[string]int, error) {
+	label := trimFilenameForLabel(infile)
+	ploidy := map[string]int{}
+	for _, tseq := range tseqs {
+		for seqname := range tseq {
+			p := cmd.ploidy.ploidy(label, seqname)
+			if haploid {
+				p = 1
+			}
+			if p == 2 {
+				continue
+			} else if p != 1 {
+				return nil, fmt.Errorf("%s: %s: ploidy %d not supported", infile, seqname, p)
+			}
+			ploidy[seqname] = p
+		}
+	}
+	if len(ploidy) == 0 {
+		return nil, nil
+	}
+	return ploidy, nil
+}
+
+// ploidySpec maps genome label (see trimFilenameForLabel) and
+// sequence name to ploidy. "*" matches any genome/sequence.
+type ploidySpec map[string]map[string]int
+
+// loadPloidySpec reads a csv file with genome,sequence,ploidy lines.
+// Blank lines and lines starting with "#" are ignored.
+func loadPloidySpec(filename string) (ploidySpec, error) {
+	f, err := open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	spec := ploidySpec{}
+	for lineIdx, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s line %d: expected 3 fields (genome,sequence,ploidy), got %d", filename, lineIdx+1, len(fields))
+		}
+		p, err := strconv.Atoi(fields[2])
+		if err != nil || p < 1 || p > 2 {
+			return nil, fmt.Errorf("%s line %d: unsupported ploidy %q (must be 1 or 2)", filename, lineIdx+1, fields[2])
+		}
+		if spec[fields[0]] == nil {
+			spec[fields[0]] = map[string]int{}
+		}
+		spec[fields[0]][fields[1]] = p
+	}
+	return spec, nil
+}
+
+// ploidy returns the ploidy of the given sequence in the given
+// genome. Specific genome/sequence entries take precedence over "*"
+// entries. The default is 2.
+func (spec ploidySpec) ploidy(genome, seqname string) int {
+	for _, g := range []string{genome, "*"} {
+		for _, s := range []string{seqname, "*"} {
+			if p, ok := spec[g][s]; ok {
+				return p
+			}
+		}
+	}
+	return 2
+}
@@ -0,0 +1,654 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// impute fills in no-call tiles in a sliced library. Each haplotype
+// is modeled as a mosaic of panel haplotypes (the other genomes in
+// the same library, or the genomes in a separate panel library) with
+// a Li-Stephens hidden Markov model over consecutive tags, and each
+// no-call tile is imputed as the panel tile variant with the highest
+// posterior probability.
+//
+// The output library has the same files and variant IDs as the
+// input. Imputed calls are stored in CompactGenome.Imputed
+// alongside the original calls, with their posterior probabilities
+// in CompactGenome.ImputedConfidence; slice-numpy uses them if
+// -min-imputed-confidence is given.
+type impute struct {
+	inputDir          string
+	outputDir         string
+	panelDir          string
+	switchRate        float64
+	errorRate         float64
+	maxNoCallFraction float64
+	projectUUID       string
+	runLocal          bool
+}
+
+// imputeReport is written to impute-report.json in the output
+// directory.
+type imputeReport struct {
+	Time       time.Time
+	Genomes    map[string]*imputeCounts
+	Provenance Provenance
+	mtx        sync.Mutex
+}
+
+type imputeCounts struct {
+	Missing int // no-call tiles (both phases)
+	Imputed int // no-call tiles with an imputed tile variant
+}
+
+func (r *imputeReport) add(name string, missing, imputed int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	c := r.Genomes[name]
+	if c == nil {
+		c = &imputeCounts{}
+		r.Genomes[name] = c
+	}
+	c.Missing += missing
+	c.Imputed += imputed
+}
+
+func (cmd *impute) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.inputDir, "input-dir", "", "input library `directory` (output of slice)")
+	flags.StringVar(&cmd.outputDir, "output-dir", "", "output `directory`")
+	flags.StringVar(&cmd.panelDir, "panel", "", "reference panel library `directory`, sliced with the same tag library and -tags-per-file as the input (default: impute each genome from the other genomes in the input)")
+	flags.Float64Var(&cmd.switchRate, "switch-rate", 0.01, "probability of switching to a different panel haplotype between consecutive tags")
+	flags.Float64Var(&cmd.errorRate, "error-rate", 0.01, "probability that a called tile variant differs from the panel haplotype being copied")
+	flags.Float64Var(&cmd.maxNoCallFraction, "max-nocall-fraction", 0, "impute tile variants with more than `P` no-call bases (tile variants whose sequence is unknown are always imputed)")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.inputDir == "" {
+		err = errors.New("input library (-input-dir) not specified")
+		return 2
+	} else if cmd.outputDir == "" && cmd.runLocal {
+		err = errors.New("output directory (-output-dir) not specified")
+		return 2
+	} else if cmd.switchRate <= 0 || cmd.switchRate >= 1 {
+		err = errors.New("-switch-rate must be between 0 and 1")
+		return 2
+	} else if cmd.errorRate <= 0 || cmd.errorRate >= 0.5 {
+		err = errors.New("-error-rate must be between 0 and 0.5")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputDir != "" {
+			err = errors.New("cannot specify output directory in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning impute",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+		}
+		err = runner.TranslatePaths(&cmd.inputDir, &cmd.panelDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"impute", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", cmd.inputDir,
+			"-output-dir", "/mnt/output",
+			"-panel", cmd.panelDir,
+			fmt.Sprintf("-switch-rate=%f", cmd.switchRate),
+			fmt.Sprintf("-error-rate=%f", cmd.errorRate),
+			fmt.Sprintf("-max-nocall-fraction=%f", cmd.maxNoCallFraction),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	report := &imputeReport{Time: time.Now().UTC(), Genomes: map[string]*imputeCounts{}}
+	err = cmd.impute(prog, args, report)
+	if err != nil {
+		return 1
+	}
+	err = writeJSONFile(cmd.outputDir+"/impute-report.json", report)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// impute makes two passes over the input files: the first collects
+// provenance records, the second imputes and writes each file to the
+// output directory.
+func (cmd *impute) impute(prog string, args []string, report *imputeReport) error {
+	infiles, err := allFiles(cmd.inputDir, matchGobFile)
+	if err != nil {
+		return err
+	}
+	if len(infiles) == 0 {
+		return fmt.Errorf("no input files found in %s", cmd.inputDir)
+	}
+	prov := startProvenance(prog, args, cmd.inputDir, cmd.panelDir)
+	err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+		prov.addParents(ent.Provenance)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p, err := prov.finish()
+	if err != nil {
+		return err
+	}
+	report.Provenance = p
+
+	log.Printf("impute: writing %d files", len(infiles))
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, infile := range infiles {
+		infile := infile
+		throttle.Go(func() error {
+			rel := filepath.Base(infile)
+			if r, err := filepath.Rel(cmd.inputDir, infile); err == nil && r != "." {
+				rel = r
+			}
+			panelfile := ""
+			if cmd.panelDir != "" {
+				panelfile = cmd.panelDir + "/" + rel
+			}
+			err := cmd.imputeFile(infile, panelfile, cmd.outputDir+"/"+rel, p, report)
+			if err != nil {
+				return fmt.Errorf("%s: %w", infile, err)
+			}
+			return nil
+		})
+	}
+	return throttle.Wait()
+}
+
+// imputeSlice is the data from one file of a sliced library that is
+// needed for imputation.
+type imputeSlice struct {
+	ents     []*LibraryEntry
+	cgs      []*CompactGenome
+	startTag tagID
+	endTag   tagID
+	variants map[tileLibRef]*TileVariant
+}
+
+func readImputeSlice(fnm string) (*imputeSlice, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sl := &imputeSlice{variants: map[tileLibRef]*TileVariant{}}
+	err = DecodeLibrary(f, strings.HasSuffix(fnm, ".gz"), func(ent *LibraryEntry) error {
+		sl.ents = append(sl.ents, ent)
+		for i := range ent.TileVariants {
+			tv := &ent.TileVariants[i]
+			sl.variants[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tv
+		}
+		for i := range ent.CompactGenomes {
+			cg := &ent.CompactGenomes[i]
+			if len(sl.cgs) == 0 {
+				sl.startTag, sl.endTag = cg.StartTag, cg.EndTag
+			} else if cg.StartTag != sl.startTag || cg.EndTag != sl.endTag {
+				return fmt.Errorf("genomes %s and %s have different tag ranges", sl.cgs[0].Name, cg.Name)
+			}
+			sl.cgs = append(sl.cgs, cg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sl.cgs) > 0 && sl.endTag <= sl.startTag {
+		return nil, errors.New("input is not a sliced library (see slice)")
+	}
+	return sl, nil
+}
+
+// imputeAlleles assigns a small integer to each distinct tile
+// variant (by hash) at each tag of a slice.
+type imputeAlleles struct {
+	startTag tagID
+	index    []map[[blake2b.Size256]byte]int32
+	mtx      sync.Mutex
+}
+
+func (ia *imputeAlleles) get(tag tagID, hash [blake2b.Size256]byte) int32 {
+	m := ia.index[tag-ia.startTag]
+	if m == nil {
+		m = map[[blake2b.Size256]byte]int32{}
+		ia.index[tag-ia.startTag] = m
+	}
+	a, ok := m[hash]
+	if !ok {
+		a = int32(len(m))
+		m[hash] = a
+	}
+	return a
+}
+
+// haplotypes returns the observed alleles of each genome in sl, two
+// haplotypes per genome. Tags where a genome has no tile (e.g.,
+// tag not found, or covered by a spanning tile) are -2, no-calls
+// are -1.
+func (cmd *impute) haplotypes(sl *imputeSlice, ia *imputeAlleles) [][]int32 {
+	ntags := int(sl.endTag - sl.startTag)
+	haps := make([][]int32, len(sl.cgs)*2)
+	for gi, cg := range sl.cgs {
+		for phase := 0; phase < 2; phase++ {
+			hap := make([]int32, ntags)
+			for t := range hap {
+				var v tileVariantID
+				if i := t*2 + phase; i < len(cg.Variants) {
+					v = cg.Variants[i]
+				}
+				if v == 0 {
+					hap[t] = -2
+					continue
+				}
+				tv := sl.variants[tileLibRef{Tag: sl.startTag + tagID(t), Variant: v}]
+				if tv == nil {
+					hap[t] = -1
+					continue
+				}
+				length, nocalls := tv.noCallCounts()
+				if length == 0 || float64(nocalls) > cmd.maxNoCallFraction*float64(length) {
+					hap[t] = -1
+					continue
+				}
+				hap[t] = ia.get(tv.Tag, tv.Blake2b)
+			}
+			haps[gi*2+phase] = hap
+		}
+	}
+	return haps
+}
+
+func (cmd *impute) imputeFile(infile, panelfile, outfile string, prov Provenance, report *imputeReport) error {
+	sl, err := readImputeSlice(infile)
+	if err != nil {
+		return err
+	}
+	ia := &imputeAlleles{startTag: sl.startTag, index: make([]map[[blake2b.Size256]byte]int32, sl.endTag-sl.startTag)}
+	haps := cmd.haplotypes(sl, ia)
+	// owner[k] is the index of the genome in sl.cgs that panel
+	// haplotype k belongs to (-1 for an external panel)
+	var panel [][]int32
+	var owner []int
+	var panelsl *imputeSlice
+	if panelfile == "" {
+		panel = haps
+		for k := range haps {
+			owner = append(owner, k/2)
+		}
+	} else {
+		panelsl, err = readImputeSlice(panelfile)
+		if err != nil {
+			return err
+		}
+		if len(sl.cgs) > 0 && len(panelsl.cgs) > 0 && (panelsl.startTag != sl.startTag || panelsl.endTag != sl.endTag) {
+			return fmt.Errorf("panel file %s has tags %d-%d, input has %d-%d (use the same -tags-per-file when slicing)", panelfile, panelsl.startTag, panelsl.endTag, sl.startTag, sl.endTag)
+		}
+		panelsl.startTag, panelsl.endTag = sl.startTag, sl.endTag
+		panel = cmd.haplotypes(panelsl, ia)
+		for range panel {
+			owner = append(owner, -1)
+		}
+	}
+
+	// Map each allele back to a tile variant: one in the input
+	// if possible, otherwise one from the panel, which is added
+	// to the output with a new variant ID.
+	ntags := int(sl.endTag - sl.startTag)
+	alleleVariant := make([][]tileVariantID, ntags)
+	maxVariant := make([]tileVariantID, ntags)
+	for libref, tv := range sl.variants {
+		t := int(libref.Tag - sl.startTag)
+		if t < 0 || t >= ntags {
+			continue
+		}
+		if maxVariant[t] < libref.Variant {
+			maxVariant[t] = libref.Variant
+		}
+		if a, ok := ia.index[t][tv.Blake2b]; ok {
+			for int(a) >= len(alleleVariant[t]) {
+				alleleVariant[t] = append(alleleVariant[t], 0)
+			}
+			if v := alleleVariant[t][a]; v == 0 || v > libref.Variant {
+				alleleVariant[t][a] = libref.Variant
+			}
+		}
+	}
+	var added []TileVariant
+	variantForAllele := func(t int, a int32) tileVariantID {
+		ia.mtx.Lock()
+		defer ia.mtx.Unlock()
+		if int(a) < len(alleleVariant[t]) && alleleVariant[t][a] > 0 {
+			return alleleVariant[t][a]
+		}
+		for int(a) >= len(alleleVariant[t]) {
+			alleleVariant[t] = append(alleleVariant[t], 0)
+		}
+		tag := sl.startTag + tagID(t)
+		for libref, tv := range panelsl.variants {
+			if libref.Tag != tag {
+				continue
+			}
+			if b, ok := ia.index[t][tv.Blake2b]; !ok || b != a {
+				continue
+			}
+			maxVariant[t]++
+			newtv := *tv
+			newtv.Variant = maxVariant[t]
+			newtv.Ref = false
+			added = append(added, newtv)
+			alleleVariant[t][a] = newtv.Variant
+			break
+		}
+		return alleleVariant[t][a]
+	}
+
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for gi, cg := range sl.cgs {
+		gi, cg := gi, cg
+		throttle.Go(func() error {
+			var genomePanel [][]int32
+			for k, hap := range panel {
+				if owner[k] != gi {
+					genomePanel = append(genomePanel, hap)
+				}
+			}
+			missing, imputed := 0, 0
+			for phase := 0; phase < 2; phase++ {
+				target := haps[gi*2+phase]
+				nmissing := 0
+				for _, a := range target {
+					if a == -1 {
+						nmissing++
+					}
+				}
+				if nmissing == 0 {
+					continue
+				}
+				missing += nmissing
+				alleles, confidence := liStephens(target, genomePanel, cmd.switchRate, cmd.errorRate)
+				for t, a := range alleles {
+					if target[t] != -1 || a < 0 {
+						continue
+					}
+					if cg.Imputed == nil {
+						cg.Imputed = make([]tileVariantID, len(cg.Variants))
+						cg.ImputedConfidence = make([]float32, len(cg.Variants))
+					}
+					cg.Imputed[t*2+phase] = variantForAllele(t, a)
+					cg.ImputedConfidence[t*2+phase] = float32(confidence[t])
+					imputed++
+				}
+			}
+			report.add(cg.Name, missing, imputed)
+			return nil
+		})
+	}
+	err = throttle.Wait()
+	if err != nil {
+		return err
+	}
+	sort.Slice(added, func(i, j int) bool {
+		if added[i].Tag != added[j].Tag {
+			return added[i].Tag < added[j].Tag
+		}
+		return added[i].Variant < added[j].Variant
+	})
+	return writeImputedFile(outfile, sl.ents, added, prov)
+}
+
+// writeImputedFile writes the given library entries to outfile,
+// followed by the added tile variants and a provenance record
+// (replacing any provenance records in ents).
+func writeImputedFile(outfile string, ents []*LibraryEntry, added []TileVariant, prov Provenance) error {
+	err := os.MkdirAll(filepath.Dir(outfile), 0777)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(outfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	bufw := bufio.NewWriterSize(out, 1<<26)
+	var w io.Writer = bufw
+	var zw *pgzip.Writer
+	if strings.HasSuffix(outfile, ".gz") {
+		zw = pgzip.NewWriter(bufw)
+		w = zw
+	}
+	enc := gob.NewEncoder(w)
+	for _, ent := range ents {
+		ent.Provenance = nil
+		if len(ent.TagSet) == 0 && len(ent.TileVariants) == 0 && len(ent.CompactGenomes) == 0 && len(ent.CompactSequences) == 0 {
+			continue
+		}
+		err = enc.Encode(ent)
+		if err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		err = enc.Encode(LibraryEntry{TileVariants: added})
+		if err != nil {
+			return err
+		}
+	}
+	err = enc.Encode(LibraryEntry{Provenance: []Provenance{prov}})
+	if err != nil {
+		return err
+	}
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// liStephens imputes the missing (-1) entries of target, modeling
+// target as a mosaic of the panel haplotypes: at each position,
+// target copies one panel haplotype, switching to a uniformly
+// chosen panel haplotype with probability switchRate between
+// consecutive positions, and differing from the copied allele with
+// probability errorRate. Alleles are non-negative; negative entries
+// (in target or panel) are not observed.
+//
+// For each missing position t, alleles[t] is the allele with the
+// highest posterior probability among the panel haplotypes observed
+// at t, and confidence[t] is its posterior probability. Other
+// positions, and missing positions where no panel haplotype is
+// observed, have alleles[t] == -1.
+func liStephens(target []int32, panel [][]int32, switchRate, errorRate float64) (alleles []int32, confidence []float64) {
+	ntags := len(target)
+	alleles = make([]int32, ntags)
+	confidence = make([]float64, ntags)
+	for t := range alleles {
+		alleles[t] = -1
+	}
+	K := len(panel)
+	if K == 0 || ntags == 0 {
+		return
+	}
+	emit := func(t, k int) float64 {
+		o, p := target[t], panel[k][t]
+		if o < 0 || p < 0 {
+			return 1
+		} else if o == p {
+			return 1 - errorRate
+		} else {
+			return errorRate
+		}
+	}
+	normalize := func(x []float64) {
+		sum := 0.0
+		for _, v := range x {
+			sum += v
+		}
+		for k := range x {
+			x[k] /= sum
+		}
+	}
+	stay, jump := 1-switchRate, switchRate/float64(K)
+
+	// Forward pass, keeping the (normalized) forward
+	// probabilities at missing positions.
+	alpha := make([]float64, K)
+	saved := map[int][]float64{}
+	for t := 0; t < ntags; t++ {
+		for k := range alpha {
+			if t == 0 {
+				alpha[k] = emit(t, k)
+			} else {
+				alpha[k] = emit(t, k) * (stay*alpha[k] + jump)
+			}
+		}
+		normalize(alpha)
+		if target[t] == -1 {
+			saved[t] = append([]float64(nil), alpha...)
+		}
+	}
+
+	// Backward pass, combining forward and backward
+	// probabilities at missing positions.
+	beta := make([]float64, K)
+	for k := range beta {
+		beta[k] = 1
+	}
+	next := make([]float64, K)
+	for t := ntags - 1; t >= 0; t-- {
+		if target[t] == -1 {
+			mass := map[int32]float64{}
+			total := 0.0
+			for k, a := range saved[t] {
+				if allele := panel[k][t]; allele >= 0 {
+					mass[allele] += a * beta[k]
+					total += a * beta[k]
+				}
+			}
+			if total > 0 {
+				best := int32(-1)
+				for allele, m := range mass {
+					if best < 0 || m > mass[best] || (m == mass[best] && allele < best) {
+						best = allele
+					}
+				}
+				alleles[t] = best
+				confidence[t] = mass[best] / total
+			}
+		}
+		if t == 0 {
+			break
+		}
+		sum := 0.0
+		for k := range beta {
+			next[k] = emit(t, k) * beta[k]
+			sum += next[k]
+		}
+		for k := range beta {
+			beta[k] = stay*next[k] + jump*sum
+		}
+		normalize(beta)
+	}
+	return
+}
+
+// useImputed replaces no-calls in cg.Variants with the imputed tile
+// variants whose confidence is at least minConfidence, and returns
+// the number of calls replaced.
+func (cg *CompactGenome) useImputed(minConfidence float64) int {
+	n := 0
+	for i, v := range cg.Imputed {
+		if v > 0 && i < len(cg.Variants) && float64(cg.ImputedConfidence[i]) >= minConfidence {
+			cg.Variants[i] = v
+			n++
+		}
+	}
+	return n
+}
+
+// trimImputed drops the imputed calls whose original calls have been
+// dropped from cg.Variants (e.g., by filter), so Imputed and
+// ImputedConfidence have one entry per entry in Variants.
+func (cg *CompactGenome) trimImputed() {
+	if cg.Imputed == nil {
+		return
+	}
+	if len(cg.Imputed) > len(cg.Variants) {
+		cg.Imputed = cg.Imputed[:len(cg.Variants)]
+		cg.ImputedConfidence = cg.ImputedConfidence[:len(cg.Variants)]
+	}
+	for i, v := range cg.Imputed {
+		if v > 0 && cg.Variants[i] == 0 {
+			cg.Imputed[i] = 0
+			cg.ImputedConfidence[i] = 0
+		}
+	}
+}
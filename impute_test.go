@@ -0,0 +1,267 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kshedden/gonpy"
+	"gopkg.in/check.v1"
+)
+
+type imputeSuite struct{}
+
+var _ = check.Suite(&imputeSuite{})
+
+func (s *imputeSuite) TestLiStephens(c *check.C) {
+	// Panel haplotypes 0, 1, and 2 have alleles 0, 1, and 2 at
+	// every position, except where not observed (-1).
+	panel := make([][]int32, 3)
+	for k := range panel {
+		panel[k] = make([]int32, 20)
+		for t := range panel[k] {
+			panel[k][t] = int32(k)
+		}
+	}
+	panel[0][15], panel[1][15], panel[2][15] = -1, -1, -1
+	panel[1][17] = -1
+	// Target copies haplotype 0, then haplotype 1.
+	target := make([]int32, 20)
+	for t := 10; t < 20; t++ {
+		target[t] = 1
+	}
+	target[3], target[12], target[15], target[17] = -1, -1, -1, -1
+	// A tag with no tile at all (e.g., spanning tile) is not
+	// imputed.
+	target[5] = -2
+
+	alleles, confidence := liStephens(target, panel, 0.01, 0.01)
+	for t := range target {
+		switch t {
+		case 3:
+			c.Check(alleles[t], check.Equals, int32(0))
+			c.Check(confidence[t] > 0.95, check.Equals, true, check.Commentf("confidence %v", confidence[t]))
+		case 12:
+			c.Check(alleles[t], check.Equals, int32(1))
+			c.Check(confidence[t] > 0.95, check.Equals, true, check.Commentf("confidence %v", confidence[t]))
+		case 17:
+			// The haplotype being copied is not observed
+			// here, so the best guess is much less
+			// certain.
+			c.Check(alleles[t] >= 0, check.Equals, true)
+			c.Check(confidence[t] < 0.95, check.Equals, true, check.Commentf("confidence %v", confidence[t]))
+		default:
+			// Not missing, or no panel haplotype is
+			// observed.
+			c.Check(alleles[t], check.Equals, int32(-1), check.Commentf("t=%d", t))
+		}
+	}
+
+	alleles, _ = liStephens(target, nil, 0.01, 0.01)
+	c.Check(alleles[3], check.Equals, int32(-1))
+}
+
+func (s *imputeSuite) TestImpute(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"imputed", "cohort", "panel", "panelimputed"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	cwd, err := os.Getwd()
+	c.Assert(err, check.IsNil)
+	for _, phase := range []string{"1", "2"} {
+		err = os.Symlink(cwd+"/testdata/pipeline1/input1."+phase+".fasta", tmpdir+"/panel/input1."+phase+".fasta")
+		c.Assert(err, check.IsNil)
+		err = os.Symlink(cwd+"/testdata/pipeline1/input2."+phase+".fasta", tmpdir+"/cohort/input2."+phase+".fasta")
+		c.Assert(err, check.IsNil)
+	}
+	// Without -save-incomplete-tiles, input2's tiles with
+	// no-calls (at tag 0 on chr1 and chr2) are not saved.
+	importAndSlice(c, tmpdir)
+	importLibrary(c, tmpdir+"/cohortlib/cohort.gob", tmpdir+"/cohort")
+	importLibrary(c, tmpdir+"/panellib/panel.gob", tmpdir+"/panel")
+	sliceLibraries(c, tmpdir+"/cohortsliced", tmpdir+"/lib1", tmpdir+"/cohortlib")
+	sliceLibraries(c, tmpdir+"/panelsliced", tmpdir+"/lib1", tmpdir+"/panellib")
+
+	c.Log("=== impute from other genomes in the library ===")
+	exited := (&impute{}).RunCommand("impute", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/sliced",
+		"-output-dir", tmpdir + "/imputed",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	buf, err := ioutil.ReadFile(tmpdir + "/imputed/impute-report.json")
+	c.Assert(err, check.IsNil)
+	var report imputeReport
+	err = json.Unmarshal(buf, &report)
+	c.Assert(err, check.IsNil)
+	// input1 has no no-calls.
+	c.Check(report.Genomes["testdata/pipeline1/input1.1.fasta"], check.DeepEquals, &imputeCounts{Missing: 0, Imputed: 0})
+	c.Check(report.Genomes["testdata/pipeline1/input2.1.fasta"], check.DeepEquals, &imputeCounts{Missing: 2, Imputed: 2})
+	c.Check(report.Provenance.Command[0], check.Equals, "impute")
+
+	// The only other genome is input1, so input2's no-calls (on
+	// both phases at tag 0) are imputed as one of input1's tile
+	// variants.
+	cgs, tvs := s.readLibrary(c, tmpdir+"/imputed")
+	input1, input2 := cgs["testdata/pipeline1/input1.1.fasta"], cgs["testdata/pipeline1/input2.1.fasta"]
+	c.Check(input1.Imputed, check.IsNil)
+	c.Assert(input2.Imputed, check.NotNil)
+	for i, v := range input2.Imputed {
+		if i >= 2 {
+			c.Check(v, check.Equals, tileVariantID(0))
+			continue
+		}
+		c.Check(len(tvs[tileLibRef{0, input2.Variants[i]}].Sequence), check.Equals, 0)
+		c.Check(v == input1.Variants[0] || v == input1.Variants[1], check.Equals, true)
+		c.Check(input2.ImputedConfidence[i] > 0.5, check.Equals, true)
+	}
+
+	for _, trial := range []struct {
+		minConfidence string
+		expect        []int16
+	}{
+		{"0", []int16{2, 1, 1, 2, 1, 1, 1, 1, -1, -1, 1, 1, 1, 1, 1, 1}},
+		{"0.5", []int16{1, 2, 1, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	} {
+		c.Logf("=== slice-numpy -min-imputed-confidence=%s", trial.minConfidence)
+		npydir := c.MkDir()
+		exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-input-dir=" + tmpdir + "/imputed",
+			"-output-dir=" + npydir,
+			"-min-imputed-confidence=" + trial.minConfidence,
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		f, err := os.Open(npydir + "/matrix.0000.npy")
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		npy, err := gonpy.NewReader(f)
+		c.Assert(err, check.IsNil)
+		variants, err := npy.GetInt16()
+		c.Assert(err, check.IsNil)
+		c.Check(variants, check.DeepEquals, trial.expect)
+	}
+
+	c.Log("=== slice the impute output again, then slice-numpy ===")
+	// Slicing with another library renumbers the tile variants,
+	// and a different -tags-per-file splits the genomes
+	// differently. The imputed calls must follow.
+	resliced := c.MkDir()
+	exited = (&slicecmd{}).RunCommand("slice", []string{
+		"-local=true",
+		"-tags-per-file=2",
+		"-output-dir=" + resliced,
+		tmpdir + "/imputed",
+		tmpdir + "/cohortlib",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	recgs, retvs := s.readLibrary(c, resliced)
+	reinput2 := recgs["testdata/pipeline1/input2.1.fasta"]
+	c.Assert(reinput2.Imputed, check.HasLen, 4)
+	for i, v := range reinput2.Imputed[:2] {
+		c.Check(v, check.Not(check.Equals), input2.Imputed[i])
+		c.Check(retvs[tileLibRef{0, v}].Blake2b, check.Equals, tvs[tileLibRef{0, input2.Imputed[i]}].Blake2b)
+		c.Check(reinput2.ImputedConfidence[i], check.Equals, input2.ImputedConfidence[i])
+	}
+	npydir := c.MkDir()
+	exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+		"-local=true",
+		"-input-dir=" + resliced,
+		"-output-dir=" + npydir,
+		"-min-imputed-confidence=0.5",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	f, err := os.Open(npydir + "/matrix.0000.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err := gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	variants, err := npy.GetInt16()
+	c.Assert(err, check.IsNil)
+	// Rows are the cohort library's input2 (not imputed), then
+	// input1 and input2 as above.
+	c.Check(variants, check.DeepEquals, []int16{-1, -1, 1, 1, 1, 2, 1, 2, 1, 1, 1, 1})
+
+	c.Log("=== remove-genomes keeps tile variants used by imputed calls ===")
+	// input2's imputed calls at tag 0 refer to input1's tile
+	// variants, so fsck fails if they are dropped along with
+	// input1.
+	err = ioutil.WriteFile(tmpdir+"/remove.txt", []byte("input1\n"), 0666)
+	c.Assert(err, check.IsNil)
+	removed := c.MkDir()
+	exited = (&removeGenomes{}).RunCommand("remove-genomes", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/imputed",
+		"-output-dir", removed,
+		"-audit-file", tmpdir + "/removed-genomes.json",
+		"-samples", tmpdir + "/remove.txt",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&fsckCmd{}).RunCommand("fsck", []string{"-local=true", "-input-dir", removed}, nil, ioutil.Discard, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+
+	c.Log("=== impute from a separate panel ===")
+	exited = (&impute{}).RunCommand("impute", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/cohortsliced",
+		"-panel", tmpdir + "/panelsliced",
+		"-output-dir", tmpdir + "/panelimputed",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, tvs = s.readLibrary(c, tmpdir+"/panelimputed")
+	panelcgs, paneltvs := s.readLibrary(c, tmpdir+"/panelsliced")
+	var cohortcg, panelcg CompactGenome
+	for name, cg := range cgs {
+		if strings.HasSuffix(name, "/input2.1.fasta") {
+			cohortcg = cg
+		}
+	}
+	for name, cg := range panelcgs {
+		if strings.HasSuffix(name, "/input1.1.fasta") {
+			panelcg = cg
+		}
+	}
+	c.Assert(cohortcg.Imputed, check.NotNil)
+	for i, v := range cohortcg.Imputed[:2] {
+		// input1's tile variants at tag 0 are only in the
+		// panel, so they are added to the output with new
+		// variant IDs.
+		tv, ok := tvs[tileLibRef{0, v}]
+		c.Assert(ok, check.Equals, true, check.Commentf("phase %d variant %d", i, v))
+		c.Check(tv.Blake2b == paneltvs[tileLibRef{0, panelcg.Variants[0]}].Blake2b ||
+			tv.Blake2b == paneltvs[tileLibRef{0, panelcg.Variants[1]}].Blake2b, check.Equals, true)
+		c.Check(len(tv.Sequence) > 0, check.Equals, true)
+	}
+}
+
+// readLibrary returns the genomes (with tags in the first slice only)
+// and the tile variants of a sliced library.
+func (s *imputeSuite) readLibrary(c *check.C, dir string) (map[string]CompactGenome, map[tileLibRef]TileVariant) {
+	cgs := map[string]CompactGenome{}
+	tvs := map[tileLibRef]TileVariant{}
+	infiles, err := allFiles(dir, matchGobFile)
+	c.Assert(err, check.IsNil)
+	var mtx sync.Mutex
+	err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, cg := range ent.CompactGenomes {
+			if cg.StartTag == 0 {
+				cgs[cg.Name] = cg
+			}
+		}
+		for _, tv := range ent.TileVariants {
+			tvs[tileLibRef{tv.Tag, tv.Variant}] = tv
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	return cgs, tvs
+}
@@ -0,0 +1,260 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arvados/lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// knownVariantOptions are command line options for cross-referencing
+// variants against local VCF files (e.g., ClinVar, dbSNP).
+type knownVariantOptions struct {
+	Files      string // comma-separated VCF filenames
+	InfoFields string // comma-separated INFO keys to copy
+}
+
+func (o *knownVariantOptions) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Files, "known-variants", "", "cross-reference variants against known variants in the given VCF `files` (comma-separated, e.g., ClinVar and dbSNP)")
+	flags.StringVar(&o.InfoFields, "known-info", "CLNSIG,CLNDN", "comma-separated INFO `fields` to copy from matching known variants")
+}
+
+func (o *knownVariantOptions) Args() []string {
+	return []string{
+		"-known-variants=" + o.Files,
+		"-known-info=" + o.InfoFields,
+	}
+}
+
+// TranslatePaths updates o.Files to refer to paths in the arvados
+// container.
+func (o *knownVariantOptions) TranslatePaths(runner *arvadosContainerRunner) error {
+	if o.Files == "" {
+		return nil
+	}
+	files := strings.Split(o.Files, ",")
+	for i := range files {
+		err := runner.TranslatePaths(&files[i])
+		if err != nil {
+			return err
+		}
+	}
+	o.Files = strings.Join(files, ",")
+	return nil
+}
+
+// Load returns a knownVariantDB with the variants in the specified
+// files, or nil if no files are specified.
+func (o *knownVariantOptions) Load() (*knownVariantDB, error) {
+	if o.Files == "" {
+		return nil, nil
+	}
+	var infoFields []string
+	if o.InfoFields != "" {
+		infoFields = strings.Split(o.InfoFields, ",")
+	}
+	db := &knownVariantDB{
+		infoFields: infoFields,
+		variants:   map[knownVariantKey][]*knownVariant{},
+	}
+	for _, fnm := range strings.Split(o.Files, ",") {
+		err := db.loadVCF(fnm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// knownVariantKey identifies a variant in its minimal representation
+// (common prefix and suffix removed, so Ref or Alt may be empty) at
+// its leftmost position.
+type knownVariantKey struct {
+	seqname string // without "chr" prefix
+	pos     int
+	ref     string
+	alt     string
+}
+
+func makeKnownVariantKey(seqname string, pos int, ref, alt string) knownVariantKey {
+	ref, alt = strings.ToUpper(ref), strings.ToUpper(alt)
+	for len(ref) > 0 && len(alt) > 0 && ref[len(ref)-1] == alt[len(alt)-1] {
+		ref, alt = ref[:len(ref)-1], alt[:len(alt)-1]
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[0] == alt[0] {
+		ref, alt = ref[1:], alt[1:]
+		pos++
+	}
+	return knownVariantKey{
+		seqname: strings.TrimPrefix(seqname, "chr"),
+		pos:     pos,
+		ref:     ref,
+		alt:     alt,
+	}
+}
+
+type knownVariant struct {
+	ID   string   // VCF ID column, or "" if "."
+	Info []string // values of selected INFO fields, or "" if absent
+}
+
+// knownVariantDB is an index of variants loaded from VCF files.
+type knownVariantDB struct {
+	infoFields []string
+	variants   map[knownVariantKey][]*knownVariant
+}
+
+// loadVCF adds the variants in the given VCF file (optionally
+// gzipped). Records are expected to be left-aligned, as is the case
+// for ClinVar and dbSNP releases. Multi-allelic records are split,
+// and INFO values with one entry per ALT allele are split
+// accordingly. Symbolic and "*" alleles are ignored.
+func (db *knownVariantDB) loadVCF(fnm string) error {
+	log.Infof("loading known variants from %s", fnm)
+	f, err := zopen(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 1<<28)
+	n := 0
+	for lineIdx := 1; scanner.Scan(); lineIdx++ {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{'\t'}, 9)
+		if len(fields) < 8 {
+			return fmt.Errorf("%s line %d: wrong number of fields (%d < %d)", fnm, lineIdx, len(fields), 8)
+		}
+		pos, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return fmt.Errorf("%s line %d: cannot parse POS %q: %w", fnm, lineIdx, fields[1], err)
+		}
+		id := string(fields[2])
+		if id == "." {
+			id = ""
+		}
+		alts := strings.Split(string(fields[4]), ",")
+		info := map[string]string{}
+		for _, kv := range strings.Split(string(fields[7]), ";") {
+			if eq := strings.IndexByte(kv, '='); eq > 0 {
+				info[kv[:eq]] = kv[eq+1:]
+			}
+		}
+		for altIdx, alt := range alts {
+			if alt == "*" || alt == "." || strings.ContainsAny(alt, "<>[]") {
+				continue
+			}
+			kv := &knownVariant{ID: id}
+			for _, key := range db.infoFields {
+				val := info[key]
+				if len(alts) > 1 {
+					if vals := strings.Split(val, ","); len(vals) == len(alts) {
+						val = vals[altIdx]
+					}
+				}
+				kv.Info = append(kv.Info, val)
+			}
+			key := makeKnownVariantKey(string(fields[0]), pos, string(fields[3]), alt)
+			db.variants[key] = append(db.variants[key], kv)
+			n++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", fnm, err)
+	}
+	log.Infof("loaded %d known variants from %s", n, fnm)
+	return nil
+}
+
+// Lookup returns the known variants matching v, which must already
+// be left-aligned (see hgvs.Variant.NormalizeLeft).
+func (db *knownVariantDB) Lookup(seqname string, v hgvs.Variant) []*knownVariant {
+	return db.variants[makeKnownVariantKey(seqname, v.Position, v.Ref, v.New)]
+}
+
+// LookupNormalize is like Lookup, but first left-aligns v using
+// refseq, the upper-case reference sequence that v.Position refers
+// to.
+func (db *knownVariantDB) LookupNormalize(seqname string, refseq string, v hgvs.Variant) []*knownVariant {
+	return db.Lookup(seqname, v.NormalizeLeft(refseq))
+}
+
+// LookupAnchored is like LookupNormalize, but v may include
+// unchanged leading bases, as in a VCF record (e.g., {Position: 3,
+// Ref: "AA", New: "A"}). If refseq is empty, v is not left-aligned.
+func (db *knownVariantDB) LookupAnchored(seqname string, refseq string, v hgvs.Variant) []*knownVariant {
+	v.Ref, v.New = strings.ToUpper(v.Ref), strings.ToUpper(v.New)
+	for len(v.Ref) > 0 && len(v.New) > 0 && v.Ref[0] == v.New[0] {
+		v.Left = v.Ref[:1]
+		v.Ref, v.New = v.Ref[1:], v.New[1:]
+		v.Position++
+	}
+	if refseq == "" {
+		return db.Lookup(seqname, v)
+	}
+	return db.LookupNormalize(seqname, refseq, v)
+}
+
+// CSV returns 2 comma-separated fields: the IDs of the given known
+// variants, and their selected INFO fields ("KEY=value;..."). Commas
+// in INFO values are replaced by "|" to keep the CSV output
+// parseable.
+func (db *knownVariantDB) CSV(kvs []*knownVariant) string {
+	var ids, info []string
+	for _, kv := range kvs {
+		if kv.ID != "" {
+			ids = append(ids, kv.ID)
+		}
+		for i, val := range kv.Info {
+			if val != "" {
+				info = append(info, db.infoFields[i]+"="+strings.Replace(val, ",", "|", -1))
+			}
+		}
+	}
+	return strings.Join(ids, ";") + "," + strings.Join(info, ";")
+}
+
+// VCFInfo returns the selected INFO fields of the given known
+// variants, in VCF INFO format with a leading ";" (or "" if there
+// are none). Values from multiple known variants are joined with ",".
+func (db *knownVariantDB) VCFInfo(kvs []*knownVariant) string {
+	var out string
+	for i, key := range db.infoFields {
+		var vals []string
+		for _, kv := range kvs {
+			if kv.Info[i] != "" {
+				vals = append(vals, kv.Info[i])
+			}
+		}
+		if len(vals) > 0 {
+			out += ";" + key + "=" + strings.Join(vals, ",")
+		}
+	}
+	return out
+}
+
+// VCFHeader returns VCF header lines describing the INFO fields
+// added by VCFInfo.
+func (db *knownVariantDB) VCFHeader() string {
+	var out string
+	for _, key := range db.infoFields {
+		out += fmt.Sprintf("##INFO=<ID=%s,Number=.,Type=String,Description=\"%s from known variants\">\n", key, key)
+	}
+	return out
+}
+
+// emptyKnownVariantCSV is a placeholder for the known variant fields
+// in annotation rows that don't describe a variant.
+const emptyKnownVariantCSV = ","
@@ -0,0 +1,81 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+
+	"github.com/arvados/lightning/hgvs"
+	"gopkg.in/check.v1"
+)
+
+type knownVariantsSuite struct{}
+
+var _ = check.Suite(&knownVariantsSuite{})
+
+func (s *knownVariantsSuite) TestLookup(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/clinvar.vcf", []byte(`##fileformat=VCFv4.1
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	5	12345	G	A	.	.	CLNSIG=Pathogenic;CLNDN=Some_disease,Other_disease
+1	1	23456	CA	C	.	.	CLNSIG=Benign
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/dbsnp.vcf", []byte(`##fileformat=VCFv4.1
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+chr1	5	rs1	G	A,T	.	.	CLNSIG=x,y
+chr1	7	rs2	T	<DEL>	.	.	.
+`), 0666)
+	c.Assert(err, check.IsNil)
+
+	opts := knownVariantOptions{Files: tmpdir + "/clinvar.vcf," + tmpdir + "/dbsnp.vcf", InfoFields: "CLNSIG,CLNDN"}
+	db, err := opts.Load()
+	c.Assert(err, check.IsNil)
+
+	// SNV present in both files
+	kvs := db.Lookup("chr1", hgvs.Variant{Position: 5, Ref: "G", New: "A"})
+	c.Check(kvs, check.HasLen, 2)
+	c.Check(db.CSV(kvs), check.Equals, "12345;rs1,CLNSIG=Pathogenic;CLNDN=Some_disease|Other_disease;CLNSIG=x")
+	c.Check(db.VCFInfo(kvs), check.Equals, ";CLNSIG=Pathogenic,x;CLNDN=Some_disease,Other_disease")
+
+	// second ALT of multi-allelic record
+	kvs = db.Lookup("1", hgvs.Variant{Position: 4, Ref: "CG", New: "CT"})
+	c.Check(db.CSV(kvs), check.Equals, "rs1,CLNSIG=y")
+
+	// 3'-normalized deletion in a repeat matches the
+	// left-aligned record after normalization
+	refseq := "CAAAGTT"
+	v := hgvs.Variant{Position: 4, Ref: "A", Left: "A"}
+	c.Check(db.Lookup("1", v), check.HasLen, 0)
+	c.Check(db.CSV(db.LookupNormalize("1", refseq, v)), check.Equals, "23456,CLNSIG=Benign")
+
+	// 3'-normalized indels in a repeat with a VCF-style anchor
+	// base match the left-aligned records
+	err = ioutil.WriteFile(tmpdir+"/repeats.vcf", []byte(`##fileformat=VCFv4.1
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	1	rs3	C	CA	.	.	.
+`), 0666)
+	c.Assert(err, check.IsNil)
+	repeatopts := knownVariantOptions{Files: tmpdir + "/clinvar.vcf," + tmpdir + "/repeats.vcf"}
+	repeatdb, err := repeatopts.Load()
+	c.Assert(err, check.IsNil)
+	del := hgvs.Variant{Position: 3, Ref: "AA", New: "A"}
+	c.Check(repeatdb.LookupAnchored("1", "", del), check.HasLen, 0)
+	c.Check(repeatdb.CSV(repeatdb.LookupAnchored("1", refseq, del)), check.Equals, "23456,")
+	ins := hgvs.Variant{Position: 4, Ref: "a", New: "aa"}
+	c.Check(repeatdb.LookupAnchored("1", "", ins), check.HasLen, 0)
+	c.Check(repeatdb.CSV(repeatdb.LookupAnchored("1", refseq, ins)), check.Equals, "rs3,")
+	// SNVs are unaffected
+	c.Check(repeatdb.CSV(repeatdb.LookupAnchored("1", refseq, hgvs.Variant{Position: 5, Ref: "G", New: "A"})), check.Equals, "12345,")
+
+	// no match
+	c.Check(db.CSV(db.Lookup("1", hgvs.Variant{Position: 5, Ref: "G", New: "C"})), check.Equals, ",")
+	c.Check(db.Lookup("2", hgvs.Variant{Position: 5, Ref: "G", New: "A"}), check.HasLen, 0)
+
+	noopts := knownVariantOptions{}
+	db, err = noopts.Load()
+	c.Check(err, check.IsNil)
+	c.Check(db, check.IsNil)
+}
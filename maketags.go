@@ -0,0 +1,412 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// makeTags builds a tag library (one unique k-mer roughly every
+// tileSpacing bases) from a reference genome.
+type makeTags struct {
+	refFile         string
+	outputFile      string
+	reportFile      string
+	projectUUID     string
+	runLocal        bool
+	tagLength       int
+	tileSpacing     int
+	candidates      int
+	matchChromosome *regexp.Regexp
+}
+
+func (cmd *makeTags) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
+	flags.StringVar(&cmd.outputFile, "o", "-", "output tag library fasta `file`")
+	flags.StringVar(&cmd.reportFile, "report", "", "output tile length and gap report to `file` (json)")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	flags.IntVar(&cmd.tagLength, "tag-length", 24, "tag length `k` (at most 32)")
+	flags.IntVar(&cmd.tileSpacing, "tile-spacing", 250, "target distance `N` between tags")
+	flags.IntVar(&cmd.candidates, "candidates", 8, "number of candidate k-mers to try in each tile-spacing window")
+	matchChromosome := flags.String("match-chromosome", "^(chr)?([0-9]+|X|Y|MT?)$", "use reference sequences whose names match the given `regexp`")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.refFile == "" {
+		err = errors.New("reference data (-ref) not specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if cmd.tagLength < 8 || cmd.tagLength > tagmapKeySize {
+		err = fmt.Errorf("invalid -tag-length %d (must be between 8 and %d)", cmd.tagLength, tagmapKeySize)
+		return 2
+	} else if cmd.tileSpacing < cmd.tagLength*2 {
+		err = fmt.Errorf("invalid -tile-spacing %d (must be at least 2x tag length)", cmd.tileSpacing)
+		return 2
+	} else if cmd.candidates < 1 {
+		err = fmt.Errorf("invalid -candidates %d", cmd.candidates)
+		return 2
+	}
+	cmd.matchChromosome, err = regexp.Compile(*matchChromosome)
+	if err != nil {
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputFile != "-" || cmd.reportFile != "" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning make-tags",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         64000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(&cmd.refFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"make-tags", "-local=true",
+			"-ref", cmd.refFile,
+			"-o", "/mnt/output/tags.fa",
+			"-report", "/mnt/output/report.json",
+			fmt.Sprintf("-tag-length=%d", cmd.tagLength),
+			fmt.Sprintf("-tile-spacing=%d", cmd.tileSpacing),
+			fmt.Sprintf("-candidates=%d", cmd.candidates),
+			"-match-chromosome", cmd.matchChromosome.String(),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/tags.fa")
+		return 0
+	}
+
+	seqs, err := cmd.loadReference()
+	if err != nil {
+		return 1
+	}
+	tags, err := cmd.chooseTags(seqs)
+	if err != nil {
+		return 1
+	}
+
+	var out io.WriteCloser
+	if cmd.outputFile == "-" {
+		out = nopCloser{stdout}
+	} else {
+		out, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			return 1
+		}
+		defer out.Close()
+	}
+	bufw := bufio.NewWriter(out)
+	for i, seq := range seqs {
+		fmt.Fprintf(bufw, ">%s\n", seq.name)
+		for _, pos := range tags[i] {
+			bufw.Write(seq.seq[pos : pos+cmd.tagLength])
+			bufw.WriteByte('\n')
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = out.Close()
+	if err != nil {
+		return 1
+	}
+
+	if cmd.reportFile != "" {
+		var f *os.File
+		f, err = os.OpenFile(cmd.reportFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			return 1
+		}
+		defer f.Close()
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(cmd.report(seqs, tags))
+		if err != nil {
+			return 1
+		}
+		err = f.Close()
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+type refSequence struct {
+	name string
+	seq  []byte // lower case
+}
+
+func (cmd *makeTags) loadReference() ([]refSequence, error) {
+	f, err := zopen(cmd.refFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var seqs []refSequence
+	skip := true
+	scanner := bufio.NewScanner(bufio.NewReaderSize(f, 8*1024*1024))
+	scanner.Buffer(make([]byte, 256), 1<<29) // in case fasta does not have line breaks
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if len(buf) > 0 && buf[0] == '>' {
+			name := strings.SplitN(strings.TrimSpace(string(buf[1:])), " ", 2)[0]
+			skip = !cmd.matchChromosome.MatchString(name)
+			if !skip {
+				seqs = append(seqs, refSequence{name: name})
+			}
+		} else if !skip {
+			seqs[len(seqs)-1].seq = append(seqs[len(seqs)-1].seq, bytes.ToLower(bytes.TrimSpace(buf))...)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", cmd.refFile, err)
+	}
+	if len(seqs) == 0 {
+		return nil, fmt.Errorf("%s: no sequences match %s", cmd.refFile, cmd.matchChromosome)
+	}
+	log.Infof("%s: loaded %d sequences", cmd.refFile, len(seqs))
+	return seqs, nil
+}
+
+// chooseTags returns, for each input sequence, the positions of the
+// chosen tags. Each tag occurs exactly once in the reference, and
+// tags do not overlap.
+//
+// Each sequence is divided into windows of tileSpacing bases, and the
+// first unique k-mer (of cmd.candidates evenly spaced k-mers) in each
+// window becomes a tag. Windows with no unique candidate are left
+// out, yielding a longer tile.
+func (cmd *makeTags) chooseTags(seqs []refSequence) ([][]int, error) {
+	k := cmd.tagLength
+	step := cmd.tileSpacing / cmd.candidates
+	if step < 1 {
+		step = 1
+	}
+	type candidate struct {
+		seq int
+		pos int
+		id  tagID // index in candidate tag library, or -1 if duplicated among candidates
+	}
+	var cands []candidate
+	var candseqs [][]byte
+	keyidx := map[tagmapKey]int{} // key => index in cands
+	mask := tagmapKey(1<<(k*2)) - 1
+	for si, seq := range seqs {
+		for wstart := 0; wstart+k <= len(seq.seq); wstart += cmd.tileSpacing {
+			for pos := wstart; pos < wstart+cmd.tileSpacing && pos+k <= len(seq.seq); pos += step {
+				kmer := seq.seq[pos : pos+k]
+				if countBases(kmer) != k {
+					continue
+				}
+				var key tagmapKey
+				for _, b := range kmer {
+					key = (key << 2) | twobit[int(b)]
+				}
+				key &= mask
+				if prev, ok := keyidx[key]; ok {
+					cands[prev].id = -1
+					cands = append(cands, candidate{seq: si, pos: pos, id: -1})
+					continue
+				}
+				keyidx[key] = len(cands)
+				cands = append(cands, candidate{seq: si, pos: pos, id: tagID(len(candseqs))})
+				candseqs = append(candseqs, kmer)
+			}
+		}
+	}
+	keyidx = nil
+	log.Infof("checking uniqueness of %d candidate tags", len(candseqs))
+	var taglib tagLibrary
+	err := taglib.setTags(candseqs)
+	if err != nil {
+		return nil, err
+	}
+	count := make([]int32, len(candseqs))
+	throttle := throttle{Max: runtime.NumCPU()}
+	for _, seq := range seqs {
+		seq := seq
+		throttle.Go(func() error {
+			taglib.CountAll(seq.seq, count)
+			return nil
+		})
+	}
+	throttle.Wait()
+
+	tags := make([][]int, len(seqs))
+	unique := 0
+	for i, c := range cands {
+		if c.id < 0 || count[c.id] != 1 {
+			continue
+		}
+		unique++
+		pos := tags[c.seq]
+		if len(pos) > 0 {
+			last := pos[len(pos)-1]
+			if c.pos/cmd.tileSpacing == last/cmd.tileSpacing || c.pos < last+k {
+				// already have a tag in this
+				// window, or overlapping
+				continue
+			}
+		}
+		tags[c.seq] = append(tags[c.seq], cands[i].pos)
+	}
+	ntags := 0
+	for _, pos := range tags {
+		ntags += len(pos)
+	}
+	log.Infof("%d of %d candidates are unique, chose %d tags", unique, len(cands), ntags)
+	return tags, nil
+}
+
+type makeTagsReport struct {
+	TagLength           int
+	TileSpacing         int
+	Tags                int
+	TileLength          makeTagsTileLength
+	TileLengthHistogram []makeTagsHistogramBin
+	Sequences           []makeTagsSequenceReport
+	// Regions longer than 2x tile spacing with no tags,
+	// including the ends of sequences.
+	Gaps []makeTagsGap
+}
+
+type makeTagsTileLength struct {
+	Min, P10, Median, P90, Max int
+	Mean                       float64
+}
+
+type makeTagsHistogramBin struct {
+	From  int // minimum tile length
+	To    int // maximum tile length + 1
+	Count int
+}
+
+type makeTagsSequenceReport struct {
+	Name          string
+	Length        int
+	Tags          int
+	MaxTileLength int
+}
+
+type makeTagsGap struct {
+	Sequence string
+	Start    int // 0-based
+	End      int
+}
+
+// report summarizes the distribution of tile lengths (measured from
+// start of tag to end of next tag) and gaps.
+func (cmd *makeTags) report(seqs []refSequence, tags [][]int) makeTagsReport {
+	k := cmd.tagLength
+	rpt := makeTagsReport{TagLength: k, TileSpacing: cmd.tileSpacing}
+	var lengths []int
+	for i, seq := range seqs {
+		pos := tags[i]
+		srpt := makeTagsSequenceReport{Name: seq.name, Length: len(seq.seq), Tags: len(pos)}
+		rpt.Tags += len(pos)
+		gapstart := 0
+		for j, p := range pos {
+			if j > 0 {
+				tilelen := p + k - pos[j-1]
+				lengths = append(lengths, tilelen)
+				if srpt.MaxTileLength < tilelen {
+					srpt.MaxTileLength = tilelen
+				}
+			}
+			if p-gapstart > 2*cmd.tileSpacing {
+				rpt.Gaps = append(rpt.Gaps, makeTagsGap{Sequence: seq.name, Start: gapstart, End: p})
+			}
+			gapstart = p + k
+		}
+		if len(seq.seq)-gapstart > 2*cmd.tileSpacing {
+			rpt.Gaps = append(rpt.Gaps, makeTagsGap{Sequence: seq.name, Start: gapstart, End: len(seq.seq)})
+		}
+		rpt.Sequences = append(rpt.Sequences, srpt)
+	}
+	if len(lengths) == 0 {
+		return rpt
+	}
+	sort.Ints(lengths)
+	sum := 0
+	for _, l := range lengths {
+		sum += l
+	}
+	quantile := func(q float64) int { return lengths[int(q*float64(len(lengths)-1))] }
+	rpt.TileLength = makeTagsTileLength{
+		Min:    lengths[0],
+		P10:    quantile(0.1),
+		Median: quantile(0.5),
+		P90:    quantile(0.9),
+		Max:    lengths[len(lengths)-1],
+		Mean:   float64(sum) / float64(len(lengths)),
+	}
+	// Bins are tileSpacing/4 wide, up to 4x tileSpacing; the
+	// last bin holds all longer tiles.
+	width := cmd.tileSpacing / 4
+	for _, l := range lengths {
+		bin := l / width
+		if bin > 16 {
+			bin = 16
+		}
+		for len(rpt.TileLengthHistogram) <= bin {
+			i := len(rpt.TileLengthHistogram)
+			rpt.TileLengthHistogram = append(rpt.TileLengthHistogram, makeTagsHistogramBin{From: i * width, To: (i + 1) * width})
+		}
+		rpt.TileLengthHistogram[bin].Count++
+	}
+	if last := &rpt.TileLengthHistogram[len(rpt.TileLengthHistogram)-1]; last.To <= rpt.TileLength.Max {
+		last.To = rpt.TileLength.Max + 1
+	}
+	return rpt
+}
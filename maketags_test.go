@@ -0,0 +1,125 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"regexp"
+
+	"gopkg.in/check.v1"
+)
+
+type makeTagsSuite struct{}
+
+var _ = check.Suite(&makeTagsSuite{})
+
+func (s *makeTagsSuite) TestMakeTags(c *check.C) {
+	tmpdir := c.MkDir()
+	rnd := rand.New(rand.NewSource(1))
+	randseq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	// chr1 has a 1000-base segment at 3000 that is repeated at
+	// 6000, so there can't be any tags there.
+	repeat := randseq(1000)
+	var chr1 []byte
+	chr1 = append(chr1, randseq(3000)...)
+	chr1 = append(chr1, repeat...)
+	chr1 = append(chr1, randseq(2000)...)
+	chr1 = append(chr1, repeat...)
+	chr1 = append(chr1, randseq(3000)...)
+	chr2 := randseq(5000)
+	var fasta bytes.Buffer
+	fasta.WriteString(">chr1\n")
+	for i := 0; i < len(chr1); i += 60 {
+		end := i + 60
+		if end > len(chr1) {
+			end = len(chr1)
+		}
+		fasta.Write(bytes.ToUpper(chr1[i:end]))
+		fasta.WriteString("\n")
+	}
+	fasta.WriteString(">chr2 some description\n")
+	fasta.Write(chr2)
+	fasta.WriteString("\n>chrUn_xyz\nacgtacgtacgtacgtacgtacgtacgtacgtacgt\n")
+	err := ioutil.WriteFile(tmpdir+"/ref.fa", fasta.Bytes(), 0644)
+	c.Assert(err, check.IsNil)
+
+	exited := (&makeTags{}).RunCommand("make-tags", []string{
+		"-local=true",
+		"-ref", tmpdir + "/ref.fa",
+		"-tile-spacing", "200",
+		"-o", tmpdir + "/tags.fa",
+		"-report", tmpdir + "/report.json",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	f, err := os.Open(tmpdir + "/tags.fa")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	var taglib tagLibrary
+	err = taglib.Load(f)
+	c.Assert(err, check.IsNil)
+	c.Check(taglib.TagLen(), check.Equals, 24)
+	c.Logf("%d tags", taglib.Len())
+	c.Check(taglib.Len() > (len(chr1)-2000)/200-5, check.Equals, true)
+
+	// each tag occurs exactly once, in order, and tags on chr1
+	// are 200 +/- 50 bases apart except at the repeats
+	count := make([]int32, taglib.Len())
+	var found []tagMatch
+	for _, seq := range [][]byte{chr1, chr2} {
+		taglib.CountAll(seq, count)
+		taglib.FindAll(seq, func(id tagID, pos, taglen int) {
+			found = append(found, tagMatch{id, pos, taglen})
+		})
+	}
+	for id, n := range count {
+		c.Check(n, check.Equals, int32(1), check.Commentf("tag %d", id))
+	}
+	c.Assert(found, check.HasLen, taglib.Len())
+	for i, m := range found {
+		c.Check(m.id, check.Equals, tagID(i))
+		if i > 0 && m.pos > found[i-1].pos && m.pos < 3000 {
+			c.Check(m.pos-found[i-1].pos >= 150 && m.pos-found[i-1].pos <= 250, check.Equals, true, check.Commentf("tag %d pos %d prev %d", i, m.pos, found[i-1].pos))
+		}
+	}
+
+	buf, err := ioutil.ReadFile(tmpdir + "/report.json")
+	c.Assert(err, check.IsNil)
+	var rpt makeTagsReport
+	err = json.Unmarshal(buf, &rpt)
+	c.Assert(err, check.IsNil)
+	c.Check(rpt.Tags, check.Equals, taglib.Len())
+	c.Check(rpt.Sequences, check.HasLen, 2)
+	c.Check(rpt.Sequences[1].Name, check.Equals, "chr2")
+	c.Check(rpt.TileLength.Median >= 200 && rpt.TileLength.Median <= 250, check.Equals, true, check.Commentf("%+v", rpt.TileLength))
+	c.Check(rpt.TileLength.Max > 1000, check.Equals, true)
+	total := 0
+	for _, bin := range rpt.TileLengthHistogram {
+		total += bin.Count
+	}
+	c.Check(total, check.Equals, rpt.Tags-2)
+	c.Assert(rpt.Gaps, check.HasLen, 2)
+	for i, start := range []int{3000, 6000} {
+		c.Check(rpt.Gaps[i].Sequence, check.Equals, "chr1")
+		c.Check(rpt.Gaps[i].Start <= start && rpt.Gaps[i].Start > start-250, check.Equals, true, check.Commentf("%+v", rpt.Gaps[i]))
+		c.Check(rpt.Gaps[i].End >= start+1000 && rpt.Gaps[i].End < start+1250, check.Equals, true, check.Commentf("%+v", rpt.Gaps[i]))
+	}
+
+	// the new tag library can be used to import the reference
+	tilelib := &tileLibrary{taglib: &taglib, retainNoCalls: true}
+	tseq, _, err := tilelib.TileFasta("ref", bytes.NewReader(fasta.Bytes()), regexp.MustCompile(`^chr[12]$`), true)
+	c.Assert(err, check.IsNil)
+	c.Check(len(tseq["chr1"])+len(tseq["chr2"]), check.Equals, taglib.Len())
+}
@@ -30,7 +30,8 @@ func (cmd *manhattanPlot) RunCommand(prog string, args []string, stdin io.Reader
 	flags := flag.NewFlagSet("", flag.ContinueOnError)
 	flags.SetOutput(stderr)
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
-	inputDirectory := flags.String("i", "-", "input `directory` (output of slice-numpy -single-onehot)")
+	inputDirectory := flags.String("i", "-", "input `directory` (output of slice-numpy -single-onehot, or lightning fst)")
+	plotFst := flags.Bool("fst", false, "plot Fst values from fst-tile-variants.csv (output of lightning fst) instead of p-values")
 	outputFilename := flags.String("o", "", "output `filename` (e.g., './plot.png')")
 	csvOutputFilename := flags.String("csv-output", "", "csv output `filename` (e.g., './tile-locations-pvalues.csv')")
 	csvOutputThreshold := flags.Float64("csv-output-threshold", 0, "logpvalue threshold for csv output (0 for none)")
@@ -74,6 +75,7 @@ func (cmd *manhattanPlot) RunCommand(prog string, args []string, stdin io.Reader
 		*outputFilename,
 		fmt.Sprintf("%g", *csvOutputThreshold),
 		*csvOutputFilename,
+		fmt.Sprintf("%v", *plotFst),
 	}
 	if *runlocal {
 		if *outputFilename == "" {
@@ -16,8 +16,46 @@ import qmplot
  output_path,
  csv_threshold_str,
  csv_output_path,
+ plot_fst_str,
  ) = sys.argv
 csv_threshold = float(csv_threshold_str)
+plot_fst = plot_fst_str == 'true'
+
+if plot_fst:
+    # fst-tile-variants.csv is written by "lightning fst":
+    # tag,variant,chrom,pos,fst
+    print(f'loading fst-tile-variants.csv', file=sys.stderr)
+    series = {"#CHROM": [], "POS": [], "FST": []}
+    with open(os.path.join(input_path, 'fst-tile-variants.csv'), 'rt', newline='') as f:
+        for row in csv.DictReader(f):
+            series["#CHROM"].append(row['chrom'])
+            series["POS"].append(int(row['pos']))
+            series["FST"].append(float(row['fst']))
+    chroms = {chrom: True for chrom in series["#CHROM"]}
+    chroms[None] = True
+    print(f'generating plots', file=sys.stderr)
+    for chrom in chroms.keys():
+        output_file = output_path
+        xlabel = "Chromosome"
+        if chrom:
+            output_file = f'.{chrom}.'.join(output_file.rsplit('.', 1))
+            xlabel = f'position on {chrom}'
+        qmplot.manhattanplot(data=pandas.DataFrame(series),
+                             CHR=chrom,
+                             pv="FST",
+                             logp=False,
+                             color='#1D2A44,#441D2A',
+                             suggestiveline=None,
+                             genomewideline=None,
+                             marker=".",
+                             alpha = 0.6,
+                             title="Tile Variant Fst",
+                             xlabel=xlabel,
+                             ylabel=r"$F_{ST}$",
+                             xticklabel_kws={"rotation": "vertical"})
+        matplotlib.pyplot.savefig(output_file, bbox_inches="tight")
+        matplotlib.pyplot.close()
+    sys.exit(0)
 
 print(f'loading onehot-columns.npy', file=sys.stderr)
 columns = numpy.load(os.path.join(input_path, 'onehot-columns.npy'))
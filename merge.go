@@ -33,6 +33,8 @@ type merger struct {
 	mapped  map[string]map[tileLibRef]tileVariantID
 	mtxTags sync.Mutex
 	errs    chan error
+
+	provenance *provenanceRecorder
 }
 
 func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -115,6 +117,7 @@ func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdou
 	}
 	bufw := bufio.NewWriterSize(outw, 64*1024*1024)
 	cmd.output = bufw
+	cmd.provenance = startProvenance(prog, args, cmd.inputs...)
 	err = cmd.doMerge()
 	if err != nil {
 		return 1
@@ -191,8 +194,17 @@ func (cmd *merger) doMerge() error {
 	if err := <-cmd.errs; err != nil {
 		return err
 	}
+	cmd.provenance.addParents(cmd.tilelib.provenance)
+	prov, err := cmd.provenance.finish()
+	if err != nil {
+		return err
+	}
+	err = encoder.Encode(LibraryEntry{Provenance: []Provenance{prov}})
+	if err != nil {
+		return err
+	}
 	log.Print("flushing")
-	err := w.Flush()
+	err = w.Flush()
 	if err != nil {
 		return err
 	}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -116,23 +117,29 @@ chr2:g.[472=];[472G>A]	.
 	c.Check(code, check.Equals, 0)
 	vcfout, err := ioutil.ReadFile(tmpdir + "/out.vcf")
 	c.Check(err, check.IsNil)
-	c.Check(sortLines(string(vcfout)), check.Equals, sortLines(`##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+	c.Check(sortLines(string(vcfout)), check.Equals, sortLines(`##INFO=<ID=SVTYPE,Number=1,Type=String,Description="Type of structural variant">
+##INFO=<ID=SVLEN,Number=1,Type=Integer,Description="Difference in length between REF and ALT alleles">
+##INFO=<ID=END,Number=1,Type=Integer,Description="End position of the variant described in this record">
+##ALT=<ID=DEL,Description="Deletion">
+##ALT=<ID=DUP,Description="Duplication">
+##ALT=<ID=INV,Description="Inversion">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
 #CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	testdata/pipeline1/input1.1.fasta	testdata/pipeline1/input2.1.fasta
-chr1	1	.	NNN	GGC	.	.	.	GT	1/1	0/0
-chr1	41	.	T	A	.	.	.	GT	1/0	0/0
-chr1	42	.	T	A	.	.	.	GT	1/0	0/0
-chr1	161	.	A	T	.	.	.	GT	0/1	0/0
-chr1	178	.	A	T	.	.	.	GT	0/1	0/0
-chr1	221	.	TCCA	T	.	.	.	GT	1/1	0/0
-chr1	302	.	TTTT	AAAA	.	.	.	GT	0/1	0/0
-chr2	1	.	TTT	AAA	.	.	.	GT	0/0	0/1
-chr2	125	.	CTT	AAA	.	.	.	GT	0/0	1/1
-chr2	240	.	ATTTTTCTTGCTCTC	A	.	.	.	GT	1/0	0/0
-chr2	258	.	CCTTGTATTTTT	AA	.	.	.	GT	1/0	0/0
-chr2	315	.	C	A	.	.	.	GT	1/0	0/0
-chr2	469	.	GTGG	G	.	.	.	GT	1/0	0/0
-chr2	471	.	G	A	.	.	.	GT	0/1	0/0
-chr2	472	.	G	A	.	.	.	GT	0/1	0/0
+chr1	1	.	NNN	GGC	.	.	.	GT	1|1	0|0
+chr1	41	.	T	A	.	.	.	GT	1|0	0|0
+chr1	42	.	T	A	.	.	.	GT	1|0	0|0
+chr1	161	.	A	T	.	.	.	GT	0|1	0|0
+chr1	178	.	A	T	.	.	.	GT	0|1	0|0
+chr1	221	.	TCCA	T	.	.	.	GT	1|1	0|0
+chr1	302	.	TTTT	AAAA	.	.	.	GT	0|1	0|0
+chr2	1	.	TTT	AAA	.	.	.	GT	0|0	0|1
+chr2	125	.	CTT	AAA	.	.	.	GT	0|0	1|1
+chr2	240	.	ATTTTTCTTGCTCTC	A	.	.	.	GT	1|0	0|0
+chr2	258	.	CCTTGTATTTTT	AA	.	.	.	GT	1|0	0|0
+chr2	315	.	C	A	.	.	.	GT	1|0	0|0
+chr2	468	.	CGTG	C	.	.	.	GT	1|0	0|0
+chr2	471	.	G	A	.	.	.	GT	0|1	0|0
+chr2	472	.	G	A	.	.	.	GT	0|1	0|0
 `))
 	bedout, err := ioutil.ReadFile(tmpdir + "/export.bed")
 	c.Check(err, check.IsNil)
@@ -171,6 +178,26 @@ chr2 472 572 7 1000 . 496 572
 6,6,e36dce85efbef,chr2:g.472G>A
 6,6,f81388b184f4a,chr2:g.470_472del
 `))
+
+	// With -gtf, each variant still gets one row, with
+	// overlapping transcripts' consequences joined by ";"
+	// (same as slice-numpy annotations).
+	err = ioutil.WriteFile(tmpdir+"/test.gtf", []byte(`chr2	test	exon	100	200	.	+	.	gene_id "G1"; transcript_id "TX1"; gene_name "GENE1";
+chr2	test	exon	120	130	.	+	.	gene_id "G2"; transcript_id "TX2"; gene_name "GENE2";
+`), 0600)
+	c.Assert(err, check.IsNil)
+	annotateout = &bytes.Buffer{}
+	code = (&annotatecmd{}).RunCommand("lightning annotate", []string{"-local", "-variant-hash=true", "-gtf", tmpdir + "/test.gtf", "-i", tmpdir + "/merged/library.gob"}, bytes.NewReader(nil), annotateout, os.Stderr)
+	c.Check(code, check.Equals, 0)
+	c.Logf("%s", annotateout.String())
+	lines := strings.Split(strings.TrimSuffix(annotateout.String(), "\n"), "\n")
+	c.Check(lines, check.HasLen, strings.Count(sorted, "\n"))
+	for _, line := range lines {
+		c.Check(strings.Split(line, ","), check.HasLen, 9, check.Commentf("%s", line))
+		if strings.Contains(line, "chr2:g.125_127delinsAAA") {
+			c.Check(line, check.Matches, `.*,chr2:g\.125_127delinsAAA,GENE1;GENE2,TX1;TX2,[^,]*;[^,]*,;,[^,;]+;[^,;]+`)
+		}
+	}
 }
 
 func sortLines(txt string) string {
@@ -178,3 +205,41 @@ func sortLines(txt string) string {
 	sort.Strings(lines)
 	return strings.Join(lines, "\n") + "\n"
 }
+
+// importLibrary imports infile (a fasta file or a directory) into
+// outfile using testdata/tags, creating outfile's directory if
+// needed. args are additional import flags, like
+// "-save-incomplete-tiles".
+func importLibrary(c *check.C, outfile, infile string, args ...string) {
+	err := os.MkdirAll(filepath.Dir(outfile), 0777)
+	c.Assert(err, check.IsNil)
+	exited := (&importer{}).RunCommand("import", append(append([]string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-o", outfile,
+	}, args...), infile), nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+}
+
+// sliceLibraries slices the given libraries into outdir, 4 tags per
+// file.
+func sliceLibraries(c *check.C, outdir string, inputs ...string) {
+	err := os.MkdirAll(outdir, 0777)
+	c.Assert(err, check.IsNil)
+	exited := (&slicecmd{}).RunCommand("slice", append([]string{
+		"-local=true",
+		"-output-dir=" + outdir,
+		"-tags-per-file=4",
+	}, inputs...), nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+}
+
+// importAndSlice imports testdata/ref.fasta into
+// tmpdir/lib1/library.gob and testdata/pipeline1 into
+// tmpdir/lib2/library.gob, and slices both into tmpdir/sliced.
+func importAndSlice(c *check.C, tmpdir string) {
+	importLibrary(c, tmpdir+"/lib1/library.gob", "testdata/ref.fasta", "-save-incomplete-tiles")
+	importLibrary(c, tmpdir+"/lib2/library.gob", "testdata/pipeline1")
+	sliceLibraries(c, tmpdir+"/sliced", tmpdir+"/lib1", tmpdir+"/lib2")
+}
@@ -0,0 +1,214 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Provenance records how a library (or an output directory) was
+// produced. A command that reads libraries includes their
+// provenance records as Parents of its own.
+type Provenance struct {
+	Version   string // lightning version
+	Command   []string
+	StartTime time.Time
+	EndTime   time.Time
+	Inputs    []ProvenanceInput
+	Parents   []Provenance
+}
+
+type ProvenanceInput struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	SHA256  string // hex
+}
+
+// provenanceRecorder builds a Provenance record for the running
+// command. Input files are checksummed in the background while the
+// command does its work.
+type provenanceRecorder struct {
+	prov    Provenance
+	parents map[string]bool
+	mtx     sync.Mutex
+	wg      sync.WaitGroup
+	err     error
+}
+
+// startProvenance starts recording provenance for the command
+// "prog args...", and starts checksumming the given input files
+// (directories are expanded, "" and "-" are skipped).
+func startProvenance(prog string, args []string, inputs ...string) *provenanceRecorder {
+	pr := &provenanceRecorder{
+		prov: Provenance{
+			Version:   cmd.Version.String(),
+			Command:   append([]string{prog}, args...),
+			StartTime: time.Now().UTC(),
+		},
+		parents: map[string]bool{},
+	}
+	var files []string
+	for _, input := range inputs {
+		if input == "" || input == "-" {
+			continue
+		}
+		add, err := allFiles(input, nil)
+		if err != nil {
+			pr.err = err
+			return pr
+		}
+		files = append(files, add...)
+	}
+	pr.prov.Inputs = make([]ProvenanceInput, len(files))
+	throttle := throttle{Max: 8}
+	for i, fnm := range files {
+		i, fnm := i, fnm
+		pr.wg.Add(1)
+		go func() {
+			defer pr.wg.Done()
+			throttle.Acquire()
+			defer throttle.Release()
+			in, err := provenanceInput(fnm)
+			pr.mtx.Lock()
+			defer pr.mtx.Unlock()
+			if err != nil && pr.err == nil {
+				pr.err = err
+			}
+			pr.prov.Inputs[i] = in
+		}()
+	}
+	return pr
+}
+
+func provenanceInput(fnm string) (ProvenanceInput, error) {
+	in := ProvenanceInput{Path: fnm}
+	f, err := open(fnm)
+	if err != nil {
+		return in, err
+	}
+	defer f.Close()
+	if fi, err := os.Stat(fnm); err == nil {
+		in.ModTime = fi.ModTime().UTC()
+	}
+	h := sha256.New()
+	in.Size, err = io.Copy(h, f)
+	if err != nil {
+		return in, fmt.Errorf("%s: %w", fnm, err)
+	}
+	in.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	return in, nil
+}
+
+// addParents adds provenance records of input libraries, skipping
+// duplicates (e.g., the same record in each file of a sliced
+// library).
+func (pr *provenanceRecorder) addParents(parents []Provenance) {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+	for _, p := range parents {
+		key, _ := json.Marshal(p)
+		if !pr.parents[string(key)] {
+			pr.parents[string(key)] = true
+			pr.prov.Parents = append(pr.prov.Parents, p)
+		}
+	}
+}
+
+// redactProvenance returns a copy of provs, including all ancestor
+// records, without the Inputs that refer to removed genomes, and
+// with "[removed]" in place of Command arguments that refer to
+// removed genomes.
+func redactProvenance(provs []Provenance, isRemoved func(string) bool) []Provenance {
+	if provs == nil {
+		return nil
+	}
+	redacted := make([]Provenance, len(provs))
+	for i, p := range provs {
+		p.Command = append([]string(nil), p.Command...)
+		for j, arg := range p.Command {
+			if eq := strings.Index(arg, "="); strings.HasPrefix(arg, "-") && eq > 0 {
+				arg = arg[eq+1:]
+			}
+			if isRemoved(arg) {
+				p.Command[j] = "[removed]"
+			}
+		}
+		var inputs []ProvenanceInput
+		for _, in := range p.Inputs {
+			if !isRemoved(in.Path) {
+				inputs = append(inputs, in)
+			}
+		}
+		p.Inputs = inputs
+		p.Parents = redactProvenance(p.Parents, isRemoved)
+		redacted[i] = p
+	}
+	return redacted
+}
+
+// finish waits for input checksums and returns the completed
+// record.
+func (pr *provenanceRecorder) finish() (Provenance, error) {
+	pr.wg.Wait()
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+	pr.prov.EndTime = time.Now().UTC()
+	return pr.prov, pr.err
+}
+
+// writeJSON writes the completed record to dir/provenance.json.
+func (pr *provenanceRecorder) writeJSON(dir string) error {
+	prov, err := pr.finish()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dir+"/provenance.json", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(prov)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %s/provenance.json", dir)
+	return f.Close()
+}
+
+// loadProvenance adds the given records (read from an input
+// library) to tilelib.provenance, skipping duplicates.
+func (tilelib *tileLibrary) loadProvenance(provs []Provenance) {
+	if len(provs) == 0 {
+		return
+	}
+	tilelib.mtx.Lock()
+	defer tilelib.mtx.Unlock()
+	for _, p := range provs {
+		dup := false
+		key, _ := json.Marshal(p)
+		for _, have := range tilelib.provenance {
+			if havekey, _ := json.Marshal(have); string(havekey) == string(key) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			tilelib.provenance = append(tilelib.provenance, p)
+		}
+	}
+}
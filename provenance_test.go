@@ -0,0 +1,131 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type provenanceSuite struct{}
+
+var _ = check.Suite(&provenanceSuite{})
+
+func (s *provenanceSuite) TestChain(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"lib1", "lib2", "merged", "sliced", "export"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	for _, args := range [][]string{
+		{"-save-incomplete-tiles", "-o", tmpdir + "/lib1/library.gob", "testdata/ref.fasta"},
+		{"-o", tmpdir + "/lib2/library.gob", "testdata/pipeline1"},
+	} {
+		exited := (&importer{}).RunCommand("lightning import", append([]string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+		}, args...), nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	exited := (&merger{}).RunCommand("lightning merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/merged/library.gob",
+		tmpdir + "/lib1/library.gob",
+		tmpdir + "/lib2/library.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&slicecmd{}).RunCommand("lightning slice", []string{
+		"-local=true",
+		"-output-dir=" + tmpdir + "/sliced",
+		"-tags-per-file=4",
+		tmpdir + "/merged",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// Every slice has the same record, and the import records
+	// (with input checksums) are reachable through the merge
+	// record.
+	var sliceProv []Provenance
+	for i := 0; i < 3; i++ {
+		var provs []Provenance
+		f, err := os.Open(fmt.Sprintf("%s/sliced/library%04d.gob.gz", tmpdir, i))
+		c.Assert(err, check.IsNil)
+		err = DecodeLibrary(f, true, func(ent *LibraryEntry) error {
+			provs = append(provs, ent.Provenance...)
+			return nil
+		})
+		f.Close()
+		c.Assert(err, check.IsNil)
+		c.Assert(provs, check.HasLen, 1)
+		if i == 0 {
+			sliceProv = provs
+		} else {
+			c.Check(provs, check.DeepEquals, sliceProv)
+		}
+	}
+	prov := sliceProv[0]
+	c.Check(prov.Command[0], check.Equals, "lightning slice")
+	c.Check(prov.EndTime.Before(prov.StartTime), check.Equals, false)
+	c.Assert(prov.Parents, check.HasLen, 1)
+	c.Check(prov.Parents[0].Command[0], check.Equals, "lightning merge")
+	c.Assert(prov.Parents[0].Parents, check.HasLen, 2)
+	refdata, err := ioutil.ReadFile("testdata/ref.fasta")
+	c.Assert(err, check.IsNil)
+	found := false
+	for _, parent := range prov.Parents[0].Parents {
+		c.Check(parent.Command[0], check.Equals, "lightning import")
+		for _, in := range parent.Inputs {
+			c.Check(in.SHA256, check.HasLen, 64)
+			if in.Path == "testdata/ref.fasta" {
+				found = true
+				c.Check(in.Size, check.Equals, int64(len(refdata)))
+				c.Check(in.SHA256, check.Equals, fmt.Sprintf("%x", sha256.Sum256(refdata)))
+			}
+		}
+	}
+	c.Check(found, check.Equals, true)
+
+	exited = (&exporter{}).RunCommand("lightning export", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/merged",
+		"-output-dir=" + tmpdir + "/export",
+		"-output-format=vcf",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	buf, err := ioutil.ReadFile(tmpdir + "/export/provenance.json")
+	c.Assert(err, check.IsNil)
+	var exportProv Provenance
+	err = json.Unmarshal(buf, &exportProv)
+	c.Assert(err, check.IsNil)
+	c.Check(exportProv.Command[0], check.Equals, "lightning export")
+	c.Check(exportProv.Parents, check.DeepEquals, prov.Parents)
+	c.Assert(exportProv.Inputs, check.HasLen, 1)
+	c.Check(exportProv.Inputs[0].Path, check.Equals, tmpdir+"/merged/library.gob")
+}
+
+func (s *provenanceSuite) TestRedact(c *check.C) {
+	isRemoved := func(name string) bool { return trimFilenameForLabel(name) == "input2" }
+	provs := []Provenance{{
+		Command: []string{"lightning merge", "-o", "merged.gob", "lib.gob"},
+		Parents: []Provenance{{
+			Command: []string{"lightning import", "-ref=x/input2.1.fasta", "x/input1.1.fasta", "x/input2.2.fasta"},
+			Inputs:  []ProvenanceInput{{Path: "x/input1.1.fasta"}, {Path: "x/input2.1.fasta", SHA256: "abcdef"}},
+		}},
+	}}
+	redacted := redactProvenance(provs, isRemoved)
+	c.Check(redacted[0].Command, check.DeepEquals, provs[0].Command)
+	c.Check(redacted[0].Parents[0].Command, check.DeepEquals, []string{"lightning import", "[removed]", "x/input1.1.fasta", "[removed]"})
+	c.Check(redacted[0].Parents[0].Inputs, check.DeepEquals, []ProvenanceInput{{Path: "x/input1.1.fasta"}})
+	// original records are not modified
+	c.Check(provs[0].Parents[0].Inputs, check.HasLen, 2)
+	c.Check(provs[0].Parents[0].Command[1], check.Equals, "-ref=x/input2.1.fasta")
+}
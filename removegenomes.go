@@ -0,0 +1,451 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+)
+
+// removeGenomes rewrites a library (a single file, or a directory
+// such as the output of slice) without the specified genomes, and
+// without the tile variants that were only used by those genomes.
+//
+// By default the output has the same files and variant IDs as the
+// input. With -tidy, the library is loaded into memory, renumbered
+// with Tidy, and written with WriteDir.
+type removeGenomes struct {
+	inputDir    string
+	outputDir   string
+	auditFile   string
+	samplesFile string
+	tidy        bool
+	projectUUID string
+	runLocal    bool
+}
+
+// removeGenomesAudit is written to the -audit-file path (not the
+// output directory, so the audit record doesn't travel with the
+// library it describes).
+type removeGenomesAudit struct {
+	Time                time.Time
+	Requested           []string // sample IDs from -samples file
+	RemovedGenomes      []string // genome names removed
+	NotFound            []string // requested sample IDs that did not match any genome
+	RemainingGenomes    int
+	RemovedTileVariants int
+	Provenance          Provenance
+}
+
+func (cmd *removeGenomes) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.inputDir, "input-dir", "", "input library `directory` (or file)")
+	flags.StringVar(&cmd.outputDir, "output-dir", "", "output `directory`")
+	flags.StringVar(&cmd.auditFile, "audit-file", "", "write audit record (json) to `file`, which must not be in the output directory (in container mode, the audit record is written to the container log)")
+	flags.StringVar(&cmd.samplesFile, "samples", "", "`file` with IDs of samples to remove, one per line (genome name or label, e.g., \"HG00096\" for \"HG00096.1.fasta\")")
+	flags.BoolVar(&cmd.tidy, "tidy", false, "load the whole library into memory and renumber tile variants with the most common first (input must not be sliced; output is written in the same layout as flake)")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.inputDir == "" {
+		err = errors.New("input library (-input-dir) not specified")
+		return 2
+	} else if cmd.samplesFile == "" {
+		err = errors.New("samples to remove (-samples) not specified")
+		return 2
+	} else if cmd.outputDir == "" && cmd.runLocal {
+		err = errors.New("output directory (-output-dir) not specified")
+		return 2
+	} else if cmd.auditFile == "" && cmd.runLocal {
+		err = errors.New("audit file (-audit-file) not specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputDir != "" {
+			err = errors.New("cannot specify output directory in container mode: not implemented")
+			return 2
+		} else if cmd.auditFile != "" {
+			err = errors.New("cannot specify audit file in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning remove-genomes",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+		}
+		if cmd.tidy {
+			runner.RAM = 700000000000
+			runner.VCPUs = 96
+		}
+		err = runner.TranslatePaths(&cmd.inputDir, &cmd.samplesFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"remove-genomes", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", cmd.inputDir,
+			"-output-dir", "/mnt/output",
+			"-audit-file", "/dev/stderr",
+			"-samples", cmd.samplesFile,
+			fmt.Sprintf("-tidy=%v", cmd.tidy),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	auditPath, _ := filepath.Abs(cmd.auditFile)
+	outputPath, _ := filepath.Abs(cmd.outputDir)
+	if strings.HasPrefix(auditPath, outputPath+"/") {
+		err = fmt.Errorf("audit file %s must not be in output directory %s", cmd.auditFile, cmd.outputDir)
+		return 2
+	}
+
+	prov := startProvenance(prog, args, cmd.inputDir, cmd.samplesFile)
+	ids, err := readSampleIDs(cmd.samplesFile)
+	if err != nil {
+		return 1
+	}
+	audit := removeGenomesAudit{Time: time.Now().UTC(), Requested: ids}
+	remove := map[string]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+	isRemoved := func(name string) bool {
+		return remove[name] || remove[trimFilenameForLabel(name)]
+	}
+
+	if cmd.tidy {
+		err = cmd.removeTidy(&audit, isRemoved, prov)
+	} else {
+		err = cmd.removeStreaming(&audit, isRemoved, prov)
+	}
+	if err != nil {
+		return 1
+	}
+	matched := map[string]bool{}
+	for _, name := range audit.RemovedGenomes {
+		matched[name] = true
+		matched[trimFilenameForLabel(name)] = true
+	}
+	for _, id := range ids {
+		if !matched[id] {
+			log.Warnf("sample ID %q did not match any genome in input", id)
+			audit.NotFound = append(audit.NotFound, id)
+		}
+	}
+	log.Printf("removed %d genomes and %d tile variants, %d genomes remain", len(audit.RemovedGenomes), audit.RemovedTileVariants, audit.RemainingGenomes)
+	err = writeJSONFile(cmd.auditFile, audit)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// readSampleIDs returns the non-empty lines of the given file.
+func readSampleIDs(fnm string) ([]string, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	var ids []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if id := strings.TrimSpace(line); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func writeJSONFile(fnm string, v interface{}) error {
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeTidy loads the whole library, removes genomes, and writes a
+// tidied copy.
+func (cmd *removeGenomes) removeTidy(audit *removeGenomesAudit, isRemoved func(string) bool, prov *provenanceRecorder) error {
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err := tilelib.LoadDir(context.Background(), cmd.inputDir)
+	if err != nil {
+		return err
+	}
+	prov.addParents(redactProvenance(tilelib.provenance, isRemoved))
+	for name := range tilelib.compactGenomes {
+		if isRemoved(name) {
+			delete(tilelib.compactGenomes, name)
+			delete(tilelib.cgmeta, name)
+			audit.RemovedGenomes = append(audit.RemovedGenomes, name)
+		}
+	}
+	sort.Strings(audit.RemovedGenomes)
+	audit.RemainingGenomes = len(tilelib.compactGenomes)
+	countVariants := func() (n int) {
+		for _, variants := range tilelib.variant {
+			n += len(variants)
+		}
+		return
+	}
+	before := countVariants()
+	tilelib.Tidy()
+	audit.RemovedTileVariants = before - countVariants()
+	p, err := prov.finish()
+	if err != nil {
+		return err
+	}
+	audit.Provenance = p
+	tilelib.provenance = []Provenance{p}
+	return tilelib.WriteDir(cmd.outputDir)
+}
+
+// removeStreaming makes two passes over the input files: the first
+// finds the tile variants used by the remaining genomes and
+// reference sequences, the second writes each input file to the
+// output directory without the removed genomes and unused tile
+// variants.
+func (cmd *removeGenomes) removeStreaming(audit *removeGenomesAudit, isRemoved func(string) bool, prov *provenanceRecorder) error {
+	infiles, err := allFiles(cmd.inputDir, matchGobFile)
+	if err != nil {
+		return err
+	}
+	if len(infiles) == 0 {
+		return fmt.Errorf("no input files found in %s", cmd.inputDir)
+	}
+
+	var mtx sync.Mutex
+	var used [][]bool // used[tag][variant]
+	markUsed := func(tag tagID, variant tileVariantID) {
+		if variant == 0 {
+			return
+		}
+		for int(tag) >= len(used) {
+			used = append(used, nil)
+		}
+		for int(variant) >= len(used[tag]) {
+			used[tag] = append(used[tag], false)
+		}
+		used[tag][variant] = true
+	}
+	removed := map[string]bool{}
+	remaining := map[string]bool{}
+
+	log.Printf("remove-genomes: finding tile variants used by remaining genomes")
+	pass1 := throttle{Max: 8}
+	for _, infile := range infiles {
+		infile := infile
+		pass1.Go(func() error {
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				prov.addParents(redactProvenance(ent.Provenance, isRemoved))
+				for _, cg := range ent.CompactGenomes {
+					if isRemoved(cg.Name) {
+						removed[cg.Name] = true
+						continue
+					}
+					remaining[cg.Name] = true
+					for i, v := range cg.Variants {
+						markUsed(cg.StartTag+tagID(i/2), v)
+					}
+					for i, v := range cg.Imputed {
+						markUsed(cg.StartTag+tagID(i/2), v)
+					}
+				}
+				for _, cseq := range ent.CompactSequences {
+					for _, path := range cseq.TileSequences {
+						for _, libref := range path {
+							markUsed(libref.Tag, libref.Variant)
+						}
+					}
+				}
+				return nil
+			})
+		})
+	}
+	err = pass1.Wait()
+	if err != nil {
+		return err
+	}
+	for name := range removed {
+		audit.RemovedGenomes = append(audit.RemovedGenomes, name)
+	}
+	sort.Strings(audit.RemovedGenomes)
+	audit.RemainingGenomes = len(remaining)
+	p, err := prov.finish()
+	if err != nil {
+		return err
+	}
+	audit.Provenance = p
+
+	log.Printf("remove-genomes: writing %d files", len(infiles))
+	var removedTileVariants int64
+	pass2 := throttle{Max: 8}
+	for _, infile := range infiles {
+		infile := infile
+		pass2.Go(func() error {
+			outfile := cmd.outputDir + "/" + filepath.Base(infile)
+			if rel, err := filepath.Rel(cmd.inputDir, infile); err == nil && rel != "." {
+				outfile = cmd.outputDir + "/" + rel
+			}
+			n, err := removeGenomesFile(infile, outfile, isRemoved, func(tv TileVariant) bool {
+				return tv.Ref || (int(tv.Tag) < len(used) && int(tv.Variant) < len(used[tv.Tag]) && used[tv.Tag][tv.Variant])
+			}, p)
+			mtx.Lock()
+			removedTileVariants += int64(n)
+			mtx.Unlock()
+			return err
+		})
+	}
+	err = pass2.Wait()
+	if err != nil {
+		return err
+	}
+	audit.RemovedTileVariants = int(removedTileVariants)
+	return nil
+}
+
+// removeGenomesFile copies a library file, skipping genomes where
+// isRemoved(name) is true and tile variants where keep(tv) is false,
+// and replacing provenance records with prov. It returns the number
+// of tile variants skipped.
+func removeGenomesFile(infile, outfile string, isRemoved func(string) bool, keep func(TileVariant) bool, prov Provenance) (int, error) {
+	in, err := open(infile)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	err = os.MkdirAll(filepath.Dir(outfile), 0777)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(outfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	bufw := bufio.NewWriterSize(out, 1<<26)
+	var w io.Writer = bufw
+	var zw *pgzip.Writer
+	if strings.HasSuffix(outfile, ".gz") {
+		zw = pgzip.NewWriter(bufw)
+		w = zw
+	}
+	enc := gob.NewEncoder(w)
+	skipped := 0
+	err = DecodeLibrary(in, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+		ent.Provenance = nil
+		tvs := ent.TileVariants[:0]
+		for _, tv := range ent.TileVariants {
+			if keep(tv) {
+				tvs = append(tvs, tv)
+			} else {
+				skipped++
+			}
+		}
+		ent.TileVariants = tvs
+		cgs := ent.CompactGenomes[:0]
+		for _, cg := range ent.CompactGenomes {
+			if !isRemoved(cg.Name) {
+				cgs = append(cgs, cg)
+			}
+		}
+		ent.CompactGenomes = cgs
+		if len(ent.TagSet) == 0 && len(ent.TileVariants) == 0 && len(ent.CompactGenomes) == 0 && len(ent.CompactSequences) == 0 {
+			return nil
+		}
+		return enc.Encode(ent)
+	})
+	if err != nil {
+		return skipped, fmt.Errorf("%s: %w", infile, err)
+	}
+	err = enc.Encode(LibraryEntry{Provenance: []Provenance{prov}})
+	if err != nil {
+		return skipped, err
+	}
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return skipped, err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return skipped, err
+	}
+	return skipped, out.Close()
+}
@@ -0,0 +1,144 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type removeGenomesSuite struct{}
+
+var _ = check.Suite(&removeGenomesSuite{})
+
+func (s *removeGenomesSuite) TestRemove(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"merged", "removed", "tidy"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	importAndSlice(c, tmpdir)
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/merged/library.gob",
+		tmpdir + "/lib1/library.gob",
+		tmpdir + "/lib2/library.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	err := ioutil.WriteFile(tmpdir+"/remove.txt", []byte("input2\nnosuchsample\n"), 0666)
+	c.Assert(err, check.IsNil)
+
+	// -audit-file must not be in the output directory.
+	exited = (&removeGenomes{}).RunCommand("remove-genomes", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/sliced",
+		"-output-dir", tmpdir + "/removed",
+		"-audit-file", tmpdir + "/removed/removed-genomes.json",
+		"-samples", tmpdir + "/remove.txt",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 2)
+
+	for _, trial := range []struct {
+		inputDir  string
+		outputDir string
+		tidy      bool
+	}{
+		{tmpdir + "/sliced", tmpdir + "/removed", false},
+		// LoadDir doesn't support sliced libraries, so -tidy
+		// needs an unsliced input.
+		{tmpdir + "/merged", tmpdir + "/tidy", true},
+	} {
+		c.Logf("=== %+v", trial)
+		exited = (&removeGenomes{}).RunCommand("remove-genomes", []string{
+			"-local=true",
+			"-input-dir", trial.inputDir,
+			"-output-dir", trial.outputDir,
+			"-audit-file", trial.outputDir + ".json",
+			"-samples", tmpdir + "/remove.txt",
+			"-tidy=" + map[bool]string{false: "false", true: "true"}[trial.tidy],
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+
+		// The audit record is not written into the output
+		// library.
+		ents, err := ioutil.ReadDir(trial.outputDir)
+		c.Assert(err, check.IsNil)
+		for _, ent := range ents {
+			c.Check(ent.Name(), check.Matches, `.*\.gob(\.gz)?`)
+		}
+
+		buf, err := ioutil.ReadFile(trial.outputDir + ".json")
+		c.Assert(err, check.IsNil)
+		var audit removeGenomesAudit
+		err = json.Unmarshal(buf, &audit)
+		c.Assert(err, check.IsNil)
+		c.Check(audit.RemovedGenomes, check.DeepEquals, []string{"testdata/pipeline1/input2.1.fasta"})
+		c.Check(audit.NotFound, check.DeepEquals, []string{"nosuchsample"})
+		c.Check(audit.RemainingGenomes, check.Equals, 1)
+		c.Check(audit.RemovedTileVariants > 0, check.Equals, true)
+		c.Check(audit.Provenance.Command[0], check.Equals, "remove-genomes")
+
+		if !trial.tidy {
+			// (Merge and WriteDir don't preserve Ref
+			// flags, so fsck would report problems with
+			// the tidy output.)
+			exited = (&fsckCmd{}).RunCommand("fsck", []string{"-local=true", "-input-dir", trial.outputDir}, nil, ioutil.Discard, os.Stderr)
+			c.Check(exited, check.Equals, 0)
+		}
+
+		// Every remaining tile variant is used by the
+		// remaining genome or the reference.
+		// Provenance records of the removed genome's inputs
+		// are redacted, and the others are kept.
+		buf, err = json.Marshal(audit.Provenance)
+		c.Assert(err, check.IsNil)
+		c.Check(string(buf), check.Not(check.Matches), `(?s).*input2.*`)
+		c.Check(string(buf), check.Matches, `(?s).*input1\.1\.fasta.*`)
+
+		var names []string
+		used := map[tileLibRef]bool{}
+		have := map[tileLibRef]bool{}
+		files, err := allFiles(trial.outputDir, matchGobFile)
+		c.Assert(err, check.IsNil)
+		for _, fnm := range files {
+			f, err := os.Open(fnm)
+			c.Assert(err, check.IsNil)
+			err = DecodeLibrary(f, strings.HasSuffix(fnm, ".gz"), func(ent *LibraryEntry) error {
+				buf, err := json.Marshal(ent)
+				c.Assert(err, check.IsNil)
+				c.Check(string(buf), check.Not(check.Matches), `(?s).*input2.*`)
+				for _, tv := range ent.TileVariants {
+					have[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = true
+				}
+				for _, cg := range ent.CompactGenomes {
+					if cg.StartTag == 0 {
+						names = append(names, cg.Name)
+					}
+					for i, v := range cg.Variants {
+						if v > 0 {
+							used[tileLibRef{Tag: cg.StartTag + tagID(i/2), Variant: v}] = true
+						}
+					}
+				}
+				for _, cseq := range ent.CompactSequences {
+					for _, path := range cseq.TileSequences {
+						for _, libref := range path {
+							used[libref] = true
+						}
+					}
+				}
+				return nil
+			})
+			f.Close()
+			c.Assert(err, check.IsNil)
+		}
+		c.Check(names, check.DeepEquals, []string{"testdata/pipeline1/input1.1.fasta"})
+		c.Check(have, check.DeepEquals, used)
+	}
+}
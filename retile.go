@@ -0,0 +1,484 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+)
+
+// retiler converts a library to a different tag set by
+// reconstructing each haplotype's sequence from its tiles and tiling
+// it again with the new tags. The output can be merged with other
+// libraries that use the new tag set.
+type retiler struct {
+	tagLibraryFile      string
+	refname             string
+	inputDir            string
+	outputFile          string
+	tagMapFile          string
+	saveIncompleteTiles bool
+	projectUUID         string
+	runLocal            bool
+	provenance          *provenanceRecorder
+}
+
+func (cmd *retiler) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.tagLibraryFile, "tag-library", "", "new tag library fasta `file`")
+	flags.StringVar(&cmd.refname, "ref", "", "reference genome `name` in input library")
+	flags.StringVar(&cmd.inputDir, "input-dir", ".", "input library `directory` (or file)")
+	flags.StringVar(&cmd.outputFile, "o", "-", "output library `file`")
+	flags.StringVar(&cmd.tagMapFile, "tag-map", "", "output mapping from old tags to new tags to csv `file`")
+	flags.BoolVar(&cmd.saveIncompleteTiles, "save-incomplete-tiles", false, "treat tiles with no-calls as regular tiles")
+	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
+	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	priority := flags.Int("priority", 500, "container request priority")
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.tagLibraryFile == "" {
+		err = errors.New("new tag library (-tag-library) not specified")
+		return 2
+	} else if cmd.refname == "" {
+		err = errors.New("reference genome (-ref) not specified")
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !cmd.runLocal {
+		if cmd.outputFile != "-" || cmd.tagMapFile != "" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 2
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning retile",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: cmd.projectUUID,
+			RAM:         500000000000,
+			VCPUs:       64,
+			Priority:    *priority,
+			KeepCache:   2,
+		}
+		err = runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"retile", "-local=true",
+			"-pprof", ":6060",
+			"-tag-library", cmd.tagLibraryFile,
+			"-ref", cmd.refname,
+			"-input-dir", cmd.inputDir,
+			"-o", "/mnt/output/library.gob.gz",
+			"-tag-map", "/mnt/output/tagmap.csv",
+			fmt.Sprintf("-save-incomplete-tiles=%v", cmd.saveIncompleteTiles),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob.gz")
+		return 0
+	}
+
+	cmd.provenance = startProvenance(prog, args, cmd.tagLibraryFile, cmd.inputDir)
+	err = cmd.retile(stdout)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (cmd *retiler) retile(stdout io.Writer) error {
+	taglib, err := (&importer{tagLibraryFile: cmd.tagLibraryFile}).loadTagLibrary()
+	if err != nil {
+		return err
+	}
+
+	oldlib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = oldlib.LoadDir(context.Background(), cmd.inputDir)
+	if err != nil {
+		return err
+	}
+	refseq, ok := oldlib.refseqs[cmd.refname]
+	if !ok {
+		return fmt.Errorf("reference name %q not found in input; have %v", cmd.refname, func() (names []string) {
+			for name := range oldlib.refseqs {
+				names = append(names, name)
+			}
+			return
+		}())
+	}
+	if len(oldlib.refseqs) > 1 {
+		log.Warnf("retile: input has %d reference genomes, only %q will be included in output", len(oldlib.refseqs), cmd.refname)
+	}
+	var seqnames []string
+	for seqname := range refseq {
+		seqnames = append(seqnames, seqname)
+	}
+	sort.Strings(seqnames)
+
+	var outw, outf io.WriteCloser
+	if cmd.outputFile == "-" {
+		outw = nopCloser{stdout}
+	} else {
+		outf, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		defer outf.Close()
+		if strings.HasSuffix(cmd.outputFile, ".gz") {
+			outw = pgzip.NewWriter(outf)
+		} else {
+			outw = outf
+		}
+	}
+	bufw := bufio.NewWriterSize(outw, 64*1024*1024)
+	enc := gob.NewEncoder(bufw)
+	err = enc.Encode(LibraryEntry{TagSet: taglib.Tags()})
+	if err != nil {
+		return err
+	}
+	// Retile the reference first, so the new tag map can be
+	// computed from the reference positions of old and new
+	// tags. Reference tiles are always saved in full, so the
+	// output can be retiled again.
+	newlib := &tileLibrary{taglib: taglib, retainNoCalls: true, encoder: enc}
+	log.Printf("retile: reference %s", cmd.refname)
+	newrefseq := tileSeq{}
+	var tagmap []tagMapRow
+	for _, seqname := range seqnames {
+		path := refseq[seqname]
+		segs, oldstarts := oldlib.haplotypeSequence(path, func(i int) tileVariantID { return path[i].Variant })
+		for i, start := range oldstarts {
+			if start < 0 {
+				return fmt.Errorf("%s %s: reference tile sequence not available for tag %d variant %d (reference was imported without -save-incomplete-tiles?)", cmd.refname, seqname, path[i].Tag, path[i].Variant)
+			}
+		}
+		seq := segs[0].seq
+		tseq, _, err := newlib.TileFasta(cmd.refname, fastaReader(seqname, seq), matchAnySequence, true)
+		if err != nil {
+			return err
+		}
+		newpath := tseq[seqname]
+		newrefseq[seqname] = newpath
+		tagmap = append(tagmap, tagMapping(seqname, seq, path, oldstarts, newpath, taglib)...)
+	}
+	err = enc.Encode(LibraryEntry{
+		CompactSequences: []CompactSequence{{Name: cmd.refname, TileSequences: newrefseq}},
+	})
+	if err != nil {
+		return err
+	}
+
+	newlib.retainNoCalls = cmd.saveIncompleteTiles
+	names := cgnames(oldlib)
+	errs := make(chan error, 1)
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, name := range names {
+		name := name
+		cg := oldlib.compactGenome(name)
+		throttle.Acquire()
+		go func() {
+			defer throttle.Release()
+			if len(errs) > 0 {
+				return
+			}
+			log.Printf("retile: %s", name)
+			variants := make([][]tileVariantID, 2)
+			for phase := 0; phase < 2; phase++ {
+				tseq := tileSeq{}
+				for _, seqname := range seqnames {
+					path := refseq[seqname]
+					segs, _ := oldlib.haplotypeSequence(path, func(i int) tileVariantID {
+						if idx := int(path[i].Tag)*2 + phase; idx < len(cg.Variants) {
+							return cg.Variants[idx]
+						}
+						return 0
+					})
+					// New tiles that are not
+					// entirely inside a segment
+					// are left out, i.e., they
+					// are missing (variant 0)
+					// like the old tiles they
+					// overlap.
+					for segidx, seg := range segs {
+						t, _, err := newlib.tileFasta(fmt.Sprintf("%s phase %d", name, phase+1), fastaReader(seqname, seg.seq), matchAnySequence, false, !seg.atStart, !seg.atEnd)
+						if err != nil {
+							select {
+							case errs <- err:
+							default:
+							}
+							return
+						}
+						tseq[fmt.Sprintf("%s %d", seqname, segidx)] = t[seqname]
+					}
+				}
+				variants[phase], _, _ = tseq.Variants()
+			}
+			err := enc.Encode(LibraryEntry{
+				CompactGenomes: []CompactGenome{{
+					Name:     name,
+					Variants: flatten(variants),
+					Ploidy:   cg.Ploidy,
+					Unphased: cg.Unphased,
+				}},
+			})
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+	}
+	throttle.Wait()
+	if len(errs) > 0 {
+		return <-errs
+	}
+	log.Printf("retile: %d genomes, %d tile variants", len(names), newlib.Len())
+
+	cmd.provenance.addParents(oldlib.provenance)
+	prov, err := cmd.provenance.finish()
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(LibraryEntry{Provenance: []Provenance{prov}})
+	if err != nil {
+		return err
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = outw.Close()
+	if err != nil {
+		return err
+	}
+	if outf != nil && outf != outw {
+		err = outf.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.tagMapFile != "" {
+		err = writeTagMap(cmd.tagMapFile, tagmap)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var matchAnySequence = regexp.MustCompile(``)
+
+func fastaReader(seqname string, seq []byte) io.Reader {
+	return io.MultiReader(strings.NewReader(">"+seqname+"\n"), bytes.NewReader(seq), strings.NewReader("\n"))
+}
+
+// haplotypeSegment is a part of a haplotype reconstructed by
+// haplotypeSequence.
+type haplotypeSegment struct {
+	seq []byte
+	// atStart (atEnd) is true if seq extends to the beginning
+	// (end) of the sequence, rather than starting (ending) at
+	// the tag of a tile that is missing from the haplotype.
+	atStart bool
+	atEnd   bool
+}
+
+// haplotypeSequence reconstructs a haplotype by following the given
+// reference tile path and concatenating the sequences of the
+// haplotype's tiles, variant(i) being the haplotype's tile variant
+// at path[i].Tag.
+//
+// The haplotype's first tile, like the first tile of any tiled
+// sequence, extends back to the beginning of the sequence even if
+// it is not path[0].
+//
+// If the haplotype's tile at path[i] spans one or more reference
+// tags (i.e., ends with a tag beyond path[i+1]), the tags it spans
+// are skipped. A tile that is missing (variant 0) or whose sequence
+// was not retained splits the haplotype into separate segments.
+//
+// starts[i] is the position of path[i]'s tag in its segment (0 for
+// the first tile), or -1 if it was spanned or missing.
+func (tilelib *tileLibrary) haplotypeSequence(path []tileLibRef, variant func(i int) tileVariantID) (segs []haplotypeSegment, starts []int) {
+	tags := tilelib.taglib.tagseqs
+	starts = make([]int, len(path))
+	for i := range starts {
+		starts[i] = -1
+	}
+	// seg is the segment being extended, or nil if the
+	// previous tile was missing.
+	var seg *haplotypeSegment
+	for i := 0; i < len(path); {
+		tag := path[i].Tag
+		var tileseq []byte
+		if v := variant(i); v > 0 {
+			tileseq = tilelib.TileVariantSequence(tileLibRef{Tag: tag, Variant: v})
+		}
+		if tileseq == nil {
+			seg = nil
+			i++
+			continue
+		}
+		atStart := i == 0
+		if tag := tags[tag]; i > 0 && (len(tileseq) < len(tag) || !sameTag(tileseq[:len(tag)], tag)) {
+			// This is the haplotype's first tile, which
+			// starts at the beginning of the sequence
+			// instead of at its tag, so it replaces
+			// everything so far.
+			segs, seg = segs[:0], nil
+			atStart = true
+		}
+		if seg == nil {
+			segs = append(segs, haplotypeSegment{atStart: atStart})
+			seg = &segs[len(segs)-1]
+			starts[i] = 0
+		} else {
+			// Our start tag is already at the end of
+			// seg.seq, as the end tag of the previous
+			// tile.
+			overlap := len(tags[tag])
+			starts[i] = len(seg.seq) - overlap
+			seg.seq = seg.seq[:len(seg.seq)-overlap]
+		}
+		seg.seq = append(seg.seq, tileseq...)
+		next := -1
+		for j := i + 1; j < len(path); j++ {
+			endtag := tags[path[j].Tag]
+			if len(tileseq) >= len(endtag) && sameTag(tileseq[len(tileseq)-len(endtag):], endtag) {
+				next = j
+				break
+			}
+		}
+		if next < 0 {
+			// No end tag, so this tile extends to the
+			// end of the sequence.
+			seg.atEnd = true
+			next = i + 1
+		}
+		i = next
+	}
+	return segs, starts
+}
+
+// tagMapRow indicates that reference positions [Start,End) on
+// Sequence belong to tile OldTag in the old tag set and tile NewTag
+// in the new tag set. Here a tile is taken to end where the next
+// tile's tag starts, so each reference position belongs to exactly
+// one old and one new tile.
+type tagMapRow struct {
+	Sequence string
+	OldTag   tagID
+	NewTag   tagID
+	Start    int
+	End      int
+}
+
+func tagMapping(seqname string, seq []byte, oldpath []tileLibRef, oldstarts []int, newpath []tileLibRef, newtaglib *tagLibrary) []tagMapRow {
+	newpos := make(map[tagID]int, len(newpath))
+	newtaglib.FindAll(seq, func(id tagID, pos, taglen int) {
+		newpos[id] = pos
+	})
+	newstarts := make([]int, len(newpath))
+	for i, libref := range newpath {
+		if i > 0 {
+			newstarts[i] = newpos[libref.Tag]
+		}
+	}
+	var rows []tagMapRow
+	for i, j := 0, 0; i < len(oldpath) && j < len(newpath); {
+		oldend, newend := len(seq), len(seq)
+		if i+1 < len(oldpath) {
+			oldend = oldstarts[i+1]
+		}
+		if j+1 < len(newpath) {
+			newend = newstarts[j+1]
+		}
+		start, end := oldstarts[i], oldend
+		if start < newstarts[j] {
+			start = newstarts[j]
+		}
+		if end > newend {
+			end = newend
+		}
+		if start < end {
+			rows = append(rows, tagMapRow{
+				Sequence: seqname,
+				OldTag:   oldpath[i].Tag,
+				NewTag:   newpath[j].Tag,
+				Start:    start,
+				End:      end,
+			})
+		}
+		if oldend <= newend {
+			i++
+		} else {
+			j++
+		}
+	}
+	return rows
+}
+
+func writeTagMap(fnm string, rows []tagMapRow) error {
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprintln(bufw, "chrom,start,end,oldtag,newtag")
+	for _, row := range rows {
+		fmt.Fprintf(bufw, "%s,%d,%d,%d,%d\n", row.Sequence, row.Start, row.End, row.OldTag, row.NewTag)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,178 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type retileSuite struct{}
+
+var _ = check.Suite(&retileSuite{})
+
+func (s *retileSuite) TestRetile(c *check.C) {
+	tmpdir := c.MkDir()
+	for i, args := range [][]string{
+		{"-save-incomplete-tiles", "-o", tmpdir + "/ref.gob", "testdata/ref.fasta"},
+		{"-o", tmpdir + "/genomes.gob", "testdata/pipeline1"},
+	} {
+		exited := (&importer{}).RunCommand("import", append([]string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+		}, args...), nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0, check.Commentf("import %d", i))
+	}
+	libdir := tmpdir + "/old"
+	err := os.Mkdir(libdir, 0777)
+	c.Assert(err, check.IsNil)
+	exited := (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", libdir + "/library.gob",
+		tmpdir + "/ref.gob",
+		tmpdir + "/genomes.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// New tag set: a 24-mer from the middle of each segment
+	// between the old tags.
+	ref, err := ioutil.ReadFile("testdata/ref.fasta")
+	c.Assert(err, check.IsNil)
+	var newtags bytes.Buffer
+	newtags.WriteString(">new\n")
+	ntags := 0
+	for _, chunk := range strings.Split(string(ref), ">")[1:] {
+		lines := strings.Split(chunk, "\n")[1:]
+		for i := 0; i < len(lines); i += 2 {
+			if len(lines[i]) > 64 {
+				newtags.WriteString(lines[i][40:64] + "\n")
+				ntags++
+			}
+		}
+	}
+	err = ioutil.WriteFile(tmpdir+"/newtags", newtags.Bytes(), 0666)
+	c.Assert(err, check.IsNil)
+
+	newdir := tmpdir + "/new"
+	err = os.Mkdir(newdir, 0777)
+	c.Assert(err, check.IsNil)
+	exited = (&retiler{}).RunCommand("retile", []string{
+		"-local=true",
+		"-tag-library", tmpdir + "/newtags",
+		"-ref", "testdata/ref.fasta",
+		"-input-dir", libdir,
+		"-o", newdir + "/library.gob",
+		"-tag-map", tmpdir + "/tagmap.csv",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// Both libraries spell out the same haplotypes, except
+	// that a missing tile can cover more of the sequence after
+	// retiling.
+	var libs []*tileLibrary
+	for _, dir := range []string{libdir, newdir} {
+		tilelib := &tileLibrary{retainNoCalls: true, retainTileSequences: true, compactGenomes: map[string][]tileVariantID{}}
+		err = tilelib.LoadDir(context.Background(), dir)
+		c.Assert(err, check.IsNil)
+		libs = append(libs, tilelib)
+	}
+	c.Check(libs[1].taglib.Len(), check.Equals, ntags)
+	c.Check(libs[1].compactGenomes, check.HasLen, 2)
+	c.Check(libs[1].refseqs["testdata/ref.fasta"]["chr1"], check.HasLen, 5)
+	for _, name := range cgnames(libs[0]) {
+		for _, seqname := range []string{"chr1", "chr2"} {
+			for phase := 0; phase < 2; phase++ {
+				var segs [][]haplotypeSegment
+				for _, tilelib := range libs {
+					path := tilelib.refseqs["testdata/ref.fasta"][seqname]
+					cg := tilelib.compactGenomes[name]
+					hsegs, _ := tilelib.haplotypeSequence(path, func(i int) tileVariantID { return cg[int(path[i].Tag)*2+phase] })
+					segs = append(segs, hsegs)
+				}
+				comment := check.Commentf("%s %s phase %d\n%+v\n%+v", name, seqname, phase, segs[0], segs[1])
+				for _, newseg := range segs[1] {
+					// Missing tiles are not
+					// filled in.
+					c.Check(bytes.Count(newseg.seq, []byte{'n'}) < 10, check.Equals, true, comment)
+					found := false
+					for _, oldseg := range segs[0] {
+						found = found || bytes.Contains(oldseg.seq, newseg.seq)
+					}
+					c.Check(found, check.Equals, true, comment)
+				}
+				if strings.HasPrefix(name, "testdata/pipeline1/input1") {
+					c.Check(segs[1], check.DeepEquals, segs[0], comment)
+				}
+			}
+		}
+	}
+
+	// input2's first chr1 tile (up to position 224) is missing
+	// in the old library, so the new tiles that overlap it are
+	// missing too, rather than filled in with no-calls.
+	newpath := libs[1].refseqs["testdata/ref.fasta"]["chr1"]
+	newcg := libs[1].compactGenomes["testdata/pipeline1/input2.1.fasta"]
+	for i, expect := range []bool{true, true, false} {
+		tag := newpath[i].Tag
+		c.Check(newcg[tag*2] == 0 && newcg[tag*2+1] == 0, check.Equals, expect, check.Commentf("new tag %d", tag))
+	}
+
+	// A missing tile in the middle of a haplotype splits it
+	// into two segments.
+	path := libs[0].refseqs["testdata/ref.fasta"]["chr1"]
+	cg := libs[0].compactGenomes["testdata/pipeline1/input1.1.fasta"]
+	segs, starts := libs[0].haplotypeSequence(path, func(i int) tileVariantID {
+		if i == 2 {
+			return 0
+		}
+		return cg[int(path[i].Tag)*2]
+	})
+	if c.Check(segs, check.HasLen, 2) {
+		c.Check(segs[0].atStart, check.Equals, true)
+		c.Check(segs[0].atEnd, check.Equals, false)
+		c.Check(segs[1].atStart, check.Equals, false)
+		c.Check(segs[1].atEnd, check.Equals, true)
+	}
+	c.Check(starts[2], check.Equals, -1)
+	c.Check(starts[3], check.Equals, 0)
+
+	exited = (&fsckCmd{}).RunCommand("fsck", []string{"-local=true", "-input-dir", newdir}, nil, ioutil.Discard, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+
+	// The retiled library can be merged with one imported
+	// using the new tags.
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", tmpdir + "/newtags",
+		"-output-tiles",
+		"-o", tmpdir + "/newimport.gob",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/merged.gob",
+		newdir + "/library.gob",
+		tmpdir + "/newimport.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+
+	buf, err := ioutil.ReadFile(tmpdir + "/tagmap.csv")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", buf)
+	lines := strings.Split(string(buf), "\n")
+	c.Check(lines[0], check.Equals, "chrom,start,end,oldtag,newtag")
+	// Old tile 0 on chr1 (up to old tag 1 at 224) overlaps new
+	// tiles 0 (up to new tag 1 at 164) and 1.
+	c.Check(lines[1], check.Equals, "chr1,0,164,0,0")
+	c.Check(lines[2], check.Equals, "chr1,164,224,0,1")
+	c.Check(lines[3], check.Equals, "chr1,224,288,1,1")
+}
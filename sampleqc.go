@@ -0,0 +1,383 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// sampleQC computes per-genome quality metrics and flags outliers.
+type sampleQC struct {
+	refName      string
+	chrX         string
+	chrY         string
+	minYCoverage float64
+	maxSD        float64
+}
+
+// sampleQCMetrics are the metrics computed for each genome.
+type sampleQCMetrics struct {
+	Name               string
+	Heterozygosity     float64 // fraction of fully called tags where haplotypes differ
+	NoCallFraction     float64 // fraction of haplotype calls that are missing or contain no-calls
+	PrivateVariants    int     // tile variants not called in any other genome
+	ChrXCoverage       float64
+	ChrXHeterozygosity float64
+	ChrYCoverage       float64
+	Sex                string
+	Outliers           []string
+}
+
+func (cmd *sampleQC) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputDir := flags.String("input-dir", "./in", "input `directory` (a single library, e.g., output of slice or merge)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	flags.StringVar(&cmd.refName, "ref", "", "reference genome `name` (default: the only reference genome in the library)")
+	flags.StringVar(&cmd.chrX, "chrx", "chrX", "X chromosome `name` in reference genome")
+	flags.StringVar(&cmd.chrY, "chry", "chrY", "Y chromosome `name` in reference genome")
+	flags.Float64Var(&cmd.minYCoverage, "min-y-coverage", 0.1, "infer male sex if at least `P` of Y chromosome haplotype calls are present")
+	flags.Float64Var(&cmd.maxSD, "max-sd", 3, "flag genomes whose metrics are more than `N` standard deviations from the mean (above the mean, for no-call fraction and private variants)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning sample-qc",
+			Client:      arvadosClientFromEnv,
+			ProjectUUID: *projectUUID,
+			RAM:         240000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		err = runner.TranslatePaths(inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"sample-qc", "-local=true",
+			"-pprof=:6060",
+			"-input-dir=" + *inputDir,
+			"-output-dir=/mnt/output",
+			"-ref=" + cmd.refName,
+			"-chrx=" + cmd.chrX,
+			"-chry=" + cmd.chrY,
+			fmt.Sprintf("-min-y-coverage=%f", cmd.minYCoverage),
+			fmt.Sprintf("-max-sd=%f", cmd.maxSD),
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	prov := startProvenance(prog, args, *inputDir)
+	lib, err := readLibraryContents(*inputDir)
+	if err != nil {
+		return 1
+	}
+	metrics, err := cmd.compute(lib)
+	if err != nil {
+		return 1
+	}
+	cmd.flagOutliers(metrics)
+
+	err = writeSampleQC(*outputDir+"/sample-qc.tsv", metrics)
+	if err != nil {
+		return 1
+	}
+	// Regexp for "-match-genome" that matches the genomes that
+	// passed.
+	var passed []string
+	for _, m := range metrics {
+		if len(m.Outliers) == 0 {
+			passed = append(passed, regexp.QuoteMeta(m.Name))
+		}
+	}
+	log.Infof("%d of %d genomes passed", len(passed), len(metrics))
+	err = os.WriteFile(*outputDir+"/match-genome.txt", []byte("^("+strings.Join(passed, "|")+")$\n"), 0666)
+	if err != nil {
+		return 1
+	}
+	err = prov.writeJSON(*outputDir)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// compute returns metrics for each genome in lib, sorted by name.
+func (cmd *sampleQC) compute(lib *libraryContents) ([]*sampleQCMetrics, error) {
+	refName := cmd.refName
+	if refName == "" {
+		if len(lib.refs) != 1 {
+			return nil, fmt.Errorf("library has %d reference genomes, need -ref to choose one", len(lib.refs))
+		}
+		for name := range lib.refs {
+			refName = name
+		}
+	}
+	ref, ok := lib.refs[refName]
+	if !ok {
+		return nil, fmt.Errorf("reference genome %q not found in library", refName)
+	}
+	chrTags := func(chr string) []tagID {
+		path, ok := ref[chr]
+		if !ok {
+			path, ok = ref[strings.TrimPrefix(chr, "chr")]
+		}
+		if !ok {
+			path = ref["chr"+chr]
+		}
+		var tags []tagID
+		for _, libref := range path {
+			tags = append(tags, libref.Tag)
+		}
+		return tags
+	}
+	xtags, ytags := chrTags(cmd.chrX), chrTags(cmd.chrY)
+	if len(ytags) == 0 {
+		log.Warnf("no tiles found on %s in reference genome %q, cannot infer sex", cmd.chrY, refName)
+	}
+
+	type tile struct {
+		tag  int
+		hash [blake2b.Size256]byte
+	}
+	// carrier[t] is the index of the only genome that has tile
+	// t, or -1 if more than one genome has it. No-call tiles are
+	// not counted.
+	carrier := map[tile]int{}
+	labels := make([]string, 0, len(lib.genomes))
+	for label := range lib.genomes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for i, label := range labels {
+		for idx, v := range lib.genomes[label] {
+			if v == 0 {
+				continue
+			}
+			th, ok := lib.variants[tileLibRef{Tag: tagID(idx / 2), Variant: v}]
+			if !ok || th.nocall {
+				continue
+			}
+			t := tile{idx / 2, th.hash}
+			if c, ok := carrier[t]; !ok {
+				carrier[t] = i
+			} else if c != i {
+				carrier[t] = -1
+			}
+		}
+	}
+	private := make([]int, len(labels))
+	for _, c := range carrier {
+		if c >= 0 {
+			private[c]++
+		}
+	}
+
+	alltags := make([]tagID, len(lib.tagset))
+	for tag := range alltags {
+		alltags[tag] = tagID(tag)
+	}
+	var metrics []*sampleQCMetrics
+	for i, label := range labels {
+		variants := lib.genomes[label]
+		called := func(tag tagID, phase int) (tileHash, bool) {
+			idx := int(tag)*2 + phase
+			if idx >= len(variants) || variants[idx] == 0 {
+				return tileHash{}, false
+			}
+			th, ok := lib.variants[tileLibRef{Tag: tag, Variant: variants[idx]}]
+			return th, ok && !th.nocall
+		}
+		// coverage returns the fraction of haplotype calls
+		// present at the given tags, and the heterozygosity
+		// at the tags where both haplotypes are called.
+		coverage := func(tags []tagID) (cov, het float64) {
+			calls, full, diff := 0, 0, 0
+			for _, tag := range tags {
+				a, oka := called(tag, 0)
+				b, okb := called(tag, 1)
+				if oka {
+					calls++
+				}
+				if okb {
+					calls++
+				}
+				if oka && okb {
+					full++
+					if a.hash != b.hash {
+						diff++
+					}
+				}
+			}
+			if len(tags) > 0 {
+				cov = float64(calls) / float64(len(tags)*2)
+			}
+			if full > 0 {
+				het = float64(diff) / float64(full)
+			}
+			return
+		}
+		m := &sampleQCMetrics{Name: lib.names[label], PrivateVariants: private[i]}
+		var cov float64
+		cov, m.Heterozygosity = coverage(alltags)
+		m.NoCallFraction = 1 - cov
+		m.ChrXCoverage, m.ChrXHeterozygosity = coverage(xtags)
+		m.ChrYCoverage, _ = coverage(ytags)
+		if len(ytags) > 0 {
+			if m.ChrYCoverage >= cmd.minYCoverage {
+				m.Sex = "male"
+			} else {
+				m.Sex = "female"
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// flagOutliers adds metric names to m.Outliers for each genome m
+// whose metric is more than cmd.maxSD standard deviations from the
+// mean. An unusually low no-call fraction or private variant count
+// is not a quality problem, so only high values of those metrics are
+// flagged.
+func (cmd *sampleQC) flagOutliers(metrics []*sampleQCMetrics) {
+	for _, metric := range []struct {
+		name      string
+		value     func(*sampleQCMetrics) float64
+		upperOnly bool
+	}{
+		{"Heterozygosity", func(m *sampleQCMetrics) float64 { return m.Heterozygosity }, false},
+		{"NoCallFraction", func(m *sampleQCMetrics) float64 { return m.NoCallFraction }, true},
+		{"PrivateVariants", func(m *sampleQCMetrics) float64 { return float64(m.PrivateVariants) }, true},
+	} {
+		var sum, sumsq float64
+		for _, m := range metrics {
+			x := metric.value(m)
+			sum += x
+			sumsq += x * x
+		}
+		n := float64(len(metrics))
+		mean := sum / n
+		sd := math.Sqrt(math.Max(0, sumsq/n-mean*mean))
+		log.Infof("%s: mean %f, sd %f", metric.name, mean, sd)
+		for _, m := range metrics {
+			diff := metric.value(m) - mean
+			if !metric.upperOnly {
+				diff = math.Abs(diff)
+			}
+			if diff > cmd.maxSD*sd {
+				m.Outliers = append(m.Outliers, metric.name)
+			}
+		}
+	}
+}
+
+// writeSampleQC writes a tsv file with one row per genome. The
+// first column is the sample ID (see trimFilenameForLabel), so the
+// file can be used as a choose-samples case/control file or with
+// choose-samples -sample-qc-file.
+func writeSampleQC(fnm string, metrics []*sampleQCMetrics) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprint(w, "SampleID\tName\tHeterozygosity\tNoCallFraction\tPrivateVariants\tChrXCoverage\tChrXHeterozygosity\tChrYCoverage\tSex\tOutliers\tPass\n")
+	for _, m := range metrics {
+		pass := 1
+		if len(m.Outliers) > 0 {
+			pass = 0
+		}
+		fmt.Fprintf(w, "%s\t%s\t%f\t%f\t%d\t%f\t%f\t%f\t%s\t%s\t%d\n", trimFilenameForLabel(m.Name), m.Name, m.Heterozygosity, m.NoCallFraction, m.PrivateVariants, m.ChrXCoverage, m.ChrXHeterozygosity, m.ChrYCoverage, m.Sex, strings.Join(m.Outliers, ","), pass)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// loadSampleQCFailures returns the sample IDs that did not pass, as
+// listed in a tsv file written by sample-qc.
+func loadSampleQCFailures(fnm string) (map[string]bool, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	failed := map[string]bool{}
+	passCol := -1
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		split := strings.Split(line, "\t")
+		if passCol < 0 {
+			for col, name := range split {
+				if name == "Pass" {
+					passCol = col
+				}
+			}
+			if passCol < 0 {
+				return nil, fmt.Errorf("%s: no Pass column in header row", fnm)
+			}
+			continue
+		}
+		if len(split) > passCol && split[passCol] == "0" {
+			failed[split[0]] = true
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type sampleQCSuite struct{}
+
+var _ = check.Suite(&sampleQCSuite{})
+
+func (s *sampleQCSuite) TestSampleQC(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"qc", "choose"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	importAndSlice(c, tmpdir)
+
+	// The test data has no sex chromosomes, so use chr1 and
+	// chr2 instead.
+	exited := (&sampleQC{}).RunCommand("sample-qc", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/sliced",
+		"-output-dir", tmpdir + "/qc",
+		"-chrx", "chr1",
+		"-chry", "chr2",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	buf, err := ioutil.ReadFile(tmpdir + "/qc/sample-qc.tsv")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	c.Assert(lines, check.HasLen, 3)
+	c.Check(lines[0], check.Matches, `SampleID\tName\tHeterozygosity\t.*\tSex\tOutliers\tPass`)
+	c.Check(lines[1], check.Matches, `input1\ttestdata/pipeline1/input1.1.fasta\t.*\tmale\t\t1`)
+	c.Check(lines[2], check.Matches, `input2\ttestdata/pipeline1/input2.1.fasta\t.*\tmale\t\t1`)
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		c.Check(fields[2], check.Not(check.Equals), "0.000000") // heterozygosity
+		c.Check(fields[4], check.Not(check.Equals), "0")        // private variants
+	}
+
+	buf, err = ioutil.ReadFile(tmpdir + "/qc/match-genome.txt")
+	c.Assert(err, check.IsNil)
+	re, err := regexp.Compile(strings.TrimSpace(string(buf)))
+	c.Assert(err, check.IsNil)
+	c.Check(re.MatchString("testdata/pipeline1/input1.1.fasta"), check.Equals, true)
+	c.Check(re.MatchString("testdata/pipeline1/input1.1.fastax"), check.Equals, false)
+
+	// choose-samples excludes samples that failed QC.
+	err = ioutil.WriteFile(tmpdir+"/qc-edited.tsv", []byte(strings.Join([]string{
+		lines[0],
+		lines[1],
+		strings.TrimSuffix(lines[2], "\t\t1") + "\tNoCallFraction\t0",
+	}, "\n")+"\n"), 0666)
+	c.Assert(err, check.IsNil)
+	err = (&chooseSamples{}).run("choose-samples", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/sliced",
+		"-output-dir", tmpdir + "/choose",
+		"-training-set-size=1",
+		"-sample-qc-file", tmpdir + "/qc-edited.tsv",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(err, check.IsNil)
+	buf, err = ioutil.ReadFile(tmpdir + "/choose/samples.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "Index,SampleID,CaseControl,TrainingValidation\n0,input1,0,1\n")
+}
+
+func (s *sampleQCSuite) TestFlagOutliers(c *check.C) {
+	var metrics []*sampleQCMetrics
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, &sampleQCMetrics{
+			Heterozygosity:  0.3 + float64(i%3)*0.01,
+			NoCallFraction:  0.1,
+			PrivateVariants: 100 + i%5,
+		})
+	}
+	metrics[7].NoCallFraction = 0.5
+	metrics[11].Heterozygosity = 0.9
+	(&sampleQC{maxSD: 3}).flagOutliers(metrics)
+	for i, m := range metrics {
+		switch i {
+		case 7:
+			c.Check(m.Outliers, check.DeepEquals, []string{"NoCallFraction"})
+		case 11:
+			c.Check(m.Outliers, check.DeepEquals, []string{"Heterozygosity"})
+		default:
+			c.Check(m.Outliers, check.HasLen, 0)
+		}
+	}
+
+	// Low heterozygosity is flagged, but a low no-call fraction
+	// or private variant count is not.
+	metrics = nil
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, &sampleQCMetrics{
+			Heterozygosity:  0.3 + float64(i%3)*0.01,
+			NoCallFraction:  0.1 + float64(i%3)*0.001,
+			PrivateVariants: 100 + i%5,
+		})
+	}
+	metrics[3].NoCallFraction = 0
+	metrics[5].PrivateVariants = 0
+	metrics[9].Heterozygosity = 0
+	(&sampleQC{maxSD: 3}).flagOutliers(metrics)
+	for i, m := range metrics {
+		switch i {
+		case 9:
+			c.Check(m.Outliers, check.DeepEquals, []string{"Heterozygosity"})
+		default:
+			c.Check(m.Outliers, check.HasLen, 0, check.Commentf("%d: %+v", i, m))
+		}
+	}
+}
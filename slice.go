@@ -93,7 +93,7 @@ func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 0
 	}
 
-	err = Slice(*tagsPerFile, *outputDir, inputDirs)
+	err = Slice(*tagsPerFile, *outputDir, inputDirs, startProvenance(prog, args, inputDirs...))
 	if err != nil {
 		return 1
 	}
@@ -101,8 +101,9 @@ func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 }
 
 // Read tags+tiles+genomes from srcdir, write to dstdir with (up to)
-// the specified number of tags per file.
-func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
+// the specified number of tags per file. Each output file gets a
+// copy of the provenance record.
+func Slice(tagsPerFile int, dstdir string, srcdirs []string, prov *provenanceRecorder) error {
 	var infiles []string
 	for _, srcdir := range srcdirs {
 		files, err := allFiles(srcdir, matchGobFile)
@@ -121,6 +122,14 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 		}
 	}
 	namespaces := tileVariantID(len(dirNamespace))
+	// namespaced returns the output variant ID for variant v from
+	// the given namespace, or an error if it would overflow.
+	namespaced := func(v, namespace tileVariantID) (tileVariantID, error) {
+		if v > (maxTileVariantID-namespace)/namespaces {
+			return 0, fmt.Errorf("variant %d in namespace %d of %d: %w (limit %d)", v, namespace, namespaces, errTooManyVariants, maxTileVariantID)
+		}
+		return v*namespaces + namespace, nil
+	}
 
 	var (
 		tagset     [][]byte
@@ -172,9 +181,13 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				if err := throttle.Err(); err != nil {
 					return err
 				}
+				prov.addParents(ent.Provenance)
 				atomic.AddInt64(&countTileVariants, int64(len(ent.TileVariants)))
 				for _, tv := range ent.TileVariants {
-					tv.Variant = tv.Variant*namespaces + namespace
+					tv.Variant, err = namespaced(tv.Variant, namespace)
+					if err != nil {
+						return fmt.Errorf("tag %d: %w", tv.Tag, err)
+					}
 					fileno := 0
 					if !tv.Ref {
 						fileno = int(tv.Tag) / tagsPerFile
@@ -191,31 +204,63 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				// genome, even if there are no
 				// variants in the relevant range.
 				// Easier for downstream code.
+				//
+				// If the input is already sliced,
+				// each output file gets the entry
+				// from the input slice that covers
+				// it, so the output slices must not
+				// cross input slice boundaries.
 				atomic.AddInt64(&countGenomes, int64(len(ent.CompactGenomes)))
 				for _, cg := range ent.CompactGenomes {
+					if cg.EndTag > 0 && (int(cg.StartTag)%tagsPerFile != 0 || int(cg.EndTag)%tagsPerFile != 0) {
+						return fmt.Errorf("%s: genome %s is sliced at tags %d-%d, cannot re-slice with -tags-per-file=%d", infile, cg.Name, cg.StartTag, cg.EndTag-1, tagsPerFile)
+					}
 					for i, v := range cg.Variants {
 						if v > 0 {
-							cg.Variants[i] = v*namespaces + namespace
+							cg.Variants[i], err = namespaced(v, namespace)
+							if err != nil {
+								return fmt.Errorf("%s: tag %d: %w", cg.Name, int(cg.StartTag)+i/2, err)
+							}
+						}
+					}
+					for i, v := range cg.Imputed {
+						if v > 0 {
+							cg.Imputed[i], err = namespaced(v, namespace)
+							if err != nil {
+								return fmt.Errorf("%s: tag %d: imputed: %w", cg.Name, int(cg.StartTag)+i/2, err)
+							}
 						}
 					}
 					for i, enc := range encs {
 						start := i * tagsPerFile
 						end := start + tagsPerFile
+						if cg.EndTag > 0 && (start < int(cg.StartTag) || start >= int(cg.EndTag)) {
+							continue
+						}
 						if max := len(cg.Variants)/2 + int(cg.StartTag); end > max {
 							end = max
 						}
 						if start < int(cg.StartTag) {
 							start = int(cg.StartTag)
 						}
-						var variants []tileVariantID
+						var variants, imputed []tileVariantID
+						var confidence []float32
 						if start < end {
 							variants = cg.Variants[(start-int(cg.StartTag))*2 : (end-int(cg.StartTag))*2]
+							if cg.Imputed != nil {
+								imputed = cg.Imputed[(start-int(cg.StartTag))*2 : (end-int(cg.StartTag))*2]
+								confidence = cg.ImputedConfidence[(start-int(cg.StartTag))*2 : (end-int(cg.StartTag))*2]
+							}
 						}
 						err := enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{{
-							Name:     cg.Name,
-							Variants: variants,
-							StartTag: tagID(start),
-							EndTag:   tagID(start + tagsPerFile),
+							Name:              cg.Name,
+							Variants:          variants,
+							StartTag:          tagID(start),
+							EndTag:            tagID(start + tagsPerFile),
+							Ploidy:            cg.Ploidy,
+							Unphased:          cg.Unphased,
+							Imputed:           imputed,
+							ImputedConfidence: confidence,
 						}}})
 						if err != nil {
 							return err
@@ -227,9 +272,12 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				atomic.AddInt64(&countReferences, int64(len(ent.CompactSequences)))
 				if len(ent.CompactSequences) > 0 {
 					for _, cs := range ent.CompactSequences {
-						for _, tseq := range cs.TileSequences {
+						for seqname, tseq := range cs.TileSequences {
 							for i, libref := range tseq {
-								tseq[i].Variant = libref.Variant*namespaces + namespace
+								tseq[i].Variant, err = namespaced(libref.Variant, namespace)
+								if err != nil {
+									return fmt.Errorf("%s %s: tag %d: %w", cs.Name, seqname, libref.Tag, err)
+								}
 							}
 						}
 					}
@@ -247,6 +295,18 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 		closeOutFiles(fs, bufws, gzws, encs)
 		return throttle.Err()
 	}
+	p, err := prov.finish()
+	if err != nil {
+		closeOutFiles(fs, bufws, gzws, encs)
+		return err
+	}
+	for _, enc := range encs {
+		err = enc.Encode(LibraryEntry{Provenance: []Provenance{p}})
+		if err != nil {
+			closeOutFiles(fs, bufws, gzws, encs)
+			return err
+		}
+	}
 	defer log.Printf("Total %d tile variants, %d genomes, %d reference sequences", countTileVariants, countGenomes, countReferences)
 	return closeOutFiles(fs, bufws, gzws, encs)
 }
@@ -5,9 +5,13 @@
 package lightning
 
 import (
+	"encoding/gob"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
@@ -697,6 +701,130 @@ spanningtile/input1	1
 	}
 }
 
+func (s *sliceSuite) TestPartiallyCalledTiles(c *check.C) {
+	tmpdir := c.MkDir()
+	writePartiallyCalledInput(c, tmpdir+"/input")
+	for _, infile := range []string{"testdata/ref.fasta", tmpdir + "/input"} {
+		exited := (&importer{}).RunCommand("import", []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-save-incomplete-tiles",
+			"-o", tmpdir + "/" + filepath.Base(infile) + ".gob",
+			infile,
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	slicedir := c.MkDir()
+	exited := (&slicecmd{}).RunCommand("slice", []string{
+		"-local=true",
+		"-output-dir=" + slicedir,
+		"-tags-per-file=4",
+		tmpdir + "/ref.fasta.gob",
+		tmpdir + "/input.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	npydir := c.MkDir()
+	exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+		"-local=true",
+		"-input-dir=" + slicedir,
+		"-output-dir=" + npydir,
+		"-chunked-hgvs-matrix=true",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// No-call bases are not annotated as variants.
+	annotations, err := ioutil.ReadFile(npydir + "/matrix.0000.annotations.csv")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", annotations)
+	c.Check(string(annotations), check.Matches, `(?ms).*,chr1:g\.130T>C,.*`)
+	c.Check(string(annotations), check.Matches, `(?ms).*,chr1:g\.135A>C,.*`)
+	c.Check(string(annotations), check.Not(check.Matches), `(?ms).*>N.*`)
+
+	annotations, err = ioutil.ReadFile(npydir + "/hgvs.chr1.annotations.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(annotations), check.Equals, "0,chr1:g.130T>C\n1,chr1:g.135A>C\n")
+	f, err := os.Open(npydir + "/hgvs.chr1.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err := gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{1, 4})
+	hgvsmatrix, err := npy.GetInt8()
+	c.Assert(err, check.IsNil)
+	// Phase 1 is a no-call at chr1:130, so the genome's hom/het
+	// columns for chr1:130 are -1. It is heterozygous for
+	// chr1:135.
+	c.Check(hgvsmatrix, check.DeepEquals, []int8{-1, -1, 0, 1})
+}
+
+func (s *sliceSuite) TestChunkedHGVSMatrix(c *check.C) {
+	tmpdir := c.MkDir()
+	importAndSlice(c, tmpdir)
+	npydir := c.MkDir()
+	exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/sliced",
+		"-output-dir=" + npydir,
+		"-chunked-hgvs-matrix=true",
+		"-single-hgvs-matrix=true",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	readMatrix := func(fnm string) (labels []string, cols int, values []int16) {
+		buf, err := ioutil.ReadFile(fnm + ".annotations.csv")
+		c.Assert(err, check.IsNil)
+		for _, line := range strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n") {
+			labels = append(labels, strings.SplitN(line, ",", 2)[1])
+		}
+		f, err := os.Open(fnm + ".npy")
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		npy, err := gonpy.NewReader(f)
+		c.Assert(err, check.IsNil)
+		c.Assert(npy.Shape, check.HasLen, 2)
+		if npy.Dtype == "i1" {
+			int8s, err := npy.GetInt8()
+			c.Assert(err, check.IsNil)
+			for _, v := range int8s {
+				values = append(values, int16(v))
+			}
+		} else {
+			values, err = npy.GetInt16()
+			c.Assert(err, check.IsNil)
+		}
+		return labels, npy.Shape[1], values
+	}
+	// Each variant in the per-chromosome matrix has a pair of
+	// hom/het columns, which should agree with the pair of
+	// columns (one per phase) in the single matrix.
+	singleLabels, singleCols, single := readMatrix(npydir + "/hgvs")
+	chunkLabels, chunkCols, chunk := readMatrix(npydir + "/hgvs.chr2")
+	c.Assert(len(chunkLabels) > 1, check.Equals, true)
+	c.Check(chunkCols, check.Equals, len(chunkLabels)*2)
+	rows := len(chunk) / chunkCols
+	c.Check(rows, check.Equals, 2)
+	for ci, label := range chunkLabels {
+		si := -1
+		for i, l := range singleLabels {
+			if l == label {
+				si = i
+			}
+		}
+		c.Assert(si >= 0, check.Equals, true, check.Commentf("%s not in single matrix %q", label, singleLabels))
+		for row := 0; row < rows; row++ {
+			expect := []int16{0, 0}
+			if a, b := single[row*singleCols+si*2], single[row*singleCols+si*2+1]; a == 1 && b == 1 {
+				expect = []int16{1, 0}
+			} else if a == 1 || b == 1 {
+				expect = []int16{0, 1}
+			}
+			c.Check(chunk[row*chunkCols+ci*2:row*chunkCols+ci*2+2], check.DeepEquals, expect, check.Commentf("%s row %d", label, row))
+		}
+	}
+}
+
 func (s *sliceSuite) Test_tv2homhet(c *check.C) {
 	cmd := &sliceNumpy{
 		cgnames:         []string{"sample1", "sample2", "sample3", "sample4"},
@@ -727,7 +855,7 @@ func (s *sliceSuite) Test_tv2homhet(c *check.C) {
 	for tag := tagID(10); tag < 12; tag++ {
 		seq[tag-chunkstarttag] = []TileVariant{TileVariant{}, fakevariant, TileVariant{}, TileVariant{}, TileVariant{}, fakevariant}
 		c.Logf("=== tag %d", tag)
-		chunk, xref := cmd.tv2homhet(cgs, maxv, remap, tag, chunkstarttag, seq)
+		chunk, xref := cmd.tv2homhet(cgs, maxv, remap, tag, chunkstarttag, seq, nil)
 		c.Logf("chunk len=%d", len(chunk))
 		for _, x := range chunk {
 			c.Logf("%+v", x)
@@ -748,3 +876,38 @@ func (s *sliceSuite) Test_tv2homhet(c *check.C) {
 		}
 	}
 }
+
+func (s *sliceSuite) Test_allele2homhet(c *check.C) {
+	colpair := [2][]int8{
+		{1, 1, 0, -1, 1, 0},
+		{1, 0, 0, 0, 1, 0},
+	}
+	// rows 4 and 5 are hemizygous
+	allele2homhet(colpair, []bool{false, false, false, false, true, true})
+	c.Check(colpair[0], check.DeepEquals, []int8{1, 0, 0, -1, 0, 0})
+	c.Check(colpair[1], check.DeepEquals, []int8{0, 1, 0, -1, 1, 0})
+}
+
+func (s *sliceSuite) TestVariantIDOverflow(c *check.C) {
+	defer func(orig tileVariantID) { maxTileVariantID = orig }(maxTileVariantID)
+	maxTileVariantID = 4
+
+	tmpdir := c.MkDir()
+	tagset := [][]byte{[]byte("ggagaactgtgctccgccttcaga")}
+	for _, dir := range []string{"lib1", "lib2", "out"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	for _, dir := range []string{"lib1", "lib2"} {
+		f, err := os.Create(tmpdir + "/" + dir + "/library.gob")
+		c.Assert(err, check.IsNil)
+		enc := gob.NewEncoder(f)
+		c.Assert(enc.Encode(LibraryEntry{TagSet: tagset}), check.IsNil)
+		c.Assert(enc.Encode(LibraryEntry{TileVariants: []TileVariant{{Tag: 0, Variant: 2, Sequence: []byte("acgt")}}}), check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+	}
+	// Variant 2 becomes 2*2+0=4 (ok) in the first namespace and
+	// 2*2+1=5 (too big) in the second.
+	err := Slice(1, tmpdir+"/out", []string{tmpdir + "/lib1", tmpdir + "/lib2"}, startProvenance("slice", nil))
+	c.Check(errors.Is(err, errTooManyVariants), check.Equals, true, check.Commentf("%v", err))
+}
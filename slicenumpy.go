@@ -50,6 +50,8 @@ type sliceNumpy struct {
 	includeVariant1 bool
 	debugTag        tagID
 
+	minImputedConfidence float64
+
 	cgnames         []string
 	samples         []sampleInfo
 	trainingSet     []int // samples index => training set index, or -1 if not in training set
@@ -81,6 +83,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
 	ref := flags.String("ref", "", "reference name (if blank, choose last one that appears in input)")
 	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed `file`")
+	var knownOptions knownVariantOptions
+	knownOptions.Flags(flags)
+	gtfFilename := flags.String("gtf", "", "add gene/transcript/consequence columns to annotations, using transcript model in specified GTF or GFF3 `file`")
 	expandRegions := flags.Int("expand-regions", 0, "expand specified regions by `N` base pairs on each side`")
 	mergeOutput := flags.Bool("merge-output", false, "merge output into one matrix.npy and one matrix.annotations.csv")
 	hgvsSingle := flags.Bool("single-hgvs-matrix", false, "also generate hgvs-based matrix")
@@ -97,6 +102,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	flags.Float64Var(&cmd.chi2PValue, "chi2-p-value", 1, "do Χ² test (or logistic regression if -samples file has PCA components) and omit columns with p-value above this threshold")
 	flags.Float64Var(&cmd.glmMinFrequency, "glm-min-frequency", 0.01, "skip GLM calculation on tile variants below this frequency in the training set")
 	flags.BoolVar(&cmd.includeVariant1, "include-variant-1", false, "include most common variant when building one-hot matrix")
+	flags.Float64Var(&cmd.minImputedConfidence, "min-imputed-confidence", 0, "replace no-calls with imputed tile variants (see impute) whose posterior probability is at least `P` (default: don't use imputed calls)")
 	cmd.filter.Flags(flags)
 	err := flags.Parse(args)
 	if err == flag.ErrHelp {
@@ -131,7 +137,11 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			APIAccess:   true,
 			Preemptible: *preemptible,
 		}
-		err = runner.TranslatePaths(inputDir, regionsFilename, samplesFilename)
+		err = runner.TranslatePaths(inputDir, regionsFilename, samplesFilename, gtfFilename, &cmd.filter.HWEControls)
+		if err != nil {
+			return err
+		}
+		err = knownOptions.TranslatePaths(&runner)
 		if err != nil {
 			return err
 		}
@@ -141,6 +151,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			"-output-dir=/mnt/output",
 			"-threads=" + fmt.Sprintf("%d", cmd.threads),
 			"-regions=" + *regionsFilename,
+			"-gtf=" + *gtfFilename,
 			"-expand-regions=" + fmt.Sprintf("%d", *expandRegions),
 			"-merge-output=" + fmt.Sprintf("%v", *mergeOutput),
 			"-single-hgvs-matrix=" + fmt.Sprintf("%v", *hgvsSingle),
@@ -156,8 +167,10 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			"-glm-min-frequency=" + fmt.Sprintf("%f", cmd.glmMinFrequency),
 			"-include-variant-1=" + fmt.Sprintf("%v", cmd.includeVariant1),
 			"-debug-tag=" + fmt.Sprintf("%d", cmd.debugTag),
+			"-min-imputed-confidence=" + fmt.Sprintf("%f", cmd.minImputedConfidence),
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
+		runner.Args = append(runner.Args, knownOptions.Args()...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -176,6 +189,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		return err
 	}
 	sort.Strings(infiles)
+	prov := startProvenance(prog, args, *inputDir, *regionsFilename, *gtfFilename, *samplesFilename)
 
 	var refseq map[string][]tileLibRef
 	var reftiledata = make(map[tileLibRef][]byte, 11000000)
@@ -200,6 +214,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	}
 
 	cmd.cgnames = nil
+	// ploidy[name] is the Ploidy of genome name, if any (see
+	// CompactGenome.Ploidy)
+	ploidy := map[string]map[string]int{}
 	var tagset [][]byte
 	err = DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
 		if len(ent.TagSet) > 0 {
@@ -213,6 +230,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		for _, cg := range ent.CompactGenomes {
 			if matchGenome.MatchString(cg.Name) {
 				cmd.cgnames = append(cmd.cgnames, cg.Name)
+				if len(cg.Ploidy) > 0 {
+					ploidy[cg.Name] = cg.Ploidy
+				}
 			}
 		}
 		for _, tv := range ent.TileVariants {
@@ -220,6 +240,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				reftiledata[tileLibRef{tv.Tag, tv.Variant}] = tv.Sequence
 			}
 		}
+		prov.addParents(ent.Provenance)
 		return nil
 	})
 	if err != nil {
@@ -246,8 +267,36 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	if len(cmd.cgnames) == 0 {
 		return fmt.Errorf("fatal: 0 matching samples in library, nothing to do")
 	}
+	// lowCallRate[name]==true for samples dropped by
+	// -min-call-rate
+	var lowCallRate map[string]bool
+	if cmd.filter.MinCallRate > 0 {
+		ntags := len(tagset)
+		if cmd.filter.MaxTag >= 0 && ntags > cmd.filter.MaxTag+1 {
+			ntags = cmd.filter.MaxTag + 1
+		}
+		names := map[string]bool{}
+		for _, name := range cmd.cgnames {
+			names[name] = true
+		}
+		log.Info("computing call rates")
+		lowCallRate, err = cmd.filter.lowCallRateGenomes(infiles, names, ntags)
+		if err != nil {
+			return err
+		}
+		log.Infof("dropping %d samples with call rate below %f", len(lowCallRate), cmd.filter.MinCallRate)
+	}
 	cmd.trainingSet = make([]int, len(cmd.cgnames))
 	if *samplesFilename == "" {
+		if len(lowCallRate) > 0 {
+			kept := cmd.cgnames[:0]
+			for _, name := range cmd.cgnames {
+				if !lowCallRate[name] {
+					kept = append(kept, name)
+				}
+			}
+			cmd.cgnames = kept
+		}
 		cmd.trainingSetSize = len(cmd.cgnames)
 		for i, name := range cmd.cgnames {
 			cmd.samples = append(cmd.samples, sampleInfo{
@@ -264,9 +313,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				return fmt.Errorf("mismatched sample list: sample %d is %q in library, %q in %s", i, s, cmd.samples[i].id, *samplesFilename)
 			}
 		}
-		if *caseControlOnly {
+		if *caseControlOnly || len(lowCallRate) > 0 {
 			for i := 0; i < len(cmd.samples); i++ {
-				if !cmd.samples[i].isTraining && !cmd.samples[i].isValidation {
+				if (*caseControlOnly && !cmd.samples[i].isTraining && !cmd.samples[i].isValidation) || lowCallRate[cmd.cgnames[i]] {
 					if i+1 < len(cmd.samples) {
 						copy(cmd.samples[i:], cmd.samples[i+1:])
 						copy(cmd.cgnames[i:], cmd.cgnames[i+1:])
@@ -294,6 +343,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			}
 		}
 	}
+	if len(cmd.cgnames) == 0 {
+		return fmt.Errorf("fatal: all samples dropped by -min-call-rate, nothing to do")
+	}
 	if cmd.filter.MinCoverage == 1 {
 		// In the generic formula below, floating point
 		// arithmetic can effectively push the coverage
@@ -326,10 +378,29 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		cgnamemap[name] = true
 	}
 
+	// hweControl[i]==true if cmd.cgnames[i] is a control for
+	// -hwe-p-value (nil if no tile variant or tag filters are
+	// enabled)
+	var hweControl []bool
+	if cmd.filter.tagFilters() {
+		isControl, err := cmd.filter.loadHWEControls()
+		if err != nil {
+			return err
+		}
+		hweControl = make([]bool, len(cmd.cgnames))
+		for i, name := range cmd.cgnames {
+			hweControl[i] = isControl(name)
+		}
+	}
+
 	err = writeSampleInfo(cmd.samples, *outputDir)
 	if err != nil {
 		return err
 	}
+	err = writePloidyInfo(cmd.samples, cmd.cgnames, ploidy, *outputDir)
+	if err != nil {
+		return err
+	}
 
 	log.Info("indexing reference tiles")
 	type reftileinfo struct {
@@ -393,6 +464,71 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		log.Printf("... %s done, len %d", seqname, pos+taglen)
 	}
 
+	// conseq[seqname] computes consequence annotations for
+	// variants on reference sequence seqname.
+	var conseq map[string]*consequenceAnnotator
+	var tm *transcriptModel
+	if *gtfFilename != "" {
+		tm, err = loadTranscriptModel(*gtfFilename)
+		if err != nil {
+			return err
+		}
+		conseq = make(map[string]*consequenceAnnotator, len(refseq))
+	}
+	known, err := knownOptions.Load()
+	if err != nil {
+		return err
+	}
+	// refseqstr[seqname] is the upper-case reference sequence,
+	// used to left-align variants before looking up known
+	// variants.
+	var refseqstr map[string]string
+	if known != nil {
+		refseqstr = make(map[string]string, len(refseq))
+	}
+	if tm != nil || known != nil {
+		for seqname, cseq := range refseq {
+			var seq []byte
+			for _, libref := range cseq {
+				if cmd.filter.MaxTag >= 0 && libref.Tag > tagID(cmd.filter.MaxTag) {
+					continue
+				}
+				tiledata := reftiledata[libref]
+				if len(seq) > 0 {
+					tiledata = tiledata[taglen:]
+				}
+				seq = append(seq, tiledata...)
+			}
+			if tm != nil {
+				conseq[seqname] = tm.annotator(seqname, seq)
+			}
+			if known != nil {
+				refseqstr[seqname] = strings.ToUpper(string(seq))
+			}
+		}
+	}
+	// extraColumns returns the consequence and known-variant
+	// columns (if any) for an annotation row. diff is nil for
+	// rows that don't describe a variant.
+	extraColumns := func(seqname string, diff *hgvs.Variant) string {
+		var cols string
+		if conseq != nil {
+			if diff == nil {
+				cols += "," + emptyConsequenceCSV
+			} else {
+				cols += "," + consequencesCSV(conseq[seqname].Annotate(*diff))
+			}
+		}
+		if known != nil {
+			if diff == nil {
+				cols += "," + emptyKnownVariantCSV
+			} else {
+				cols += "," + known.CSV(known.LookupNormalize(seqname, refseqstr[seqname], *diff))
+			}
+		}
+		return cols
+	}
+
 	var mask *mask
 	if *regionsFilename != "" {
 		log.Printf("loading regions from %s", *regionsFilename)
@@ -442,9 +578,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		}
 	}
 
-	var toMerge [][]int16
+	var toMerge []*variantMatrix
 	if *mergeOutput || *hgvsSingle {
-		toMerge = make([][]int16, len(infiles))
+		toMerge = make([]*variantMatrix, len(infiles))
 	}
 	var onehotIndirect [][2][]uint32 // [chunkIndex][axis][index]
 	var onehotChunkSize []uint32
@@ -492,7 +628,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					// spanning tile.
 					if mask != nil && reftile[tv.Tag].excluded &&
 						(int(tv.Tag+1) >= len(tagset) ||
-							(bytes.HasSuffix(tv.Sequence, tagset[tv.Tag+1]) && reftile[tv.Tag+1] != nil && !reftile[tv.Tag+1].excluded)) {
+							(len(tv.Sequence) >= len(tagset[tv.Tag+1]) && matchTag(tv.Sequence[len(tv.Sequence)-len(tagset[tv.Tag+1]):], tagset[tv.Tag+1], tv.approxEndTag(len(tagset[tv.Tag+1]))) && reftile[tv.Tag+1] != nil && !reftile[tv.Tag+1].excluded)) {
 						continue
 					}
 					if tv.Tag == cmd.debugTag {
@@ -521,6 +657,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					if sliceSize := 2 * int(cg.EndTag-cg.StartTag); len(cg.Variants) < sliceSize {
 						cg.Variants = append(cg.Variants, make([]tileVariantID, sliceSize-len(cg.Variants))...)
 					}
+					if cmd.minImputedConfidence > 0 {
+						cg.useImputed(cmd.minImputedConfidence)
+					}
 					cgs[cg.Name] = cg
 				}
 				return nil
@@ -534,7 +673,29 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			tagend := cgs[cmd.cgnames[0]].EndTag
 			chunkStartTag[infileIdx] = tagstart
 
-			// TODO: filters
+			if hweControl != nil {
+				calls := make([]tileVariantID, len(cmd.cgnames)*2)
+				haploid := make([]bool, len(cmd.cgnames))
+				for tag := tagstart; tag < tagend; tag++ {
+					idx := int(tag-tagstart) * 2
+					rt := reftile[tag]
+					for i, name := range cmd.cgnames {
+						cg := cgs[name]
+						copy(calls[i*2:i*2+2], cg.Variants[idx:idx+2])
+						haploid[i] = rt != nil && cg.ploidy(rt.seqname) == 1
+					}
+					variants := seq[tag]
+					cmd.filter.applyTag(calls, func(v tileVariantID) (int, int) {
+						if int(v) < len(variants) {
+							return variants[v].noCallCounts()
+						}
+						return 0, 0
+					}, hweControl, haploid)
+					for i, name := range cmd.cgnames {
+						copy(cgs[name].Variants[idx:idx+2], calls[i*2:])
+					}
+				}
+			}
 
 			log.Infof("%04d: renumber/dedup variants for tags %d-%d", infileIdx, tagstart, tagend)
 			variantRemap := make([][]tileVariantID, tagend-tagstart)
@@ -680,8 +841,19 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						maxv = v
 					}
 				}
+				var haploid []bool
+				if rt != nil {
+					for i, name := range cmd.cgnames {
+						if cg := cgs[name]; cg.ploidy(rt.seqname) == 1 {
+							if haploid == nil {
+								haploid = make([]bool, len(cmd.cgnames))
+							}
+							haploid[i] = true
+						}
+					}
+				}
 				if *onehotChunked || *onehotSingle || *onlyPCA {
-					onehot, xrefs := cmd.tv2homhet(cgs, maxv, remap, tag, tagstart, seq)
+					onehot, xrefs := cmd.tv2homhet(cgs, maxv, remap, tag, tagstart, seq, haploid)
 					if tag == cmd.debugTag {
 						log.WithFields(logrus.Fields{
 							"onehot": onehot,
@@ -705,12 +877,13 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					outcol++
 					continue
 				}
-				fmt.Fprintf(annow, "%d,%d,%d,=,%s,%d,,,\n", tag, outcol, rt.variant, rt.seqname, rt.pos)
+				fmt.Fprintf(annow, "%d,%d,%d,=,%s,%d,,,%s\n", tag, outcol, rt.variant, rt.seqname, rt.pos, extraColumns(rt.seqname, nil))
 				variants := seq[tag]
 				reftilestr := strings.ToUpper(string(rt.tiledata))
 
 				done := make([]bool, maxv+1)
 				variantDiffs := make([][]hgvs.Variant, maxv+1)
+				variantNoCalls := make([][][2]int, maxv+1)
 				for v, tv := range variants {
 					v := remap[v]
 					if v == 0 || v == rt.variant || done[v] {
@@ -722,14 +895,21 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						continue
 					}
 					// if reftilestr doesn't end
-					// in the same tag as tv,
+					// in the same tag as tv
+					// (allowing one mismatch if
+					// tv's end tag has one, see
+					// TileVariant.approxEndTag),
 					// extend reftilestr with
 					// following ref tiles until
 					// it does (up to an arbitrary
 					// sanity-check limit)
 					reftilestr := reftilestr
-					endtagstr := strings.ToUpper(string(tv.Sequence[len(tv.Sequence)-taglen:]))
-					for i, rt := 0, rt; i < annotationMaxTileSpan && !strings.HasSuffix(reftilestr, endtagstr) && rt.nexttag >= 0; i++ {
+					endtag := tv.Sequence[len(tv.Sequence)-taglen:]
+					approx := tv.approxEndTag(taglen)
+					endsWithTag := func(s string) bool {
+						return len(s) >= taglen && matchTag([]byte(s[len(s)-taglen:]), endtag, approx)
+					}
+					for i, rt := 0, rt; i < annotationMaxTileSpan && !endsWithTag(reftilestr) && rt.nexttag >= 0; i++ {
 						rt = reftile[rt.nexttag]
 						if rt == nil {
 							break
@@ -739,20 +919,35 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					if mask != nil && !mask.Check(strings.TrimPrefix(rt.seqname, "chr"), rt.pos, rt.pos+len(reftilestr)) {
 						continue
 					}
-					if !strings.HasSuffix(reftilestr, endtagstr) {
-						fmt.Fprintf(annow, "%d,%d,%d,,%s,%d,,,\n", tag, outcol, v, rt.seqname, rt.pos)
+					if !endsWithTag(reftilestr) {
+						fmt.Fprintf(annow, "%d,%d,%d,,%s,%d,,,%s\n", tag, outcol, v, rt.seqname, rt.pos, extraColumns(rt.seqname, nil))
 						continue
 					}
+					var diffs []hgvs.Variant
 					if lendiff := len(reftilestr) - len(tv.Sequence); lendiff < -1000 || lendiff > 1000 {
-						fmt.Fprintf(annow, "%d,%d,%d,,%s,%d,,,\n", tag, outcol, v, rt.seqname, rt.pos)
-						continue
+						// Large indel: use a
+						// deterministic, memory-bounded
+						// alignment instead of
+						// diffmatchpatch.
+						diffs, _ = hgvs.DiffBanded(reftilestr, strings.ToUpper(string(tv.Sequence)), hgvs.DefaultBandwidth)
+					} else {
+						diffs, _ = hgvs.Diff(reftilestr, strings.ToUpper(string(tv.Sequence)), 0)
 					}
-					diffs, _ := hgvs.Diff(reftilestr, strings.ToUpper(string(tv.Sequence)), 0)
-					for i := range diffs {
-						diffs[i].Position += rt.pos
+					// Omit no-call bases in
+					// partially called tiles, but
+					// remember where they are.
+					called := diffs[:0]
+					for _, diff := range diffs {
+						diff.Position += rt.pos
+						if isNoCallVariant(diff) {
+							variantNoCalls[v] = append(variantNoCalls[v], variantSpan(diff))
+						} else {
+							called = append(called, diff)
+						}
 					}
+					diffs = called
 					for _, diff := range diffs {
-						fmt.Fprintf(annow, "%d,%d,%d,%s:g.%s,%s,%d,%s,%s,%s\n", tag, outcol, v, rt.seqname, diff.String(), rt.seqname, diff.Position, diff.Ref, diff.New, diff.Left)
+						fmt.Fprintf(annow, "%d,%d,%d,%s:g.%s,%s,%d,%s,%s,%s%s\n", tag, outcol, v, rt.seqname, diff.String(), rt.seqname, diff.Position, diff.Ref, diff.New, diff.Left, extraColumns(rt.seqname, &diff))
 					}
 					if *hgvsChunked {
 						variantDiffs[v] = diffs
@@ -789,12 +984,22 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 							}
 							if v == rt.variant {
 								// hgvsCol[*][ph][row] is already 0
-							} else if len(variantDiffs[v]) == 0 {
+							} else if len(variantDiffs[v]) == 0 && len(variantNoCalls[v]) == 0 {
 								// lacking coverage / couldn't be diffed
 								for _, col := range hgvsCol {
 									col[ph][row] = -1
 								}
 							} else {
+								for diff, col := range hgvsCol {
+									span := variantSpan(diff)
+									for _, r := range variantNoCalls[v] {
+										if span[0] < r[1] && r[0] < span[1] {
+											// overlaps no-call bases
+											col[ph][row] = -1
+											break
+										}
+									}
+								}
 								for _, diff := range variantDiffs[v] {
 									hgvsCol[diff][ph][row] = 1
 								}
@@ -802,7 +1007,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						}
 					}
 					for diff, colpair := range hgvsCol {
-						allele2homhet(colpair)
+						allele2homhet(colpair, haploid)
 						if !cmd.filterHGVScolpair(colpair) {
 							delete(hgvsCol, diff)
 						}
@@ -854,7 +1059,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				throttleNumpyMem.Acquire()
 				rows := len(cmd.cgnames)
 				cols := 2 * outcol
-				out := make([]int16, rows*cols)
+				out := newVariantMatrix(rows, cols)
 				for row, name := range cmd.cgnames {
 					outidx := row * cols
 					for col, v := range cgs[name].Variants {
@@ -866,14 +1071,14 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 							continue
 						}
 						if v == 0 {
-							out[outidx] = 0 // tag not found / spanning tile
+							out.Set(outidx, 0) // tag not found / spanning tile
 						} else if variants, ok := seq[tag]; ok && int(v) < len(variants) && len(variants[v].Sequence) > 0 {
-							out[outidx] = int16(variantRemap[tag-tagstart][v])
+							out.Set(outidx, int(variantRemap[tag-tagstart][v]))
 						} else {
-							out[outidx] = -1 // low quality tile variant
+							out.Set(outidx, -1) // low quality tile variant
 						}
 						if tag == cmd.debugTag {
-							log.Printf("tag %d row %d col %d outidx %d v %d out %d", tag, row, col, outidx, v, out[outidx])
+							log.Printf("tag %d row %d col %d outidx %d v %d out %d", tag, row, col, outidx, v, out.At(outidx))
 						}
 						outidx++
 					}
@@ -888,7 +1093,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				}
 				if !*mergeOutput && !*onehotChunked && !*onehotSingle {
 					fnm := fmt.Sprintf("%s/matrix.%04d.npy", *outputDir, infileIdx)
-					err = writeNumpyInt16(fnm, out, rows, cols)
+					err = out.writeNumpy(fnm)
 					if err != nil {
 						return err
 					}
@@ -902,6 +1107,10 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	if err = throttleMem.Wait(); err != nil {
 		return err
 	}
+	err = cmd.filter.writeReport()
+	if err != nil {
+		return err
+	}
 
 	if *hgvsChunked {
 		log.Info("flushing hgvsCols temp files")
@@ -950,7 +1159,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				hgvsCols := hgvsCols[variant]
 				for row := range cmd.cgnames {
 					for ph := 0; ph < 2; ph++ {
-						out[row*cols+varIdx+ph] = hgvsCols[ph][row]
+						out[row*cols+varIdx*2+ph] = hgvsCols[ph][row]
 					}
 				}
 			}
@@ -988,20 +1197,20 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		rows := len(cmd.cgnames)
 		cols := 0
 		for _, chunk := range toMerge {
-			cols += len(chunk) / rows
+			cols += chunk.cols
 		}
 		log.Infof("merging output matrix (rows=%d, cols=%d, mem=%d) and annotations", rows, cols, rows*cols*2)
-		var out []int16
+		var out *variantMatrix
 		if *mergeOutput {
-			out = make([]int16, rows*cols)
+			out = newVariantMatrix(rows, cols)
 		}
 		hgvsCols := map[string][2][]int16{} // hgvs -> [[g0,g1,g2,...], [g0,g1,g2,...]] (slice of genomes for each phase)
 		startcol := 0
 		for outIdx, chunk := range toMerge {
-			chunkcols := len(chunk) / rows
+			chunkcols := chunk.cols
 			if *mergeOutput {
 				for row := 0; row < rows; row++ {
-					copy(out[row*cols+startcol:], chunk[row*chunkcols:(row+1)*chunkcols])
+					out.copyFrom(row*cols+startcol, chunk, row*chunkcols, chunkcols)
 				}
 			}
 			toMerge[outIdx] = nil
@@ -1062,7 +1271,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					}
 					for ph := 0; ph < 2; ph++ {
 						for row := 0; row < rows; row++ {
-							v := chunk[row*chunkcols+incol*2+ph]
+							v := chunk.At(row*chunkcols + incol*2 + ph)
 							if tileVariantID(v) == rt.variant {
 								hgvsColPair[ph][row] = 0
 							} else {
@@ -1077,7 +1286,17 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 							Ref:      string(refseq),
 							New:      string(refseq),
 						}
-						fmt.Fprintf(annow, "%d,%d,%d,%s:g.%s,%s,%d,%s,%s,%s\n", tag, incol+startcol/2, rt.variant, seqname, hgvsref.String(), seqname, pos, refseq, refseq, fields[8])
+						// fields[8] is the "left"
+						// column, followed by
+						// consequence and known
+						// variant columns (if
+						// any) which don't apply
+						// to the ref.
+						left := fields[8]
+						if i := bytes.IndexByte(left, ','); i >= 0 {
+							left = left[:i]
+						}
+						fmt.Fprintf(annow, "%d,%d,%d,%s:g.%s,%s,%d,%s,%s,%s%s\n", tag, incol+startcol/2, rt.variant, seqname, hgvsref.String(), seqname, pos, refseq, refseq, left, extraColumns(seqname, nil))
 					}
 				}
 				if annow != nil {
@@ -1085,8 +1304,8 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				}
 				for ph := 0; ph < 2; ph++ {
 					for row := 0; row < rows; row++ {
-						v := chunk[row*chunkcols+incol*2+ph]
-						if int(v) == tileVariant {
+						v := chunk.At(row*chunkcols + incol*2 + ph)
+						if v == tileVariant {
 							hgvsColPair[ph][row] = 1
 						}
 					}
@@ -1104,7 +1323,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
-			err = writeNumpyInt16(fmt.Sprintf("%s/matrix.npy", *outputDir), out, rows, cols)
+			err = out.writeNumpy(fmt.Sprintf("%s/matrix.npy", *outputDir))
 			if err != nil {
 				return err
 			}
@@ -1114,7 +1333,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		if *hgvsSingle {
 			cols = len(hgvsCols) * 2
 			log.Printf("building hgvs-based matrix: %d rows x %d cols", rows, cols)
-			out = make([]int16, rows*cols)
+			out := make([]int16, rows*cols)
 			hgvsIDs := make([]string, 0, cols/2)
 			for hgvsID := range hgvsCols {
 				hgvsIDs = append(hgvsIDs, hgvsID)
@@ -1299,7 +1518,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		}
 	}
 
-	return nil
+	return prov.writeJSON(*outputDir)
 }
 
 type sampleInfo struct {
@@ -1416,6 +1635,36 @@ func writeSampleInfo(samples []sampleInfo, outputDir string) error {
 	return nil
 }
 
+// writePloidyInfo writes a genome,sequence,ploidy line (see
+// loadPloidySpec) to ploidy.csv for each haploid sequence of each
+// sample, so anno2vcf can write single-allele genotypes for them. It
+// does nothing if no sample has a haploid sequence.
+func writePloidyInfo(samples []sampleInfo, cgnames []string, ploidy map[string]map[string]int, outputDir string) error {
+	var lines []string
+	for i, name := range cgnames {
+		var seqnames []string
+		for seqname, p := range ploidy[name] {
+			if p == 1 {
+				seqnames = append(seqnames, seqname)
+			}
+		}
+		sort.Strings(seqnames)
+		for _, seqname := range seqnames {
+			lines = append(lines, fmt.Sprintf("%s,%s,1\n", samples[i].id, seqname))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	fnm := outputDir + "/ploidy.csv"
+	log.Infof("writing haploid sequences to %s", fnm)
+	err := ioutil.WriteFile(fnm, []byte("# genome,sequence,ploidy\n"+strings.Join(lines, "")), 0666)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", fnm, err)
+	}
+	return nil
+}
+
 func (cmd *sliceNumpy) filterHGVScolpair(colpair [2][]int8) bool {
 	if cmd.chi2PValue >= 1 {
 		return true
@@ -1539,13 +1788,22 @@ func writeNumpyInt8(fnm string, out []int8, rows, cols int) error {
 	return output.Close()
 }
 
-func allele2homhet(colpair [2][]int8) {
+// allele2homhet recodes a pair of per-haplotype allele columns as
+// hom and het columns. If haploid[i] is true, row i is a hemizygous
+// call (see CompactGenome.Ploidy), which has one copy of the allele
+// and is coded as het.
+func allele2homhet(colpair [2][]int8, haploid []bool) {
 	a, b := colpair[0], colpair[1]
 	for i, av := range a {
 		bv := b[i]
 		if av < 0 || bv < 0 {
 			// no-call
 			a[i], b[i] = -1, -1
+		} else if len(haploid) > i && haploid[i] {
+			// hemizygous
+			if av > 0 {
+				a[i], b[i] = 0, 1
+			}
 		} else if av > 0 && bv > 0 {
 			// hom
 			a[i], b[i] = 1, 0
@@ -1571,8 +1829,11 @@ const onehotXrefSize = unsafe.Sizeof(onehotXref{})
 // Build onehot matrix (m[tileVariantIndex][genome] == 0 or 1) for all
 // variants of a single tile/tag#.
 //
+// If haploid[cgid] is true, the genome's call is hemizygous, and
+// counts as het (one copy) rather than hom.
+//
 // Return nil if no tile variant passes Χ² filter.
-func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantID, remap []tileVariantID, tag, chunkstarttag tagID, seq map[tagID][]TileVariant) ([][]int8, []onehotXref) {
+func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantID, remap []tileVariantID, tag, chunkstarttag tagID, seq map[tagID][]TileVariant, haploid []bool) ([][]int8, []onehotXref) {
 	if tag == cmd.debugTag {
 		tv := make([]tileVariantID, len(cmd.cgnames)*2)
 		for i, name := range cmd.cgnames {
@@ -1619,8 +1880,9 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 		tsid := cmd.trainingSet[cgid]
 		cgvars := cgs[name].Variants[tagoffset*2:]
 		tv0, tv1 := remap[cgvars[0]], remap[cgvars[1]]
+		hom := len(haploid) == 0 || !haploid[cgid]
 		for v := tileVariantID(1); v <= maxv; v++ {
-			if tv0 == v && tv1 == v {
+			if tv0 == v && tv1 == v && hom {
 				if tsid >= 0 {
 					obs[v*2][tsid] = true
 				}
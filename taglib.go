@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 const tagmapKeySize = 32
@@ -24,6 +25,7 @@ type tagInfo struct {
 
 type tagLibrary struct {
 	tagmap  map[tagmapKey]tagInfo
+	tagseqs [][]byte // tagseqs[id] is the sequence of tag id
 	keylen  int
 	keymask tagmapKey
 }
@@ -69,6 +71,120 @@ func (taglib *tagLibrary) FindAll(buf []byte, fn func(id tagID, pos, taglen int)
 	}
 }
 
+// CountAll adds the number of occurrences of each tag in buf
+// (including overlapping occurrences) to count[id]. Only the first
+// keylen bases of each tag are compared. It is safe to call CountAll
+// concurrently with the same count slice.
+func (taglib *tagLibrary) CountAll(buf []byte, count []int32) {
+	var key tagmapKey
+	valid := 0
+	for _, base := range buf {
+		if !isbase[int(base)] {
+			valid = 0
+			continue
+		}
+		key = ((key << 2) | twobit[int(base)]) & taglib.keymask
+		valid++
+		if valid < taglib.keylen {
+			continue
+		} else if taginfo, ok := taglib.tagmap[key]; ok {
+			atomic.AddInt32(&count[taginfo.id], 1)
+		}
+	}
+}
+
+// FindApprox returns the position of the only place in buf where
+// the given tag occurs with at most one mismatch, and the offset of
+// the mismatch within the tag (-1 if it is an exact match). A no-call
+// counts as a mismatch. If there is no such place, or more than one,
+// pos is -1.
+func (taglib *tagLibrary) FindApprox(buf []byte, id tagID) (pos, mismatch int) {
+	pos, mismatch = -1, -1
+	if int(id) >= len(taglib.tagseqs) {
+		return
+	}
+	tagseq := taglib.tagseqs[id]
+	for start := 0; start+len(tagseq) <= len(buf); start++ {
+		if m, n := tagMismatches(tagseq, buf[start:start+len(tagseq)]); n <= 1 {
+			if pos >= 0 {
+				// ambiguous
+				return -1, -1
+			}
+			pos, mismatch = start, m
+		}
+	}
+	return
+}
+
+// tagMismatches returns the number of positions (up to 2) where a and
+// b (which must have the same length) differ, ignoring case, and the
+// offset of the first one. Non-ACGT bases never match.
+func tagMismatches(a, b []byte) (first, n int) {
+	first = -1
+	for i, base := range a {
+		if isbase[int(base)] && isbase[int(b[i])] && twobit[int(base)] == twobit[int(b[i])] {
+			continue
+		}
+		if n == 0 {
+			first = i
+		}
+		if n++; n > 1 {
+			break
+		}
+	}
+	return
+}
+
+// sameTag returns true if a and b are the same tag, allowing one
+// mismatch.
+func sameTag(a, b []byte) bool {
+	_, n := tagMismatches(a, b)
+	return n <= 1
+}
+
+// matchTag returns true if a and b are the same tag, ignoring
+// case. If approx is true (i.e., one of them was found by
+// tileLibrary.approxTags, see TileVariant.approxEndTag), one
+// mismatch is allowed.
+func matchTag(a, b []byte, approx bool) bool {
+	if approx {
+		return sameTag(a, b)
+	}
+	return bytes.EqualFold(a, b)
+}
+
+// approxTagID returns the ID of the tag that matches seq exactly
+// (tag2id maps tag sequences to IDs), or if there is none and approx
+// is true, the only tag that matches seq with one mismatch, e.g., a
+// tag that was found by tileLibrary.approxTags. seq and the keys of
+// tag2id must be lower case.
+func approxTagID(tag2id map[string]tagID, seq []byte, approx bool) (tagID, bool) {
+	if id, ok := tag2id[string(seq)]; ok {
+		return id, true
+	} else if !approx {
+		return -1, false
+	}
+	found, ok := tagID(-1), false
+	buf := append([]byte(nil), seq...)
+	for i, orig := range seq {
+		for _, base := range []byte("acgt") {
+			if base == orig {
+				continue
+			}
+			buf[i] = base
+			if id, match := tag2id[string(buf)]; match {
+				if ok && id != found {
+					// ambiguous
+					return -1, false
+				}
+				found, ok = id, true
+			}
+		}
+		buf[i] = orig
+	}
+	return found, ok
+}
+
 func (taglib *tagLibrary) Len() int {
 	return len(taglib.tagmap)
 }
@@ -113,6 +229,7 @@ func (taglib *tagLibrary) setTags(tags [][]byte) error {
 	}
 	taglib.keymask = tagmapKey((1 << (taglib.keylen * 2)) - 1)
 	taglib.tagmap = map[tagmapKey]tagInfo{}
+	taglib.tagseqs = tags
 	for i, tag := range tags {
 		var key tagmapKey
 		for _, b := range tag[:taglib.keylen] {
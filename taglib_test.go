@@ -97,3 +97,72 @@ func (s *taglibSuite) TestFindAllRealisticSize(c *check.C) {
 	c.Check(matches[0], check.Equals, tagMatch{0, 0, tagsize})
 	c.Check(matches[1].id, check.Equals, tagID(1))
 }
+
+func (s *taglibSuite) TestFindApprox(c *check.C) {
+	var taglib tagLibrary
+	err := taglib.Load(strings.NewReader(">0000.00\nggagaactgtgctccgccttcaga\nacacatgctagcgcgtcggggtgg\n"))
+	c.Assert(err, check.IsNil)
+	for _, trial := range []struct {
+		haystack string
+		pos      int
+		mismatch int
+	}{
+		{"ccccacacatgctagcgcgtcggggtggcccc", 4, -1},
+		{"ccccacacatgctagcgcgtcggggtgccccc", 4, 23},
+		{"ccccACACATGCTAGCNCGTCGGGGTGGcccc", 4, 12},
+		{"ccccacacatgctagcgcgtcggggcccccc", -1, -1},
+		{"ccccacacttgctagcgcgtcggggaggcccc", -1, -1},
+		{"acacatgctagcgcgtcggggtgaacacatgctagcgcgtcggggtgc", -1, -1},
+	} {
+		pos, mismatch := taglib.FindApprox([]byte(trial.haystack), 1)
+		c.Check(pos, check.Equals, trial.pos, check.Commentf("%s", trial.haystack))
+		c.Check(mismatch, check.Equals, trial.mismatch, check.Commentf("%s", trial.haystack))
+	}
+}
+
+func (s *taglibSuite) TestApproxTagID(c *check.C) {
+	tag2id := map[string]tagID{
+		"ggagaactgtgctccgccttcaga": 0,
+		"acacatgctagcgcgtcggggtgg": 1,
+		"acacatgctagcgcgtcggggtcc": 2,
+	}
+	for _, trial := range []struct {
+		seq string
+		id  tagID
+		ok  bool
+	}{
+		{"ggagaactgtgctccgccttcaga", 0, true},
+		{"ggagaactgtgctacgccttcaga", 0, true},
+		{"ngagaactgtgctccgccttcaga", 0, true},
+		{"acacatgctagcgcgtcggggtcg", -1, false}, // one mismatch from tags 1 and 2
+		{"acacatgctagcgcgtcggggtcc", 2, true},
+		{"ggagaactgtgctccgccttcatt", -1, false},
+	} {
+		id, ok := approxTagID(tag2id, []byte(trial.seq), true)
+		c.Check(id, check.Equals, trial.id, check.Commentf("%s", trial.seq))
+		c.Check(ok, check.Equals, trial.ok, check.Commentf("%s", trial.seq))
+		// Without approx, only exact matches are found
+		exact := tag2id[trial.seq]
+		id, ok = approxTagID(tag2id, []byte(trial.seq), false)
+		if _, found := tag2id[trial.seq]; found {
+			c.Check(id, check.Equals, exact, check.Commentf("%s", trial.seq))
+			c.Check(ok, check.Equals, true, check.Commentf("%s", trial.seq))
+		} else {
+			c.Check(ok, check.Equals, false, check.Commentf("%s", trial.seq))
+		}
+	}
+}
+
+func (s *taglibSuite) TestMatchTag(c *check.C) {
+	c.Check(matchTag([]byte("acgtac"), []byte("ACGTAC"), false), check.Equals, true)
+	c.Check(matchTag([]byte("acgtac"), []byte("acttac"), false), check.Equals, false)
+	c.Check(matchTag([]byte("acgtac"), []byte("acttac"), true), check.Equals, true)
+	c.Check(matchTag([]byte("acgtac"), []byte("atttac"), true), check.Equals, false)
+
+	tv := TileVariant{Sequence: []byte("acgtacgtacgt"), Length: 12, TagMismatches: []int{2}}
+	c.Check(tv.approxEndTag(4), check.Equals, false)
+	tv.TagMismatches = []int{2, 9}
+	c.Check(tv.approxEndTag(4), check.Equals, true)
+	tv.TagMismatches = nil
+	c.Check(tv.approxEndTag(4), check.Equals, false)
+}
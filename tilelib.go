@@ -9,8 +9,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"regexp"
 	"runtime"
@@ -24,7 +26,17 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
-type tileVariantID uint16 // 1-based
+// tileVariantID is 1-based. Libraries written when it was a uint16
+// still decode correctly, since gob encodes unsigned integers
+// without regard to their size.
+type tileVariantID uint32
+
+// maxTileVariantID is the largest variant ID that can be assigned.
+// It is limited to the int32 range so variant numbers fit in int32
+// numpy matrices.
+var maxTileVariantID = tileVariantID(math.MaxInt32)
+
+var errTooManyVariants = errors.New("too many variants")
 
 type tileLibRef struct {
 	Tag     tagID
@@ -62,11 +74,16 @@ type tileLibrary struct {
 	skipOOO             bool
 	retainTileSequences bool
 	useDups             bool
+	// if true, look for tags with one mismatch where they are
+	// expected but not found exactly
+	approxTags bool
 
 	taglib         *tagLibrary
 	variant        [][][blake2b.Size256]byte
 	refseqs        map[string]map[string][]tileLibRef
 	compactGenomes map[string][]tileVariantID
+	cgmeta         map[string]CompactGenome // Ploidy, Unphased, and Imputed (not Variants) of retained genomes
+	provenance     []Provenance             // provenance records of loaded libraries
 	seq2           map[[2]byte]map[[blake2b.Size256]byte][]byte
 	seq2lock       map[[2]byte]sync.Locker
 	variants       int64
@@ -79,10 +96,21 @@ type tileLibrary struct {
 	onAddGenome      func(CompactGenome) error
 	onAddRefseq      func(CompactSequence) error
 
+	// Blake2b, Length, NoCalls, and TagMismatches of tile
+	// variants whose sequences are dropped despite
+	// retainTileSequences, keyed by hash in variant
+	nocalls map[[blake2b.Size256]byte]TileVariant
+	// TagMismatches of other tile variants, if any, keyed by
+	// hash in variant
+	tagMismatches map[[blake2b.Size256]byte][]int
+	nocallsLock   sync.Mutex
+
 	mtx   sync.RWMutex
 	vlock []sync.Locker
 }
 
+var errDifferentTagsets = errors.New("cannot merge libraries with differing tagsets (use \"lightning retile\" to convert a library to a different tagset)")
+
 func (tilelib *tileLibrary) loadTagSet(newtagset [][]byte) error {
 	// Loading a tagset means either passing it through to the
 	// output (if it's the first one we've seen), or just ensuring
@@ -106,15 +134,8 @@ func (tilelib *tileLibrary) loadTagSet(newtagset [][]byte) error {
 				return err
 			}
 		}
-	} else if tilelib.taglib.Len() != len(newtagset) {
-		return fmt.Errorf("cannot merge libraries with differing tagsets")
-	} else {
-		current := tilelib.taglib.Tags()
-		for i := range newtagset {
-			if !bytes.Equal(newtagset[i], current[i]) {
-				return fmt.Errorf("cannot merge libraries with differing tagsets")
-			}
-		}
+	} else if !sameTagset(tilelib.taglib.Tags(), newtagset) {
+		return errDifferentTagsets
 	}
 	return nil
 }
@@ -123,7 +144,11 @@ func (tilelib *tileLibrary) loadTileVariants(tvs []TileVariant, variantmap map[t
 	for _, tv := range tvs {
 		// Assign a new variant ID (unique across all inputs)
 		// for each input variant.
-		variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRef(tv.Tag, tv.Sequence, tv.Ref).Variant
+		libref, err := tilelib.addTileVariant(tv)
+		if err != nil {
+			return err
+		}
+		variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = libref.Variant
 	}
 	return nil
 }
@@ -157,6 +182,22 @@ func (tilelib *tileLibrary) loadCompactGenomes(cgs []CompactGenome, variantmap m
 				// log.Tracef("loadCompactGenomes: cg %s tag %d variant %d => %d", cg.Name, tag, variant, newvariant)
 				cg.Variants[i] = newvariant
 			}
+			for i, variant := range cg.Imputed {
+				if variant == 0 {
+					continue
+				}
+				tag := tagID(i / 2)
+				newvariant, ok := variantmap[tileLibRef{Tag: tag, Variant: variant}]
+				if !ok {
+					err := fmt.Errorf("oops: genome %q has imputed variant %d for tag %d, but that variant was not in its library", cg.Name, variant, tag)
+					select {
+					case errs <- err:
+					default:
+					}
+					return
+				}
+				cg.Imputed[i] = newvariant
+			}
 			if tilelib.onAddGenome != nil {
 				err := tilelib.onAddGenome(cg)
 				if err != nil {
@@ -183,6 +224,7 @@ func (tilelib *tileLibrary) loadCompactGenomes(cgs []CompactGenome, variantmap m
 				tilelib.mtx.Lock()
 				defer tilelib.mtx.Unlock()
 				tilelib.compactGenomes[cg.Name] = cg.Variants
+				tilelib.setGenomeMeta(cg)
 			}
 		}()
 	}
@@ -191,6 +233,47 @@ func (tilelib *tileLibrary) loadCompactGenomes(cgs []CompactGenome, variantmap m
 	return <-errs
 }
 
+// setGenomeMeta records the non-diploid and unphased sequences and
+// the imputed calls of a retained genome. Caller must have
+// tilelib.mtx locked.
+func (tilelib *tileLibrary) setGenomeMeta(cg CompactGenome) {
+	if len(cg.Ploidy) == 0 && len(cg.Unphased) == 0 && cg.Imputed == nil {
+		return
+	}
+	if tilelib.cgmeta == nil {
+		tilelib.cgmeta = map[string]CompactGenome{}
+	}
+	tilelib.cgmeta[cg.Name] = CompactGenome{
+		Ploidy:            cg.Ploidy,
+		Unphased:          cg.Unphased,
+		Imputed:           cg.Imputed,
+		ImputedConfidence: cg.ImputedConfidence,
+	}
+}
+
+// compactGenome returns the named retained genome.
+func (tilelib *tileLibrary) compactGenome(name string) CompactGenome {
+	cg := tilelib.cgmeta[name]
+	cg.Name = name
+	cg.Variants = tilelib.compactGenomes[name]
+	return cg
+}
+
+// haploidFunc returns a function that reports whether the named
+// retained genome is haploid at the given tag (see haploidFunc), or
+// nil if no retained genome has a haploid sequence.
+func (tilelib *tileLibrary) haploidFunc() func(name string, tag int) bool {
+	var refseqs []tileSeq
+	for _, refseq := range tilelib.refseqs {
+		refseqs = append(refseqs, refseq)
+	}
+	ploidy := map[string]map[string]int{}
+	for name, cg := range tilelib.cgmeta {
+		ploidy[name] = cg.Ploidy
+	}
+	return haploidFunc(refseqs, ploidy)
+}
+
 func (tilelib *tileLibrary) loadCompactSequences(cseqs []CompactSequence, variantmap map[tileLibRef]tileVariantID) error {
 	log.Infof("loadCompactSequences: %d todo", len(cseqs))
 	for _, cseq := range cseqs {
@@ -313,8 +396,13 @@ func (tilelib *tileLibrary) LoadDir(ctx context.Context, path string) error {
 					mtx.Unlock()
 				}
 				for _, tv := range ent.TileVariants {
-					variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRef(tv.Tag, tv.Sequence, tv.Ref).Variant
+					libref, err := tilelib.addTileVariant(tv)
+					if err != nil {
+						return err
+					}
+					variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = libref.Variant
 				}
+				tilelib.loadProvenance(ent.Provenance)
 				cgs = append(cgs, ent.CompactGenomes...)
 				cseqs = append(cseqs, ent.CompactSequences...)
 				return nil
@@ -405,7 +493,7 @@ func (tilelib *tileLibrary) WriteDir(dir string) error {
 	for start := range files {
 		start := start
 		go func() {
-			err := encoders[start].Encode(LibraryEntry{TagSet: tilelib.taglib.Tags()})
+			err := encoders[start].Encode(LibraryEntry{TagSet: tilelib.taglib.Tags(), Provenance: tilelib.provenance})
 			if err != nil {
 				errs <- err
 				return
@@ -421,10 +509,7 @@ func (tilelib *tileLibrary) WriteDir(dir string) error {
 				return
 			}
 			for i := start; i < len(cgnames); i += ntilefiles {
-				err := encoders[start].Encode(LibraryEntry{CompactGenomes: []CompactGenome{{
-					Name:     cgnames[i],
-					Variants: tilelib.compactGenomes[cgnames[i]],
-				}}})
+				err := encoders[start].Encode(LibraryEntry{CompactGenomes: []CompactGenome{tilelib.compactGenome(cgnames[i])}})
 				if err != nil {
 					errs <- err
 					return
@@ -434,12 +519,10 @@ func (tilelib *tileLibrary) WriteDir(dir string) error {
 			for tag := start; tag < len(tilelib.variant) && ctx.Err() == nil; tag += ntilefiles {
 				tvs = tvs[:0]
 				for idx, hash := range tilelib.variant[tag] {
-					tvs = append(tvs, TileVariant{
-						Tag:      tagID(tag),
-						Variant:  tileVariantID(idx + 1),
-						Blake2b:  hash,
-						Sequence: tilelib.hashSequence(hash),
-					})
+					tv := tilelib.hashTileVariant(hash)
+					tv.Tag = tagID(tag)
+					tv.Variant = tileVariantID(idx + 1)
+					tvs = append(tvs, tv)
 				}
 				err := encoders[start].Encode(LibraryEntry{TileVariants: tvs})
 				if err != nil {
@@ -492,6 +575,7 @@ func (tilelib *tileLibrary) LoadGob(ctx context.Context, rdr io.Reader, gz bool)
 		if err := tilelib.loadTileVariants(ent.TileVariants, variantmap); err != nil {
 			return err
 		}
+		tilelib.loadProvenance(ent.Provenance)
 		cgs = append(cgs, ent.CompactGenomes...)
 		cseqs = append(cseqs, ent.CompactSequences...)
 		return nil
@@ -551,9 +635,47 @@ type importStats struct {
 	PathLength            int
 	DroppedRepeatedTags   int
 	DroppedOutOfOrderTags int
+	RescuedTags           int
+	RescuedTagMismatches  []rescuedTag
 }
 
-func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChromosome *regexp.Regexp, isRef bool) (tileSeq, []importStats, error) {
+// rescuedTag describes a tag that was found with one mismatch (see
+// -approx-tags).
+type rescuedTag struct {
+	Tag      tagID
+	Position int // position of the tag in the input sequence
+	Mismatch int // offset of the mismatch within the tag
+}
+
+const (
+	// Only try to rescue a tag if it is one of at most
+	// maxRescueTags tags expected between two found tags that
+	// are at most maxRescueGap bases apart.
+	maxRescueTags = 4
+	maxRescueGap  = 10000
+)
+
+// sequenceMatcher selects sequences to tile, e.g., a
+// *regexp.Regexp.
+type sequenceMatcher interface {
+	MatchString(string) bool
+}
+
+// matchFunc is a sequenceMatcher that calls a func.
+type matchFunc func(string) bool
+
+func (f matchFunc) MatchString(s string) bool { return f(s) }
+
+func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChromosome sequenceMatcher, isRef bool) (tileSeq, []importStats, error) {
+	return tilelib.tileFasta(filelabel, rdr, matchChromosome, isRef, false, false)
+}
+
+// tileFasta is like TileFasta, but if clipStart is true, the
+// sequence before the first tag is dropped instead of being
+// included in the first tile, and if clipEnd is true, the tile that
+// starts at the last tag (which would extend to the end of the
+// sequence) is dropped. This is used to tile part of a sequence.
+func (tilelib *tileLibrary) tileFasta(filelabel string, rdr io.Reader, matchChromosome sequenceMatcher, isRef, clipStart, clipEnd bool) (tileSeq, []importStats, error) {
 	ret := tileSeq{}
 	type jobT struct {
 		label string
@@ -608,6 +730,13 @@ func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChro
 		if len(found) == 0 {
 			log.Warnf("%s %s no tags found", filelabel, job.label)
 		}
+		var seen map[tagID]bool
+		if tilelib.approxTags {
+			seen = make(map[tagID]bool, len(found))
+			for _, ft := range found {
+				seen[ft.tagid] = true
+			}
+		}
 
 		droppedDup := 0
 		if !tilelib.useDups {
@@ -639,17 +768,63 @@ func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChro
 			found = found[:len(keep)]
 		}
 
-		log.Infof("%s %s getting %d librefs", filelabel, job.label, len(found))
+		var rescued []rescuedTag
+		// rescuedAt[pos] is the offset of the mismatch in
+		// the tag rescued at pos
+		var rescuedAt map[int]int
+		if tilelib.approxTags {
+			// Look for tags that are expected (according
+			// to the tags on either side) but weren't
+			// found, e.g., because of a SNP or no-call,
+			// allowing one mismatch.
+			var add []foundtag
+			for i := 0; i+1 < len(found); i++ {
+				prev, next := found[i], found[i+1]
+				if next.tagid <= prev.tagid+1 || next.tagid-prev.tagid-1 > maxRescueTags || next.pos-prev.pos > maxRescueGap {
+					continue
+				}
+				cursor := prev.pos + taglen
+				for tagid := prev.tagid + 1; tagid < next.tagid && cursor < next.pos; tagid++ {
+					if seen[tagid] {
+						// found elsewhere
+						continue
+					}
+					pos, mismatch := tilelib.taglib.FindApprox(job.fasta[cursor:next.pos], tagid)
+					if pos < 0 {
+						continue
+					}
+					log.Debugf("%s %s rescued tag %d at %d, mismatch at tag offset %d", filelabel, job.label, tagid, cursor+pos, mismatch)
+					add = append(add, foundtag{pos: cursor + pos, tagid: tagid})
+					rescued = append(rescued, rescuedTag{Tag: tagid, Position: cursor + pos, Mismatch: mismatch})
+					cursor += pos + len(tilelib.taglib.tagseqs[tagid])
+				}
+			}
+			if len(add) > 0 {
+				rescuedAt = make(map[int]int, len(rescued))
+				for _, r := range rescued {
+					rescuedAt[r.Position] = r.Mismatch
+				}
+				found = append(found, add...)
+				sort.Slice(found, func(i, j int) bool { return found[i].pos < found[j].pos })
+			}
+			log.Infof("%s %s rescued %d tags with one mismatch", filelabel, job.label, len(rescued))
+		}
+
+		ntiles := len(found)
+		if clipEnd && ntiles > 0 {
+			ntiles--
+		}
+		log.Infof("%s %s getting %d librefs", filelabel, job.label, ntiles)
 		throttle := &throttle{Max: runtime.NumCPU()}
-		path = path[:len(found)]
+		path = path[:ntiles]
 		var lowquality int64
-		for i, f := range found {
+		for i, f := range found[:ntiles] {
 			i, f := i, f
 			throttle.Acquire()
 			go func() {
 				defer throttle.Release()
 				var startpos, endpos int
-				if i == 0 {
+				if i == 0 && !clipStart {
 					startpos = 0
 				} else {
 					startpos = f.pos
@@ -659,13 +834,32 @@ func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChro
 				} else {
 					endpos = found[i+1].pos + taglen
 				}
-				path[i] = tilelib.getRef(f.tagid, job.fasta[startpos:endpos], isRef)
+				var tagMismatches []int
+				if m, ok := rescuedAt[f.pos]; ok {
+					tagMismatches = append(tagMismatches, f.pos-startpos+m)
+				}
+				if i < len(found)-1 {
+					if m, ok := rescuedAt[found[i+1].pos]; ok {
+						tagMismatches = append(tagMismatches, found[i+1].pos-startpos+m)
+					}
+				}
+				var err error
+				path[i], err = tilelib.getRef(f.tagid, job.fasta[startpos:endpos], isRef, tagMismatches)
+				throttle.Report(err)
 				if countBases(job.fasta[startpos:endpos]) != endpos-startpos {
 					atomic.AddInt64(&lowquality, 1)
 				}
 			}()
 		}
-		throttle.Wait()
+		err := throttle.Wait()
+		if err != nil {
+			go func() {
+				// let the reader goroutine finish
+				for range todo {
+				}
+			}()
+			return nil, nil, fmt.Errorf("%s %s: %w", filelabel, job.label, err)
+		}
 
 		log.Infof("%s %s copying path", filelabel, job.label)
 
@@ -683,6 +877,8 @@ func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChro
 			PathLength:            len(path),
 			DroppedOutOfOrderTags: droppedOOO,
 			DroppedRepeatedTags:   droppedDup,
+			RescuedTags:           len(rescued),
+			RescuedTagMismatches:  rescued,
 		})
 
 		totalPathLen += len(path)
@@ -696,18 +892,44 @@ func (tilelib *tileLibrary) Len() int64 {
 }
 
 // Return a tileLibRef for a tile with the given tag and sequence,
-// adding the sequence to the library if needed.
-func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLibRef {
-	dropSeq := false
-	if !tilelib.retainNoCalls {
-		for _, b := range seq {
-			if b != 'a' && b != 'c' && b != 'g' && b != 't' {
-				dropSeq = true
-				break
-			}
-		}
+// adding the sequence to the library if needed. tagMismatches are
+// the positions of mismatches in approximately matched tags (see
+// TileVariant.TagMismatches). An error is returned if the tag
+// already has maxTileVariantID variants.
+func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool, tagMismatches []int) (tileLibRef, error) {
+	return tilelib.addTileVariant(TileVariant{
+		Tag:           tag,
+		Ref:           usedByRef,
+		Blake2b:       blake2b.Sum256(seq),
+		Sequence:      seq,
+		Length:        len(seq),
+		NoCalls:       noCallRanges(seq),
+		TagMismatches: tagMismatches,
+	})
+}
+
+// Return a tileLibRef for a tile variant loaded from a library
+// (tv.Variant is ignored), adding it to the library if needed. If
+// tv.Sequence was not saved, tv.Blake2b, tv.Length, and tv.NoCalls
+// are retained instead.
+func (tilelib *tileLibrary) addTileVariant(tv TileVariant) (tileLibRef, error) {
+	tag, seq := tv.Tag, tv.Sequence
+	if tv.Length == 0 && len(seq) > 0 {
+		// written before Length and NoCalls were added
+		tv.Length, tv.NoCalls = len(seq), noCallRanges(seq)
+	}
+	if tv.Blake2b == ([blake2b.Size256]byte{}) {
+		tv.Blake2b = blake2b.Sum256(seq)
+	}
+	haveSeq := len(seq) > 0 || tv.Length == 0
+	dropSeq := !haveSeq || (!tilelib.retainNoCalls && len(tv.NoCalls) > 0)
+	seqhash := tv.Blake2b
+	if !haveSeq {
+		// The input library treats this tile variant as a
+		// no-call, so keep it distinct from a complete tile
+		// variant with the same sequence.
+		seqhash = blake2b.Sum256(append([]byte("nocall:"), tv.Blake2b[:]...))
 	}
-	seqhash := blake2b.Sum256(seq)
 	var vlock sync.Locker
 
 	tilelib.mtx.RLock()
@@ -721,7 +943,7 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 		for i, varhash := range tilelib.variant[tag] {
 			if varhash == seqhash {
 				vlock.Unlock()
-				return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}
+				return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}, nil
 			}
 		}
 		vlock.Unlock()
@@ -773,14 +995,34 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 	for i, varhash := range tilelib.variant[tag] {
 		if varhash == seqhash {
 			vlock.Unlock()
-			return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}
+			return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}, nil
 		}
 	}
+	if int64(len(tilelib.variant[tag])) >= int64(maxTileVariantID) {
+		vlock.Unlock()
+		return tileLibRef{}, fmt.Errorf("tag %d: %w (limit %d)", tag, errTooManyVariants, maxTileVariantID)
+	}
 	atomic.AddInt64(&tilelib.variants, 1)
 	tilelib.variant[tag] = append(tilelib.variant[tag], seqhash)
 	variant := tileVariantID(len(tilelib.variant[tag]))
 	vlock.Unlock()
 
+	if tilelib.retainTileSequences && dropSeq {
+		tilelib.nocallsLock.Lock()
+		if tilelib.nocalls == nil {
+			tilelib.nocalls = map[[blake2b.Size256]byte]TileVariant{}
+		}
+		tilelib.nocalls[seqhash] = TileVariant{Blake2b: tv.Blake2b, Length: tv.Length, NoCalls: tv.NoCalls, TagMismatches: tv.TagMismatches}
+		tilelib.nocallsLock.Unlock()
+	} else if tilelib.retainTileSequences && len(tv.TagMismatches) > 0 {
+		tilelib.nocallsLock.Lock()
+		if tilelib.tagMismatches == nil {
+			tilelib.tagMismatches = map[[blake2b.Size256]byte][]int{}
+		}
+		tilelib.tagMismatches[seqhash] = tv.TagMismatches
+		tilelib.nocallsLock.Unlock()
+	}
+
 	if tilelib.retainTileSequences && !dropSeq {
 		seqCopy := append([]byte(nil), seq...)
 		if tilelib.seq2 == nil {
@@ -817,18 +1059,21 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 	if tilelib.encoder != nil {
 		tilelib.encoder.Encode(LibraryEntry{
 			TileVariants: []TileVariant{{
-				Tag:      tag,
-				Ref:      usedByRef,
-				Variant:  variant,
-				Blake2b:  seqhash,
-				Sequence: saveSeq,
+				Tag:           tag,
+				Ref:           tv.Ref,
+				Variant:       variant,
+				Blake2b:       tv.Blake2b,
+				Sequence:      saveSeq,
+				Length:        tv.Length,
+				NoCalls:       tv.NoCalls,
+				TagMismatches: tv.TagMismatches,
 			}},
 		})
 	}
 	if tilelib.onAddTileVariant != nil {
 		tilelib.onAddTileVariant(tileLibRef{tag, variant}, seqhash, saveSeq)
 	}
-	return tileLibRef{Tag: tag, Variant: variant}
+	return tileLibRef{Tag: tag, Variant: variant}, nil
 }
 
 func (tilelib *tileLibrary) hashSequence(hash [blake2b.Size256]byte) []byte {
@@ -837,6 +1082,44 @@ func (tilelib *tileLibrary) hashSequence(hash [blake2b.Size256]byte) []byte {
 	return tilelib.seq2[partition][hash]
 }
 
+// hashTileVariant returns the Blake2b, Sequence, Length, NoCalls,
+// and TagMismatches fields of the tile variant with the given hash
+// (key in tilelib.variant).
+func (tilelib *tileLibrary) hashTileVariant(hash [blake2b.Size256]byte) TileVariant {
+	if seq := tilelib.hashSequence(hash); seq != nil {
+		tilelib.nocallsLock.Lock()
+		defer tilelib.nocallsLock.Unlock()
+		return TileVariant{Blake2b: hash, Sequence: seq, Length: len(seq), NoCalls: noCallRanges(seq), TagMismatches: tilelib.tagMismatches[hash]}
+	}
+	tilelib.nocallsLock.Lock()
+	defer tilelib.nocallsLock.Unlock()
+	if tv, ok := tilelib.nocalls[hash]; ok {
+		return tv
+	}
+	return TileVariant{Blake2b: hash}
+}
+
+// TileVariantNoCalls returns the length of a tile variant and the
+// number of no-call bases in it, or a zero length if unknown.
+func (tilelib *tileLibrary) TileVariantNoCalls(libref tileLibRef) (length, nocalls int) {
+	if libref.Variant == 0 || len(tilelib.variant) <= int(libref.Tag) || len(tilelib.variant[libref.Tag]) < int(libref.Variant) {
+		return 0, 0
+	}
+	tv := tilelib.hashTileVariant(tilelib.variant[libref.Tag][libref.Variant-1])
+	return tv.noCallCounts()
+}
+
+// TileVariantApproxEndTag returns true if the end tag (of length
+// taglen) of a tile variant was found with a mismatch (see
+// TileVariant.approxEndTag).
+func (tilelib *tileLibrary) TileVariantApproxEndTag(libref tileLibRef, taglen int) bool {
+	if libref.Variant == 0 || len(tilelib.variant) <= int(libref.Tag) || len(tilelib.variant[libref.Tag]) < int(libref.Variant) {
+		return false
+	}
+	tv := tilelib.hashTileVariant(tilelib.variant[libref.Tag][libref.Variant-1])
+	return tv.approxEndTag(taglen)
+}
+
 func (tilelib *tileLibrary) TileVariantSequence(libref tileLibRef) []byte {
 	if libref.Variant == 0 || len(tilelib.variant) <= int(libref.Tag) || len(tilelib.variant[libref.Tag]) < int(libref.Variant) {
 		return nil
@@ -876,6 +1159,17 @@ func (tilelib *tileLibrary) Tidy() {
 					}
 				}
 			}
+			// Variants used only by imputed calls are
+			// kept, but don't affect the order.
+			inimputed := make([]bool, len(oldvariants))
+			for _, cg := range tilelib.cgmeta {
+				for phase := 0; phase < 2; phase++ {
+					cgi := int(tag)*2 + phase
+					if cgi < len(cg.Imputed) && cg.Imputed[cgi] > 0 {
+						inimputed[cg.Imputed[cgi]-1] = true
+					}
+				}
+			}
 
 			// Compute desired order of variants:
 			// neworder[x] == index in oldvariants that
@@ -898,7 +1192,7 @@ func (tilelib *tileLibrary) Tidy() {
 			remaptag := make([]tileVariantID, len(oldvariants)+1)
 			newvariants := make([][blake2b.Size256]byte, 0, len(neworder))
 			for _, oldi := range neworder {
-				if uses[oldi] > 0 || inref[tileLibRef{Tag: tag, Variant: tileVariantID(oldi + 1)}] {
+				if uses[oldi] > 0 || inimputed[oldi] || inref[tileLibRef{Tag: tag, Variant: tileVariantID(oldi + 1)}] {
 					newvariants = append(newvariants, oldvariants[oldi])
 					remaptag[oldi+1] = tileVariantID(len(newvariants))
 				}
@@ -923,6 +1217,16 @@ func (tilelib *tileLibrary) Tidy() {
 			}
 		}()
 	}
+	for _, cg := range tilelib.cgmeta {
+		imputed := cg.Imputed
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx, variant := range imputed {
+				imputed[idx] = remap[tagID(idx/2)][variant]
+			}
+		}()
+	}
 	for _, refcs := range tilelib.refseqs {
 		for _, refseq := range refcs {
 			refseq := refseq
@@ -939,6 +1243,29 @@ func (tilelib *tileLibrary) Tidy() {
 	log.Print("Tidy: done")
 }
 
+// sequenceNoCalls returns the length of seq and the number of no-call
+// (non-ACGT) bases in it.
+func sequenceNoCalls(seq []byte) (length, nocalls int) {
+	return len(seq), len(seq) - countBases(seq)
+}
+
+// noCallRanges returns the half-open [start,end) ranges of no-call
+// positions in seq, or nil if all bases are called.
+func noCallRanges(seq []byte) [][2]int {
+	var ranges [][2]int
+	for i, c := range seq {
+		if isbase[c] {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == i {
+			ranges[n-1][1] = i + 1
+		} else {
+			ranges = append(ranges, [2]int{i, i + 1})
+		}
+	}
+	return ranges
+}
+
 func countBases(seq []byte) int {
 	n := 0
 	for _, c := range seq {
@@ -6,9 +6,14 @@ package lightning
 
 import (
 	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
 
+	"golang.org/x/crypto/blake2b"
 	"gopkg.in/check.v1"
 )
 
@@ -141,3 +146,226 @@ func (s *tilelibSuite) TestSkipOOO(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 1}, {1, 1}, {3, 1}}})
 }
+
+func (s *tilelibSuite) TestApproxTags(c *check.C) {
+	matchAllChromosomes := regexp.MustCompile(".")
+	// tag 1 has a SNP at offset 5, tag 3 has a no-call at
+	// offset 0
+	snp1 := "acacaagctagcgcgtcggggtgg\n"
+	nocall3 := "nctcccgagccgagccacccgtca\n"
+	input := ">test-seq\n" +
+		s.tag[0] +
+		"cccccccccccccccccccc\n" +
+		snp1 +
+		"ggggggggggggggggggggggg\n" +
+		s.tag[2] +
+		"cccccccccccccccccccc\n" +
+		nocall3 +
+		"ggggggggggggggggggggggg\n" +
+		s.tag[4] +
+		"\n"
+
+	tilelib := &tileLibrary{taglib: &s.taglib, retainNoCalls: true}
+	tseq, _, err := tilelib.TileFasta("test-label", bytes.NewBufferString(input), matchAllChromosomes, false)
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 1}, {2, 1}, {4, 1}}})
+
+	tilelib = &tileLibrary{taglib: &s.taglib, retainNoCalls: true, approxTags: true, retainTileSequences: true}
+	tseq, stats, err := tilelib.TileFasta("test-label", bytes.NewBufferString(input), matchAllChromosomes, false)
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 1}, {1, 1}, {2, 1}, {3, 1}, {4, 1}}})
+	c.Check(stats[0].RescuedTags, check.Equals, 2)
+	pos1 := len(strings.Replace(s.tag[0]+"cccccccccccccccccccc", "\n", "", -1))
+	pos3 := pos1 + len(strings.Replace(snp1+"ggggggggggggggggggggggg"+s.tag[2]+"cccccccccccccccccccc", "\n", "", -1))
+	c.Check(stats[0].RescuedTagMismatches, check.DeepEquals, []rescuedTag{
+		{Tag: 1, Position: pos1, Mismatch: 5},
+		{Tag: 3, Position: pos3, Mismatch: 0},
+	})
+	// the SNP appears at the end of tile 0 and the start of
+	// tile 1
+	c.Check(string(tilelib.TileVariantSequence(tileLibRef{0, 1})), check.Equals, strings.Replace(s.tag[0]+"cccccccccccccccccccc\n"+snp1, "\n", "", -1))
+	c.Check(string(tilelib.TileVariantSequence(tileLibRef{1, 1})), check.Equals, strings.Replace(snp1+"ggggggggggggggggggggggg\n"+s.tag[2], "\n", "", -1))
+	// the mismatches are recorded in the tile variants
+	for _, trial := range []struct {
+		libref        tileLibRef
+		tagMismatches []int
+	}{
+		{tileLibRef{0, 1}, []int{pos1 + 5}},
+		{tileLibRef{1, 1}, []int{5}},
+		{tileLibRef{2, 1}, []int{44}},
+		{tileLibRef{3, 1}, []int{0}},
+		{tileLibRef{4, 1}, nil},
+	} {
+		tv := tilelib.hashTileVariant(tilelib.variant[trial.libref.Tag][trial.libref.Variant-1])
+		c.Check(tv.TagMismatches, check.DeepEquals, trial.tagMismatches, check.Commentf("%v", trial.libref))
+	}
+	// GFA export links the tiles through the mismatched tags
+	g := gfaGraph{tilelib: tilelib, taglen: s.taglib.TagLen(), tag2id: map[string]tagID{}}
+	for id, tagseq := range s.taglib.Tags() {
+		g.tag2id[string(tagseq)] = tagID(id)
+	}
+	for tag := tagID(0); tag < 4; tag++ {
+		c.Check(g.endTag(tileLibRef{tag, 1}), check.Equals, tag+1)
+	}
+
+	// ambiguous: the mismatched tag appears twice between
+	// tags 0 and 2
+	tseq, _, err = tilelib.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+
+		s.tag[0]+
+		snp1+
+		"cccccccccccccccccccc\n"+
+		snp1+
+		s.tag[2]+
+		"\n"), matchAllChromosomes, false)
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 2}, {2, 2}}})
+}
+
+func (s *tilelibSuite) TestTooManyVariants(c *check.C) {
+	defer func(orig tileVariantID) { maxTileVariantID = orig }(maxTileVariantID)
+	maxTileVariantID = 2
+
+	tilelib := &tileLibrary{taglib: &s.taglib}
+	for i, seq := range []string{"a", "c", "a", "c", "g"} {
+		libref, err := tilelib.getRef(0, []byte(s.tag[0]+seq), false, nil)
+		if i < 4 {
+			c.Check(err, check.IsNil)
+			c.Check(libref, check.Equals, tileLibRef{0, tileVariantID(i%2 + 1)})
+		} else {
+			c.Check(errors.Is(err, errTooManyVariants), check.Equals, true, check.Commentf("%v", err))
+		}
+	}
+
+	matchAllChromosomes := regexp.MustCompile(".")
+	_, _, err := tilelib.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+s.tag[0]+"tttttttttt\n"+s.tag[1]), matchAllChromosomes, false)
+	c.Check(errors.Is(err, errTooManyVariants), check.Equals, true, check.Commentf("%v", err))
+}
+
+func (s *tilelibSuite) TestNoCalls(c *check.C) {
+	c.Check(noCallRanges([]byte("acgtacgt")), check.IsNil)
+	c.Check(noCallRanges([]byte("nnacgnntnn")), check.DeepEquals, [][2]int{{0, 2}, {5, 7}, {8, 10}})
+
+	tag := strings.TrimSuffix(s.tag[0], "\n")
+	var buf bytes.Buffer
+	tilelib := &tileLibrary{taglib: &s.taglib, encoder: gob.NewEncoder(&buf)}
+	for _, seq := range []string{"acgtac", "acnnac", "nnnnnn"} {
+		_, err := tilelib.getRef(0, []byte(tag+seq), false, nil)
+		c.Assert(err, check.IsNil)
+	}
+	var tvs []TileVariant
+	err := DecodeLibrary(&buf, false, func(ent *LibraryEntry) error {
+		tvs = append(tvs, ent.TileVariants...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(tvs, check.HasLen, 3)
+	taglen := len(tag)
+	c.Check(tvs[0].Sequence, check.NotNil)
+	c.Check(tvs[0].NoCalls, check.IsNil)
+	// Sequences with no-calls are not saved, but the positions
+	// of the no-calls are.
+	c.Check(tvs[1].Sequence, check.IsNil)
+	c.Check(tvs[1].Length, check.Equals, taglen+6)
+	c.Check(tvs[1].NoCalls, check.DeepEquals, [][2]int{{taglen + 2, taglen + 4}})
+	for i, expect := range []int{0, 2, 6} {
+		length, nocalls := tvs[i].noCallCounts()
+		c.Check(length, check.Equals, taglen+6)
+		c.Check(nocalls, check.Equals, expect)
+	}
+
+	// Libraries written before Length and NoCalls were added
+	length, nocalls := (&TileVariant{Sequence: []byte("acgnnt")}).noCallCounts()
+	c.Check(length, check.Equals, 6)
+	c.Check(nocalls, check.Equals, 2)
+	length, _ = (&TileVariant{}).noCallCounts()
+	c.Check(length, check.Equals, 0)
+}
+
+func (s *tilelibSuite) TestNoCallsRoundTrip(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, dir := range []string{"lib", "merged", "flaked"} {
+		err := os.Mkdir(tmpdir+"/"+dir, 0777)
+		c.Assert(err, check.IsNil)
+	}
+	// Without -save-incomplete-tiles, input2's tiles with
+	// no-calls are saved without sequences.
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-o", tmpdir + "/lib/library.gob",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&merger{}).RunCommand("merge", []string{
+		"-local=true",
+		"-o", tmpdir + "/merged/library.gob",
+		tmpdir + "/lib/library.gob",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&flakecmd{}).RunCommand("flake", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/merged",
+		"-output-dir", tmpdir + "/flaked",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	readDropped := func(dir string) map[[blake2b.Size256]byte]TileVariant {
+		infiles, err := allFiles(dir, matchGobFile)
+		c.Assert(err, check.IsNil)
+		var mtx sync.Mutex
+		dropped := map[[blake2b.Size256]byte]TileVariant{}
+		err = decodeAllFiles(infiles, func(ent *LibraryEntry) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, tv := range ent.TileVariants {
+				if len(tv.Sequence) == 0 {
+					dropped[tv.Blake2b] = TileVariant{Tag: tv.Tag, Blake2b: tv.Blake2b, Length: tv.Length, NoCalls: tv.NoCalls}
+				}
+			}
+			return nil
+		})
+		c.Assert(err, check.IsNil)
+		return dropped
+	}
+	imported := readDropped(tmpdir + "/lib")
+	c.Assert(imported, check.Not(check.HasLen), 0)
+	for _, tv := range imported {
+		c.Check(tv.Length > 0, check.Equals, true)
+		c.Check(tv.NoCalls, check.Not(check.HasLen), 0)
+	}
+	c.Check(readDropped(tmpdir+"/merged"), check.DeepEquals, imported)
+	c.Check(readDropped(tmpdir+"/flaked"), check.DeepEquals, imported)
+}
+
+func (s *tilelibSuite) TestDecodeUint16Variants(c *check.C) {
+	// Library entries encoded when tileVariantID was a uint16
+	type oldTileVariant struct {
+		Tag      tagID
+		Variant  uint16
+		Sequence []byte
+	}
+	type oldCompactGenome struct {
+		Name     string
+		Variants []uint16
+	}
+	type oldLibraryEntry struct {
+		TileVariants   []oldTileVariant
+		CompactGenomes []oldCompactGenome
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(oldLibraryEntry{
+		TileVariants:   []oldTileVariant{{Tag: 1, Variant: 65535, Sequence: []byte("acgt")}},
+		CompactGenomes: []oldCompactGenome{{Name: "g1", Variants: []uint16{1, 65535}}},
+	})
+	c.Assert(err, check.IsNil)
+	var ents []*LibraryEntry
+	err = DecodeLibrary(&buf, false, func(ent *LibraryEntry) error {
+		ents = append(ents, ent)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(ents, check.HasLen, 1)
+	c.Check(ents[0].TileVariants[0].Variant, check.Equals, tileVariantID(65535))
+	c.Check(ents[0].CompactGenomes[0].Variants, check.DeepEquals, []tileVariantID{1, 65535})
+}
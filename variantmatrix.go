@@ -0,0 +1,118 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+
+	"github.com/kshedden/gonpy"
+)
+
+// variantMatrix is a rows×cols matrix of tile variant numbers (0 for
+// no-call, -1 for low quality). Values are stored as int16, which
+// is enough for nearly all tiles; if a larger value is stored, the
+// whole matrix is converted to int32.
+type variantMatrix struct {
+	rows   int
+	cols   int
+	int16s []int16
+	int32s []int32
+}
+
+func newVariantMatrix(rows, cols int) *variantMatrix {
+	return &variantMatrix{rows: rows, cols: cols, int16s: make([]int16, rows*cols)}
+}
+
+// Len returns rows*cols.
+func (m *variantMatrix) Len() int {
+	if m.int32s != nil {
+		return len(m.int32s)
+	}
+	return len(m.int16s)
+}
+
+// At returns the value at the given index (row*cols+col).
+func (m *variantMatrix) At(idx int) int {
+	if m.int32s != nil {
+		return int(m.int32s[idx])
+	}
+	return int(m.int16s[idx])
+}
+
+// Set stores v at the given index (row*cols+col), widening the
+// matrix if needed.
+func (m *variantMatrix) Set(idx int, v int) {
+	if m.int32s == nil && (v > math.MaxInt16 || v < math.MinInt16) {
+		m.widen()
+	}
+	if m.int32s != nil {
+		m.int32s[idx] = int32(v)
+	} else {
+		m.int16s[idx] = int16(v)
+	}
+}
+
+func (m *variantMatrix) widen() {
+	m.int32s = make([]int32, len(m.int16s))
+	for i, v := range m.int16s {
+		m.int32s[i] = int32(v)
+	}
+	m.int16s = nil
+}
+
+// copyFrom copies n values from src (starting at srcidx) to m
+// (starting at idx).
+func (m *variantMatrix) copyFrom(idx int, src *variantMatrix, srcidx, n int) {
+	if src.int32s != nil && m.int32s == nil {
+		m.widen()
+	}
+	if m.int32s == nil {
+		copy(m.int16s[idx:idx+n], src.int16s[srcidx:srcidx+n])
+	} else if src.int32s != nil {
+		copy(m.int32s[idx:idx+n], src.int32s[srcidx:srcidx+n])
+	} else {
+		for i, v := range src.int16s[srcidx : srcidx+n] {
+			m.int32s[idx+i] = int32(v)
+		}
+	}
+}
+
+// writeNumpy writes the matrix to a numpy file, as int16 if all
+// values fit, otherwise int32.
+func (m *variantMatrix) writeNumpy(fnm string) error {
+	if m.int32s != nil {
+		return writeNumpyInt32(fnm, m.int32s, m.rows, m.cols)
+	}
+	return writeNumpyInt16(fnm, m.int16s, m.rows, m.cols)
+}
+
+// loadVariantMatrix reads an int16 or int32 matrix written by
+// writeNumpy.
+func loadVariantMatrix(fnm string) (*variantMatrix, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	npy, err := gonpy.NewReader(bufio.NewReaderSize(f, 1<<26))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(npy.Shape) != 2 {
+		return nil, fmt.Errorf("%s: shape %v is not 2-dimensional", fnm, npy.Shape)
+	}
+	m := &variantMatrix{rows: npy.Shape[0], cols: npy.Shape[1]}
+	if npy.Dtype == "i4" {
+		m.int32s, err = npy.GetInt32()
+	} else {
+		m.int16s, err = npy.GetInt16()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return m, nil
+}